@@ -0,0 +1,140 @@
+// Package frames splits a stream into newline terminated events without
+// copying.  Each stream is read into a pooled chunk and events are handed
+// out as slices of it, which the caller uses in place.  A chunk goes back
+// to the pool once every event in it has been released.  Only an event left
+// incomplete at the end of a chunk is copied, to the start of the next.
+// Anything keeping event bytes after releasing them must take its own copy.
+//
+// Nothing here knows about sockets, so framing can be exercised with any
+// io.Reader.
+package frames
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A pooled buffer holding events.
+type Chunk struct {
+	buf  []byte
+	refs int32
+}
+
+// Chunks are pooled by size, which is the same for all connections unless
+// an oversized event needed a bigger one.
+var chunkPools sync.Map
+
+func getChunk(size int) *Chunk {
+	pool, _ := chunkPools.LoadOrStore(size, &sync.Pool{})
+	if c, ok := pool.(*sync.Pool).Get().(*Chunk); ok {
+		c.refs = 1
+		return c
+	}
+	return &Chunk{buf: make([]byte, size), refs: 1}
+}
+
+func (c *Chunk) retain() {
+	atomic.AddInt32(&c.refs, 1)
+}
+
+// Gives up a hold on the chunk, returning it to the pool after the last.
+func (c *Chunk) Release() {
+	if atomic.AddInt32(&c.refs, -1) == 0 {
+		pool, _ := chunkPools.Load(len(c.buf))
+		pool.(*sync.Pool).Put(c)
+	}
+}
+
+// Splits a stream into newline terminated events.
+type Framer struct {
+	r    io.Reader
+	size int
+	max  int // largest event allowed, 0 for no limit
+
+	// Set while discarding the rest of an oversized event.
+	skipping bool
+
+	// When anything was last read.
+	Active time.Time
+
+	cur     *Chunk
+	start   int // first byte of the next event
+	scanned int // bytes from start known to have no newline
+	end     int // end of data read
+}
+
+// Returned for an event larger than the limit, which is discarded.
+var ErrTooBig = errors.New("event too big")
+
+// Returns a framer reading r into chunks of size bytes, or larger to hold
+// an event which doesn't fit.  Events over max bytes are discarded, unless
+// max is 0.  A size below 1 is taken as 1.
+func New(r io.Reader, size, max int) *Framer {
+	if size < 1 {
+		size = 1
+	}
+	return &Framer{r: r, size: size, max: max, cur: getChunk(size),
+		Active: time.Now()}
+}
+
+// Returns the next event, and the chunk holding it which the caller must
+// release when done.  On error the incomplete event is kept, so a read
+// which timed out can be resumed.
+func (f *Framer) Next() ([]byte, *Chunk, error) {
+	for {
+		if i := bytes.IndexByte(f.cur.buf[f.start+f.scanned:f.end], '\n'); i >= 0 {
+			stop := f.start + f.scanned + i + 1
+			data := f.cur.buf[f.start:stop:stop]
+			f.start, f.scanned = stop, 0
+			if f.skipping || (f.max > 0 && len(data) > f.max) {
+				f.skipping = false
+				return nil, nil, ErrTooBig
+			}
+			f.cur.retain()
+			return data, f.cur, nil
+		}
+		f.scanned = f.end - f.start
+
+		// Don't buffer an oversized event, just look for its end.
+		if f.max > 0 && f.scanned > f.max {
+			f.skipping = true
+			f.start, f.scanned = f.end, 0
+		}
+
+		if f.end == len(f.cur.buf) {
+			f.rollover()
+		}
+
+		n, err := f.r.Read(f.cur.buf[f.end:])
+		f.end += n
+		if n > 0 {
+			f.Active = time.Now()
+		}
+		if err != nil && n == 0 {
+			return nil, nil, err
+		}
+	}
+}
+
+// Moves the incomplete event to a fresh chunk, large enough to take at
+// least as much again.
+func (f *Framer) rollover() {
+	partial := f.end - f.start
+	size := f.size
+	for size < 2*partial {
+		size *= 2
+	}
+	next := getChunk(size)
+	copy(next.buf, f.cur.buf[f.start:f.end])
+	f.cur.Release()
+	f.cur, f.start, f.end = next, 0, partial
+}
+
+// Releases the framer's hold on its chunk.
+func (f *Framer) Close() {
+	f.cur.Release()
+}
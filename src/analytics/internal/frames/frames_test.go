@@ -0,0 +1,187 @@
+package frames
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// Reads every event, as the strings returned, "!" for one too big, until
+// the framer's error.
+func readAll(f *Framer) ([]string, error) {
+	var events []string
+	for {
+		data, chunk, err := f.Next()
+		if err == ErrTooBig {
+			events = append(events, "!")
+			continue
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, string(data))
+		chunk.Release()
+	}
+}
+
+func TestFramer(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		size   int
+		max    int
+		events []string
+	}{
+		{"empty", "", 16, 0, nil},
+		{"one", "a\n", 16, 0, []string{"a\n"}},
+		{"several", "a\nbb\n\nccc\n", 16, 0, []string{"a\n", "bb\n", "\n", "ccc\n"}},
+		{"partial at end", "a\nbb", 16, 0, []string{"a\n"}},
+		{"only partial", "abc", 16, 0, nil},
+		{"spans chunks", "abcdef\nghijklmnop\nq\n", 4, 0,
+			[]string{"abcdef\n", "ghijklmnop\n", "q\n"}},
+		{"exactly a chunk", "abc\nabc\n", 4, 0, []string{"abc\n", "abc\n"}},
+		{"at the limit", "abcd\n", 16, 5, []string{"abcd\n"}},
+		{"over the limit", "abcde\nf\n", 16, 5, []string{"!", "f\n"}},
+		{"over the limit across chunks", "a\nbcdefghijklmnop\nq\n", 4, 5,
+			[]string{"a\n", "!", "q\n"}},
+		{"oversized partial at end", "a\nbcdefghij", 4, 5, []string{"a\n"}},
+		{"no chunk size", "ab\ncde\n", 0, 0, []string{"ab\n", "cde\n"}},
+		{"negative chunk size", "ab\ncde\n", -1, 0, []string{"ab\n", "cde\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, r := range []struct {
+				name string
+				r    io.Reader
+			}{
+				{"whole", bytes.NewReader([]byte(tt.input))},
+				{"bytewise", iotest.OneByteReader(bytes.NewReader([]byte(tt.input)))},
+			} {
+				f := New(r.r, tt.size, tt.max)
+				events, err := readAll(f)
+				f.Close()
+				if err != io.EOF {
+					t.Errorf("%s: got error %v, want EOF", r.name, err)
+				}
+				if !equal(events, tt.events) {
+					t.Errorf("%s: got %q, want %q", r.name, events, tt.events)
+				}
+			}
+		})
+	}
+}
+
+// A read which fails part way through an event, as one timing out, leaves
+// the partial event to be finished by the next.
+func TestFramerResumes(t *testing.T) {
+	timeout := errors.New("timeout")
+	r := &script{reads: []read{
+		{"a\nbc", nil},
+		{"", timeout},
+		{"d\n", nil},
+	}}
+	f := New(r, 4, 0)
+	defer f.Close()
+
+	events, err := readAll(f)
+	if err != timeout || !equal(events, []string{"a\n"}) {
+		t.Fatalf("got %q, %v before the timeout", events, err)
+	}
+	events, err = readAll(f)
+	if err != io.EOF || !equal(events, []string{"bcd\n"}) {
+		t.Fatalf("got %q, %v after the timeout", events, err)
+	}
+}
+
+// Events stay intact while held, though the framer moves on to other
+// chunks.
+func TestFramerHeldEvents(t *testing.T) {
+	f := New(bytes.NewReader([]byte("abc\ndefgh\nij\n")), 4, 0)
+	defer f.Close()
+	var held [][]byte
+	var chunks []*Chunk
+	for {
+		data, chunk, err := f.Next()
+		if err != nil {
+			break
+		}
+		held = append(held, data)
+		chunks = append(chunks, chunk)
+	}
+	want := []string{"abc\n", "defgh\n", "ij\n"}
+	for i, data := range held {
+		if string(data) != want[i] {
+			t.Errorf("event %d: got %q, want %q", i, data, want[i])
+		}
+	}
+	for _, c := range chunks {
+		c.Release()
+	}
+}
+
+func FuzzFramer(f *testing.F) {
+	f.Add([]byte("a\nbb\n\nccc\n"), uint8(4), uint8(0))
+	f.Add([]byte("abcde\nf\nghijklmnop"), uint8(2), uint8(5))
+	f.Fuzz(func(t *testing.T, input []byte, size, max uint8) {
+		framer := New(bytes.NewReader(input), int(size%64)+1, int(max))
+		events, err := readAll(framer)
+		framer.Close()
+		if err != io.EOF {
+			t.Fatalf("got error %v, want EOF", err)
+		}
+
+		// Every complete line, or "!" if it's too big.
+		var want []string
+		for _, line := range bytes.SplitAfter(input, []byte("\n")) {
+			if !bytes.HasSuffix(line, []byte("\n")) {
+				break
+			}
+			if max > 0 && len(line) > int(max) {
+				want = append(want, "!")
+			} else {
+				want = append(want, string(line))
+			}
+		}
+		if !equal(events, want) {
+			t.Fatalf("got %q, want %q", events, want)
+		}
+	})
+}
+
+type read struct {
+	data string
+	err  error
+}
+
+// Returns the reads given, then EOF.
+type script struct {
+	reads []read
+}
+
+func (s *script) Read(p []byte) (int, error) {
+	if len(s.reads) == 0 {
+		return 0, io.EOF
+	}
+	r := s.reads[0]
+	n := copy(p, r.data)
+	if n < len(r.data) {
+		s.reads[0].data = r.data[n:]
+		return n, nil
+	}
+	s.reads = s.reads[1:]
+	return n, r.err
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+// Command protofields writes Go constants for the field numbers of a
+// protobuf message, so code encoding it by hand follows the schema rather
+// than numbers of its own.  Run by go generate, as
+//
+//	protofields -message Event -prefix protobufEvent -package input \
+//	    -o event_fields.go event.proto
+//
+// For each field it writes a constant, the prefix followed by the field
+// name in camel case, and it lists the singular string fields, by name and
+// number, in <prefix>Strings.  Only the plain proto3 field syntax is
+// understood: nested messages, oneofs and maps are refused.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type field struct {
+	name     string
+	typ      string
+	repeated bool
+	number   string
+}
+
+var (
+	messageStart = regexp.MustCompile(`^message\s+(\w+)\s*\{$`)
+	fieldLine    = regexp.MustCompile(`^(repeated\s+)?(\w+)\s+(\w+)\s*=\s*(\d+)\s*;$`)
+)
+
+// Reads the fields of the named message.
+func parse(path, message string) ([]field, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var fields []field
+	in, found := false, false
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case !in:
+			if m := messageStart.FindStringSubmatch(line); m != nil && m[1] == message {
+				in, found = true, true
+			}
+		case line == "}":
+			in = false
+		default:
+			m := fieldLine.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("%s:%d: unsupported in %s: %s", path, n,
+					message, line)
+			}
+			fields = append(fields, field{
+				name:     m[3],
+				typ:      m[2],
+				repeated: m[1] != "",
+				number:   m[4],
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: no message %s", path, message)
+	}
+	return fields, nil
+}
+
+func camel(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+func main() {
+	message := flag.String("message", "", "message to describe")
+	prefix := flag.String("prefix", "", "prefix of the names written")
+	pkg := flag.String("package", "", "Go package written")
+	out := flag.String("o", "", "file written")
+	flag.Parse()
+	if *message == "" || *prefix == "" || *pkg == "" || *out == "" || flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: protofields -message M -prefix p -package pkg -o file.go schema.proto")
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+	fields, err := parse(path, *message)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by protofields from %s; DO NOT EDIT.\n\n",
+		path[strings.LastIndex(path, "/")+1:])
+	fmt.Fprintf(&b, "package %s\n\n", *pkg)
+	fmt.Fprintf(&b, "// Field numbers of the %s message.\n", *message)
+	fmt.Fprintf(&b, "const (\n")
+	for _, f := range fields {
+		fmt.Fprintf(&b, "%s%s = %s\n", *prefix, camel(f.name), f.number)
+	}
+	fmt.Fprintf(&b, ")\n\n")
+	fmt.Fprintf(&b, "// The %s message's singular string fields.\n", *message)
+	fmt.Fprintf(&b, "var %sStrings = []struct {\nname string\nnumber uint64\n}{\n", *prefix)
+	for _, f := range fields {
+		if f.typ == "string" && !f.repeated {
+			fmt.Fprintf(&b, "{%q, %s%s},\n", f.name, *prefix, camel(f.name))
+		}
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,11 @@
+// Input - acts as a bridge between cybermon and cherami.  The bridge itself
+// is in pkg/input, so other components can embed it; this runs it.
+package main
+
+import (
+	"analytics/pkg/input"
+)
+
+func main() {
+	input.Main()
+}
@@ -0,0 +1,68 @@
+// Filtering by event action.  ACTION_DENY lists actions to drop at the edge,
+// e.g. "connection_up,connection_down"; if ACTION_ALLOW is set, only the
+// actions it lists are passed.  Dropped events are counted by action, up to
+// METRIC_LABEL_LIMIT of them.
+
+package input
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type actionStage struct {
+	allow   map[string]bool
+	deny    map[string]bool
+	dropped *prometheus.CounterVec
+	actions *labelGuard
+}
+
+func newActionStage() (stage, error) {
+	allow := utils.Getenv("ACTION_ALLOW", "")
+	deny := utils.Getenv("ACTION_DENY", "")
+	if allow == "" && deny == "" {
+		return nil, nil
+	}
+
+	a := &actionStage{
+		allow: stringSet(allow),
+		deny:  stringSet(deny),
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "action_filtered_events",
+				Help: "Events dropped by action filtering",
+			},
+			[]string{"action"},
+		),
+	}
+	var err error
+	a.actions, err = newLabelGuard("action_filtered_events")
+	if err != nil {
+		return nil, err
+	}
+	mustRegister(a.dropped)
+	return a, nil
+}
+
+func (a *actionStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	action, _ := fields["action"].(string)
+	if a.deny[action] || (len(a.allow) > 0 && !a.allow[action]) {
+		a.dropped.With(prometheus.Labels{"action": a.actions.value(action)}).Inc()
+		e.output = ""
+		return false
+	}
+	return true
+}
+
+// Makes a set from a comma separated list.
+func stringSet(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, v := range splitList(s) {
+		set[v] = true
+	}
+	return set
+}
@@ -0,0 +1,68 @@
+// Administrative endpoints, served alongside the metrics.  Requests must
+// carry ADMIN_TOKEN as a bearer token.  Without a token the endpoints answer
+// 403, since tail and peek give away events and drain takes the bridge out
+// of service, unless ADMIN_INSECURE=true opens them to anyone who can reach
+// the metrics port.
+//
+//   POST /admin/drain    stop taking connections and close the open ones
+//   POST /admin/resume   take connections again after a drain
+//   GET  /admin/tail     stream events being forwarded, see tail.go
+//   GET  /admin/peek     the latest events forwarded, see peek.go
+//   GET  /admin/top      the heaviest devices and destinations, see top.go
+
+package input
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Who may use the admin endpoints.  Read by NewService, once any secrets
+// have been loaded from Vault.
+type adminAuth struct {
+	token    string
+	insecure bool
+}
+
+func newAdminAuth() *adminAuth {
+	return &adminAuth{
+		token:    utils.Getenv("ADMIN_TOKEN", ""),
+		insecure: utils.Getenv("ADMIN_INSECURE", "") == "true",
+	}
+}
+
+// Wraps an admin handler with the token check, and restricts it to method.
+func (a *adminAuth) handler(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case a.token == "" && !a.insecure:
+			http.Error(w, "ADMIN_TOKEN not set", http.StatusForbidden)
+			return
+		case a.token != "":
+			auth := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+a.token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// Registers /ready and the admin endpoints.
+func (s *Service) Handlers(mux *http.ServeMux) {
+	admin := s.admin.handler
+	mux.HandleFunc("/ready", s.ready)
+	mux.HandleFunc("/admin/drain", admin("POST", s.drainHandler))
+	mux.HandleFunc("/admin/resume", admin("POST", s.resumeHandler))
+	mux.HandleFunc("/admin/tail", admin("GET", s.tailHandler))
+	mux.HandleFunc("/admin/peek", admin("GET", s.peekHandler))
+	mux.HandleFunc("/admin/top", admin("GET", s.topHandler))
+}
@@ -0,0 +1,122 @@
+// Windowed aggregation.  With AGGREGATE_OUTPUT set, counts of events by
+// device and action are kept and a summary sent to that output every
+// AGGREGATE_INTERVAL, a cheap real-time feed for dashboards:
+//
+//   {"action": "aggregate", "time": "..", "instance": "..", "interval": 10,
+//    "counts": [{"device": "dmz-1", "action": "dns_message", "count": 1234}, ..]}
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	AGGREGATE_INTERVAL = "10s"
+)
+
+type aggregateKey struct {
+	Device string `json:"device"`
+	Action string `json:"action"`
+}
+
+type aggregateCount struct {
+	aggregateKey
+	Count int64 `json:"count"`
+}
+
+type aggregateStage struct {
+	output   string
+	interval time.Duration
+	send     sendFunc
+
+	mutex  sync.Mutex
+	counts map[aggregateKey]int64
+}
+
+func newAggregateStage() (stage, error) {
+	output := utils.Getenv("AGGREGATE_OUTPUT", "")
+	if output == "" {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(utils.Getenv("AGGREGATE_INTERVAL",
+		AGGREGATE_INTERVAL))
+	if err != nil {
+		return nil, fmt.Errorf("AGGREGATE_INTERVAL: %s", err.Error())
+	}
+	return &aggregateStage{
+		output:   output,
+		interval: interval,
+		counts:   map[aggregateKey]int64{},
+	}, nil
+}
+
+func (a *aggregateStage) start(ctx context.Context, wg *sync.WaitGroup, send sendFunc) {
+	a.send = send
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// The last window, cut short.
+				a.flush()
+				return
+			case <-ticker.C:
+				a.flush()
+			}
+		}
+	}()
+}
+
+func (a *aggregateStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	var key aggregateKey
+	key.Device, _ = fields["device"].(string)
+	key.Action, _ = fields["action"].(string)
+
+	a.mutex.Lock()
+	a.counts[key]++
+	a.mutex.Unlock()
+	return true
+}
+
+func (a *aggregateStage) flush() {
+	a.mutex.Lock()
+	counts := a.counts
+	a.counts = map[aggregateKey]int64{}
+	a.mutex.Unlock()
+
+	summary := struct {
+		Action   string           `json:"action"`
+		Time     string           `json:"time"`
+		Instance string           `json:"instance"`
+		Interval float64          `json:"interval"`
+		Counts   []aggregateCount `json:"counts"`
+	}{
+		Action:   "aggregate",
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Instance: instanceID,
+		Interval: a.interval.Seconds(),
+		Counts:   []aggregateCount{},
+	}
+	for k, n := range counts {
+		summary.Counts = append(summary.Counts, aggregateCount{k, n})
+	}
+
+	msg, err := json.Marshal(summary)
+	if err != nil {
+		return
+	}
+	a.send(a.output, append(msg, '\n'))
+}
@@ -0,0 +1,310 @@
+// Alerts posted to a webhook, for sites without Prometheus alerting at the
+// edge.  With ALERT_WEBHOOK set, the rules in ALERT_RULES are checked every
+// ALERT_INTERVAL against the bridge's own metrics, and the webhook told
+// when one starts or stops holding.  Rules are separated by ';', each
+//
+//   name:expression>threshold
+//
+// with < and the like as well, the expression being a metric summed over its
+// labels, or min(metric), max(metric) or rate(metric), the last per second
+// since the previous check.  The defaults alert on a send backlog, a failing
+// output and losing every probe connection:
+//
+//   backlog:send_queue_depth>10000;outputs:min(output_healthy)<1;
+//   connections:open_connections<1
+//
+// ALERT_FORMAT is "slack", for Slack's and compatible incoming webhooks,
+// "pagerduty", for PagerDuty's Events API with ALERT_ROUTING_KEY, or
+// "json" for {"alert", "state", "value", "threshold", "instance"}.
+
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	ALERT_RULES = "backlog:send_queue_depth>10000;outputs:min(output_healthy)<1;" +
+		"connections:open_connections<1"
+	ALERT_INTERVAL = "30s"
+	ALERT_FORMAT   = "slack"
+	ALERT_TIMEOUT  = 10 * time.Second
+)
+
+type alertRule struct {
+	name      string
+	text      string
+	fn        string
+	metric    string
+	op        string
+	threshold float64
+
+	firing bool
+
+	// For rates, the previous value and when it was taken.
+	last   float64
+	lastAt time.Time
+}
+
+var alertOps = []string{">=", "<=", ">", "<"}
+
+func parseAlertRule(spec string) (*alertRule, error) {
+	i := strings.Index(spec, ":")
+	if i < 1 {
+		return nil, fmt.Errorf("expected name:expression, got %q", spec)
+	}
+	r := &alertRule{name: strings.TrimSpace(spec[:i]), text: strings.TrimSpace(spec[i+1:])}
+	expr := r.text
+	for _, op := range alertOps {
+		if j := strings.Index(expr, op); j > 0 {
+			threshold, err := strconv.ParseFloat(strings.TrimSpace(expr[j+len(op):]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad threshold", r.name)
+			}
+			r.op, r.threshold = op, threshold
+			expr = strings.TrimSpace(expr[:j])
+			break
+		}
+	}
+	if r.op == "" {
+		return nil, fmt.Errorf("%s: no comparison", r.name)
+	}
+	r.fn, r.metric = "sum", expr
+	if j := strings.Index(expr, "("); j > 0 && strings.HasSuffix(expr, ")") {
+		r.fn, r.metric = expr[:j], expr[j+1:len(expr)-1]
+	}
+	switch r.fn {
+	case "sum", "min", "max", "rate":
+	default:
+		return nil, fmt.Errorf("%s: unknown function %q", r.name, r.fn)
+	}
+	return r, nil
+}
+
+// Returns the values of each series of the gathered metrics, by name.
+func gatherMetrics() (map[string][]float64, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	values := map[string][]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var v float64
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				v = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				v = m.GetGauge().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				v = float64(m.GetHistogram().GetSampleCount())
+			case dto.MetricType_SUMMARY:
+				v = float64(m.GetSummary().GetSampleCount())
+			default:
+				v = m.GetUntyped().GetValue()
+			}
+			values[f.GetName()] = append(values[f.GetName()], v)
+		}
+	}
+	return values, nil
+}
+
+// Returns the rule's value, and whether it has one yet.
+func (r *alertRule) value(metrics map[string][]float64, now time.Time) (float64, bool) {
+	series, ok := metrics[r.metric]
+	if !ok {
+		return 0, false
+	}
+	var v float64
+	for i, x := range series {
+		switch {
+		case r.fn == "min" && (i == 0 || x < v), r.fn == "max" && (i == 0 || x > v):
+			v = x
+		case r.fn == "sum", r.fn == "rate":
+			v += x
+		}
+	}
+	if r.fn != "rate" {
+		return v, true
+	}
+	last, lastAt := r.last, r.lastAt
+	r.last, r.lastAt = v, now
+	if lastAt.IsZero() || !now.After(lastAt) {
+		return 0, false
+	}
+	return (v - last) / now.Sub(lastAt).Seconds(), true
+}
+
+func (r *alertRule) holds(v float64) bool {
+	switch r.op {
+	case ">":
+		return v > r.threshold
+	case "<":
+		return v < r.threshold
+	case ">=":
+		return v >= r.threshold
+	}
+	return v <= r.threshold
+}
+
+type alerter struct {
+	url        string
+	format     string
+	routingKey string
+	rules      []*alertRule
+	client     *http.Client
+	posted     *prometheus.CounterVec
+}
+
+// Starts checking alert rules, if there's a webhook to tell.
+func (s *Service) startAlerts() error {
+	url := utils.Getenv("ALERT_WEBHOOK", "")
+	if url == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(utils.Getenv("ALERT_INTERVAL", ALERT_INTERVAL))
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("ALERT_INTERVAL: must be a positive duration")
+	}
+	a := &alerter{
+		url:        url,
+		format:     utils.Getenv("ALERT_FORMAT", ALERT_FORMAT),
+		routingKey: utils.Getenv("ALERT_ROUTING_KEY", ""),
+		client:     &http.Client{Timeout: ALERT_TIMEOUT},
+		posted: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "alert_webhooks",
+				Help: "Alert webhook posts, by result",
+			},
+			[]string{"result"},
+		),
+	}
+	switch a.format {
+	case "slack", "json":
+	case "pagerduty":
+		if a.routingKey == "" {
+			return fmt.Errorf("ALERT_ROUTING_KEY: needed for PagerDuty")
+		}
+	default:
+		return fmt.Errorf("ALERT_FORMAT: expected slack, pagerduty or json, got %q", a.format)
+	}
+	for _, spec := range strings.Split(utils.Getenv("ALERT_RULES", ALERT_RULES), ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		r, err := parseAlertRule(spec)
+		if err != nil {
+			return fmt.Errorf("ALERT_RULES: %s", err.Error())
+		}
+		a.rules = append(a.rules, r)
+	}
+	mustRegister(a.posted)
+
+	utils.Log("INFO: Checking %d alert rules every %s", len(a.rules), interval)
+	s.waitGroup.Add(1)
+	go func() {
+		defer s.waitGroup.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case now := <-ticker.C:
+				a.check(now)
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *alerter) check(now time.Time) {
+	metrics, err := gatherMetrics()
+	if err != nil {
+		utils.Log("WARN: Unable to gather metrics for alerts: %s", err.Error())
+		return
+	}
+	for _, r := range a.rules {
+		v, ok := r.value(metrics, now)
+		if !ok || r.holds(v) == r.firing {
+			continue
+		}
+		r.firing = !r.firing
+		if err := a.notify(r, v); err != nil {
+			a.posted.With(prometheus.Labels{"result": "failed"}).Inc()
+			utils.Log("WARN: Unable to post alert %s: %s", r.name, err.Error())
+			// Try again next time.
+			r.firing = !r.firing
+			continue
+		}
+		a.posted.With(prometheus.Labels{"result": "sent"}).Inc()
+		if r.firing {
+			utils.Log("WARN: Alert %s firing: %s, at %g", r.name, r.text, v)
+		} else {
+			utils.Log("INFO: Alert %s resolved, at %g", r.name, v)
+		}
+	}
+}
+
+// Posts a rule's change of state to the webhook.
+func (a *alerter) notify(r *alertRule, v float64) error {
+	state := "resolved"
+	if r.firing {
+		state = "firing"
+	}
+	summary := fmt.Sprintf("analytics-input %s: alert %s %s (%s, now %g)",
+		instanceID, r.name, state, r.text, v)
+
+	var body interface{}
+	switch a.format {
+	case "slack":
+		body = map[string]interface{}{"text": summary}
+	case "pagerduty":
+		action := "resolve"
+		if r.firing {
+			action = "trigger"
+		}
+		body = map[string]interface{}{
+			"routing_key":  a.routingKey,
+			"event_action": action,
+			"dedup_key":    "analytics-input-" + instanceID + "-" + r.name,
+			"payload": map[string]interface{}{
+				"summary":  summary,
+				"source":   instanceID,
+				"severity": "error",
+			},
+		}
+	default:
+		body = map[string]interface{}{
+			"alert":     r.name,
+			"state":     state,
+			"rule":      r.text,
+			"value":     v,
+			"threshold": r.threshold,
+			"instance":  instanceID,
+		}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Autonomous system enrichment from a local MaxMind ASN database.
+// ASN_DATABASE names the database and ASN_FIELDS the address fields to look
+// up.  Results are added under "asn", keyed by field:
+//
+//   "asn": {"dest": {"number": 15169, "org": "Google LLC"}}
+//
+// The database is reopened every ASN_RELOAD_INTERVAL if it has changed on
+// disk, so it can be updated in place.
+
+package input
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	ASN_FIELDS          = "src,dest"
+	ASN_RELOAD_INTERVAL = "1h"
+)
+
+type asnStage struct {
+	path   string
+	fields [][]string
+
+	mutex    sync.RWMutex
+	db       *geoip2.Reader
+	modified time.Time
+}
+
+func newASNStage() (stage, error) {
+	path := utils.Getenv("ASN_DATABASE", "")
+	if path == "" {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(utils.Getenv("ASN_RELOAD_INTERVAL",
+		ASN_RELOAD_INTERVAL))
+	if err != nil {
+		return nil, err
+	}
+
+	a := &asnStage{
+		path:   path,
+		fields: fieldPaths(utils.Getenv("ASN_FIELDS", ASN_FIELDS)),
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := a.load(); err != nil {
+				utils.Log("WARN: Unable to reload ASN database: %s", err.Error())
+			}
+		}
+	}()
+	return a, nil
+}
+
+// Opens the database if it's changed since it was last loaded.
+func (a *asnStage) load() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	if !info.ModTime().After(a.modified) {
+		return nil
+	}
+
+	db, err := geoip2.Open(a.path)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	old := a.db
+	a.db = db
+	a.modified = info.ModTime()
+	a.mutex.Unlock()
+
+	if old != nil {
+		old.Close()
+		utils.Log("INFO: Reloaded ASN database: %s", a.path)
+	}
+	return nil
+}
+
+func (a *asnStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	eachAddress(fields, a.fields, func(path string, ip net.IP) {
+		asn, err := a.db.ASN(ip)
+		if err != nil || asn.AutonomousSystemNumber == 0 {
+			return
+		}
+		annotate(fields, "asn", path, map[string]interface{}{
+			"number": asn.AutonomousSystemNumber,
+			"org":    asn.AutonomousSystemOrganization,
+		})
+		e.modified()
+	})
+	return true
+}
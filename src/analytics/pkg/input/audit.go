@@ -0,0 +1,78 @@
+// Audit trail of who fed data into the pipeline.  Connection lifecycle,
+// authentication results and administrative actions are written as JSON
+// lines to AUDIT_LOG_FILE and/or sent to the output named by AUDIT_OUTPUT,
+// separately from the operational log.
+
+package input
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type auditLog struct {
+	mutex  sync.Mutex
+	file   *os.File
+	output string
+	worker Publisher
+}
+
+type auditRecord struct {
+	Time   string `json:"time"`
+	Action string `json:"action"`
+	Remote string `json:"remote,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Returns nil if auditing isn't configured.  A nil auditLog discards
+// records, so callers needn't check.
+func newAuditLog(w Publisher) (*auditLog, error) {
+	path := utils.Getenv("AUDIT_LOG_FILE", "")
+	output := utils.Getenv("AUDIT_OUTPUT", "")
+	if path == "" && output == "" {
+		return nil, nil
+	}
+
+	a := &auditLog{output: output, worker: w}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+func (a *auditLog) record(action, remote, detail string) {
+	if a == nil {
+		return
+	}
+
+	rec, err := json.Marshal(auditRecord{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Action: action,
+		Remote: remote,
+		Detail: detail,
+	})
+	if err != nil {
+		return
+	}
+	rec = append(rec, '\n')
+
+	if a.file != nil {
+		a.mutex.Lock()
+		_, err := a.file.Write(rec)
+		a.mutex.Unlock()
+		if err != nil {
+			utils.Log("ERROR: Unable to write audit log: %s", err.Error())
+		}
+	}
+	if a.output != "" {
+		a.worker.Send(a.output, rec)
+	}
+}
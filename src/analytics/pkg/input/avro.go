@@ -0,0 +1,401 @@
+// Avro output encoding, for consumers wanting typed records.  Events are
+// encoded in Avro's binary form with the schema in AVRO_SCHEMA_FILE, a JSON
+// schema document as usual.  Fields the schema doesn't have are left out,
+// and a field the event lacks takes the schema's default, or null if its
+// type allows, or else the event can't be encoded.  Unions take the first
+// branch the value fits.
+//
+// With AVRO_SCHEMA_REGISTRY set to the URL of a Confluent compatible schema
+// registry, the schema is checked for compatibility with the latest version
+// under AVRO_SUBJECT and registered at startup, and each event is prefixed
+// with the registry's wire format header: a zero byte and the schema ID.
+
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	AVRO_SUBJECT = "analytics-input-value"
+)
+
+type avroType struct {
+	// A primitive type name, or record, enum, array, map, fixed or union.
+	kind string
+
+	fields   []avroField
+	symbols  []string
+	items    *avroType
+	branches []*avroType
+	size     int
+}
+
+type avroField struct {
+	name       string
+	typ        *avroType
+	def        interface{}
+	hasDefault bool
+}
+
+type avroEncoder struct {
+	schema *avroType
+
+	// The wire format header, if registered.
+	header []byte
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+func newAvroEncoder() (encoder, error) {
+	file := utils.Getenv("AVRO_SCHEMA_FILE", "")
+	if file == "" {
+		return nil, fmt.Errorf("AVRO_SCHEMA_FILE: must be set for avro encoding")
+	}
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("AVRO_SCHEMA_FILE: %s", err.Error())
+	}
+	var doc interface{}
+	if err := json.Unmarshal(text, &doc); err != nil {
+		return nil, fmt.Errorf("AVRO_SCHEMA_FILE: %s", err.Error())
+	}
+	schema, err := parseAvroType(doc, "", map[string]*avroType{})
+	if err != nil {
+		return nil, fmt.Errorf("AVRO_SCHEMA_FILE: %s", err.Error())
+	}
+	a := &avroEncoder{schema: schema}
+
+	if registry := utils.Getenv("AVRO_SCHEMA_REGISTRY", ""); registry != "" {
+		subject := utils.Getenv("AVRO_SUBJECT", AVRO_SUBJECT)
+		id, err := registerAvroSchema(registry, subject, string(text))
+		if err != nil {
+			return nil, fmt.Errorf("AVRO_SCHEMA_REGISTRY: %s", err.Error())
+		}
+		a.header = make([]byte, 5)
+		binary.BigEndian.PutUint32(a.header[1:], id)
+		utils.Log("INFO: Avro schema registered as %s, ID %d", subject, id)
+	}
+	return a, nil
+}
+
+// Parses a schema, recording named types so later references find them.
+func parseAvroType(v interface{}, namespace string, named map[string]*avroType) (*avroType, error) {
+	switch v := v.(type) {
+	case string:
+		if avroPrimitives[v] {
+			return &avroType{kind: v}, nil
+		}
+		if t, ok := named[v]; ok {
+			return t, nil
+		}
+		if t, ok := named[namespace+"."+v]; ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", v)
+	case []interface{}:
+		t := &avroType{kind: "union"}
+		for _, b := range v {
+			bt, err := parseAvroType(b, namespace, named)
+			if err != nil {
+				return nil, err
+			}
+			t.branches = append(t.branches, bt)
+		}
+		return t, nil
+	case map[string]interface{}:
+		kind, _ := v["type"].(string)
+		if ns, ok := v["namespace"].(string); ok {
+			namespace = ns
+		}
+		t := &avroType{kind: kind}
+		switch kind {
+		case "record", "enum", "fixed":
+			name, _ := v["name"].(string)
+			if name == "" {
+				return nil, fmt.Errorf("%s without a name", kind)
+			}
+			named[name] = t
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				named[name[i+1:]] = t
+			} else if namespace != "" {
+				named[namespace+"."+name] = t
+			}
+		}
+		switch kind {
+		case "record":
+			fields, _ := v["fields"].([]interface{})
+			for _, f := range fields {
+				f, _ := f.(map[string]interface{})
+				name, _ := f["name"].(string)
+				if name == "" {
+					return nil, fmt.Errorf("field without a name")
+				}
+				ft, err := parseAvroType(f["type"], namespace, named)
+				if err != nil {
+					return nil, fmt.Errorf("field %s: %s", name, err.Error())
+				}
+				def, hasDefault := f["default"]
+				t.fields = append(t.fields, avroField{name, ft, def, hasDefault})
+			}
+		case "enum":
+			symbols, _ := v["symbols"].([]interface{})
+			for _, s := range symbols {
+				s, _ := s.(string)
+				t.symbols = append(t.symbols, s)
+			}
+		case "array", "map":
+			key := "items"
+			if kind == "map" {
+				key = "values"
+			}
+			items, err := parseAvroType(v[key], namespace, named)
+			if err != nil {
+				return nil, err
+			}
+			t.items = items
+		case "fixed":
+			size, _ := v["size"].(float64)
+			t.size = int(size)
+		default:
+			// A primitive in object form, perhaps with a logical type.
+			return parseAvroType(v["type"], namespace, named)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("bad schema %v", v)
+}
+
+func (a *avroEncoder) encode(msg []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	buf := append([]byte(nil), a.header...)
+	return appendAvro(buf, a.schema, v)
+}
+
+var errAvroType = errors.New("doesn't fit the schema")
+
+func appendAvroLong(buf []byte, n int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], n)]...)
+}
+
+// Appends a JSON value encoded as the type.
+func appendAvro(buf []byte, t *avroType, v interface{}) ([]byte, error) {
+	switch t.kind {
+	case "null":
+		if v != nil {
+			return nil, errAvroType
+		}
+		return buf, nil
+	case "boolean":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, errAvroType
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case "int", "long":
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, errAvroType
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return nil, errAvroType
+		}
+		if t.kind == "int" && (i < math.MinInt32 || i > math.MaxInt32) {
+			return nil, errAvroType
+		}
+		return appendAvroLong(buf, i), nil
+	case "float", "double":
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, errAvroType
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, errAvroType
+		}
+		if t.kind == "float" {
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(f)))
+			return append(buf, b[:]...), nil
+		}
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+		return append(buf, b[:]...), nil
+	case "string", "bytes":
+		s, ok := v.(string)
+		if !ok {
+			return nil, errAvroType
+		}
+		buf = appendAvroLong(buf, int64(len(s)))
+		return append(buf, s...), nil
+	case "fixed":
+		s, ok := v.(string)
+		if !ok || len(s) != t.size {
+			return nil, errAvroType
+		}
+		return append(buf, s...), nil
+	case "enum":
+		s, ok := v.(string)
+		if ok {
+			for i, symbol := range t.symbols {
+				if s == symbol {
+					return appendAvroLong(buf, int64(i)), nil
+				}
+			}
+		}
+		return nil, errAvroType
+	case "record":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errAvroType
+		}
+		var err error
+		for _, f := range t.fields {
+			fv, present := obj[f.name]
+			if !present && f.hasDefault {
+				fv = normaliseAvroDefault(f.def)
+			}
+			buf, err = appendAvro(buf, f.typ, fv)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", f.name, err.Error())
+			}
+		}
+		return buf, nil
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return nil, errAvroType
+		}
+		if len(items) > 0 {
+			buf = appendAvroLong(buf, int64(len(items)))
+			var err error
+			for _, item := range items {
+				buf, err = appendAvro(buf, t.items, item)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return append(buf, 0), nil
+	case "map":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errAvroType
+		}
+		if len(obj) > 0 {
+			buf = appendAvroLong(buf, int64(len(obj)))
+			var err error
+			for k, item := range obj {
+				buf = appendAvroLong(buf, int64(len(k)))
+				buf = append(buf, k...)
+				buf, err = appendAvro(buf, t.items, item)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return append(buf, 0), nil
+	case "union":
+		for i, b := range t.branches {
+			out, err := appendAvro(appendAvroLong(buf, int64(i)), b, v)
+			if err == nil {
+				return out, nil
+			}
+		}
+		return nil, errAvroType
+	}
+	return nil, fmt.Errorf("unsupported type %s", t.kind)
+}
+
+// Schema defaults are decoded as float64, encoding wants json.Number.
+func normaliseAvroDefault(v interface{}) interface{} {
+	switch v := v.(type) {
+	case float64:
+		return json.Number(fmt.Sprint(v))
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = normaliseAvroDefault(item)
+		}
+		return out
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, item := range v {
+			out[k] = normaliseAvroDefault(item)
+		}
+		return out
+	}
+	return v
+}
+
+// Checks the schema is compatible with the subject's latest version, if it
+// has one, and registers it, returning its ID.
+func registerAvroSchema(registry, subject, schema string) (uint32, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	base := strings.TrimRight(registry, "/")
+	call := func(path string, result interface{}) (int, error) {
+		resp, err := client.Post(base+path, "application/vnd.schemaregistry.v1+json",
+			bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status,
+				strings.TrimSpace(string(msg)))
+		}
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(result)
+	}
+
+	subject = url.PathEscape(subject)
+	var compat struct {
+		Compatible bool `json:"is_compatible"`
+	}
+	status, err := call("/compatibility/subjects/"+subject+"/versions/latest", &compat)
+	switch {
+	case status == http.StatusNotFound:
+		// Nothing registered yet.
+	case err != nil:
+		return 0, err
+	case !compat.Compatible:
+		return 0, fmt.Errorf("schema isn't compatible with subject %s", subject)
+	}
+
+	var registered struct {
+		ID uint32 `json:"id"`
+	}
+	if _, err := call("/subjects/"+subject+"/versions", &registered); err != nil {
+		return 0, err
+	}
+	return registered.ID, nil
+}
@@ -0,0 +1,133 @@
+// Batching for outputs which accept several newline separated events in
+// one message, listed in BATCH_OUTPUTS.  Events are collected until there
+// are BATCH_MAX_EVENTS of them, they reach BATCH_MAX_BYTES, or the first has
+// waited BATCH_LINGER, and published together, through whatever delivers
+// the output.  Events in binary encodings are length prefixed, see
+// encode.go.  The Parquet and TAXII outputs take events one at a time and
+// can't be batched.
+
+package input
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	BATCH_MAX_EVENTS = "100"
+	BATCH_MAX_BYTES  = "1048576"
+	BATCH_LINGER     = "10ms"
+)
+
+type batcher struct {
+	output    string
+	maxEvents int
+	maxBytes  int
+	linger    time.Duration
+	publish   publishFunc
+	size      prometheus.Observer
+
+	mutex      sync.Mutex
+	buf        []byte
+	received   []time.Time
+	count      int
+	generation int
+}
+
+// Publishes a batch, given when each of its events was read.
+type publishFunc func(output string, msg []byte, received []time.Time)
+
+// Makes a batcher for each output listed in BATCH_OUTPUTS.
+func newBatchers(publish publishFunc) (map[string]*batcher, error) {
+	outputs := splitList(utils.Getenv("BATCH_OUTPUTS", ""))
+	if len(outputs) == 0 {
+		return nil, nil
+	}
+
+	maxEvents, err := strconv.Atoi(utils.Getenv("BATCH_MAX_EVENTS", BATCH_MAX_EVENTS))
+	if err != nil || maxEvents < 1 {
+		return nil, fmt.Errorf("BATCH_MAX_EVENTS: must be a positive number")
+	}
+	maxBytes, err := strconv.Atoi(utils.Getenv("BATCH_MAX_BYTES", BATCH_MAX_BYTES))
+	if err != nil || maxBytes < 1 {
+		return nil, fmt.Errorf("BATCH_MAX_BYTES: must be a positive number")
+	}
+	linger, err := time.ParseDuration(utils.Getenv("BATCH_LINGER", BATCH_LINGER))
+	if err != nil {
+		return nil, fmt.Errorf("BATCH_LINGER: %s", err.Error())
+	}
+
+	size := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "batch_events",
+			Help:    "Events per published batch",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+		[]string{"output"},
+	)
+	mustRegister(size)
+
+	batchers := map[string]*batcher{}
+	for _, output := range outputs {
+		batchers[output] = &batcher{
+			output:    output,
+			maxEvents: maxEvents,
+			maxBytes:  maxBytes,
+			linger:    linger,
+			publish:   publish,
+			size:      size.With(prometheus.Labels{"output": output}),
+		}
+	}
+	return batchers, nil
+}
+
+// Adds an event to the batch.  The bytes are copied so the event can be
+// released straight away.
+func (b *batcher) add(data []byte, received time.Time) {
+	b.mutex.Lock()
+	if len(b.buf) > 0 && len(b.buf)+len(data) > b.maxBytes {
+		b.flushLocked()
+	}
+	b.buf = append(b.buf, data...)
+	b.received = append(b.received, received)
+	b.count++
+	if b.count == 1 {
+		gen := b.generation
+		time.AfterFunc(b.linger, func() {
+			b.mutex.Lock()
+			if b.generation == gen {
+				b.flushLocked()
+			}
+			b.mutex.Unlock()
+		})
+	}
+	if b.count >= b.maxEvents || len(b.buf) >= b.maxBytes {
+		b.flushLocked()
+	}
+	b.mutex.Unlock()
+}
+
+func (b *batcher) flush() {
+	b.mutex.Lock()
+	b.flushLocked()
+	b.mutex.Unlock()
+}
+
+// Publishes the batch, called with the mutex held.  Publishing under the
+// lock keeps batches in order.
+func (b *batcher) flushLocked() {
+	if b.count == 0 {
+		return
+	}
+	b.publish(b.output, b.buf, b.received)
+	b.size.Observe(float64(b.count))
+	b.buf = make([]byte, 0, cap(b.buf))
+	b.received = b.received[:0]
+	b.count = 0
+	b.generation++
+}
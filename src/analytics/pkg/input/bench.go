@@ -0,0 +1,127 @@
+// Benchmarking the bridge's own path, for comparing releases.  "input
+// bench" runs generated events through the stages and senders to the
+// outputs as fast as they're taken, without a socket in the way, then
+// reports the throughput, the allocations per event and the time from
+// reading to acceptance by each output:
+//
+//   input bench -count 1000000 -size 600 output:/queue/bench
+//
+// The usual configuration applies, so the stages measured are those
+// configured in the environment.
+
+package input
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Distinct events generated up front, and cycled through, so generation
+// isn't measured.
+const benchEvents = 10000
+
+// Runs the bench subcommand.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	count := fs.Int("count", 1000000, "events to send")
+	devices := fs.Int("devices", 10, "number of probe devices")
+	size := fs.Int("size", 600, "median event size in bytes")
+	spread := fs.Float64("spread", 0.5, "spread of event sizes, 0 for all the same")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *count < 1 || *devices < 1 || *size < 1 {
+		return fmt.Errorf("count, devices and size must be positive")
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no outputs defined")
+	}
+
+	g := &eventGenerator{
+		devices: *devices,
+		size:    *size,
+		spread:  *spread,
+		rnd:     rand.New(rand.NewSource(1)),
+	}
+	type sample struct {
+		device int
+		data   []byte
+	}
+	samples := make([]sample, benchEvents)
+	for i := range samples {
+		d := g.rnd.Intn(g.devices)
+		samples[i] = sample{d, g.event(d)}
+	}
+
+	s, err := newWorkerService(fs.Args())
+	if err != nil {
+		return err
+	}
+	var mutex sync.Mutex
+	latencies := map[string][]time.Duration{}
+	s.sender.onDelivered = func(output string, d time.Duration) {
+		mutex.Lock()
+		latencies[output] = append(latencies[output], d)
+		mutex.Unlock()
+	}
+	clients := make([]*client, g.devices)
+	for i := range clients {
+		clients[i] = &client{
+			id:     nextConnection(),
+			remote: g.address(i),
+			state:  map[stage]interface{}{},
+		}
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := 0; i < *count; i++ {
+		smp := samples[i%len(samples)]
+		cl := clients[smp.device]
+
+		// The stages may change the event, so work on a copy as the
+		// connection would on what it read.
+		e := &event{
+			data:     append([]byte(nil), smp.data...),
+			output:   "output",
+			remote:   cl.remote,
+			client:   cl,
+			received: time.Now(),
+		}
+		s.process(e)
+		s.send(e)
+	}
+	s.Stop()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	fmt.Printf("events:           %d in %s\n", *count, elapsed)
+	fmt.Printf("events/s:         %.0f\n", float64(*count)/elapsed.Seconds())
+	fmt.Printf("allocs/event:     %.1f\n",
+		float64(after.Mallocs-before.Mallocs)/float64(*count))
+	fmt.Printf("bytes/event:      %.0f\n",
+		float64(after.TotalAlloc-before.TotalAlloc)/float64(*count))
+
+	var outputs []string
+	for output := range latencies {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+	for _, output := range outputs {
+		l := latencies[output]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Printf("%s: delivered %d, p50 %s, p99 %s, max %s\n", output,
+			len(l), l[len(l)/2], l[len(l)*99/100], l[len(l)-1])
+	}
+	utils.Log("INFO: Benchmark complete")
+	return nil
+}
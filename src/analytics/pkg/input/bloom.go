@@ -0,0 +1,110 @@
+// Probabilistic dedup for high event rates, selected by DEDUP_MODE=bloom.
+// Memory is fixed by DEDUP_SIZE and DEDUP_FALSE_POSITIVE, the chance of a
+// unique event being mistaken for a duplicate and dropped.  Two filters are
+// kept, the older being discarded each DEDUP_WINDOW or when the newer fills,
+// so ids are remembered for between one and two windows.
+
+package input
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	DEDUP_FALSE_POSITIVE = "0.001"
+)
+
+type bloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// Sizes a filter for n entries at false positive rate p.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Ceil(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// Bit positions by double hashing the two halves of a 64 bit hash.
+func (b *bloomFilter) positions(id string, fn func(pos uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	for i := uint64(0); i < b.k; i++ {
+		fn((h1 + i*h2) % b.m)
+	}
+}
+
+func (b *bloomFilter) contains(id string) bool {
+	found := true
+	b.positions(id, func(pos uint64) {
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+func (b *bloomFilter) add(id string) {
+	b.positions(id, func(pos uint64) {
+		b.bits[pos/64] |= 1 << (pos % 64)
+	})
+}
+
+func (b *bloomFilter) reset() {
+	for i := range b.bits {
+		b.bits[i] = 0
+	}
+}
+
+type bloomDedup struct {
+	window time.Duration
+	size   int
+
+	mutex    sync.Mutex
+	current  *bloomFilter
+	previous *bloomFilter
+	count    int
+	rotated  time.Time
+}
+
+func newBloomDedup(window time.Duration, size int, p float64) *bloomDedup {
+	return &bloomDedup{
+		window:   window,
+		size:     size,
+		current:  newBloomFilter(size, p),
+		previous: newBloomFilter(size, p),
+		rotated:  time.Now(),
+	}
+}
+
+func (d *bloomDedup) seen(id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.count >= d.size || time.Since(d.rotated) >= d.window {
+		d.previous, d.current = d.current, d.previous
+		d.current.reset()
+		d.count = 0
+		d.rotated = time.Now()
+	}
+
+	if d.current.contains(id) || d.previous.contains(id) {
+		return true
+	}
+	d.current.add(id)
+	d.count++
+	return false
+}
@@ -0,0 +1,95 @@
+// Canary events, for monitoring the whole path to the store.  With
+// CANARY_INTERVAL set, an event like
+//
+//   {"action": "canary", "id": "canary-<instance>-<n>", "canary": true,
+//    "time": "..", "device": "analytics-input", "instance": ".."}
+//
+// is queued for each output every interval, so downstream can check events
+// are arriving, and how long they take, however quiet the probes are.  The
+// outputs are those given on the command line, or CANARY_OUTPUTS.  Canaries
+// skip the processing stages but are otherwise sent like any event.
+
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type canary struct {
+	Action   string `json:"action"`
+	ID       string `json:"id"`
+	Canary   bool   `json:"canary"`
+	Time     string `json:"time"`
+	Device   string `json:"device"`
+	Instance string `json:"instance"`
+}
+
+// Starts sending canaries, if configured.  outputs are the output
+// specifications the bridge was started with.
+func (s *Service) startCanary(outputs []string) error {
+	v := utils.Getenv("CANARY_INTERVAL", "")
+	if v == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("CANARY_INTERVAL: must be a positive duration")
+	}
+
+	names := splitList(utils.Getenv("CANARY_OUTPUTS", ""))
+	if len(names) == 0 {
+		names = outputNames(outputs)
+	}
+
+	sent := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "canary_events_sent",
+			Help: "Canary events queued for each output",
+		},
+		[]string{"output"},
+	)
+	mustRegister(sent)
+
+	utils.Log("INFO: Sending canaries to %s every %s", strings.Join(names, ", "), interval)
+	s.waitGroup.Add(1)
+	go func() {
+		defer s.waitGroup.Done()
+		n := 0
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, output := range names {
+				n++
+				msg, err := json.Marshal(canary{
+					Action:   "canary",
+					ID:       fmt.Sprintf("canary-%s-%d", instanceID, n),
+					Canary:   true,
+					Time:     time.Now().UTC().Format(time.RFC3339Nano),
+					Device:   "analytics-input",
+					Instance: instanceID,
+				})
+				if err != nil {
+					continue
+				}
+				s.sender.enqueue(&event{
+					data:     append(msg, '\n'),
+					output:   output,
+					received: time.Now(),
+				})
+				sent.With(prometheus.Labels{"output": output}).Inc()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,116 @@
+// Filtering and routing with CEL expressions over the decoded event, bound
+// to the variable "event":
+//
+//   CEL_FILTER  events for which this is false are dropped, e.g.
+//               event.action != 'connection_up'
+//   CEL_ROUTES  ';' separated output:expression rules, the first match
+//               sending the event to that output, e.g.
+//               priority:event.action == 'http_request' && event.device.startsWith('dmz-')
+//
+// An expression which fails to evaluate, say on a missing field, doesn't
+// match.
+
+package input
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type celRoute struct {
+	output  string
+	program cel.Program
+}
+
+type celStage struct {
+	filter   cel.Program
+	routes   []celRoute
+	filtered prometheus.Counter
+}
+
+func newCELStage() (stage, error) {
+	filter := utils.Getenv("CEL_FILTER", "")
+	routes := utils.Getenv("CEL_ROUTES", "")
+	if filter == "" && routes == "" {
+		return nil, nil
+	}
+
+	env, err := cel.NewEnv(cel.Variable("event", cel.DynType))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &celStage{
+		filtered: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "cel_filtered_events",
+			Help: "Events dropped by the CEL filter",
+		}),
+	}
+	if filter != "" {
+		if c.filter, err = celProgram(env, filter); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range strings.Split(routes, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("CEL_ROUTES: expected output:expression, got %q", rule)
+		}
+		prg, err := celProgram(env, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		c.routes = append(c.routes, celRoute{strings.TrimSpace(parts[0]), prg})
+	}
+	mustRegister(c.filtered)
+	return c, nil
+}
+
+func celProgram(env *cel.Env, expr string) (cel.Program, error) {
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("%s: %s", expr, iss.Err())
+	}
+	if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+		return nil, fmt.Errorf("%s: must be a boolean expression", expr)
+	}
+	return env.Program(ast)
+}
+
+func (c *celStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	vars := map[string]interface{}{"event": fields}
+
+	if c.filter != nil && !celMatch(c.filter, vars) {
+		c.filtered.Inc()
+		e.output = ""
+		return false
+	}
+	for _, r := range c.routes {
+		if celMatch(r.program, vars) {
+			e.output = r.output
+			break
+		}
+	}
+	return true
+}
+
+func celMatch(prg cel.Program, vars map[string]interface{}) bool {
+	out, _, err := prg.Eval(vars)
+	if err != nil {
+		return false
+	}
+	match, ok := out.Value().(bool)
+	return ok && match
+}
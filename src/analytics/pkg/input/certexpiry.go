@@ -0,0 +1,137 @@
+// Certificate expiry, so an expiring probe certificate is noticed before
+// its connections start failing.  The days left on the listener's
+// certificate, each CA in the client CA bundle, and the latest client
+// certificate seen with each subject are exported as
+//
+//   tls_certificate_expiry_days{kind="server|ca|client", subject="..."}
+//
+// worked out when scraped.  Client subjects beyond METRIC_LABEL_LIMIT are
+// counted as "other", with the soonest expiry among them.  The client CA
+// bundle, TLS_CLIENT_CA or TLS_CLIENT_CA_FILE, makes the listener ask probes
+// for a certificate and verify any they send, as tenants by certificate
+// need.
+
+package input
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type certKey struct {
+	kind, subject string
+}
+
+type certExpiry struct {
+	desc *prometheus.Desc
+
+	// Client subjects given a series of their own, nil until client
+	// certificates are asked for.
+	clients *labelGuard
+
+	mutex    sync.Mutex
+	notAfter map[certKey]time.Time
+}
+
+var certExpiries = &certExpiry{
+	desc: prometheus.NewDesc("tls_certificate_expiry_days",
+		"Days until the certificate expires", []string{"kind", "subject"}, nil),
+	notAfter: map[certKey]time.Time{},
+}
+
+func (c *certExpiry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *certExpiry) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for k, t := range c.notAfter {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue,
+			t.Sub(now).Hours()/24, k.kind, k.subject)
+	}
+}
+
+// Records the expiry of a certificate of the given kind.
+func (c *certExpiry) record(kind string, cert *x509.Certificate) {
+	subject := cert.Subject.CommonName
+	if subject == "" {
+		subject = cert.Subject.String()
+	}
+	if kind == "client" {
+		subject = c.clients.value(subject)
+	}
+	key := certKey{kind, subject}
+	c.mutex.Lock()
+	if t, ok := c.notAfter[key]; subject != "other" || !ok || cert.NotAfter.Before(t) {
+		c.notAfter[key] = cert.NotAfter
+	}
+	c.mutex.Unlock()
+}
+
+// Records the expiry of a key pair's leaf certificate.
+func (c *certExpiry) recordPair(kind string, pair *tls.Certificate) {
+	leaf := pair.Leaf
+	if leaf == nil && len(pair.Certificate) > 0 {
+		var err error
+		leaf, err = x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return
+		}
+	}
+	if leaf != nil {
+		c.record(kind, leaf)
+	}
+}
+
+// Has the listener verify client certificates against the client CA
+// bundle, if one is configured.
+func useClientCAs(cfg *tls.Config) error {
+	var err error
+	bundle := []byte(os.Getenv("TLS_CLIENT_CA"))
+	if len(bundle) == 0 {
+		file := utils.Getenv("TLS_CLIENT_CA_FILE", "")
+		if file == "" {
+			return nil
+		}
+		bundle, err = ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("TLS_CLIENT_CA_FILE: %s", err.Error())
+		}
+	}
+	certExpiries.clients, err = newLabelGuard("tls_certificate_expiry_days")
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	n := 0
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("client CA bundle: %s", err.Error())
+		}
+		pool.AddCert(cert)
+		certExpiries.record("ca", cert)
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("client CA bundle: no certificates found")
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	utils.Log("INFO: Verifying client certificates against %d CAs", n)
+	return nil
+}
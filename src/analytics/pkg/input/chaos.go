@@ -0,0 +1,111 @@
+// Fault injection, for testing retries, spooling and readiness under
+// failure.  Never for production: nothing is injected unless CHAOS_MODE is
+// "true", and a warning is logged when it is.  Then:
+//
+//   CHAOS_SEND_ERRORS    fraction of publishes failed before reaching the
+//                        output, e.g. 0.01
+//   CHAOS_SEND_LATENCY   delay added to every publish, e.g. "50ms"
+//   CHAOS_DROPS          fraction of events after which the connection is
+//                        dropped
+//   CHAOS_CORRUPTION     fraction of events with a byte overwritten, before
+//                        any processing
+
+package input
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+var errChaos = errors.New("injected send failure")
+
+type chaosConfig struct {
+	sendErrors  float64
+	sendLatency time.Duration
+	drops       float64
+	corruption  float64
+
+	injected *prometheus.CounterVec
+}
+
+// Returns the faults to inject, nil unless chaos mode is on.
+func newChaos() (*chaosConfig, error) {
+	if utils.Getenv("CHAOS_MODE", "") != "true" {
+		return nil, nil
+	}
+	c := &chaosConfig{
+		injected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "chaos_faults_injected",
+				Help: "Faults injected in chaos mode",
+			},
+			[]string{"fault"},
+		),
+	}
+	for _, f := range []struct {
+		name  string
+		value *float64
+	}{
+		{"CHAOS_SEND_ERRORS", &c.sendErrors},
+		{"CHAOS_DROPS", &c.drops},
+		{"CHAOS_CORRUPTION", &c.corruption},
+	} {
+		p, err := strconv.ParseFloat(utils.Getenv(f.name, "0"), 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("%s: must be between 0 and 1", f.name)
+		}
+		*f.value = p
+	}
+	if v := utils.Getenv("CHAOS_SEND_LATENCY", ""); v != "" {
+		var err error
+		c.sendLatency, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("CHAOS_SEND_LATENCY: %s", err.Error())
+		}
+	}
+	mustRegister(c.injected)
+	utils.Log("WARN: Chaos mode, injecting faults: send errors %g, send latency %s, "+
+		"drops %g, corruption %g", c.sendErrors, c.sendLatency, c.drops, c.corruption)
+	return c, nil
+}
+
+func (c *chaosConfig) inject(fault string, p float64) bool {
+	if p == 0 || rand.Float64() >= p {
+		return false
+	}
+	c.injected.With(prometheus.Labels{"fault": fault}).Inc()
+	return true
+}
+
+// Called before each publish, returning an error if it's to fail.
+func (c *chaosConfig) send() error {
+	if c == nil {
+		return nil
+	}
+	if c.sendLatency > 0 {
+		time.Sleep(c.sendLatency)
+	}
+	if c.inject("send_error", c.sendErrors) {
+		return errChaos
+	}
+	return nil
+}
+
+// Reports whether to drop the connection an event arrived on.
+func (c *chaosConfig) drop() bool {
+	return c != nil && c.inject("drop", c.drops)
+}
+
+// Overwrites a byte of an event, now and then.
+func (c *chaosConfig) corrupt(msg []byte) {
+	if c == nil || len(msg) == 0 || !c.inject("corruption", c.corruption) {
+		return
+	}
+	msg[rand.Intn(len(msg))] = byte(rand.Intn(256))
+}
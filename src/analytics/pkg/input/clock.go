@@ -0,0 +1,88 @@
+// Clock anomalies.  Events timestamped more than CLOCK_FUTURE_TOLERANCE
+// ahead of our clock, or more than CLOCK_MAX_AGE behind it, are counted per
+// device, so probes with broken clocks show up rather than skewing the
+// latency figures, which leave such events out.  Devices beyond
+// METRIC_LABEL_LIMIT are counted as "other", see labelguard.go.
+
+package input
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	CLOCK_FUTURE_TOLERANCE = "5s"
+	CLOCK_MAX_AGE          = "24h"
+)
+
+// Set from the environment by newClockStage, which every configuration has.
+var futureTolerance, maxClockAge time.Duration
+
+func init() {
+	futureTolerance, _ = time.ParseDuration(CLOCK_FUTURE_TOLERANCE)
+	maxClockAge, _ = time.ParseDuration(CLOCK_MAX_AGE)
+}
+
+// Classifies the offset of an event's time from when it was received:
+// "future", "old", or "" if plausible.
+func clockAnomaly(offset time.Duration) string {
+	switch {
+	case offset < -futureTolerance:
+		return "future"
+	case offset > maxClockAge:
+		return "old"
+	}
+	return ""
+}
+
+type clockStage struct {
+	anomalies *prometheus.CounterVec
+	devices   *labelGuard
+}
+
+func newClockStage() (stage, error) {
+	var err error
+	futureTolerance, err = time.ParseDuration(utils.Getenv("CLOCK_FUTURE_TOLERANCE",
+		CLOCK_FUTURE_TOLERANCE))
+	if err != nil {
+		return nil, fmt.Errorf("CLOCK_FUTURE_TOLERANCE: %s", err.Error())
+	}
+	maxClockAge, err = time.ParseDuration(utils.Getenv("CLOCK_MAX_AGE", CLOCK_MAX_AGE))
+	if err != nil {
+		return nil, fmt.Errorf("CLOCK_MAX_AGE: %s", err.Error())
+	}
+	c := &clockStage{
+		anomalies: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "clock_anomaly_events",
+				Help: "Events timestamped in the future or implausibly long ago",
+			},
+			[]string{"device", "kind"},
+		),
+	}
+	c.devices, err = newLabelGuard("clock_anomaly_events")
+	if err != nil {
+		return nil, err
+	}
+	mustRegister(c.anomalies)
+	return c, nil
+}
+
+func (c *clockStage) process(e *event) bool {
+	fields := topLevelFields(e.data, "time", "device")
+	t, err := parseEventTime(fields["time"])
+	if err != nil {
+		return true
+	}
+	if kind := clockAnomaly(e.received.Sub(t)); kind != "" {
+		c.anomalies.With(prometheus.Labels{
+			"device": c.devices.value(fields["device"]),
+			"kind":   kind,
+		}).Inc()
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+// Compression for outputs whose consumers can decompress.  OUTPUT_COMPRESSION
+// lists them as output=codec pairs separated by ';', the codec being snappy,
+// lz4 or zstd, for example
+//
+//   OUTPUT_COMPRESSION="archive=zstd;realtime=snappy"
+//
+// Each message is compressed on its own: an event, once projected and
+// encoded, or a whole batch for batched outputs, which compresses far
+// better.  Snappy is its block format, lz4 and zstd their frame formats.
+
+package input
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type compressor func(msg []byte) ([]byte, error)
+
+var compressorConstructors = map[string]func() (compressor, error){
+	"snappy": func() (compressor, error) {
+		return func(msg []byte) ([]byte, error) {
+			return snappy.Encode(nil, msg), nil
+		}, nil
+	},
+	"lz4": func() (compressor, error) {
+		return func(msg []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			w := lz4.NewWriter(&buf)
+			if _, err := w.Write(msg); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}, nil
+	},
+	"zstd": func() (compressor, error) {
+		// EncodeAll is safe for the publishers to call together.
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		return func(msg []byte) ([]byte, error) {
+			return enc.EncodeAll(msg, nil), nil
+		}, nil
+	},
+}
+
+type outputCompressor struct {
+	codec    string
+	compress compressor
+	in, out  prometheus.Counter
+}
+
+var compressedBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "compressed_bytes",
+		Help: "Bytes compressed for outputs, before and after",
+	},
+	[]string{"output", "codec", "stage"},
+)
+
+// Returns the compressor of each output listed in OUTPUT_COMPRESSION.
+func newCompressors() (map[string]*outputCompressor, error) {
+	v := utils.Getenv("OUTPUT_COMPRESSION", "")
+	if v == "" {
+		return nil, nil
+	}
+	mustRegister(compressedBytes)
+	mustRegister(encodeErrors)
+
+	compressors := map[string]*outputCompressor{}
+	for _, spec := range strings.Split(v, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		i := strings.Index(spec, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("OUTPUT_COMPRESSION: expected output=codec, got %q", spec)
+		}
+		output := strings.TrimSpace(spec[:i])
+		codec := strings.TrimSpace(spec[i+1:])
+		constructor, ok := compressorConstructors[codec]
+		if !ok {
+			return nil, fmt.Errorf("OUTPUT_COMPRESSION: unknown codec %q", codec)
+		}
+		compress, err := constructor()
+		if err != nil {
+			return nil, err
+		}
+		labels := prometheus.Labels{"output": output, "codec": codec}
+		labels["stage"] = "in"
+		in := compressedBytes.With(labels)
+		labels["stage"] = "out"
+		compressors[output] = &outputCompressor{
+			codec:    codec,
+			compress: compress,
+			in:       in,
+			out:      compressedBytes.With(labels),
+		}
+		utils.Log("INFO: Output %s compressed with %s", output, codec)
+	}
+	return compressors, nil
+}
+
+// Returns a message compressed for its output, if it's to be.
+func (s *sender) compress(output string, msg []byte) ([]byte, error) {
+	c, ok := s.compressors[output]
+	if !ok {
+		return msg, nil
+	}
+	out, err := c.compress(msg)
+	if err != nil {
+		return nil, fmt.Errorf("%s compression: %s", c.codec, err.Error())
+	}
+	c.in.Add(float64(len(msg)))
+	c.out.Add(float64(len(out)))
+	return out, nil
+}
@@ -0,0 +1,96 @@
+// Limit on simultaneous connections.  With MAX_CONNECTIONS set, a
+// connection beyond the limit is closed straight away under the "reject"
+// CONNECTION_LIMIT_POLICY, or, under "queue", the listeners stop accepting
+// until one closes, leaving new connections waiting in the kernel's backlog.
+// Either way a connection storm can't run the bridge out of descriptors.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type connLimit struct {
+	max   int64
+	queue bool
+	count int64
+
+	// Signalled when a connection closes, for those waiting to accept.
+	closed chan struct{}
+
+	rejected prometheus.Counter
+}
+
+func newConnLimit() (*connLimit, error) {
+	max, err := strconv.ParseInt(utils.Getenv("MAX_CONNECTIONS", "0"), 10, 64)
+	if err != nil || max < 0 {
+		return nil, fmt.Errorf("MAX_CONNECTIONS: must be a number")
+	}
+	l := &connLimit{
+		max:    max,
+		closed: make(chan struct{}, 1),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rejected_connections",
+			Help: "Connections closed for exceeding the connection limit",
+		}),
+	}
+	switch policy := utils.Getenv("CONNECTION_LIMIT_POLICY", "reject"); policy {
+	case "reject":
+	case "queue":
+		l.queue = true
+	default:
+		return nil, fmt.Errorf("CONNECTION_LIMIT_POLICY: unknown policy %q", policy)
+	}
+	mustRegister(l.rejected)
+	mustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "open_connections",
+			Help: "Connections currently open",
+		},
+		func() float64 { return float64(atomic.LoadInt64(&l.count)) },
+	))
+	return l, nil
+}
+
+func (l *connLimit) full() bool {
+	return l.max > 0 && atomic.LoadInt64(&l.count) >= l.max
+}
+
+// Under the queue policy, waits for room for another connection.  Returns
+// false if ctx is done first, or already.
+func (l *connLimit) wait(ctx context.Context) bool {
+	for l.queue && l.full() {
+		select {
+		case <-l.closed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// Counts a new connection in, returning false if it's over the limit and
+// must be closed.
+func (l *connLimit) admit() bool {
+	if atomic.AddInt64(&l.count, 1) > l.max && l.max > 0 && !l.queue {
+		atomic.AddInt64(&l.count, -1)
+		l.rejected.Inc()
+		return false
+	}
+	return true
+}
+
+// Counts a connection out.
+func (l *connLimit) release() {
+	atomic.AddInt64(&l.count, -1)
+	select {
+	case l.closed <- struct{}{}:
+	default:
+	}
+}
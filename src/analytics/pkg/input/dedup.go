@@ -0,0 +1,143 @@
+// Deduplication by event id.  Probes resend events after reconnecting, so
+// with DEDUP_WINDOW set an event whose id has already been seen within that
+// window is dropped.  At most DEDUP_SIZE ids are remembered, the oldest being
+// forgotten first.  DEDUP_MODE selects the store: "exact", "bloom" for
+// bounded memory at very high rates, or "redis" to dedup across instances.
+
+package input
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	DEDUP_SIZE = "1000000"
+	DEDUP_MODE = "exact"
+)
+
+// Remembers event ids.  seen reports whether an id was recorded within the
+// window, recording it if not.
+type dedupStore interface {
+	seen(id string) bool
+}
+
+type dedupStage struct {
+	store   dedupStore
+	dropped prometheus.Counter
+}
+
+func newDedupStage() (stage, error) {
+	window := utils.Getenv("DEDUP_WINDOW", "")
+	if window == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return nil, fmt.Errorf("DEDUP_WINDOW: %s", err.Error())
+	}
+	size, err := strconv.Atoi(utils.Getenv("DEDUP_SIZE", DEDUP_SIZE))
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("DEDUP_SIZE: must be a positive number")
+	}
+
+	var store dedupStore
+	switch mode := utils.Getenv("DEDUP_MODE", DEDUP_MODE); mode {
+	case "exact":
+		store = newExactDedup(d, size)
+	case "bloom":
+		p, err := strconv.ParseFloat(utils.Getenv("DEDUP_FALSE_POSITIVE",
+			DEDUP_FALSE_POSITIVE), 64)
+		if err != nil || p <= 0 || p >= 1 {
+			return nil, fmt.Errorf("DEDUP_FALSE_POSITIVE: must be between 0 and 1")
+		}
+		store = newBloomDedup(d, size, p)
+	case "redis":
+		store, err = newRedisDedup(d)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("DEDUP_MODE: unknown mode %q", mode)
+	}
+
+	s := &dedupStage{
+		store: store,
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "duplicate_events",
+			Help: "Events dropped as duplicates",
+		}),
+	}
+	mustRegister(s.dropped)
+	return s, nil
+}
+
+func (s *dedupStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	id, _ := fields["id"].(string)
+	if id == "" {
+		return true
+	}
+	if s.store.seen(id) {
+		s.dropped.Inc()
+		e.output = ""
+		return false
+	}
+	return true
+}
+
+// Exact dedup over a map, with a list in arrival order for expiry.
+type exactDedup struct {
+	window time.Duration
+	size   int
+
+	mutex sync.Mutex
+	ids   map[string]*list.Element
+	order *list.List
+}
+
+type dedupEntry struct {
+	id   string
+	seen time.Time
+}
+
+func newExactDedup(window time.Duration, size int) *exactDedup {
+	return &exactDedup{
+		window: window,
+		size:   size,
+		ids:    map[string]*list.Element{},
+		order:  list.New(),
+	}
+}
+
+func (d *exactDedup) seen(id string) bool {
+	now := time.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Forget whatever has fallen out of the window or would overflow it.
+	for front := d.order.Front(); front != nil; front = d.order.Front() {
+		ent := front.Value.(*dedupEntry)
+		if now.Sub(ent.seen) < d.window && d.order.Len() < d.size {
+			break
+		}
+		delete(d.ids, ent.id)
+		d.order.Remove(front)
+	}
+
+	if _, ok := d.ids[id]; ok {
+		return true
+	}
+	d.ids[id] = d.order.PushBack(&dedupEntry{id, now})
+	return false
+}
@@ -0,0 +1,192 @@
+// DNS query and response correlation.  With DNS_CORRELATION_WINDOW set,
+// queries are remembered for that long, by device, client address and
+// transaction id, and the response matching one is tagged with it:
+//
+//   "dns_query": {"id": "<query event id>", "name": "example.com",
+//                 "type": "A", "time": "...", "latency": 0.012}
+//
+// so the name a response resolves, and how long it took, needn't be found
+// by joining the two downstream.  At most DNS_CORRELATION_SIZE queries are
+// remembered, the oldest being forgotten first.
+
+package input
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	DNS_CORRELATION_SIZE = "100000"
+)
+
+type dnsCorrelateStage struct {
+	window time.Duration
+	size   int
+
+	mutex   sync.Mutex
+	queries map[string]*list.Element
+	order   *list.List
+
+	matched, unmatched prometheus.Counter
+}
+
+type dnsQuery struct {
+	key   string
+	id    string
+	name  interface{}
+	qtype interface{}
+	time  time.Time
+
+	// When it was remembered, for expiry.
+	seen time.Time
+}
+
+var dnsCorrelations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "dns_correlations",
+		Help: "DNS responses by whether their query was found",
+	},
+	[]string{"result"},
+)
+
+func newDNSCorrelateStage() (stage, error) {
+	window := utils.Getenv("DNS_CORRELATION_WINDOW", "")
+	if window == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return nil, fmt.Errorf("DNS_CORRELATION_WINDOW: %s", err.Error())
+	}
+	size, err := strconv.Atoi(utils.Getenv("DNS_CORRELATION_SIZE", DNS_CORRELATION_SIZE))
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("DNS_CORRELATION_SIZE: must be a positive number")
+	}
+	mustRegister(dnsCorrelations)
+	return &dnsCorrelateStage{
+		window:    d,
+		size:      size,
+		queries:   map[string]*list.Element{},
+		order:     list.New(),
+		matched:   dnsCorrelations.With(prometheus.Labels{"result": "matched"}),
+		unmatched: dnsCorrelations.With(prometheus.Labels{"result": "unmatched"}),
+	}, nil
+}
+
+// Returns the key of a query or response, the client being the source of
+// a query and the destination of its response.
+func dnsKey(fields, msg map[string]interface{}, client string) string {
+	device, _ := fields["device"].(string)
+	addrs, _ := fields[client].([]interface{})
+	parts := []string{device}
+	for _, a := range addrs {
+		a, _ := a.(string)
+		parts = append(parts, a)
+	}
+	// Without a transaction id the question has to do.
+	if id, ok := jsonFloat(msg["id"]); ok {
+		parts = append(parts, strconv.Itoa(int(id)))
+	} else if name, _ := dnsQuestion(msg); name != nil {
+		parts = append(parts, fmt.Sprint(name))
+	}
+	return strings.Join(parts, "|")
+}
+
+// Returns the name and type of a message's first question.
+func dnsQuestion(msg map[string]interface{}) (interface{}, interface{}) {
+	questions, _ := msg["query"].([]interface{})
+	if len(questions) == 0 {
+		return nil, nil
+	}
+	q, _ := questions[0].(map[string]interface{})
+	return q["name"], q["type"]
+}
+
+func (d *dnsCorrelateStage) process(e *event) bool {
+	if topLevelFields(e.data, "action")["action"] != "dns_message" && !e.dirty {
+		return true
+	}
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	msg, ok := fields["dns_message"].(map[string]interface{})
+	if !ok {
+		return true
+	}
+	now := time.Now()
+
+	switch msg["type"] {
+	case "query":
+		key := dnsKey(fields, msg, "src")
+		id, _ := fields["id"].(string)
+		name, qtype := dnsQuestion(msg)
+		t, err := e.time()
+		if err != nil {
+			t = e.received
+		}
+
+		d.mutex.Lock()
+		d.expire(now)
+		if el, ok := d.queries[key]; ok {
+			d.order.Remove(el)
+		}
+		d.queries[key] = d.order.PushBack(&dnsQuery{key, id, name, qtype, t, now})
+		d.mutex.Unlock()
+
+	case "response":
+		key := dnsKey(fields, msg, "dest")
+		d.mutex.Lock()
+		d.expire(now)
+		var q *dnsQuery
+		if el, ok := d.queries[key]; ok {
+			q = el.Value.(*dnsQuery)
+			delete(d.queries, key)
+			d.order.Remove(el)
+		}
+		d.mutex.Unlock()
+
+		if q == nil {
+			d.unmatched.Inc()
+			return true
+		}
+		d.matched.Inc()
+		tag := map[string]interface{}{
+			"id":   q.id,
+			"time": q.time.UTC().Format("2006-01-02T15:04:05.000Z"),
+		}
+		if q.name != nil {
+			tag["name"] = q.name
+		}
+		if q.qtype != nil {
+			tag["type"] = q.qtype
+		}
+		if t, err := e.time(); err == nil {
+			tag["latency"] = t.Sub(q.time).Seconds()
+		}
+		fields["dns_query"] = tag
+		e.modified()
+	}
+	return true
+}
+
+// Forgets queries which have fallen out of the window or would overflow
+// it.  Called with the mutex held.
+func (d *dnsCorrelateStage) expire(now time.Time) {
+	for front := d.order.Front(); front != nil; front = d.order.Front() {
+		q := front.Value.(*dnsQuery)
+		if now.Sub(q.seen) < d.window && d.order.Len() < d.size {
+			break
+		}
+		delete(d.queries, q.key)
+		d.order.Remove(front)
+	}
+}
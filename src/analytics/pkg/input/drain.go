@@ -0,0 +1,85 @@
+// Draining connections ahead of maintenance.  While draining, new
+// connections are closed as soon as they're accepted and the pod reports
+// not ready.  Each open connection is sent DRAIN_MESSAGE, if set, so probes
+// which read it know to go elsewhere, then given DRAIN_GRACE to finish what
+// it's sending before being closed.  Everything read is sent on as usual.
+
+package input
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	DRAIN_GRACE = "5s"
+)
+
+type drainState struct {
+	draining int32
+	message  string
+	grace    time.Duration
+}
+
+func newDrainState() (*drainState, error) {
+	grace, err := time.ParseDuration(utils.Getenv("DRAIN_GRACE", DRAIN_GRACE))
+	if err != nil {
+		return nil, fmt.Errorf("DRAIN_GRACE: %s", err.Error())
+	}
+	return &drainState{
+		message: utils.Getenv("DRAIN_MESSAGE", ""),
+		grace:   grace,
+	}, nil
+}
+
+func (d *drainState) active() bool {
+	return atomic.LoadInt32(&d.draining) != 0
+}
+
+// Reports whether connections should be accepted.
+func (s *Service) accepting() bool {
+	return s.leader.active() && !s.drain.active()
+}
+
+// Tells a connection about the drain, returning when it should be closed.
+func (d *drainState) begin(conn net.Conn) time.Time {
+	if d.message != "" {
+		conn.SetWriteDeadline(time.Now().Add(REPLY_TIMEOUT))
+		conn.Write([]byte(d.message + "\n"))
+	}
+	return time.Now().Add(d.grace)
+}
+
+// Starts or stops draining, reporting whether that's a change.
+func (s *Service) setDraining(draining bool) bool {
+	v := int32(0)
+	if draining {
+		v = 1
+	}
+	if atomic.SwapInt32(&s.drain.draining, v) == v {
+		return false
+	}
+	s.state.changed()
+	return true
+}
+
+func (s *Service) drainHandler(w http.ResponseWriter, r *http.Request) {
+	if s.setDraining(true) {
+		utils.Log("INFO: Draining connections")
+		s.audit.record("drain", r.RemoteAddr, "")
+	}
+	fmt.Fprintln(w, "draining")
+}
+
+func (s *Service) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	if s.setDraining(false) {
+		utils.Log("INFO: Accepting connections again")
+		s.audit.record("resume", r.RemoteAddr, "")
+	}
+	fmt.Fprintln(w, "accepting")
+}
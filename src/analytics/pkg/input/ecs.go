@@ -0,0 +1,172 @@
+// Elastic Common Schema output encoding, so events indexed in Elasticsearch
+// work with Kibana's dashboards as they are.  Fields with an ECS equivalent
+// are moved to it:
+//
+//   time             @timestamp
+//   id, action       event.id, event.action
+//   risk             event.risk_score
+//   device           observer.hostname
+//   network          network.name
+//   src, dest        source.ip, source.port, destination.ip, ...
+//   url              url.full
+//   dns_message      dns.type, dns.question, dns.answers, dns.resolved_ip
+//   http_request     http.request.method, user_agent.original
+//   http_response    http.response.status_code
+//
+// Everything else, including the original action's details, is kept under
+// "cybermon".
+
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+type ecsEncoder struct{}
+
+func newECSEncoder() (encoder, error) {
+	return ecsEncoder{}, nil
+}
+
+// ECS categories of the cybermon actions.
+var ecsCategories = map[string]string{
+	"connection_up":   "network",
+	"connection_down": "network",
+	"dns_message":     "network",
+	"http_request":    "web",
+	"http_response":   "web",
+}
+
+// Sets a dotted field, making the objects on the way.
+func setECS(doc map[string]interface{}, path string, v interface{}) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := doc[p].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			doc[p] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = v
+}
+
+// Sets source or destination from a cyberprobe address list.
+func setECSAddress(doc map[string]interface{}, side string, addrs interface{}) {
+	list, _ := addrs.([]interface{})
+	for _, a := range list {
+		a, _ := a.(string)
+		i := strings.Index(a, ":")
+		if i < 0 {
+			continue
+		}
+		switch kind, v := a[:i], a[i+1:]; kind {
+		case "ipv4", "ipv6":
+			setECS(doc, side+".ip", v)
+			setECS(doc, "network.type", kind)
+		case "tcp", "udp":
+			setECS(doc, side+".port", json.Number(v))
+			setECS(doc, "network.transport", kind)
+		}
+	}
+}
+
+func (ecsEncoder) encode(msg []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	doc := map[string]interface{}{}
+	move := func(from, to string) {
+		if v, ok := fields[from]; ok {
+			setECS(doc, to, v)
+			delete(fields, from)
+		}
+	}
+	move("time", "@timestamp")
+	move("id", "event.id")
+	move("risk", "event.risk_score")
+	move("device", "observer.hostname")
+	move("network", "network.name")
+	move("url", "url.full")
+	setECS(doc, "event.kind", "event")
+
+	action, _ := fields["action"].(string)
+	if action != "" {
+		setECS(doc, "event.action", action)
+		setECS(doc, "event.dataset", "cybermon."+action)
+		if category, ok := ecsCategories[action]; ok {
+			setECS(doc, "event.category", []string{category})
+		}
+		delete(fields, "action")
+	}
+	setECSAddress(doc, "source", fields["src"])
+	setECSAddress(doc, "destination", fields["dest"])
+
+	if dns, ok := fields["dns_message"].(map[string]interface{}); ok {
+		if t, ok := dns["type"].(string); ok {
+			setECS(doc, "dns.type", t)
+		}
+		if q, ok := dns["query"].([]interface{}); ok && len(q) > 0 {
+			if q, ok := q[0].(map[string]interface{}); ok {
+				setECS(doc, "dns.question.name", q["name"])
+				setECS(doc, "dns.question.type", q["type"])
+				setECS(doc, "dns.question.class", q["class"])
+			}
+		}
+		var answers []interface{}
+		var resolved []string
+		list, _ := dns["answer"].([]interface{})
+		for _, a := range list {
+			a, ok := a.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			answer := map[string]interface{}{
+				"name":  a["name"],
+				"type":  a["type"],
+				"class": a["class"],
+			}
+			if addr, ok := a["address"].(string); ok && addr != "" {
+				answer["data"] = addr
+				resolved = append(resolved, addr)
+			}
+			answers = append(answers, answer)
+		}
+		if answers != nil {
+			setECS(doc, "dns.answers", answers)
+		}
+		if resolved != nil {
+			setECS(doc, "dns.resolved_ip", resolved)
+		}
+	}
+	if req, ok := fields["http_request"].(map[string]interface{}); ok {
+		if method, ok := req["method"].(string); ok {
+			setECS(doc, "http.request.method", method)
+		}
+		if header, ok := req["header"].(map[string]interface{}); ok {
+			if ua, ok := header["User-Agent"].(string); ok {
+				setECS(doc, "user_agent.original", ua)
+			}
+		}
+	}
+	if resp, ok := fields["http_response"].(map[string]interface{}); ok {
+		if code, ok := resp["code"].(json.Number); ok {
+			setECS(doc, "http.response.status_code", code)
+		}
+	}
+
+	if len(fields) > 0 {
+		doc["cybermon"] = fields
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
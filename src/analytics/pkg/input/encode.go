@@ -0,0 +1,161 @@
+// Output encodings.  Events are forwarded as the JSON they arrived as, which
+// most outputs take.  OUTPUT_ENCODINGS lists outputs which need something
+// else as output=encoding pairs separated by ';', for example
+//
+//   OUTPUT_ENCODINGS="kafka=avro"
+//
+// Events are encoded as they're sent, so spooled events keep their JSON,
+// and batched outputs batch the encoded events, those in the binary
+// encodings, Avro and protobuf, each preceded by its length as a varint, as
+// protobuf's delimited streams are.  An event which can't be encoded is
+// dropped and counted, and one an encoding has no use for is just dropped.
+// Failures are logged at most every encodeWarnInterval.
+
+package input
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Turns an event, as JSON, into what an output takes.
+type encoder interface {
+	encode(msg []byte) ([]byte, error)
+}
+
+// Returned by encoders for events their output doesn't take.
+var errNotEncoded = errors.New("not for this output")
+
+// Encodings by name.  Each is made once, however many outputs use it.
+var encoderConstructors = map[string]func() (encoder, error){
+	"avro":     newAvroEncoder,
+	"protobuf": newProtobufEncoder,
+	"cef":      newCEFEncoder,
+	"leef":     newLEEFEncoder,
+	"stix":     newSTIXEncoder,
+	"ecs":      newECSEncoder,
+}
+
+// Encodings whose messages run together when concatenated.
+var binaryEncodings = map[string]bool{
+	"avro":     true,
+	"protobuf": true,
+}
+
+const encodeWarnInterval = 10 * time.Second
+
+// Logs a warning at most once an interval, noting how many were skipped.
+type warnLimiter struct {
+	interval time.Duration
+
+	mutex   sync.Mutex
+	last    time.Time
+	skipped int
+}
+
+func (l *warnLimiter) log(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if time.Since(l.last) < l.interval {
+		l.skipped++
+		return
+	}
+	if l.skipped > 0 {
+		format += fmt.Sprintf(" (%d more since last logged)", l.skipped)
+	}
+	utils.Log("WARN: "+format, args...)
+	l.last = time.Now()
+	l.skipped = 0
+}
+
+var encodeWarnings = &warnLimiter{interval: encodeWarnInterval}
+
+var encodeErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "encode_errors",
+		Help: "Events dropped for failing to encode for their output",
+	},
+	[]string{"output", "encoding"},
+)
+
+type outputEncoder struct {
+	encoding string
+	encoder
+}
+
+// Returns the encoder of each output listed in OUTPUT_ENCODINGS.
+func newEncoders() (map[string]*outputEncoder, error) {
+	v := utils.Getenv("OUTPUT_ENCODINGS", "")
+	if v == "" {
+		return nil, nil
+	}
+	mustRegister(encodeErrors)
+
+	made := map[string]encoder{}
+	encoders := map[string]*outputEncoder{}
+	for _, spec := range strings.Split(v, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		i := strings.Index(spec, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("OUTPUT_ENCODINGS: expected output=encoding, got %q", spec)
+		}
+		output := strings.TrimSpace(spec[:i])
+		encoding := strings.TrimSpace(spec[i+1:])
+		enc, ok := made[encoding]
+		if !ok {
+			constructor, ok := encoderConstructors[encoding]
+			if !ok {
+				return nil, fmt.Errorf("OUTPUT_ENCODINGS: unknown encoding %q", encoding)
+			}
+			var err error
+			enc, err = constructor()
+			if err != nil {
+				return nil, err
+			}
+			made[encoding] = enc
+		}
+		encoders[output] = &outputEncoder{encoding: encoding, encoder: enc}
+		utils.Log("INFO: Output %s encoded as %s", output, encoding)
+	}
+	return encoders, nil
+}
+
+// Returns the event as its output takes it, projected, encoded and unless
+// it's batched compressed, or false if it can't be.
+func (s *sender) encode(e *event) ([]byte, bool) {
+	msg, err := s.project(e.output, e.bytes())
+	encoding := "json"
+	if enc, ok := s.encoders[e.output]; ok && err == nil {
+		encoding = enc.encoding
+		msg, err = enc.encode(msg)
+	}
+	_, batched := s.batchers[e.output]
+	switch {
+	case err != nil:
+	case batched && binaryEncodings[encoding]:
+		msg = append(appendProtobufVarint(nil, uint64(len(msg))), msg...)
+	case !batched:
+		msg, err = s.compress(e.output, msg)
+	}
+	if err == errNotEncoded {
+		return nil, false
+	}
+	if err != nil {
+		encodeWarnings.log("Unable to encode event for %s as %s: %s",
+			e.output, encoding, err.Error())
+		encodeErrors.With(prometheus.Labels{
+			"output":   e.output,
+			"encoding": encoding,
+		}).Inc()
+		return nil, false
+	}
+	return msg, true
+}
@@ -0,0 +1,79 @@
+// Helpers shared by the stages which enrich events with information about
+// the addresses in them.
+
+package input
+
+import (
+	"net"
+	"strings"
+)
+
+// Returns the IP addresses held in a field value.  Cybermon gives address
+// stacks such as ["ipv4:10.0.0.1", "tcp:443"]; bare addresses are accepted
+// too.
+func addresses(val interface{}) []net.IP {
+	var ips []net.IP
+	switch v := val.(type) {
+	case string:
+		if i := strings.IndexByte(v, ':'); i > 0 {
+			proto := v[:i]
+			if proto == "ipv4" || proto == "ipv6" {
+				v = v[i+1:]
+			}
+		}
+		if ip := net.ParseIP(v); ip != nil {
+			ips = append(ips, ip)
+		}
+	case []interface{}:
+		for _, elt := range v {
+			ips = append(ips, addresses(elt)...)
+		}
+	}
+	return ips
+}
+
+// Calls fn with the first address found at each of the paths, for adding
+// an annotation named after the path.
+func eachAddress(fields map[string]interface{}, paths [][]string,
+	fn func(path string, ip net.IP)) {
+	for _, path := range paths {
+		name := strings.Join(path, ".")
+		walkPath(fields, path, func(parent map[string]interface{}, key string) {
+			if ips := addresses(parent[key]); len(ips) > 0 {
+				fn(name, ips[0])
+			}
+		})
+	}
+}
+
+// Sets fields[section][key], creating the section object if needed.
+func annotate(fields map[string]interface{}, section, key string, val interface{}) {
+	obj, ok := fields[section].(map[string]interface{})
+	if !ok {
+		obj = map[string]interface{}{}
+		fields[section] = obj
+	}
+	obj[key] = val
+}
+
+// Returns a field value with each address in it replaced by fn, keeping
+// the cybermon protocol prefix.
+func mapAddresses(val interface{}, fn func(net.IP) net.IP) interface{} {
+	switch v := val.(type) {
+	case string:
+		prefix := ""
+		if i := strings.IndexByte(v, ':'); i > 0 {
+			if proto := v[:i]; proto == "ipv4" || proto == "ipv6" {
+				prefix, v = v[:i+1], v[i+1:]
+			}
+		}
+		if ip := net.ParseIP(v); ip != nil {
+			return prefix + fn(ip).String()
+		}
+	case []interface{}:
+		for i, elt := range v {
+			v[i] = mapAddresses(elt, fn)
+		}
+	}
+	return val
+}
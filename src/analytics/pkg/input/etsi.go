@@ -0,0 +1,393 @@
+// cyberprobe's ETSI LI delivery, for pipelines with "source": "etsi", so a
+// constrained sensor can run cyberprobe alone rather than with a cybermon
+// beside it.  cyberprobe connects as it would to cybermon and streams
+// TS 102 232 PS-PDUs, which are decoded no further than their headers:
+// each IP packet delivered becomes an ip_packet event and each IRI an
+// iri_begin, iri_end, iri_continue or iri_report event.
+//
+//   {"id": "...", "action": "ip_packet", "source": "etsi",
+//    "device": "<LIID>", "time": "2024-01-02T03:04:05.123Z",
+//    "src": ["ipv4:10.0.0.1", "tcp:51234"],
+//    "dest": ["ipv4:192.0.2.1", "tcp:443"],
+//    "etsi": {"sequence": 17, "network_element": "probe1",
+//             "protocol": 6, "length": 1420}}
+//
+// ETSI_PAYLOAD=true adds each packet, base64 encoded, as "payload"; there's
+// no reassembly or protocol decoding.  ETSI_MAX_PDU bounds the size of a
+// PDU, a larger one closing the connection.
+//
+// The events are handed to the connection's usual processing as if the
+// probe had sent them, so drains, idle timeouts and recording apply as to
+// any other connection.
+
+package input
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	ETSI_MAX_PDU = "1048576"
+)
+
+var errBERTruncated = errors.New("truncated BER element")
+
+type etsiConfig struct {
+	maxPDU  int
+	payload bool
+}
+
+func newETSIConfig() (*etsiConfig, error) {
+	maxPDU, err := strconv.Atoi(utils.Getenv("ETSI_MAX_PDU", ETSI_MAX_PDU))
+	if err != nil || maxPDU < 1 {
+		return nil, fmt.Errorf("ETSI_MAX_PDU: must be a positive number")
+	}
+	return &etsiConfig{
+		maxPDU:  maxPDU,
+		payload: utils.Getenv("ETSI_PAYLOAD", "") == "true",
+	}, nil
+}
+
+// Reads PS-PDUs from a stream, giving their events as JSON lines.  A read
+// which times out leaves what's been read for the next.
+type etsiReader struct {
+	config *etsiConfig
+	r      io.Reader
+
+	// PDU bytes read but not yet decoded, and decoded events not yet
+	// read.
+	in  []byte
+	out []byte
+	buf []byte
+}
+
+func (c *etsiConfig) reader(r io.Reader) io.Reader {
+	return &etsiReader{config: c, r: r, buf: make([]byte, 65536)}
+}
+
+func (r *etsiReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		n, err := berLength(r.in)
+		switch {
+		case err == errBERTruncated:
+		case err != nil:
+			return 0, err
+		case n > r.config.maxPDU:
+			return 0, fmt.Errorf("PDU of %d bytes exceeds ETSI_MAX_PDU", n)
+		case n <= len(r.in):
+			events, err := r.config.decode(r.in[:n])
+			if err != nil {
+				return 0, err
+			}
+			for _, ev := range events {
+				data, err := json.Marshal(ev)
+				if err != nil {
+					continue
+				}
+				r.out = append(append(r.out, data...), '\n')
+			}
+			r.in = append(r.in[:0], r.in[n:]...)
+			continue
+		}
+
+		m, err := r.r.Read(r.buf)
+		r.in = append(r.in, r.buf[:m]...)
+		if err != nil {
+			if err == io.EOF && len(r.in) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// A BER element.
+type berElement struct {
+	class       int
+	tag         int
+	constructed bool
+	content     []byte
+}
+
+// Returns the length of the whole element at the start of b.
+func berLength(b []byte) (int, error) {
+	_, header, length, err := berHeader(b)
+	if err != nil {
+		return 0, err
+	}
+	return header + length, nil
+}
+
+// Reads an element's identifier and length, returning the element without
+// its content, the header's length and the content's.
+func berHeader(b []byte) (berElement, int, int, error) {
+	var el berElement
+	if len(b) < 2 {
+		return el, 0, 0, errBERTruncated
+	}
+	el.class = int(b[0] >> 6)
+	el.constructed = b[0]&0x20 != 0
+	el.tag = int(b[0] & 0x1f)
+	i := 1
+	if el.tag == 0x1f {
+		el.tag = 0
+		for {
+			if i >= len(b) {
+				return el, 0, 0, errBERTruncated
+			}
+			if i > 4 {
+				return el, 0, 0, errors.New("BER tag too long")
+			}
+			el.tag = el.tag<<7 | int(b[i]&0x7f)
+			i++
+			if b[i-1]&0x80 == 0 {
+				break
+			}
+		}
+	}
+	if i >= len(b) {
+		return el, 0, 0, errBERTruncated
+	}
+	length := int(b[i])
+	i++
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 {
+			return el, 0, 0, errors.New("indefinite BER length unsupported")
+		}
+		if n > 4 {
+			return el, 0, 0, errors.New("BER length too long")
+		}
+		if i+n > len(b) {
+			return el, 0, 0, errBERTruncated
+		}
+		length = 0
+		for _, x := range b[i : i+n] {
+			length = length<<8 | int(x)
+		}
+		i += n
+	}
+	return el, i, length, nil
+}
+
+// Splits the content of a constructed element into its elements.
+func berElements(b []byte) ([]berElement, error) {
+	var els []berElement
+	for len(b) > 0 {
+		el, header, length, err := berHeader(b)
+		if err != nil {
+			return nil, err
+		}
+		if header+length > len(b) {
+			return nil, errBERTruncated
+		}
+		el.content = b[header : header+length]
+		els = append(els, el)
+		b = b[header+length:]
+	}
+	return els, nil
+}
+
+// Returns the context specific elements of a constructed element, by tag.
+func berFields(b []byte) map[int]berElement {
+	els, _ := berElements(b)
+	fields := map[int]berElement{}
+	for _, el := range els {
+		if el.class == 2 {
+			fields[el.tag] = el
+		}
+	}
+	return fields
+}
+
+func berInt(b []byte) int64 {
+	var n int64
+	for i, x := range b {
+		if i == 0 && x&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(x)
+	}
+	return n
+}
+
+// The PS-PDU header, as the events need it.
+type etsiHeader struct {
+	liid     string
+	sequence int64
+	time     time.Time
+	details  map[string]interface{}
+}
+
+// Returns the events of a PS-PDU.
+func (c *etsiConfig) decode(pdu []byte) ([]map[string]interface{}, error) {
+	els, err := berElements(pdu)
+	if err != nil {
+		return nil, err
+	}
+	if len(els) != 1 || els[0].class != 0 || els[0].tag != 16 {
+		return nil, errors.New("not a PS-PDU")
+	}
+	pdu = els[0].content
+	fields := berFields(pdu)
+	h := etsiHeaderOf(fields[1].content)
+	payload := berFields(fields[2].content)
+
+	var events []map[string]interface{}
+	if iris, ok := payload[0]; ok {
+		list, _ := berElements(iris.content)
+		for _, iri := range list {
+			events = append(events, iriEvent(h, berFields(iri.content)))
+		}
+	}
+	if ccs, ok := payload[1]; ok {
+		list, _ := berElements(ccs.content)
+		for _, cc := range list {
+			if ev := c.packetEvent(h, berFields(cc.content)); ev != nil {
+				events = append(events, ev)
+			}
+		}
+	}
+	return events, nil
+}
+
+func etsiHeaderOf(b []byte) etsiHeader {
+	fields := berFields(b)
+	h := etsiHeader{
+		liid:     string(fields[1].content),
+		sequence: berInt(fields[4].content),
+		time:     time.Now(),
+		details:  map[string]interface{}{},
+	}
+	if ts, ok := fields[7]; ok {
+		// microSecondTimeStamp
+		parts := berFields(ts.content)
+		h.time = time.Unix(berInt(parts[0].content), berInt(parts[1].content)*1000)
+	} else if ts, ok := fields[5]; ok {
+		if t, err := time.Parse("20060102150405.999999Z0700", string(ts.content)); err == nil {
+			h.time = t
+		}
+	}
+	comm := berFields(fields[3].content)
+	network := berFields(comm[0].content)
+	if op, ok := network[0]; ok {
+		h.details["operator"] = string(op.content)
+	}
+	if ne, ok := network[1]; ok {
+		h.details["network_element"] = string(ne.content)
+	}
+	if id, ok := comm[1]; ok {
+		h.details["communication"] = berInt(id.content)
+	}
+	return h
+}
+
+func (h etsiHeader) event(action string) map[string]interface{} {
+	details := map[string]interface{}{"sequence": h.sequence}
+	for k, v := range h.details {
+		details[k] = v
+	}
+	return map[string]interface{}{
+		"id":     randomEventID(),
+		"action": action,
+		"source": "etsi",
+		"device": h.liid,
+		"time":   h.time.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"etsi":   details,
+	}
+}
+
+var iriTypes = map[int64]string{
+	1: "iri_begin",
+	2: "iri_end",
+	3: "iri_continue",
+	4: "iri_report",
+}
+
+func iriEvent(h etsiHeader, iri map[int]berElement) map[string]interface{} {
+	action, ok := iriTypes[berInt(iri[0].content)]
+	if !ok {
+		action = "iri_report"
+	}
+	return h.event(action)
+}
+
+// Returns the event of a CCPayload carrying an IP packet, nil if it
+// carries anything else.
+func (c *etsiConfig) packetEvent(h etsiHeader, cc map[int]berElement) map[string]interface{} {
+	contents := berFields(cc[2].content)
+	ipcc, ok := contents[2]
+	if !ok {
+		return nil
+	}
+	packet := berFields(ipcc.content)[0].content
+	if len(packet) == 0 {
+		return nil
+	}
+
+	ev := h.event("ip_packet")
+	details := ev["etsi"].(map[string]interface{})
+	details["length"] = len(packet)
+	if dir, ok := cc[0]; ok {
+		details["direction"] = berInt(dir.content)
+	}
+	src, dest, proto := ipAddresses(packet)
+	if src != nil {
+		ev["src"] = src
+		ev["dest"] = dest
+		details["protocol"] = proto
+	}
+	if c.payload {
+		ev["payload"] = base64.StdEncoding.EncodeToString(packet)
+	}
+	return ev
+}
+
+// Returns the addresses of an IP packet as cyberprobe address lists, with
+// the ports of TCP and UDP.  Returns nil if the packet can't be read.
+func ipAddresses(packet []byte) ([]string, []string, int) {
+	var srcIP, destIP net.IP
+	var proto int
+	var transport []byte
+	switch packet[0] >> 4 {
+	case 4:
+		ihl := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || ihl < 20 || len(packet) < ihl {
+			return nil, nil, 0
+		}
+		proto = int(packet[9])
+		srcIP, destIP = net.IP(packet[12:16]), net.IP(packet[16:20])
+		transport = packet[ihl:]
+	case 6:
+		if len(packet) < 40 {
+			return nil, nil, 0
+		}
+		proto = int(packet[6])
+		srcIP, destIP = net.IP(packet[8:24]), net.IP(packet[24:40])
+		transport = packet[40:]
+	default:
+		return nil, nil, 0
+	}
+
+	src := addressList(srcIP.String(), nil, "")
+	dest := addressList(destIP.String(), nil, "")
+	name := map[int]string{6: "tcp", 17: "udp"}[proto]
+	if name != "" && len(transport) >= 4 {
+		src = append(src, fmt.Sprintf("%s:%d", name, binary.BigEndian.Uint16(transport)))
+		dest = append(dest, fmt.Sprintf("%s:%d", name, binary.BigEndian.Uint16(transport[2:])))
+	}
+	return src, dest, proto
+}
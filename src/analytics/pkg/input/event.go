@@ -0,0 +1,188 @@
+// Events on their way through the bridge.  Most stages only need the raw
+// bytes; the JSON is decoded on first use and re-encoded only if a stage
+// changed it.
+
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"analytics/internal/frames"
+)
+
+// A probe connection.  Stages needing per-connection state keep it here,
+// keyed by the stage; only the connection's own goroutine touches it.
+type client struct {
+	// Number of the connection, which decides the send queue its events
+	// take.
+	id     uint32
+	remote net.Addr
+	state  map[stage]interface{}
+
+	// Tenant the connection belongs to, nil unless multi-tenant.
+	tenant *tenant
+
+	// Clock skew estimate, only touched by the latency sampler.
+	skew skewEstimate
+}
+
+type event struct {
+	// The event as it will be forwarded.
+	data []byte
+
+	// Pooled chunk the event was read into, which data may refer to.
+	// Anything holding on to data after the event is sent must copy it.
+	chunk *frames.Chunk
+
+	// Output the event is sent to, empty if it's been dropped.
+	output string
+
+	// Address of the probe which sent it.
+	remote net.Addr
+
+	// The connection it arrived on.
+	client *client
+
+	// Pipeline it's going through.
+	pipeline *pipeline
+
+	// When the bridge read it, and queued it for sending.
+	received time.Time
+	queued   time.Time
+
+	// Why the event was rejected, reported to the probe in strict mode.
+	problem string
+
+	// Whether it isn't a JSON object, but is being forwarded anyway.
+	malformed bool
+
+	fields map[string]interface{}
+	dirty  bool
+}
+
+// Returns the name of the event's pipeline, empty if it has none.
+func (e *event) pipelineName() string {
+	if e.pipeline == nil {
+		return ""
+	}
+	return e.pipeline.Name
+}
+
+// Returns the decoded event.  Stages which change the map must call
+// modified() so the change is forwarded.  Numbers are decoded as
+// json.Number, so an event re-encoded after a change keeps them exactly as
+// the probe gave them; jsonFloat reads them.
+func (e *event) decode() (map[string]interface{}, error) {
+	if e.fields == nil {
+		var fields map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(e.data))
+		dec.UseNumber()
+		if err := dec.Decode(&fields); err != nil {
+			return nil, err
+		}
+		e.fields = fields
+	}
+	return e.fields, nil
+}
+
+// Returns the value of a number in a decoded event, as decoded or as set
+// by a stage.
+func jsonFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func (e *event) modified() {
+	e.dirty = true
+}
+
+// Replaces the raw event, discarding any decoded form.
+func (e *event) replace(data []byte) {
+	e.data = data
+	e.fields = nil
+	e.dirty = false
+}
+
+// Releases the event's chunk once it's finished with.
+func (e *event) release() {
+	if e.chunk != nil {
+		e.chunk.Release()
+		e.chunk = nil
+	}
+	e.data = nil
+}
+
+// Returns the time the probe gave the event.
+func (e *event) time() (time.Time, error) {
+	fields, err := e.decode()
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch ts := fields["time"].(type) {
+	case string:
+		return parseEventTime(ts)
+	case json.Number:
+		return parseEventTime(string(ts))
+	case float64:
+		return parseEventTime(strconv.FormatFloat(ts, 'f', -1, 64))
+	}
+	return time.Time{}, fmt.Errorf("no event time")
+}
+
+// Returns the event as it should be forwarded, newline terminated like the
+// events we receive.
+func (e *event) bytes() []byte {
+	if e.dirty {
+		data, err := json.Marshal(e.fields)
+		if err == nil {
+			e.data = append(data, '\n')
+		}
+		e.dirty = false
+	}
+	return e.data
+}
+
+// Calls fn for each place a dotted field path such as "http_request.header"
+// occurs in the event, passing the object holding the final field.  Arrays
+// along the way are walked element by element.
+func walkPath(node interface{}, path []string,
+	fn func(parent map[string]interface{}, key string)) {
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			if _, ok := n[path[0]]; ok {
+				fn(n, path[0])
+			}
+			return
+		}
+		if child, ok := n[path[0]]; ok {
+			walkPath(child, path[1:], fn)
+		}
+	case []interface{}:
+		for _, child := range n {
+			walkPath(child, path, fn)
+		}
+	}
+}
+
+// Splits a comma separated list of dotted field paths.
+func fieldPaths(s string) [][]string {
+	var paths [][]string
+	for _, p := range splitList(s) {
+		paths = append(paths, strings.Split(p, "."))
+	}
+	return paths
+}
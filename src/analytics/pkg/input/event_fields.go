@@ -0,0 +1,32 @@
+// Code generated by protofields from event.proto; DO NOT EDIT.
+
+package input
+
+// Field numbers of the Event message.
+const (
+	protobufEventId      = 1
+	protobufEventAction  = 2
+	protobufEventDevice  = 3
+	protobufEventNetwork = 4
+	protobufEventOrigin  = 5
+	protobufEventTime    = 6
+	protobufEventUrl     = 7
+	protobufEventSrc     = 8
+	protobufEventDest    = 9
+	protobufEventRisk    = 10
+	protobufEventDetail  = 15
+)
+
+// The Event message's singular string fields.
+var protobufEventStrings = []struct {
+	name   string
+	number uint64
+}{
+	{"id", protobufEventId},
+	{"action", protobufEventAction},
+	{"device", protobufEventDevice},
+	{"network", protobufEventNetwork},
+	{"origin", protobufEventOrigin},
+	{"time", protobufEventTime},
+	{"url", protobufEventUrl},
+}
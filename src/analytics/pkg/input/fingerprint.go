@@ -0,0 +1,265 @@
+// TLS client fingerprints.  TLS_FINGERPRINTS lists those to compute, of ja3
+// and ja4, for the client hello found at TLS_HELLO_FIELD, which are added
+// under "tls_fingerprint":
+//
+//   "tls_fingerprint": {"ja3": "771,4865-4866-49195,0-23-65281-10-11,29-23,0",
+//                       "ja3_hash": "...", "ja4": "t13d1516h2_8daaf6152771_..."}
+//
+// The hello is as cybermon gives it: the version, as "3.3", cipher suites
+// and extensions each with their numeric "id" or "type", and extensions'
+// data base64 encoded.  GREASE values are left out, as both methods say.
+
+package input
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	TLS_HELLO_FIELD = "tls_client_hello"
+)
+
+type fingerprintStage struct {
+	ja3, ja4 bool
+	path     []string
+
+	// How the hello's field name appears in an event's JSON.
+	quoted []byte
+}
+
+func newFingerprintStage() (stage, error) {
+	names := splitList(utils.Getenv("TLS_FINGERPRINTS", ""))
+	if len(names) == 0 {
+		return nil, nil
+	}
+	path := strings.Split(utils.Getenv("TLS_HELLO_FIELD", TLS_HELLO_FIELD), ".")
+	f := &fingerprintStage{
+		path:   path,
+		quoted: []byte(strconv.Quote(path[len(path)-1])),
+	}
+	for _, name := range names {
+		switch name {
+		case "ja3":
+			f.ja3 = true
+		case "ja4":
+			f.ja4 = true
+		default:
+			return nil, fmt.Errorf("TLS_FINGERPRINTS: unknown fingerprint %q", name)
+		}
+	}
+	return f, nil
+}
+
+// The parts of a client hello the fingerprints use.
+type clientHello struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16
+	data       map[uint16][]byte
+}
+
+func (f *fingerprintStage) process(e *event) bool {
+	if !e.dirty && !bytes.Contains(e.data, f.quoted) {
+		return true
+	}
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	walkPath(fields, f.path, func(parent map[string]interface{}, key string) {
+		obj, ok := parent[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		hello := readClientHello(obj)
+		fp := map[string]interface{}{}
+		if f.ja3 {
+			s := hello.ja3()
+			sum := md5.Sum([]byte(s))
+			fp["ja3"] = s
+			fp["ja3_hash"] = hex.EncodeToString(sum[:])
+		}
+		if f.ja4 {
+			fp["ja4"] = hello.ja4()
+		}
+		fields["tls_fingerprint"] = fp
+		e.modified()
+	})
+	return true
+}
+
+// GREASE values, RFC 8701, are 0x0a0a, 0x1a1a... 0xfafa.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func readClientHello(obj map[string]interface{}) *clientHello {
+	h := &clientHello{data: map[uint16][]byte{}}
+	if v, ok := obj["version"].(string); ok {
+		var major, minor uint16
+		fmt.Sscanf(v, "%d.%d", &major, &minor)
+		h.version = major<<8 | minor
+	}
+	number := func(v interface{}, name string) (uint16, bool) {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		n, ok := jsonFloat(m[name])
+		return uint16(n), ok
+	}
+	ciphers, _ := obj["cipher_suites"].([]interface{})
+	for _, c := range ciphers {
+		if id, ok := number(c, "id"); ok && !isGREASE(id) {
+			h.ciphers = append(h.ciphers, id)
+		}
+	}
+	exts, _ := obj["extensions"].([]interface{})
+	for _, x := range exts {
+		t, ok := number(x, "type")
+		if !ok || isGREASE(t) {
+			continue
+		}
+		h.extensions = append(h.extensions, t)
+		if data, ok := x.(map[string]interface{})["data"].(string); ok {
+			h.data[t], _ = base64.StdEncoding.DecodeString(data)
+		}
+	}
+	return h
+}
+
+// Reads a list of 16-bit values, after a length of prefix bytes.
+func helloList16(data []byte, prefix int) []uint16 {
+	var list []uint16
+	if len(data) < prefix {
+		return nil
+	}
+	for data = data[prefix:]; len(data) >= 2; data = data[2:] {
+		if v := binary.BigEndian.Uint16(data); !isGREASE(v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func joinDecimal(list []uint16) string {
+	s := make([]string, len(list))
+	for i, v := range list {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+// Returns the JA3 string: version, ciphers, extensions, curves and point
+// formats.
+func (h *clientHello) ja3() string {
+	var formats []string
+	if pf := h.data[11]; len(pf) > 0 {
+		for _, f := range pf[1:] {
+			formats = append(formats, strconv.Itoa(int(f)))
+		}
+	}
+	return fmt.Sprintf("%d,%s,%s,%s,%s", h.version, joinDecimal(h.ciphers),
+		joinDecimal(h.extensions), joinDecimal(helloList16(h.data[10], 2)),
+		strings.Join(formats, "-"))
+}
+
+var ja4Versions = map[uint16]string{
+	0x0304: "13",
+	0x0303: "12",
+	0x0302: "11",
+	0x0301: "10",
+	0x0300: "s3",
+	0x0002: "s2",
+}
+
+// Returns values as JA4 lists them, in hex separated by ','.
+func joinHex(list []uint16) string {
+	s := make([]string, len(list))
+	for i, v := range list {
+		s[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(s, ",")
+}
+
+// Returns the hash part of a JA4.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Returns the JA4 fingerprint, for TLS over TCP.
+func (h *clientHello) ja4() string {
+	version := h.version
+	for _, v := range helloList16(h.data[43], 1) {
+		if v > version {
+			version = v
+		}
+	}
+	ver, ok := ja4Versions[version]
+	if !ok {
+		ver = "00"
+	}
+
+	sni := "i"
+	if _, ok := h.data[0]; ok {
+		sni = "d"
+	}
+	count := func(n int) int {
+		if n > 99 {
+			return 99
+		}
+		return n
+	}
+
+	// The first and last characters of the first ALPN protocol.
+	alpn := "00"
+	if d := h.data[16]; len(d) > 3 && int(d[2]) > 0 && len(d) >= 3+int(d[2]) {
+		proto := d[3 : 3+int(d[2])]
+		first, last := proto[0], proto[len(proto)-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			x := hex.EncodeToString(proto)
+			alpn = x[:1] + x[len(x)-1:]
+		}
+	}
+
+	ciphers := append([]uint16(nil), h.ciphers...)
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	var exts []uint16
+	for _, x := range h.extensions {
+		if x != 0 && x != 16 {
+			exts = append(exts, x)
+		}
+	}
+	sort.Slice(exts, func(i, j int) bool { return exts[i] < exts[j] })
+
+	// The signature algorithms, in the order given, are hashed with the
+	// extensions.
+	extensions := joinHex(exts)
+	if algs := helloList16(h.data[13], 2); len(algs) > 0 {
+		extensions += "_" + joinHex(algs)
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", ver, sni, count(len(h.ciphers)),
+		count(len(h.extensions)), alpn, ja4Hash(joinHex(ciphers)), ja4Hash(extensions))
+}
@@ -0,0 +1,280 @@
+// Flow sessions.  With FLOW_OUTPUT set, events of the actions in
+// FLOW_ACTIONS, packets and flow records by default, are grouped into
+// sessions by device and address pair, both directions together, and a
+// summary of each sent to that output once it has been idle for
+// FLOW_IDLE_TIMEOUT, or every FLOW_ACTIVE_TIMEOUT while it lasts:
+//
+//   {"id": "..", "action": "flow", "device": "dmz-1", "time": "..",
+//    "src": ["ipv4:10.0.0.1", "tcp:51234"], "dest": ["ipv4:192.0.2.1", "tcp:443"],
+//    "flow": {"start": "..", "end": "..", "duration": 12.5, "final": true,
+//             "events": 40, "packets": 40, "bytes": 31337}}
+//
+// Counts are the session's totals so far, so only the final summary of a
+// long session need be kept.  src is the side first seen sending.  Bytes
+// are taken from the fields in FLOW_BYTES_FIELDS and packets from
+// FLOW_PACKETS_FIELDS, or counted one per event.  With FLOW_DROP_EVENTS=true
+// the grouped events themselves go no further, for sites which only want
+// the sessions.  At most FLOW_MAX_SESSIONS are tracked; events for new
+// sessions beyond that pass through ungrouped.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	FLOW_ACTIONS        = "ip_packet,netflow,unrecognised_datagram,unrecognised_stream"
+	FLOW_IDLE_TIMEOUT   = "30s"
+	FLOW_ACTIVE_TIMEOUT = "5m"
+	FLOW_BYTES_FIELDS   = "etsi.length,netflow.bytes"
+	FLOW_PACKETS_FIELDS = "netflow.packets"
+	FLOW_MAX_SESSIONS   = "100000"
+)
+
+// How often sessions are checked for reporting.
+const flowSweepInterval = time.Second
+
+type flowSession struct {
+	device    string
+	src, dest []interface{}
+
+	// Event times of the first and last events, and when the session
+	// was last seen and last reported, by the bridge's clock.
+	start, end time.Time
+	seen       time.Time
+	reported   time.Time
+
+	events, packets, bytes float64
+}
+
+type flowStage struct {
+	output        string
+	actions       map[string]bool
+	idle, active  time.Duration
+	bytesFields   [][]string
+	packetsFields [][]string
+	drop          bool
+	max           int
+	send          sendFunc
+
+	mutex    sync.Mutex
+	sessions map[string]*flowSession
+
+	emitted, overflow prometheus.Counter
+}
+
+func newFlowStage() (stage, error) {
+	output := utils.Getenv("FLOW_OUTPUT", "")
+	if output == "" {
+		return nil, nil
+	}
+	idle, err := time.ParseDuration(utils.Getenv("FLOW_IDLE_TIMEOUT", FLOW_IDLE_TIMEOUT))
+	if err != nil {
+		return nil, fmt.Errorf("FLOW_IDLE_TIMEOUT: %s", err.Error())
+	}
+	active, err := time.ParseDuration(utils.Getenv("FLOW_ACTIVE_TIMEOUT", FLOW_ACTIVE_TIMEOUT))
+	if err != nil {
+		return nil, fmt.Errorf("FLOW_ACTIVE_TIMEOUT: %s", err.Error())
+	}
+	max, err := strconv.Atoi(utils.Getenv("FLOW_MAX_SESSIONS", FLOW_MAX_SESSIONS))
+	if err != nil || max < 1 {
+		return nil, fmt.Errorf("FLOW_MAX_SESSIONS: must be a positive number")
+	}
+	f := &flowStage{
+		output:        output,
+		actions:       map[string]bool{},
+		idle:          idle,
+		active:        active,
+		bytesFields:   fieldPaths(utils.Getenv("FLOW_BYTES_FIELDS", FLOW_BYTES_FIELDS)),
+		packetsFields: fieldPaths(utils.Getenv("FLOW_PACKETS_FIELDS", FLOW_PACKETS_FIELDS)),
+		drop:          utils.Getenv("FLOW_DROP_EVENTS", "") == "true",
+		max:           max,
+		sessions:      map[string]*flowSession{},
+		emitted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "flow_sessions",
+			Help: "Flow session summaries sent",
+		}),
+		overflow: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "flow_overflow_events",
+			Help: "Events not grouped for lack of room for their session",
+		}),
+	}
+	for _, a := range splitList(utils.Getenv("FLOW_ACTIONS", FLOW_ACTIONS)) {
+		f.actions[a] = true
+	}
+	mustRegister(f.emitted, f.overflow)
+	return f, nil
+}
+
+func (f *flowStage) start(ctx context.Context, wg *sync.WaitGroup, send sendFunc) {
+	f.send = send
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(flowSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				f.sweep(time.Now(), true)
+				return
+			case now := <-ticker.C:
+				f.sweep(now, false)
+			}
+		}
+	}()
+}
+
+// Returns the sum of the numbers at paths, and whether there were any.
+func sumFields(fields map[string]interface{}, paths [][]string) (float64, bool) {
+	var sum float64
+	found := false
+	for _, path := range paths {
+		walkPath(fields, path, func(parent map[string]interface{}, key string) {
+			if n, ok := jsonFloat(parent[key]); ok {
+				sum += n
+				found = true
+			}
+		})
+	}
+	return sum, found
+}
+
+func joinAddresses(list []interface{}) string {
+	parts := make([]string, 0, len(list))
+	for _, a := range list {
+		parts = append(parts, fmt.Sprint(a))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *flowStage) process(e *event) bool {
+	if !e.dirty && !f.actions[topLevelFields(e.data, "action")["action"]] {
+		return true
+	}
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	if action, _ := fields["action"].(string); !f.actions[action] {
+		return true
+	}
+	device, _ := fields["device"].(string)
+	src, _ := fields["src"].([]interface{})
+	dest, _ := fields["dest"].([]interface{})
+	if src == nil || dest == nil {
+		return true
+	}
+
+	// Both directions share a key.
+	a, b := joinAddresses(src), joinAddresses(dest)
+	if b < a {
+		a, b = b, a
+	}
+	key := device + "|" + a + "|" + b
+
+	now := time.Now()
+	t, err := e.time()
+	if err != nil {
+		t = e.received
+	}
+	bytes, _ := sumFields(fields, f.bytesFields)
+	packets, ok := sumFields(fields, f.packetsFields)
+	if !ok {
+		packets = 1
+	}
+
+	f.mutex.Lock()
+	s, ok := f.sessions[key]
+	if !ok {
+		if len(f.sessions) >= f.max {
+			f.mutex.Unlock()
+			f.overflow.Inc()
+			return true
+		}
+		s = &flowSession{
+			device:   device,
+			src:      src,
+			dest:     dest,
+			start:    t,
+			end:      t,
+			reported: now,
+		}
+		f.sessions[key] = s
+	}
+	if t.Before(s.start) {
+		s.start = t
+	}
+	if t.After(s.end) {
+		s.end = t
+	}
+	s.seen = now
+	s.events++
+	s.packets += packets
+	s.bytes += bytes
+	f.mutex.Unlock()
+
+	if f.drop {
+		e.output = ""
+		return false
+	}
+	return true
+}
+
+// Reports sessions which have gone idle, forgetting them, and those active
+// for long enough since last reported.  When closing every session is
+// reported as final, as there won't be another sweep.
+func (f *flowStage) sweep(now time.Time, closing bool) {
+	type flowReport struct {
+		flowSession
+		final bool
+	}
+	var report []flowReport
+	f.mutex.Lock()
+	for key, s := range f.sessions {
+		switch {
+		case closing || now.Sub(s.seen) >= f.idle:
+			report = append(report, flowReport{*s, true})
+			delete(f.sessions, key)
+		case now.Sub(s.reported) >= f.active:
+			report = append(report, flowReport{*s, false})
+			s.reported = now
+		}
+	}
+	f.mutex.Unlock()
+
+	for _, s := range report {
+		summary := map[string]interface{}{
+			"id":     randomEventID(),
+			"action": "flow",
+			"device": s.device,
+			"time":   s.end.UTC().Format("2006-01-02T15:04:05.000Z"),
+			"src":    s.src,
+			"dest":   s.dest,
+			"flow": map[string]interface{}{
+				"start":    s.start.UTC().Format("2006-01-02T15:04:05.000Z"),
+				"end":      s.end.UTC().Format("2006-01-02T15:04:05.000Z"),
+				"duration": s.end.Sub(s.start).Seconds(),
+				"final":    s.final,
+				"events":   s.events,
+				"packets":  s.packets,
+				"bytes":    s.bytes,
+			},
+		}
+		msg, err := json.Marshal(summary)
+		if err != nil {
+			continue
+		}
+		f.send(f.output, append(msg, '\n'))
+		f.emitted.Inc()
+	}
+}
@@ -0,0 +1,207 @@
+// Synthetic load for sizing collectors.  "input gen" fabricates
+// cybermon-style events and either runs them through the processing stages
+// to the outputs, given as for the bridge itself, or with -target writes
+// them to a bridge over TCP, one connection per device:
+//
+//   input gen -rate 5000 -devices 20 output:/queue/input
+//   input gen -rate 5000 -devices 20 -target analytics-input:48879
+//
+// Event sizes follow a log-normal distribution around -size, padded out
+// with a filler field, so the spread of small DNS events and large HTTP
+// ones is roughly what probes send.
+
+package input
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Actions generated, weighted roughly as seen from a busy network.
+var genActions = []struct {
+	action string
+	weight int
+}{
+	{"dns_message", 40},
+	{"http_request", 15},
+	{"http_response", 15},
+	{"connection_up", 10},
+	{"connection_down", 10},
+	{"icmp", 4},
+	{"unrecognised_stream", 3},
+	{"unrecognised_datagram", 2},
+	{"smtp_command", 1},
+}
+
+type eventGenerator struct {
+	rate    float64
+	devices int
+	size    int
+	spread  float64
+
+	rnd *rand.Rand
+}
+
+// Runs the gen subcommand.
+func runGen(args []string) error {
+	fs := flag.NewFlagSet("gen", flag.ContinueOnError)
+	rate := fs.Float64("rate", 1000, "events per second, across all devices")
+	devices := fs.Int("devices", 10, "number of probe devices")
+	size := fs.Int("size", 600, "median event size in bytes")
+	spread := fs.Float64("spread", 0.5, "spread of event sizes, 0 for all the same")
+	count := fs.Int("count", 0, "events to send before stopping, 0 for no limit")
+	target := fs.String("target", "", "bridge to send to over TCP, rather than the outputs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *rate <= 0 || *devices < 1 || *size < 1 {
+		return fmt.Errorf("rate, devices and size must be positive")
+	}
+
+	g := &eventGenerator{
+		rate:    *rate,
+		devices: *devices,
+		size:    *size,
+		spread:  *spread,
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	utils.Log("INFO: Generating %.0f events/s from %d devices", g.rate, g.devices)
+
+	if *target != "" {
+		return g.toBridge(*target, *count)
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no outputs defined, and no target")
+	}
+	return g.toOutputs(fs.Args(), *count)
+}
+
+// Sends events through the stages and senders to the outputs.
+func (g *eventGenerator) toOutputs(outputs []string, count int) error {
+	s, err := newWorkerService(outputs)
+	if err != nil {
+		return err
+	}
+	clients := make([]*client, g.devices)
+	for i := range clients {
+		clients[i] = &client{
+			id:     nextConnection(),
+			remote: g.address(i),
+			state:  map[stage]interface{}{},
+		}
+	}
+	g.run(count, func(device int, msg []byte) error {
+		cl := clients[device]
+		e := &event{
+			data:     msg,
+			output:   "output",
+			remote:   cl.remote,
+			client:   cl,
+			received: time.Now(),
+		}
+		s.process(e)
+		s.send(e)
+		return nil
+	})
+	s.Stop()
+	return nil
+}
+
+// Writes events to a bridge, a connection per device.
+func (g *eventGenerator) toBridge(target string, count int) error {
+	writers := make([]*bufio.Writer, g.devices)
+	for i := range writers {
+		conn, err := net.Dial("tcp", target)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		writers[i] = bufio.NewWriter(conn)
+	}
+	err := g.run(count, func(device int, msg []byte) error {
+		_, err := writers[device].Write(msg)
+		return err
+	})
+	for _, w := range writers {
+		w.Flush()
+	}
+	return err
+}
+
+// Calls send with events at the configured rate, until count have been
+// sent or send fails.
+func (g *eventGenerator) run(count int, send func(device int, msg []byte) error) error {
+	start := time.Now()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	sent := 0
+	for range ticker.C {
+		due := int(g.rate * time.Since(start).Seconds())
+		if count > 0 && due > count {
+			due = count
+		}
+		for ; sent < due; sent++ {
+			device := g.rnd.Intn(g.devices)
+			if err := send(device, g.event(device)); err != nil {
+				return err
+			}
+		}
+		if count > 0 && sent >= count {
+			break
+		}
+	}
+	utils.Log("INFO: Generated %d events in %s", sent, time.Since(start))
+	return nil
+}
+
+// Fabricates an event from a device.
+func (g *eventGenerator) event(device int) []byte {
+	pick := g.rnd.Intn(100)
+	action := genActions[0].action
+	for _, a := range genActions {
+		if pick < a.weight {
+			action = a.action
+			break
+		}
+		pick -= a.weight
+	}
+
+	src := g.address(device).(*net.TCPAddr)
+	dest := net.IPv4(byte(g.rnd.Intn(223)+1), byte(g.rnd.Intn(256)),
+		byte(g.rnd.Intn(256)), byte(g.rnd.Intn(256)))
+	ev := map[string]interface{}{
+		"id":     fmt.Sprintf("%016x%016x", g.rnd.Uint64(), g.rnd.Uint64()),
+		"action": action,
+		"device": fmt.Sprintf("device-%d", device),
+		"time":   time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		"src": []string{"ipv4:" + src.IP.String(),
+			fmt.Sprintf("tcp:%d", 1024+g.rnd.Intn(64511))},
+		"dest": []string{"ipv4:" + dest.String(), "tcp:443"},
+	}
+	data, _ := json.Marshal(ev)
+
+	// Pad out to the size drawn, leaving room for the filler field.
+	want := int(float64(g.size) * math.Exp(g.rnd.NormFloat64()*g.spread))
+	if pad := want - len(data) - len(`,"filler":""`); pad > 0 {
+		ev["filler"] = strings.Repeat("x", pad)
+		data, _ = json.Marshal(ev)
+	}
+	return append(data, '\n')
+}
+
+// Returns the address of a device.
+func (g *eventGenerator) address(device int) net.Addr {
+	return &net.TCPAddr{
+		IP:   net.IPv4(10, byte(device>>16), byte(device>>8), byte(device)),
+		Port: 10000 + device%50000,
+	}
+}
@@ -0,0 +1,62 @@
+// GeoIP enrichment from a local MaxMind City database.  GEOIP_DATABASE
+// names the database and GEOIP_FIELDS the address fields to look up, e.g.
+// "src,dest".  Results are added under "geo", keyed by field:
+//
+//   "geo": {"src": {"country": "GB", "city": "London", "lat": .., "lon": ..}}
+
+package input
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	GEOIP_FIELDS = "src,dest"
+)
+
+type geoipStage struct {
+	db     *geoip2.Reader
+	fields [][]string
+}
+
+func newGeoIPStage() (stage, error) {
+	path := utils.Getenv("GEOIP_DATABASE", "")
+	if path == "" {
+		return nil, nil
+	}
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoipStage{
+		db:     db,
+		fields: fieldPaths(utils.Getenv("GEOIP_FIELDS", GEOIP_FIELDS)),
+	}, nil
+}
+
+func (g *geoipStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	eachAddress(fields, g.fields, func(path string, ip net.IP) {
+		city, err := g.db.City(ip)
+		if err != nil || city.Country.IsoCode == "" {
+			return
+		}
+		geo := map[string]interface{}{
+			"country": city.Country.IsoCode,
+			"lat":     city.Location.Latitude,
+			"lon":     city.Location.Longitude,
+		}
+		if name, ok := city.City.Names["en"]; ok {
+			geo["city"] = name
+		}
+		annotate(fields, "geo", path, geo)
+		e.modified()
+	})
+	return true
+}
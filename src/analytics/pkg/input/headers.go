@@ -0,0 +1,87 @@
+// Metadata published alongside events, as message headers or attributes on
+// outputs which have them, rather than added to the event body.
+// MESSAGE_HEADERS lists the headers, separated by ',', from
+//
+//   instance   the bridge instance
+//   received   when the event was read, RFC 3339
+//   tenant     the connection's tenant, if multi-tenant
+//   pipeline   the event's pipeline
+//   name=value a fixed value, such as schema_version=2
+//
+// HTTP outputs send them as request headers, and workers implementing
+// SendWithHeaders, such as Kafka's or Pub/Sub's, as they see fit.  Other
+// outputs, and batches, are published with the body alone.
+
+package input
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Implemented by workers whose outputs carry headers.  key is empty unless
+// MESSAGE_KEY is set.
+type headerPublisher interface {
+	SendWithHeaders(output, key string, headers map[string]string, msg []uint8) error
+}
+
+type messageHeader struct {
+	name  string
+	value func(e *event) string
+}
+
+var messageHeaderValues = map[string]func(e *event) string{
+	"instance": func(e *event) string {
+		return instanceID
+	},
+	"received": func(e *event) string {
+		return e.received.UTC().Format(time.RFC3339Nano)
+	},
+	"tenant": func(e *event) string {
+		if e.client == nil || e.client.tenant == nil {
+			return ""
+		}
+		return e.client.tenant.Name
+	},
+	"pipeline": func(e *event) string {
+		return e.pipelineName()
+	},
+}
+
+// Returns the headers listed in MESSAGE_HEADERS.
+func newMessageHeaders() ([]messageHeader, error) {
+	var headers []messageHeader
+	for _, h := range splitList(utils.Getenv("MESSAGE_HEADERS", "")) {
+		if i := strings.Index(h, "="); i > 0 {
+			value := h[i+1:]
+			headers = append(headers, messageHeader{
+				name:  h[:i],
+				value: func(*event) string { return value },
+			})
+			continue
+		}
+		value, ok := messageHeaderValues[h]
+		if !ok {
+			return nil, fmt.Errorf("MESSAGE_HEADERS: unknown header %q", h)
+		}
+		headers = append(headers, messageHeader{name: h, value: value})
+	}
+	return headers, nil
+}
+
+// Returns an event's headers, leaving out those without a value.
+func (s *sender) messageHeaders(e *event) map[string]string {
+	if len(s.headers) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(s.headers))
+	for _, h := range s.headers {
+		if v := h.value(e); v != "" {
+			headers[h.name] = v
+		}
+	}
+	return headers
+}
@@ -0,0 +1,143 @@
+// Readiness for Kubernetes.  /ready on the metrics port answers 503 while
+// any output is failing, so the pod is taken out of the probe facing Service
+// and probes reconnect to one whose queue connection is working.  An output
+// counts as failing once READY_MAX_FAILURES publishes to it in a row have
+// failed, and recovers with the next success.  Since a pod out of the
+// Service gets no traffic to succeed with, an output which hasn't failed for
+// READY_RECOVERY_TIMEOUT is given the benefit of the doubt: the pod is ready
+// again, and the next publish decides.  A standby or draining instance is
+// never ready, nor one whose outputs, with LAZY_OUTPUTS, have yet to be
+// attached, however their publishes have gone.
+
+package input
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	READY_MAX_FAILURES     = "3"
+	READY_RECOVERY_TIMEOUT = "30s"
+)
+
+// Consecutive publish failures of each output.
+type outputHealth struct {
+	maxFailures int
+	recovery    time.Duration
+
+	mutex    sync.Mutex
+	failures map[string]int
+	failed   map[string]time.Time
+
+	healthy *prometheus.GaugeVec
+}
+
+func newOutputHealth() (*outputHealth, error) {
+	n, err := strconv.Atoi(utils.Getenv("READY_MAX_FAILURES", READY_MAX_FAILURES))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("READY_MAX_FAILURES: must be a positive number")
+	}
+	recovery, err := time.ParseDuration(utils.Getenv("READY_RECOVERY_TIMEOUT", READY_RECOVERY_TIMEOUT))
+	if err != nil || recovery <= 0 {
+		return nil, fmt.Errorf("READY_RECOVERY_TIMEOUT: must be a positive duration")
+	}
+	h := &outputHealth{
+		maxFailures: n,
+		recovery:    recovery,
+		failures:    map[string]int{},
+		failed:      map[string]time.Time{},
+		healthy: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "output_healthy",
+				Help: "Whether publishing to the output is working",
+			},
+			[]string{"output"},
+		),
+	}
+	mustRegister(h.healthy)
+	return h, nil
+}
+
+// Records the outcome of a publish.
+func (h *outputHealth) result(output string, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n, seen := h.failures[output]
+	was := n < h.maxFailures
+	if err == nil {
+		n = 0
+	} else {
+		n++
+		h.failed[output] = time.Now()
+	}
+	h.failures[output] = n
+	now := n < h.maxFailures
+	if seen && now == was {
+		return
+	}
+
+	gauge := h.healthy.With(prometheus.Labels{"output": output})
+	if now {
+		gauge.Set(1)
+	} else {
+		gauge.Set(0)
+	}
+	switch {
+	case !now:
+		utils.Log("WARN: Output %s failing: %s", output, err.Error())
+	case seen:
+		utils.Log("INFO: Output %s recovered", output)
+	}
+}
+
+// Returns the outputs currently failing, not counting those which haven't
+// failed within the recovery timeout.
+func (h *outputHealth) failing() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var names []string
+	for output, n := range h.failures {
+		if n >= h.maxFailures && time.Since(h.failed[output]) < h.recovery {
+			names = append(names, output)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Serves /ready.
+func (s *Service) ready(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.ctx.Done():
+		http.Error(w, "stopping", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	if !s.leader.active() {
+		http.Error(w, "standby", http.StatusServiceUnavailable)
+		return
+	}
+	if s.drain.active() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if l, ok := s.sender.worker.(lazyOutputs); ok && !l.attached() {
+		http.Error(w, "outputs not attached", http.StatusServiceUnavailable)
+		return
+	}
+	if failing := s.sender.health.failing(); len(failing) > 0 {
+		http.Error(w, "outputs failing: "+strings.Join(failing, ", "),
+			http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,121 @@
+// Heartbeat events, so downstream can tell a silent collector from a quiet
+// one.  With HEARTBEAT_INTERVAL set, an event like
+//
+//   {"action": "heartbeat", "id": "heartbeat-<instance>-<n>", "time": "..",
+//    "device": "analytics-input", "instance": "..",
+//    "heartbeat": {"interval": 60, "received": 91234, "delivered": 91230,
+//                  "expired": 0, "rejected_connections": 0, "connections": 12}}
+//
+// is sent to HEARTBEAT_OUTPUT, the first output given on the command line
+// unless set, every interval.  The output must be one the bridge has.  The
+// counts are of events and connections since the previous heartbeat;
+// connections is those open now.  Like canaries, heartbeats skip the
+// processing stages, but belong to the first pipeline as events from no
+// source do.
+
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type heartbeat struct {
+	Action    string             `json:"action"`
+	ID        string             `json:"id"`
+	Time      string             `json:"time"`
+	Device    string             `json:"device"`
+	Instance  string             `json:"instance"`
+	Heartbeat map[string]float64 `json:"heartbeat"`
+}
+
+// Counts in heartbeats, and the metrics they're taken from.  Counters are
+// reported as the increase since the last heartbeat.
+var heartbeatCounters = map[string]string{
+	"received":             "pipeline_events",
+	"delivered":            "publish_latency",
+	"expired":              "expired_events",
+	"rejected_connections": "rejected_connections",
+}
+
+// Starts sending heartbeats, if configured.  outputs are the output
+// specifications the bridge was started with.
+func (s *Service) startHeartbeat(outputs []string) error {
+	v := utils.Getenv("HEARTBEAT_INTERVAL", "")
+	if v == "" || toolMode {
+		return nil
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("HEARTBEAT_INTERVAL: must be a positive duration")
+	}
+	output := utils.Getenv("HEARTBEAT_OUTPUT", "")
+	if output == "" {
+		names := outputNames(outputs)
+		if len(names) == 0 {
+			return fmt.Errorf("HEARTBEAT_OUTPUT: no output to send heartbeats to")
+		}
+		output = names[0]
+	}
+	if !s.sender.knownOutputs(outputs)[output] {
+		return fmt.Errorf("HEARTBEAT_OUTPUT: unknown output %q", output)
+	}
+
+	utils.Log("INFO: Sending heartbeats to %s every %s", output, interval)
+	s.waitGroup.Add(1)
+	go func() {
+		defer s.waitGroup.Done()
+		last := map[string]float64{}
+		n := 0
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			metrics, err := gatherMetrics()
+			if err != nil {
+				utils.Log("WARN: Unable to gather metrics for heartbeat: %s", err.Error())
+				continue
+			}
+			counts := map[string]float64{"interval": interval.Seconds()}
+			for name, metric := range heartbeatCounters {
+				var total float64
+				for _, x := range metrics[metric] {
+					total += x
+				}
+				counts[name] = total - last[name]
+				last[name] = total
+			}
+			counts["connections"] = 0
+			for _, x := range metrics["open_connections"] {
+				counts["connections"] += x
+			}
+
+			n++
+			msg, err := json.Marshal(heartbeat{
+				Action:    "heartbeat",
+				ID:        fmt.Sprintf("heartbeat-%s-%d", instanceID, n),
+				Time:      time.Now().UTC().Format(time.RFC3339Nano),
+				Device:    "analytics-input",
+				Instance:  instanceID,
+				Heartbeat: counts,
+			})
+			if err != nil {
+				continue
+			}
+			s.sender.enqueue(&event{
+				data:     append(msg, '\n'),
+				output:   output,
+				pipeline: s.pipelines[0],
+				received: time.Now(),
+			})
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,85 @@
+// Message authentication.  With HMAC_KEY set, probes wrap each event in an
+// envelope carrying an HMAC-SHA256 of the event bytes:
+//
+//   {"event": {...}, "hmac": "<hex digest>"}
+//
+// The signature is checked against the shared key and the inner event is
+// forwarded on its own.  Anything unsigned or tampered with is dropped.  A
+// key kept in Vault is replaced as soon as it's rotated there.
+
+package input
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type hmacStage struct {
+	// Holds the key, a []byte.
+	key      atomic.Value
+	rejected *prometheus.CounterVec
+}
+
+type signedEvent struct {
+	Event json.RawMessage `json:"event"`
+	HMAC  string          `json:"hmac"`
+}
+
+func newHMACStage() (stage, error) {
+	key := utils.Getenv("HMAC_KEY", "")
+	if key == "" {
+		return nil, nil
+	}
+	h := &hmacStage{
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "hmac_rejected_events",
+				Help: "Events rejected by signature verification",
+			},
+			[]string{"reason"},
+		),
+	}
+	mustRegister(h.rejected)
+	h.key.Store([]byte(key))
+	watchSecret("HMAC_KEY", func(key string) {
+		h.key.Store([]byte(key))
+	})
+	return h, nil
+}
+
+func (h *hmacStage) process(e *event) bool {
+
+	var env signedEvent
+	err := json.Unmarshal(e.data, &env)
+	if err != nil || len(env.Event) == 0 || env.HMAC == "" {
+		return h.reject(e, "unsigned")
+	}
+
+	sig, err := hex.DecodeString(env.HMAC)
+	if err != nil {
+		return h.reject(e, "malformed")
+	}
+
+	mac := hmac.New(sha256.New, h.key.Load().([]byte))
+	mac.Write(env.Event)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return h.reject(e, "invalid")
+	}
+
+	e.replace(append([]byte(env.Event), '\n'))
+	return true
+}
+
+func (h *hmacStage) reject(e *event, reason string) bool {
+	utils.Log("WARN: Rejected %s event from: %s", reason, e.remote)
+	h.rejected.With(prometheus.Labels{"reason": reason}).Inc()
+	e.output = ""
+	e.problem = "signature " + reason
+	return false
+}
@@ -0,0 +1,287 @@
+// HTTP outputs, for sinks taking events over HTTP rather than through the
+// queue worker.  HTTP_OUTPUTS lists them as name=url pairs separated by ';',
+// the name being that of the output, for example
+//
+//   HTTP_OUTPUTS="siem=https://siem.example.com/ingest"
+//
+// Each event is POSTed to the URL on its own, and any 2xx answer counts as
+// delivered.
+//
+// The HTTP outputs share one pool of connections, rather than each publish
+// dialling its own.  HTTP_OUTPUT_MAX_CONNS limits the connections to each
+// host, and should be at least SENDERS for every publisher to have one.
+// Idle connections are kept for HTTP_OUTPUT_IDLE_TIMEOUT, with TCP keepalives
+// every HTTP_OUTPUT_KEEPALIVE.  Every HTTP_OUTPUT_HEALTH_INTERVAL each URL is
+// checked with a HEAD request, and while one fails the idle connections are
+// dropped, so publishes start afresh once it recovers rather than on
+// connections the far end has given up on.
+//
+// Pooled connections stay with the address they were dialled to, so each
+// host is resolved again every HTTP_OUTPUT_RESOLVE_INTERVAL, and at once
+// when its health check fails.  When its addresses change the connections
+// are dropped as they go idle, for publishes to dial the new ones.
+
+package input
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	HTTP_OUTPUT_MAX_CONNS        = "16"
+	HTTP_OUTPUT_IDLE_TIMEOUT     = "90s"
+	HTTP_OUTPUT_KEEPALIVE        = "30s"
+	HTTP_OUTPUT_HEALTH_INTERVAL  = "10s"
+	HTTP_OUTPUT_RESOLVE_INTERVAL = "1m"
+)
+
+// Connections shared by the HTTP outputs.
+type httpPool struct {
+	client    *http.Client
+	transport *http.Transport
+	interval  time.Duration
+	resolve   time.Duration
+
+	conns   *prometheus.CounterVec
+	up      *prometheus.GaugeVec
+	changes *prometheus.CounterVec
+}
+
+type httpOutput struct {
+	name string
+	url  string
+	host string
+	pool *httpPool
+
+	// The host's addresses when last resolved, sorted.
+	addrs []string
+}
+
+func newHTTPPool() (*httpPool, error) {
+	max, err := strconv.Atoi(utils.Getenv("HTTP_OUTPUT_MAX_CONNS", HTTP_OUTPUT_MAX_CONNS))
+	if err != nil || max < 1 {
+		return nil, fmt.Errorf("HTTP_OUTPUT_MAX_CONNS: must be a positive number")
+	}
+	idle, err := time.ParseDuration(utils.Getenv("HTTP_OUTPUT_IDLE_TIMEOUT",
+		HTTP_OUTPUT_IDLE_TIMEOUT))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP_OUTPUT_IDLE_TIMEOUT: %s", err.Error())
+	}
+	keepalive, err := time.ParseDuration(utils.Getenv("HTTP_OUTPUT_KEEPALIVE",
+		HTTP_OUTPUT_KEEPALIVE))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP_OUTPUT_KEEPALIVE: %s", err.Error())
+	}
+	interval, err := time.ParseDuration(utils.Getenv("HTTP_OUTPUT_HEALTH_INTERVAL",
+		HTTP_OUTPUT_HEALTH_INTERVAL))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP_OUTPUT_HEALTH_INTERVAL: %s", err.Error())
+	}
+	resolve, err := time.ParseDuration(utils.Getenv("HTTP_OUTPUT_RESOLVE_INTERVAL",
+		HTTP_OUTPUT_RESOLVE_INTERVAL))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP_OUTPUT_RESOLVE_INTERVAL: %s", err.Error())
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: keepalive,
+		}).DialContext,
+		MaxConnsPerHost:     max,
+		MaxIdleConns:        max,
+		MaxIdleConnsPerHost: max,
+		IdleConnTimeout:     idle,
+		TLSHandshakeTimeout: HANDSHAKE_TIMEOUT,
+	}
+	p := &httpPool{
+		client:    &http.Client{Transport: transport},
+		transport: transport,
+		interval:  interval,
+		resolve:   resolve,
+		conns: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_output_connections",
+				Help: "Connections used by HTTP output publishes, new or reused",
+			},
+			[]string{"output", "reused"},
+		),
+		up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "http_output_up",
+				Help: "Whether the HTTP output's health check is passing",
+			},
+			[]string{"output"},
+		),
+		changes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_output_endpoint_changes",
+				Help: "Changes to the addresses the HTTP output's host resolves to",
+			},
+			[]string{"output"},
+		),
+	}
+	mustRegister(p.conns)
+	mustRegister(p.up)
+	mustRegister(p.changes)
+	return p, nil
+}
+
+// Returns the HTTP outputs by output name.
+func newHTTPOutputs() (map[string]*httpOutput, error) {
+	outputs := map[string]*httpOutput{}
+	v := utils.Getenv("HTTP_OUTPUTS", "")
+	if v == "" {
+		return outputs, nil
+	}
+	pool, err := newHTTPPool()
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range strings.Split(v, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		i := strings.Index(spec, "=")
+		if i < 1 || strings.TrimSpace(spec[i+1:]) == "" {
+			return nil, fmt.Errorf("HTTP_OUTPUTS: expected name=url, got %q", spec)
+		}
+		o := &httpOutput{
+			name: strings.TrimSpace(spec[:i]),
+			url:  strings.TrimSpace(spec[i+1:]),
+			pool: pool,
+		}
+		u, err := url.Parse(o.url)
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("HTTP_OUTPUTS: bad URL %q", o.url)
+		}
+		o.host = u.Hostname()
+		o.resolve()
+		outputs[o.name] = o
+		utils.Log("INFO: HTTP output %s: %s", o.name, o.url)
+	}
+	go pool.check(outputs)
+	return outputs, nil
+}
+
+// Delivers an event with its headers, and its message key, if any, as
+// X-Message-Key, giving up if ctx is done first.
+func (o *httpOutput) send(ctx context.Context, key string, msg []byte, headers map[string]string) error {
+	// The transport may still be reading the body once the answer's in,
+	// and msg mustn't be kept.
+	body := append([]byte(nil), msg...)
+	req, err := http.NewRequest("POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("X-Message-Key", key)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			o.pool.conns.With(prometheus.Labels{
+				"output": o.name,
+				"reused": strconv.FormatBool(info.Reused),
+			}).Inc()
+		},
+	})
+	resp, err := o.pool.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", o.url, resp.Status)
+	}
+	return nil
+}
+
+// Resolves the output's host again, reporting whether its addresses have
+// changed since last time.
+func (o *httpOutput) resolve() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, o.host)
+	if err != nil {
+		utils.Log("WARN: HTTP output %s: unable to resolve %s: %s",
+			o.name, o.host, err.Error())
+		return false
+	}
+	sort.Strings(addrs)
+	changed := o.addrs != nil &&
+		strings.Join(addrs, ",") != strings.Join(o.addrs, ",")
+	if changed {
+		utils.Log("INFO: HTTP output %s: %s now resolves to %s",
+			o.name, o.host, strings.Join(addrs, ", "))
+		o.pool.changes.With(prometheus.Labels{"output": o.name}).Inc()
+	}
+	o.addrs = addrs
+	return changed
+}
+
+// Checks each output's URL every interval, dropping the idle connections
+// while any is failing, and resolves the hosts again when it's time or a
+// check fails.  Connections busy when an address changes are dropped once
+// they're idle, at the next check.
+func (p *httpPool) check(outputs map[string]*httpOutput) {
+	resolved := time.Now()
+	stale := false
+	for {
+		failing, changed := false, false
+		resolve := time.Since(resolved) >= p.resolve
+		for _, o := range outputs {
+			ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+			req, err := http.NewRequest("HEAD", o.url, nil)
+			if err == nil {
+				var resp *http.Response
+				resp, err = p.client.Do(req.WithContext(ctx))
+				if err == nil {
+					resp.Body.Close()
+					if resp.StatusCode >= 500 {
+						err = fmt.Errorf("answered %s", resp.Status)
+					}
+				}
+			}
+			cancel()
+
+			gauge := p.up.With(prometheus.Labels{"output": o.name})
+			if err != nil {
+				utils.Log("WARN: HTTP output %s health check failed: %s",
+					o.name, err.Error())
+				gauge.Set(0)
+				failing = true
+			} else {
+				gauge.Set(1)
+			}
+			if (resolve || err != nil) && o.resolve() {
+				changed = true
+			}
+		}
+		if resolve {
+			resolved = time.Now()
+		}
+		if failing || changed || stale {
+			p.transport.CloseIdleConnections()
+		}
+		stale = changed
+		time.Sleep(p.interval)
+	}
+}
@@ -0,0 +1,119 @@
+// HTTP event source, for pipelines with "source": "http".  Clients POST
+// events, one JSON object per line, to any path on the pipeline's port and
+// are answered once they're all queued with
+//
+//   {"events": 100, "rejected": 2}
+//
+// Events go through the same checks and processing as those from probe
+// connections.  Draining and standby refuse requests with 503.
+
+package input
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+
+	"analytics/internal/frames"
+)
+
+// Serves a pipeline's HTTP source on a listener in the background.
+func (s *Service) startHTTPSource(listener *net.TCPListener, p *pipeline) {
+	srv := &http.Server{
+		Handler:   s.ingestHandler(p),
+		TLSConfig: s.tlsConfig,
+	}
+	s.httpSources = append(s.httpSources, srv)
+	go func() {
+		var err error
+		if s.tlsConfig != nil {
+			err = srv.ServeTLS(listener, "", "")
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			utils.Log("ERROR: HTTP source %s failed: %s", p.Name, err.Error())
+		}
+	}()
+}
+
+// Stops taking requests, waiting for those in progress to be queued.
+func (s *Service) stopHTTPSources() {
+	for _, srv := range s.httpSources {
+		srv.Shutdown(context.Background())
+	}
+}
+
+func (s *Service) ingestHandler(p *pipeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.accepting() {
+			http.Error(w, "not accepting events", http.StatusServiceUnavailable)
+			return
+		}
+
+		remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		cl := &client{
+			id:     nextConnection(),
+			remote: remote,
+			state:  map[stage]interface{}{},
+		}
+		// The last line needn't be terminated, and blank lines are
+		// skipped.
+		body := io.MultiReader(r.Body, strings.NewReader("\n"))
+		framer := frames.New(body, s.readBufferSize, s.maxEventSize)
+		defer framer.Close()
+
+		var result struct {
+			Events   int `json:"events"`
+			Rejected int `json:"rejected"`
+		}
+		for {
+			msg, ck, err := framer.Next()
+			if err == io.EOF {
+				break
+			}
+			if err == frames.ErrTooBig {
+				oversizedEvents.Inc()
+				result.Rejected++
+				continue
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(bytes.TrimSpace(msg)) == 0 {
+				ck.Release()
+				continue
+			}
+			e := &event{
+				data:     msg,
+				chunk:    ck,
+				output:   p.Outputs[0],
+				remote:   remote,
+				client:   cl,
+				pipeline: p,
+				received: time.Now(),
+			}
+			s.process(e)
+			result.Events++
+			if e.problem != "" {
+				result.Rejected++
+			}
+			s.send(e)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,783 @@
+// Package input is the bridge between cybermon and cherami.
+// cherami currently does not have any lua library so This
+// bridge handles TCP connections and spits messages seperated
+// by a new line into a configurable number of cherami queues.
+//
+// Main runs the bridge as the input command does.  To embed it instead,
+// make a Service with NewService, give it TLSConfig if wanted with UseTLS,
+// Start it on each of the listeners from Listen, serve Handlers alongside
+// the Prometheus metrics, and Stop it when done.
+package input
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/trustnetworks/analytics-common/utils"
+
+	"analytics/internal/frames"
+)
+
+const (
+	PORT  = "48879"
+	PROTO = "tcp"
+
+	// Time allowed for a client to complete the TLS handshake.
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+
+	// Bounds of the delay before accepting again after an error.
+	ACCEPT_RETRY_MIN = 5 * time.Millisecond
+	ACCEPT_RETRY_MAX = time.Second
+
+	// Per connection read buffer.  Probes burst megabytes after
+	// reconnecting, so this is well above the usual 4k.
+	READ_BUFFER_SIZE = "65536"
+
+	pgm = "input"
+)
+
+// Listener Service
+type Service struct {
+	// Cancelled to stop the service.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	waitGroup *sync.WaitGroup
+
+	// Closed once the listeners have been handed to an upgraded process.
+	handedOff chan bool
+	state     *stateSignal
+	worker    Publisher
+
+	// TLS configuration for accepted connections, nil for plain TCP.
+	tlsConfig *tls.Config
+
+	// Size of each connection's read buffer, and of its socket receive
+	// buffer if non-zero.
+	readBufferSize int
+	socketBuffer   int
+	tcpOptions     *tcpOptions
+
+	// Largest event accepted, 0 for no limit.
+	maxEventSize int
+
+	// Whether rejected events are answered, as in strict.go.
+	strict bool
+
+	// Connections silent for this long are closed, if non-zero.
+	idleTimeout time.Duration
+	reaped      prometheus.Counter
+
+	// Panics recovered while serving a connection.
+	panics prometheus.Counter
+
+	// Processing applied to each event before it's sent: every configured
+	// stage, and the pipelines applying them.
+	stages    []stage
+	pipelines []*pipeline
+
+	sender *sender
+
+	// Servers for pipelines with HTTP sources.
+	httpSources []*http.Server
+
+	// Probe listeners being served, kept current as they're bound again,
+	// for handing over on upgrade.
+	listenerMutex sync.Mutex
+	listeners     []*net.TCPListener
+
+	audit *auditLog
+
+	latency *latencySampler
+
+	// Decides whether this instance is active, nil if it always is.
+	leader *leaderElection
+
+	// Tenants served, nil unless multi-tenant.
+	tenants *tenantTable
+
+	drain       *drainState
+	connections *connLimit
+
+	// Copies connections' streams to files, nil unless recording.
+	recorder *recorder
+
+	// Decoding for ETSI sources.
+	etsi *etsiConfig
+
+	tail *tailHub
+
+	admin *adminAuth
+
+	// Latest events forwarded, nil unless kept.
+	peek *peekBuffer
+
+	// Counts of the heaviest devices and destinations, nil unless kept.
+	top *topTalkers
+}
+
+// Make a new Service publishing through w.  outputs are the output
+// specifications, as given on the command line, which canaries and the
+// self-test go to, and which outputs named in the configuration are
+// checked against.
+func NewService(w Publisher, outputs []string) (*Service, error) {
+
+	stages, pipelines, err := newPipelines()
+	if err != nil {
+		utils.Log("ERROR: Failed to configure processing: %s", err.Error())
+		return nil, err
+	}
+
+	audit, err := newAuditLog(w)
+	if err != nil {
+		utils.Log("ERROR: Failed to open audit log: %s", err.Error())
+		return nil, err
+	}
+
+	readBufferSize, err := strconv.Atoi(utils.Getenv("READ_BUFFER_SIZE", READ_BUFFER_SIZE))
+	if err != nil || readBufferSize < 1 {
+		err = fmt.Errorf("READ_BUFFER_SIZE: must be a positive number")
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+	socketBuffer, err := strconv.Atoi(utils.Getenv("SOCKET_RECEIVE_BUFFER", "0"))
+	if err != nil {
+		utils.Log("ERROR: SOCKET_RECEIVE_BUFFER: %s", err.Error())
+		return nil, err
+	}
+
+	maxEventSize, err := strconv.Atoi(utils.Getenv("MAX_EVENT_SIZE", "0"))
+	if err != nil {
+		utils.Log("ERROR: MAX_EVENT_SIZE: %s", err.Error())
+		return nil, err
+	}
+
+	var idleTimeout time.Duration
+	if v := utils.Getenv("IDLE_TIMEOUT", ""); v != "" {
+		idleTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			utils.Log("ERROR: IDLE_TIMEOUT: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	tcpOptions, err := newTCPOptions()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+
+	chaos, err := newChaos()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+
+	sender, err := newSender(w, chaos)
+	if err != nil {
+		utils.Log("ERROR: Failed to start senders: %s", err.Error())
+		return nil, err
+	}
+
+	tenants, err := newTenantTable(sender.knownOutputs(outputs))
+	if err != nil {
+		utils.Log("ERROR: Failed to load tenants: %s", err.Error())
+		return nil, err
+	}
+
+	etsi, err := newETSIConfig()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+
+	recorder, err := newRecorder()
+	if err != nil {
+		utils.Log("ERROR: Failed to start recording: %s", err.Error())
+		return nil, err
+	}
+
+	peek, err := newPeekBuffer()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+
+	top, err := newTopTalkers()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+
+	connections, err := newConnLimit()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+
+	drain, err := newDrainState()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+
+	state := newStateSignal()
+	leader, err := newLeaderElection(state)
+	if err != nil {
+		utils.Log("ERROR: Failed to start leader election: %s", err.Error())
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Service{
+		ctx:       ctx,
+		cancel:    cancel,
+		handedOff: make(chan bool),
+		state:     state,
+		waitGroup: &sync.WaitGroup{},
+		worker:    w,
+		stages:    stages,
+		pipelines: pipelines,
+		sender:    sender,
+		audit:     audit,
+		latency:   newLatencySampler(),
+		leader:    leader,
+		tenants:   tenants,
+		drain:     drain,
+
+		connections: connections,
+		recorder:    recorder,
+		etsi:        etsi,
+		tail:        newTailHub(),
+		admin:       newAdminAuth(),
+		peek:        peek,
+		top:         top,
+
+		readBufferSize: readBufferSize,
+		socketBuffer:   socketBuffer,
+		tcpOptions:     tcpOptions,
+		maxEventSize:   maxEventSize,
+		strict:         strictMode(),
+		idleTimeout:    idleTimeout,
+		reaped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "idle_connections_reaped",
+			Help: "Connections closed for sending nothing",
+		}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "connection_panics",
+			Help: "Connections closed by a panic while serving them",
+		}),
+	}
+	mustRegister(s.reaped)
+	mustRegister(s.panics)
+	mustRegister(oversizedEvents, certExpiries)
+	s.startGenerators()
+	s.startRecordSweep()
+	err = s.startCanary(outputs)
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+	err = s.startHeartbeat(outputs)
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+	err = s.startAlerts()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+	err = s.startMetricsPush()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+	err = s.startResourceWatch()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return nil, err
+	}
+	return s, nil
+}
+
+// Set the TLS configuration for connections accepted from now on, nil for
+// plain TCP.
+func (s *Service) UseTLS(cfg *tls.Config) {
+	s.tlsConfig = cfg
+}
+
+// Serve a listener in the background, as the source of the first pipeline.
+func (s *Service) Start(listener *net.TCPListener) {
+	s.startSource(listener, s.pipelines[0])
+}
+
+// Serve a listener in the background as a pipeline's source.
+func (s *Service) startSource(listener *net.TCPListener, p *pipeline) {
+	s.replaceListener(nil, listener)
+	if p.Source == "http" {
+		s.startHTTPSource(listener, p)
+		return
+	}
+	s.waitGroup.Add(1)
+	go func() {
+		defer s.waitGroup.Done()
+		s.accept(listener, p)
+	}()
+}
+
+// Accept connections for the first pipeline until stopped.
+func (s *Service) Serve(listener *net.TCPListener) {
+	s.replaceListener(nil, listener)
+	s.accept(listener, s.pipelines[0])
+}
+
+// Replaces a listener being served with one bound in its place, or adds one
+// if old is nil.
+func (s *Service) replaceListener(old, l *net.TCPListener) {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	for i, x := range s.listeners {
+		if x == old && old != nil {
+			s.listeners[i] = l
+			return
+		}
+	}
+	s.listeners = append(s.listeners, l)
+}
+
+// Returns the listeners being served.
+func (s *Service) currentListeners() []*net.TCPListener {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	return append([]*net.TCPListener(nil), s.listeners...)
+}
+
+// Accept connections and spawn a goroutine to serve each one, until the
+// service is stopped or the listener has been handed over.  Accept errors
+// are retried with a growing delay, and the listener is bound again if it's
+// broken.
+func (s *Service) accept(listener *net.TCPListener, p *pipeline) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	// Wake a blocked Accept once stopped or handed over.  The listener
+	// changes if it's bound again.
+	var current atomic.Value
+	current.Store(listener)
+	go func() {
+		select {
+		case <-s.handedOff:
+			cancel()
+		case <-ctx.Done():
+		}
+		current.Load().(*net.TCPListener).SetDeadline(time.Now())
+	}()
+
+	var delay time.Duration
+	for s.connections.wait(ctx) {
+		conn, err := listener.AcceptTCP()
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			break
+		}
+		if err != nil {
+			utils.Log("ERROR: Failed to start TCP Connection: %s", err.Error())
+
+			opErr, ok := err.(*net.OpError)
+			if !ok || !opErr.Temporary() {
+				nl, err := rebind(listener)
+				if err != nil {
+					utils.Log("ERROR: Unable to listen again on %s: %s",
+						listener.Addr(), err.Error())
+				} else {
+					utils.Log("INFO: Listening again on: %s", nl.Addr())
+					s.replaceListener(listener, nl)
+					listener = nl
+					current.Store(nl)
+				}
+			}
+
+			if delay == 0 {
+				delay = ACCEPT_RETRY_MIN
+			} else if delay *= 2; delay > ACCEPT_RETRY_MAX {
+				delay = ACCEPT_RETRY_MAX
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+		if !s.accepting() {
+			conn.Close()
+			continue
+		}
+		if !s.connections.admit() {
+			utils.Log("WARN: Too many connections, refused: %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		utils.Log("INFO: Connected to address: %s", conn.RemoteAddr())
+		s.audit.record("connection_open", conn.RemoteAddr().String(), "")
+		s.waitGroup.Add(1)
+		go s.serve(conn, p)
+	}
+
+	if s.ctx.Err() != nil {
+		utils.Log("INFO: Stopping listener on: %s", listener.Addr())
+	} else {
+		utils.Log("INFO: Handed over listener on: %s", listener.Addr())
+	}
+	listener.Close()
+}
+
+// Stop the service by cancelling its context.  Block until the service is
+// really stopped and everything read has been sent.
+func (s *Service) Stop() {
+	s.cancel()
+	s.stopHTTPSources()
+	s.waitGroup.Wait()
+	s.sender.stop()
+}
+
+// Serve a connection by reading to the newline and then sending
+// it off to the cherami worker for output
+func (s *Service) serve(tcpConn *net.TCPConn, p *pipeline) {
+	// Deferred first so it runs last, after the connection is cleaned up.
+	defer s.recoverConnection(tcpConn)
+	var conn net.Conn = tcpConn
+	var err error
+	defer conn.Close()
+	defer s.waitGroup.Done()
+	defer s.connections.release()
+	remote := tcpConn.RemoteAddr().String()
+	defer s.audit.record("connection_close", remote, "")
+
+	err = s.tcpOptions.apply(tcpConn)
+	if err != nil {
+		utils.Log("WARN: Unable to set TCP options: %s, %s", remote, err.Error())
+	}
+	if s.socketBuffer > 0 {
+		err = tcpConn.SetReadBuffer(s.socketBuffer)
+		if err != nil {
+			utils.Log("WARN: Unable to set socket buffer: %s, %s", remote, err.Error())
+		}
+	}
+
+	// Complete the handshake up front, a failed handshake can't be
+	// retried once reads are being woken below.
+	if s.tlsConfig != nil {
+		tlsConn := tls.Server(tcpConn, s.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+		err = tlsConn.Handshake()
+		if err != nil {
+			utils.Log("WARN: TLS handshake failed: %s, %s", conn.RemoteAddr(), err.Error())
+			s.audit.record("auth_failure", remote, err.Error())
+			return
+		}
+		s.audit.record("auth_success", remote, peerName(tlsConn))
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			certExpiries.record("client", certs[0])
+		}
+		conn = tlsConn
+	}
+
+	cl := &client{
+		id:     nextConnection(),
+		remote: conn.RemoteAddr(),
+		state:  map[stage]interface{}{},
+	}
+	stream, stopRecording := s.recorder.wrap(conn, cl.id, conn.RemoteAddr())
+	defer stopRecording()
+	if p.Source == "etsi" {
+		stream = s.etsi.reader(stream)
+	}
+	framer := frames.New(stream, s.readBufferSize, s.maxEventSize)
+	defer framer.Close()
+
+	var closeAt time.Time
+	output := p.Outputs[0]
+	if s.tenants != nil {
+		cl.tenant, err = s.tenants.connect(conn, framer)
+		if err != nil {
+			utils.Log("WARN: Refused connection: %s, %s", remote, err.Error())
+			s.audit.record("auth_failure", remote, err.Error())
+			return
+		}
+		s.audit.record("tenant", remote, cl.tenant.Name)
+		gauge := s.tenants.connections.With(prometheus.Labels{"tenant": cl.tenant.Name})
+		gauge.Inc()
+		defer gauge.Dec()
+		if cl.tenant.Output != "" {
+			output = cl.tenant.Output
+		}
+	}
+	sample := 0
+
+	// Wake the read whenever the service stops or the state changes, for
+	// the loop to look again.
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case <-s.state.next():
+				conn.SetReadDeadline(time.Now())
+			case <-ctx.Done():
+				conn.SetReadDeadline(time.Now())
+				return
+			}
+		}
+	}()
+
+	for {
+		changed := s.state.next()
+		if s.ctx.Err() != nil {
+			utils.Log("INFO: Disconnecting from: %s", conn.RemoteAddr())
+			return
+		}
+		if !s.leader.active() {
+			utils.Log("INFO: Standing by, disconnecting from: %s", conn.RemoteAddr())
+			return
+		}
+		switch {
+		case !s.drain.active():
+			closeAt = time.Time{}
+		case closeAt.IsZero():
+			closeAt = s.drain.begin(conn)
+		case time.Now().After(closeAt):
+			utils.Log("INFO: Drained connection from: %s", conn.RemoteAddr())
+			return
+		}
+		if s.idleTimeout > 0 && time.Since(framer.Active) > s.idleTimeout {
+			utils.Log("INFO: Closing idle connection from: %s", conn.RemoteAddr())
+			s.reaped.Inc()
+			return
+		}
+
+		// Read until the drain or idle time is up, whichever is first.
+		deadline := closeAt
+		if s.idleTimeout > 0 {
+			idle := framer.Active.Add(s.idleTimeout)
+			if deadline.IsZero() || idle.Before(deadline) {
+				deadline = idle
+			}
+		}
+		conn.SetReadDeadline(deadline)
+		select {
+		case <-changed:
+			continue
+		default:
+		}
+
+		msg, ck, err := framer.Next()
+		ts := time.Now().UnixNano()
+
+		if err != nil {
+			// A partial event stays in the framer to be completed.
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				continue
+			}
+			if err == frames.ErrTooBig {
+				oversizedEvents.Inc()
+				s.replyError(conn, err.Error(), "")
+				continue
+			}
+			utils.Log("WARN: Unable to read from connection: %s, %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+		if s.sender.chaos.drop() {
+			utils.Log("INFO: Chaos, dropping connection from: %s", conn.RemoteAddr())
+			ck.Release()
+			return
+		}
+		s.sender.chaos.corrupt(msg)
+		if cl.tenant != nil && !cl.tenant.admit(time.Unix(0, ts)) {
+			ck.Release()
+			continue
+		}
+		e := &event{
+			data:     msg,
+			chunk:    ck,
+			output:   output,
+			remote:   conn.RemoteAddr(),
+			client:   cl,
+			pipeline: p,
+			received: time.Unix(0, ts),
+		}
+		s.process(e)
+		if e.problem != "" {
+			s.replyError(conn, e.problem, topLevelFields(e.data, "id")["id"])
+		}
+
+		// Sample the event as forwarded, the stages may have unwrapped it.
+		sample++
+		if sample == latencySampleRate {
+			s.latency.sample(cl, e.data, ts)
+			sample = 0
+		}
+		s.send(e)
+	}
+}
+
+// Recovers from a panic serving a connection, so it closes just that one
+// rather than the process and every other probe's connection with it.
+func (s *Service) recoverConnection(conn *net.TCPConn) {
+	if r := recover(); r != nil {
+		s.panics.Inc()
+		utils.Log("ERROR: Panic serving connection from %v: %v\n%s",
+			conn.RemoteAddr(), r, debug.Stack())
+	}
+}
+
+// Tools sharing the bridge's configuration and pipeline, run instead of it
+// by naming them first on the command line.
+var subcommands = map[string]func(args []string) error{
+	"bench":  runBench,
+	"gen":    runGen,
+	"replay": runReplay,
+}
+
+// Set when running a subcommand.  Tools share the bridge's configuration,
+// but mustn't touch what belongs to the bridge itself: they leave the spool
+// for the bridge to drain, don't contend for the leader lease and send no
+// heartbeats.
+var toolMode bool
+
+// Runs the bridge, or the subcommand named first on the command line, as the
+// input command.  Returns once stopped by SIGINT or SIGTERM.
+func Main() {
+	utils.LogPgm = pgm
+
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			toolMode = true
+			err := run(os.Args[2:])
+			if err != nil {
+				utils.Log("ERROR: %s: %s", os.Args[1], err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	// Secrets have to be in place before any configuration is read.
+	err := startVault()
+	if err != nil {
+		utils.Log("ERROR: Failed to load secrets from Vault: %s", err.Error())
+		return
+	}
+
+	err = takeOver()
+	if err != nil {
+		utils.Log("ERROR: Failed to take over from the previous process: %s", err.Error())
+		return
+	}
+
+	err = tuneRuntime()
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return
+	}
+
+	var outputs []string
+	if len(os.Args) > 0 {
+		outputs = os.Args[1:]
+	} else {
+		utils.Log("ERROR: No outputs defined. You need to define at least one")
+		return
+	}
+	publisher, err := newPublisher(outputs)
+	if err != nil {
+		utils.Log("ERROR: Failed to init: %s", err.Error())
+		return
+	}
+
+	// Make a new service and send it into the background.
+	service, err := NewService(publisher, outputs)
+	if err != nil {
+		return
+	}
+	err = service.selfTest(outputs)
+	if err != nil {
+		utils.Log("ERROR: %s", err.Error())
+		return
+	}
+	tlsConfig, err := TLSConfig()
+	if err != nil {
+		utils.Log("ERROR: Failed to configure TLS: %s", err.Error())
+		return
+	}
+	service.UseTLS(tlsConfig)
+
+	for _, p := range service.pipelines {
+		if p.Source == "netflow" {
+			conn, err := listenUDP(fmt.Sprintf(":%d", p.Port))
+			if err != nil {
+				utils.Log("ERROR: Failed to listen on address: %s", err.Error())
+				return
+			}
+			utils.Log("INFO: Listening on: %s/udp for %s", conn.LocalAddr(), p.Name)
+			service.startNetFlowSource(conn, p)
+			continue
+		}
+		ls, err := Listen(fmt.Sprintf(":%d", p.Port))
+		if err != nil {
+			utils.Log("ERROR: Failed to listen on address: %s", err.Error())
+			return
+		}
+		for _, listener := range ls {
+			utils.Log("INFO: Listening on: %s for %s", listener.Addr(), p.Name)
+			service.startSource(listener, p)
+		}
+	}
+
+	// server prometheus metrics
+	utils.Log("INFO: Starting prometheus metrics on :8080")
+	metrics, err := metricsListener(":8080")
+	if err != nil {
+		utils.Log("ERROR: Failed to listen for metrics: %s", err.Error())
+		return
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	service.Handlers(http.DefaultServeMux)
+	go http.Serve(metrics, nil)
+
+	// Handle SIGINT and SIGTERM, and SIGUSR2 to upgrade.
+	ch := make(chan os.Signal)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	var sig os.Signal
+	for {
+		sig = <-ch
+		utils.Log("INFO: Received signal: %s", sig)
+		if sig != syscall.SIGUSR2 {
+			break
+		}
+		err := service.upgrade(metrics)
+		if err == nil {
+			break
+		}
+		utils.Log("ERROR: Upgrade failed: %s", err.Error())
+	}
+	service.audit.record("shutdown", "", sig.String())
+
+	// Stop the service gracefully.
+	service.Stop()
+}
@@ -0,0 +1,255 @@
+// Threat intelligence tagging.  Indicators (addresses, domains, hashes) are
+// loaded from IOC_FILE, one per line, and/or the TAXII 2.1 collection objects
+// endpoint at IOC_TAXII_URL, and reloaded every IOC_REFRESH_INTERVAL.  Events
+// mentioning any of them get the matches listed under "ioc_match" and, if
+// IOC_OUTPUT is set, are sent to that output instead.
+
+package input
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	IOC_REFRESH_INTERVAL = "1h"
+	TAXII_CONTENT_TYPE   = "application/taxii+json;version=2.1"
+)
+
+// Values compared in STIX patterns, e.g. [domain-name:value = 'evil.com'].
+var stixValue = regexp.MustCompile(`=\s*'([^']+)'`)
+
+type iocStage struct {
+	file     string
+	taxii    string
+	user     string
+	password string
+	output   string
+	client   *http.Client
+
+	mutex sync.RWMutex
+	iocs  map[string]bool
+
+	matched prometheus.Counter
+}
+
+func newIOCStage() (stage, error) {
+	file := utils.Getenv("IOC_FILE", "")
+	taxii := utils.Getenv("IOC_TAXII_URL", "")
+	if file == "" && taxii == "" {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(utils.Getenv("IOC_REFRESH_INTERVAL",
+		IOC_REFRESH_INTERVAL))
+	if err != nil {
+		return nil, fmt.Errorf("IOC_REFRESH_INTERVAL: %s", err.Error())
+	}
+
+	s := &iocStage{
+		file:     file,
+		taxii:    taxii,
+		user:     utils.Getenv("IOC_TAXII_USER", ""),
+		password: utils.Getenv("IOC_TAXII_PASSWORD", ""),
+		output:   utils.Getenv("IOC_OUTPUT", ""),
+		client:   &http.Client{Timeout: time.Minute},
+		matched: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ioc_matched_events",
+			Help: "Events matching threat intelligence indicators",
+		}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.load(); err != nil {
+				utils.Log("WARN: Unable to reload indicators: %s", err.Error())
+			}
+		}
+	}()
+	mustRegister(s.matched)
+	return s, nil
+}
+
+// Replaces the indicator set.  On failure the old set stays in use.
+func (s *iocStage) load() error {
+	iocs := map[string]bool{}
+	if s.file != "" {
+		if err := s.loadFile(iocs); err != nil {
+			return err
+		}
+	}
+	if s.taxii != "" {
+		if err := s.loadTAXII(iocs); err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	s.iocs = iocs
+	s.mutex.Unlock()
+	utils.Log("INFO: Loaded %d indicators", len(iocs))
+	return nil
+}
+
+func (s *iocStage) loadFile(iocs map[string]bool) error {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			iocs[strings.ToLower(line)] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// Reads the indicator objects of a TAXII collection, following pagination.
+func (s *iocStage) loadTAXII(iocs map[string]bool) error {
+	base, err := url.Parse(s.taxii)
+	if err != nil {
+		return err
+	}
+	next := ""
+	for {
+		// Any query IOC_TAXII_URL has, such as a type filter, is kept.
+		u := *base
+		if next != "" {
+			q := u.Query()
+			q.Set("next", next)
+			u.RawQuery = q.Encode()
+		}
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", TAXII_CONTENT_TYPE)
+		if s.user != "" {
+			req.SetBasicAuth(s.user, s.password)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		var envelope struct {
+			More    bool   `json:"more"`
+			Next    string `json:"next"`
+			Objects []struct {
+				Type    string `json:"type"`
+				Pattern string `json:"pattern"`
+			} `json:"objects"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&envelope)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("TAXII: %s", resp.Status)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range envelope.Objects {
+			if obj.Type != "indicator" {
+				continue
+			}
+			for _, m := range stixValue.FindAllStringSubmatch(obj.Pattern, -1) {
+				iocs[strings.ToLower(m[1])] = true
+			}
+		}
+		if !envelope.More || envelope.Next == "" {
+			return nil
+		}
+		next = envelope.Next
+	}
+}
+
+func (s *iocStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+
+	s.mutex.RLock()
+	iocs := s.iocs
+	s.mutex.RUnlock()
+
+	found := map[string]bool{}
+	var matches []interface{}
+	eachString(fields, func(v string) {
+		for _, c := range iocCandidates(v) {
+			if iocs[c] && !found[c] {
+				found[c] = true
+				matches = append(matches, c)
+			}
+		}
+	})
+	if len(matches) == 0 {
+		return true
+	}
+
+	s.matched.Inc()
+	fields["ioc_match"] = matches
+	e.modified()
+	if s.output != "" {
+		e.output = s.output
+	}
+	return true
+}
+
+// Forms of a value which may match an indicator: the value itself, the
+// address of a cybermon "ipv4:" style entry, the host of a URL, and the
+// parent domains of a hostname.
+func iocCandidates(v string) []string {
+	v = strings.ToLower(v)
+	candidates := []string{v}
+	if strings.HasPrefix(v, "ipv4:") || strings.HasPrefix(v, "ipv6:") {
+		return append(candidates, v[5:])
+	}
+	host := v
+	if strings.Contains(v, "://") {
+		if u, err := url.Parse(v); err == nil && u.Hostname() != "" {
+			host = u.Hostname()
+			candidates = append(candidates, host)
+		}
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if strings.IndexByte(host, '.') < 0 {
+			break
+		}
+		candidates = append(candidates, host)
+	}
+	return candidates
+}
+
+// Calls fn on every string value in the event.
+func eachString(node interface{}, fn func(string)) {
+	switch n := node.(type) {
+	case string:
+		fn(n)
+	case map[string]interface{}:
+		for _, child := range n {
+			eachString(child, fn)
+		}
+	case []interface{}:
+		for _, child := range n {
+			eachString(child, fn)
+		}
+	}
+}
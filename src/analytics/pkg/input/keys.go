@@ -0,0 +1,126 @@
+// Keys taken from events, for ORDERING_KEY and MESSAGE_KEY.  A key is given
+// as fields to try in turn, separated by ',', the first the event has being
+// the key, for example
+//
+//   MESSAGE_KEY="session_id,src_ip,device"
+//
+// Each is a top level field, a dotted path such as "dns_message.query.name",
+// or src_ip or dest_ip for the address in src or dest.  Strings and numbers
+// can be keys.  An event with none of them is keyed by a hash of the address
+// it came from, so a probe's events stay together.
+
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+type eventKey struct {
+	// The top level fields, which are found without decoding the event.
+	topLevel []string
+
+	// Each field tried, in order, as a path or an address list name.
+	fields []keyField
+}
+
+type keyField struct {
+	name    string
+	path    []string
+	address string
+}
+
+// Parses a key, returning nil if there is none.
+func newEventKey(spec string) *eventKey {
+	names := splitList(spec)
+	if len(names) == 0 {
+		return nil
+	}
+	k := &eventKey{}
+	for _, name := range names {
+		f := keyField{name: name}
+		switch {
+		case name == "src_ip":
+			f.address = "src"
+		case name == "dest_ip":
+			f.address = "dest"
+		case strings.Contains(name, "."):
+			f.path = strings.Split(name, ".")
+		default:
+			k.topLevel = append(k.topLevel, name)
+		}
+		k.fields = append(k.fields, f)
+	}
+	return k
+}
+
+// Returns the event's key.
+func (k *eventKey) of(e *event) string {
+	var top map[string]string
+	if len(k.topLevel) > 0 && !e.dirty {
+		top = topLevelFields(e.data, k.topLevel...)
+	}
+	for _, f := range k.fields {
+		var v string
+		switch {
+		case f.address != "":
+			v = keyAddress(e, f.address)
+		case f.path != nil:
+			v = keyPath(e, f.path)
+		case top != nil:
+			v = top[f.name]
+		default:
+			v = keyPath(e, []string{f.name})
+		}
+		if v != "" {
+			return v
+		}
+	}
+	if e.remote == nil {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.remote.String()))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// Returns the first string or number at a path.
+func keyPath(e *event, path []string) string {
+	fields, err := e.decode()
+	if err != nil {
+		return ""
+	}
+	v := ""
+	walkPath(fields, path, func(parent map[string]interface{}, key string) {
+		if v != "" {
+			return
+		}
+		switch x := parent[key].(type) {
+		case string:
+			v = x
+		case json.Number:
+			v = string(x)
+		case float64:
+			v = fmt.Sprint(x)
+		}
+	})
+	return v
+}
+
+// Returns the IP address in a cyberprobe address list.
+func keyAddress(e *event, list string) string {
+	fields, err := e.decode()
+	if err != nil {
+		return ""
+	}
+	addrs, _ := fields[list].([]interface{})
+	for _, a := range addrs {
+		a, _ := a.(string)
+		if strings.HasPrefix(a, "ipv4:") || strings.HasPrefix(a, "ipv6:") {
+			return a[5:]
+		}
+	}
+	return ""
+}
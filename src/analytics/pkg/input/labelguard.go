@@ -0,0 +1,140 @@
+// Guarding label cardinality.  Metrics labelled by something the probes
+// choose, such as device names, actions or their own addresses, give the
+// METRIC_LABEL_LIMIT busiest values a series of their own and count the
+// rest under "other", so a probe sending random device names can't swamp
+// Prometheus with series.  Values turned away are counted in
+// metric_label_overflow, by metric, so a limit set too low shows.
+//
+// Each value's use is counted, the counts halving every
+// LABEL_DECAY_INTERVAL so they follow recent traffic, and a value without a
+// series takes the place of the least used one once it's been used more
+// than twice as much.  So a burst of junk names at startup holds the
+// series only until real traffic outweighs it, and two values of about the
+// same weight don't keep swapping.  A value losing its series carries on
+// under "other"; its own series just stops growing.
+
+package input
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	METRIC_LABEL_LIMIT = "100"
+
+	// How often the counts of values' use are halved.
+	LABEL_DECAY_INTERVAL = 10 * time.Minute
+)
+
+var labelOverflow = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "metric_label_overflow",
+		Help: "Label values counted as other for want of room, by metric",
+	},
+	[]string{"metric"},
+)
+
+type labelGuard struct {
+	limit    int
+	overflow prometheus.Counter
+
+	mutex sync.Mutex
+
+	// Recent use of the values with series of their own, and of those
+	// without, at most limit of each.
+	values     map[string]float64
+	candidates map[string]float64
+	decayed    time.Time
+}
+
+// Returns a guard on the values of a label of the named metric.
+func newLabelGuard(metric string) (*labelGuard, error) {
+	limit, err := strconv.Atoi(utils.Getenv("METRIC_LABEL_LIMIT", METRIC_LABEL_LIMIT))
+	if err != nil || limit < 1 {
+		return nil, fmt.Errorf("METRIC_LABEL_LIMIT: must be a positive number")
+	}
+	mustRegister(labelOverflow)
+	return &labelGuard{
+		limit:      limit,
+		overflow:   labelOverflow.With(prometheus.Labels{"metric": metric}),
+		values:     map[string]float64{},
+		candidates: map[string]float64{},
+		decayed:    time.Now(),
+	}, nil
+}
+
+// Returns the label value to use for v, "other" if it isn't among the
+// busiest.
+func (g *labelGuard) value(v string) string {
+	if g == nil {
+		return v
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if time.Since(g.decayed) >= LABEL_DECAY_INTERVAL {
+		g.decay()
+	}
+	if _, ok := g.values[v]; ok {
+		g.values[v]++
+		return v
+	}
+	if len(g.values) < g.limit {
+		g.values[v] = 1
+		return v
+	}
+
+	n, ok := g.candidates[v]
+	if !ok && len(g.candidates) >= g.limit {
+		// Make room in place of the least used.  The newcomer starts from
+		// nothing, so a flood of new names churns the candidates rather
+		// than the series.
+		least, _ := lightest(g.candidates)
+		delete(g.candidates, least)
+	}
+	n++
+	least, min := lightest(g.values)
+	if n > 2*min {
+		delete(g.values, least)
+		delete(g.candidates, v)
+		g.values[v] = n
+		g.candidates[least] = min
+		return v
+	}
+	g.candidates[v] = n
+	g.overflow.Inc()
+	return "other"
+}
+
+// Halves the counts, forgetting values without series once they're unused.
+func (g *labelGuard) decay() {
+	for v := range g.values {
+		g.values[v] /= 2
+	}
+	for v, n := range g.candidates {
+		if n < 1 {
+			delete(g.candidates, v)
+		} else {
+			g.candidates[v] = n / 2
+		}
+	}
+	g.decayed = time.Now()
+}
+
+// Returns the least used of counts, and its count.
+func lightest(counts map[string]float64) (string, float64) {
+	var least string
+	min := math.Inf(1)
+	for v, n := range counts {
+		if n < min {
+			least, min = v, n
+		}
+	}
+	return least, min
+}
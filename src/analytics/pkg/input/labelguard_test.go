@@ -0,0 +1,75 @@
+package input
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func newTestLabelGuard(t *testing.T, limit string) *labelGuard {
+	os.Setenv("METRIC_LABEL_LIMIT", limit)
+	defer os.Unsetenv("METRIC_LABEL_LIMIT")
+	g, err := newLabelGuard("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// A flood of junk names at startup gives way to the devices sending
+// steadily afterwards.
+func TestLabelGuardFloodThenSteady(t *testing.T) {
+	g := newTestLabelGuard(t, "3")
+	for i := 0; i < 50; i++ {
+		g.value(fmt.Sprintf("junk-%d", i))
+	}
+
+	devices := []string{"probe-a", "probe-b", "probe-c"}
+	for i := 0; i < 20; i++ {
+		for _, d := range devices {
+			g.value(d)
+		}
+	}
+	for _, d := range devices {
+		if got := g.value(d); got != d {
+			t.Errorf("%s: got %q", d, got)
+		}
+	}
+	if got := g.value("junk-0"); got != "other" {
+		t.Errorf("junk-0: got %q, want other", got)
+	}
+}
+
+// A value with a series keeps it against one used about as much.
+func TestLabelGuardNoFlapping(t *testing.T) {
+	g := newTestLabelGuard(t, "1")
+	for i := 0; i < 100; i++ {
+		if got := g.value("a"); got != "a" {
+			t.Fatalf("event %d: a: got %q", i, got)
+		}
+		if got := g.value("b"); got != "other" {
+			t.Fatalf("event %d: b: got %q", i, got)
+		}
+	}
+}
+
+func TestLabelGuardDecay(t *testing.T) {
+	g := newTestLabelGuard(t, "1")
+	for i := 0; i < 100; i++ {
+		g.value("old")
+	}
+	g.decay()
+	g.decay()
+	g.decay()
+	g.decay()
+	g.decay()
+	for i := 0; i < 10; i++ {
+		g.value("new")
+	}
+	if got := g.value("new"); got != "new" {
+		t.Errorf("new: got %q", got)
+	}
+	if got := g.value("old"); got != "other" {
+		t.Errorf("old: got %q, want other", got)
+	}
+}
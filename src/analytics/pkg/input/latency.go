@@ -0,0 +1,301 @@
+// Latency from the probe to the bridge, measured on a sample of events.
+// Samples are handed over a bounded channel to a single goroutine, and
+// dropped if it falls behind, so measuring never holds up the read path.
+// Only the fields needed are pulled out of each event, rather than decoding
+// the lot.
+//
+// Probe clocks drift, so alongside the raw figure a corrected latency is
+// exported, relative to the smallest offset between the probe's and our
+// clock seen on the connection recently.  That minimum approximates the
+// skew plus the fastest transit, so what remains is the delay on top.  The
+// estimate itself is exported as event_clock_skew, and is kept up even for
+// events whose time is too far out to count towards latency.
+//
+// Latency is also broken down by the event's action.  Only the actions in
+// LATENCY_ACTIONS get a label value of their own, the rest are counted as
+// "other", so a probe inventing actions can't blow up the series count.
+
+package input
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	// One event in this many is measured.
+	latencySampleRate = 10
+
+	// Samples which may wait for the measuring goroutine.
+	latencyQueueSize = 1000
+
+	// Period over which the minimum clock offset is taken.  Long enough
+	// to catch an uncongested moment, short enough to follow drift.
+	skewWindow = 10 * time.Minute
+
+	LATENCY_ACTIONS = "connection_up,connection_down,dns_message," +
+		"http_request,http_response,icmp,smtp_command,smtp_data," +
+		"ftp_command,unrecognised_stream,unrecognised_datagram"
+)
+
+type latencySample struct {
+	client *client
+	data   []byte
+	ts     int64
+}
+
+type latencySampler struct {
+	samples      chan latencySample
+	eventLatency *prometheus.SummaryVec
+	recvLabels   prometheus.Labels
+	corrected    prometheus.Summary
+
+	// Skew estimated for the connection last sampled.
+	skew prometheus.Gauge
+
+	actions       map[string]bool
+	actionLatency *prometheus.SummaryVec
+}
+
+// Minimum clock offsets over the current and previous window, so the
+// estimate follows drift without jumping when a window starts.
+type skewEstimate struct {
+	current  int64
+	previous int64
+	started  time.Time
+}
+
+// Records an offset and returns the estimated skew.
+func (s *skewEstimate) update(offset int64, now time.Time) int64 {
+	switch {
+	case s.started.IsZero():
+		s.current, s.previous, s.started = offset, offset, now
+	case now.Sub(s.started) >= skewWindow:
+		s.previous, s.current, s.started = s.current, offset, now
+	case offset < s.current:
+		s.current = offset
+	}
+	if s.previous < s.current {
+		return s.previous
+	}
+	return s.current
+}
+
+func newLatencySampler() *latencySampler {
+	l := &latencySampler{
+		samples:    make(chan latencySample, latencyQueueSize),
+		recvLabels: prometheus.Labels{"store": "trust-networks"},
+		eventLatency: prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name: "event_latency",
+				Help: "Latency from cyberprobe to store",
+			},
+			[]string{"store"},
+		),
+	}
+	l.corrected = prometheus.NewSummary(prometheus.SummaryOpts{
+		Name: "event_latency_corrected",
+		Help: "Latency from cyberprobe to store, corrected for clock skew",
+	})
+	l.skew = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "event_clock_skew",
+		Help: "Estimated probe clock skew plus fastest transit, of the connection last sampled",
+	})
+	l.actions = stringSet(utils.Getenv("LATENCY_ACTIONS", LATENCY_ACTIONS))
+	l.actionLatency = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name: "event_action_latency",
+			Help: "Latency from cyberprobe to store by event action",
+		},
+		[]string{"action"},
+	)
+	mustRegister(l.eventLatency)
+	mustRegister(l.corrected)
+	mustRegister(l.skew)
+	mustRegister(l.actionLatency)
+	l.eventLatency.With(l.recvLabels).Observe(float64(0)) // default the value to 0
+	go l.run()
+	return l
+}
+
+// Offers an event read at ts for measurement.  The bytes are copied if
+// taken, since the event's buffer is recycled.
+func (l *latencySampler) sample(cl *client, data []byte, ts int64) {
+	select {
+	case l.samples <- latencySample{cl, append([]byte(nil), data...), ts}:
+	default:
+	}
+}
+
+func (l *latencySampler) run() {
+	for s := range l.samples {
+		l.record(s.client, s.data, s.ts)
+	}
+}
+
+func (l *latencySampler) record(cl *client, msg []byte, ts int64) {
+	fields := topLevelFields(msg, "id", "time", "action")
+	if fields == nil {
+		utils.Log("WARN: Unable to log latency, couldn't parse json")
+		return
+	}
+	eTime, err := parseEventTime(fields["time"])
+	if err != nil {
+		utils.Log("Date Parse Error: %s", err.Error())
+		return
+	}
+	latency := ts - eTime.UnixNano()
+
+	// Skew is tracked whatever the latency, it matters most when it's
+	// implausible.
+	skew := cl.skew.update(latency, time.Unix(0, ts))
+	l.skew.Set(float64(skew))
+	if clockAnomaly(time.Duration(latency)) != "" {
+		// Counted separately, and would only distort the summary.
+		return
+	}
+	if latency > 1000000000 {
+		utils.Log("WARN: Latency of %d ms for event id: %s", latency/1000000, fields["id"])
+	}
+	l.eventLatency.With(l.recvLabels).Observe(float64(latency))
+
+	action := fields["action"]
+	if !l.actions[action] {
+		action = "other"
+	}
+	l.actionLatency.With(prometheus.Labels{"action": action}).Observe(float64(latency))
+	l.corrected.Observe(float64(latency - skew))
+}
+
+// Returns the values of the named top level fields of a JSON object,
+// skipping over everything else without decoding it.  Strings are unquoted
+// and other scalars given as written; objects and arrays are left out.
+// Returns nil if the object is malformed.
+func topLevelFields(data []byte, keys ...string) map[string]string {
+	found := map[string]string{}
+	i := skipSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return nil
+	}
+	i = skipSpace(data, i+1)
+	if i < len(data) && data[i] == '}' {
+		return found
+	}
+	for i < len(data) {
+		// Key
+		end := skipString(data, i)
+		if end < 0 {
+			return nil
+		}
+		key := data[i+1 : end-1]
+		i = skipSpace(data, end)
+		if i >= len(data) || data[i] != ':' {
+			return nil
+		}
+		i = skipSpace(data, i+1)
+
+		// Value
+		end = skipValue(data, i)
+		if end < 0 {
+			return nil
+		}
+		if data[i] != '{' && data[i] != '[' {
+			for _, k := range keys {
+				if string(key) != k {
+					continue
+				}
+				if data[i] != '"' {
+					found[k] = string(data[i:end])
+					continue
+				}
+				var s string
+				if json.Unmarshal(data[i:end], &s) == nil {
+					found[k] = s
+				}
+			}
+		}
+		i = skipSpace(data, end)
+		if i >= len(data) {
+			return nil
+		}
+		switch data[i] {
+		case ',':
+			i = skipSpace(data, i+1)
+		case '}':
+			return found
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' ||
+		data[i] == '\n' || data[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// Returns the index after the string starting at i, or -1.
+func skipString(data []byte, i int) int {
+	if i >= len(data) || data[i] != '"' {
+		return -1
+	}
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// Returns the index after the value starting at i, or -1.
+func skipValue(data []byte, i int) int {
+	if i >= len(data) {
+		return -1
+	}
+	switch data[i] {
+	case '"':
+		return skipString(data, i)
+	case '{', '[':
+		depth := 0
+		for i < len(data) {
+			switch data[i] {
+			case '"':
+				i = skipString(data, i)
+				if i < 0 {
+					return -1
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+		return -1
+	default:
+		// Number, true, false or null.
+		start := i
+		for i < len(data) && data[i] != ',' && data[i] != '}' && data[i] != ']' &&
+			data[i] != ' ' && data[i] != '\t' && data[i] != '\n' && data[i] != '\r' {
+			i++
+		}
+		if i == start {
+			return -1
+		}
+		return i
+	}
+}
@@ -0,0 +1,271 @@
+// Active/standby operation.  With LEADER_LEASE naming a Kubernetes Lease,
+// instances compete to hold it and only the holder accepts probe
+// connections.  The others keep their outputs connected and their stages
+// loaded, answer not ready, and close any connection that reaches them, so
+// a standby takes over within a lease duration of the active instance
+// going away.  The service account needs get, create and update on leases
+// in the namespace.
+
+package input
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	LEADER_LEASE_DURATION = "15s"
+	SA_NAMESPACE_FILE     = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	SA_CA_FILE            = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	// Layout of the Lease's MicroTime fields.
+	microTime = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+type leaderElection struct {
+	name      string
+	namespace string
+	duration  time.Duration
+	url       string
+	token     string
+	client    *http.Client
+
+	// Non-zero while we hold the lease.
+	leading int32
+	changed *stateSignal
+
+	role *prometheus.GaugeVec
+}
+
+// Starts competing for the lease if LEADER_LEASE is set, unless running a
+// tool.  Returns nil if not, in which case the instance is always active.
+// Changes of role are signalled on changed.
+func newLeaderElection(changed *stateSignal) (*leaderElection, error) {
+	name := utils.Getenv("LEADER_LEASE", "")
+	if name == "" || toolMode {
+		return nil, nil
+	}
+
+	duration, err := time.ParseDuration(utils.Getenv("LEADER_LEASE_DURATION",
+		LEADER_LEASE_DURATION))
+	if err != nil {
+		return nil, fmt.Errorf("LEADER_LEASE_DURATION: %s", err.Error())
+	}
+
+	namespace := utils.Getenv("LEADER_LEASE_NAMESPACE", "")
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(SA_NAMESPACE_FILE)
+		if err != nil {
+			return nil, fmt.Errorf("LEADER_LEASE_NAMESPACE: %s", err.Error())
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	token, err := ioutil.ReadFile(utils.Getenv("SA_TOKEN_FILE", SA_TOKEN_FILE))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(SA_CA_FILE)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	host := utils.Getenv("KUBERNETES_SERVICE_HOST", "kubernetes.default.svc")
+	port := utils.Getenv("KUBERNETES_SERVICE_PORT", "443")
+
+	l := &leaderElection{
+		name:      name,
+		namespace: namespace,
+		duration:  duration,
+		url: fmt.Sprintf("https://%s:%s/apis/coordination.k8s.io/v1/namespaces/%s/leases",
+			host, port, namespace),
+		token:   strings.TrimSpace(string(token)),
+		changed: changed,
+		client: &http.Client{
+			Timeout:   duration / 3,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		role: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "leader_role",
+				Help: "Whether this instance is the active or the standby one",
+			},
+			[]string{"role"},
+		),
+	}
+	mustRegister(l.role)
+	l.setLeading(false)
+
+	utils.Log("INFO: Electing a leader with lease %s/%s as %s",
+		namespace, name, instanceID)
+	go l.run()
+	return l, nil
+}
+
+// Reports whether this instance should be serving probes.
+func (l *leaderElection) active() bool {
+	return l == nil || atomic.LoadInt32(&l.leading) != 0
+}
+
+func (l *leaderElection) setLeading(leading bool) {
+	v := int32(0)
+	if leading {
+		v = 1
+	}
+	if atomic.SwapInt32(&l.leading, v) != v {
+		if leading {
+			utils.Log("INFO: Became the active instance")
+		} else {
+			utils.Log("INFO: Became a standby instance")
+		}
+		l.changed.changed()
+	}
+	l.role.With(prometheus.Labels{"role": "active"}).Set(float64(v))
+	l.role.With(prometheus.Labels{"role": "standby"}).Set(float64(1 - v))
+}
+
+// Tries for the lease, or renews it, a few times per lease duration.
+func (l *leaderElection) run() {
+	renewed := time.Time{}
+	for {
+		err := l.acquire()
+		switch {
+		case err == nil:
+			renewed = time.Now()
+			l.setLeading(true)
+		case err == errLeaseHeld:
+			l.setLeading(false)
+		default:
+			utils.Log("WARN: Lease %s: %s", l.name, err.Error())
+
+			// Step down before anyone else can take over.
+			if time.Since(renewed) > l.duration*2/3 {
+				l.setLeading(false)
+			}
+		}
+		time.Sleep(l.duration / 3)
+	}
+}
+
+var errLeaseHeld = errors.New("lease held by another instance")
+
+// Takes or renews the lease, returning errLeaseHeld if someone else holds
+// it.
+func (l *leaderElection) acquire() error {
+	now := time.Now()
+	var ls lease
+	status, err := l.call("GET", "/"+l.name, nil, &ls)
+	if err != nil {
+		return err
+	}
+
+	if status == http.StatusNotFound {
+		ls.APIVersion = "coordination.k8s.io/v1"
+		ls.Kind = "Lease"
+		ls.Metadata.Name = l.name
+		ls.Metadata.Namespace = l.namespace
+		l.claim(&ls, now)
+		status, err = l.call("POST", "", &ls, nil)
+	} else {
+		if ls.Spec.HolderIdentity != instanceID && !l.expired(&ls, now) {
+			return errLeaseHeld
+		}
+		if ls.Spec.HolderIdentity != instanceID {
+			ls.Spec.LeaseTransitions++
+			l.claim(&ls, now)
+		}
+		ls.Spec.RenewTime = now.UTC().Format(microTime)
+		status, err = l.call("PUT", "/"+l.name, &ls, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Someone else got there between our read and write.
+	if status == http.StatusConflict {
+		return errLeaseHeld
+	}
+	if status >= 300 {
+		return fmt.Errorf("%d from the Kubernetes API", status)
+	}
+	return nil
+}
+
+func (l *leaderElection) claim(ls *lease, now time.Time) {
+	ls.Spec.HolderIdentity = instanceID
+	ls.Spec.LeaseDurationSeconds = int(l.duration / time.Second)
+	ls.Spec.AcquireTime = now.UTC().Format(microTime)
+	ls.Spec.RenewTime = ls.Spec.AcquireTime
+}
+
+func (l *leaderElection) expired(ls *lease, now time.Time) bool {
+	if ls.Spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(microTime, ls.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	d := time.Duration(ls.Spec.LeaseDurationSeconds) * time.Second
+	return now.After(renewed.Add(d))
+}
+
+// Makes a request of the Lease API, decoding a successful response into
+// out if given.
+func (l *leaderElection) call(method, path string, body, out interface{}) (int, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, l.url+path, &buf)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+l.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return 0, err
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,98 @@
+// Listening sockets.  LISTENERS sets the number of accept loops on the
+// port, each with its own socket bound with SO_REUSEPORT so the kernel
+// spreads connections across them.  REUSE_PORT=true binds a single listener
+// that way too, for running several bridge processes on one port.
+// SO_REUSEPORT is only had on Linux; elsewhere either setting stops the
+// bridge starting.
+//
+// A listener which fails is closed and bound again, with the same options,
+// so a socket lost to an error doesn't leave the bridge deaf.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	LISTENERS = "1"
+)
+
+// How the listeners were bound, for binding them again.
+var listenConfig net.ListenConfig
+
+// Listen opens the configured listeners on addr.
+func Listen(addr string) ([]*net.TCPListener, error) {
+	n, err := strconv.Atoi(utils.Getenv("LISTENERS", LISTENERS))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTENERS: must be a positive number")
+	}
+
+	lc := &listenConfig
+	setting := ""
+	switch {
+	case n > 1:
+		setting = "LISTENERS"
+	case utils.Getenv("REUSE_PORT", "") == "true":
+		setting = "REUSE_PORT"
+	}
+	if setting != "" {
+		lc.Control, err = reusePort(setting)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Already bound by the process being upgraded.
+	if handedOver != nil {
+		return handedOver.take(addr)
+	}
+
+	var listeners []*net.TCPListener
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), PROTO, addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l.(*net.TCPListener))
+	}
+	return listeners, nil
+}
+
+// Returns a socket control function setting SO_REUSEPORT, for the setting
+// asking for it, or an error if the platform hasn't it.
+func reusePort(setting string) (func(network, address string, c syscall.RawConn) error, error) {
+	if !reusePortSupported {
+		return nil, fmt.Errorf("%s: SO_REUSEPORT is only supported on Linux", setting)
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = setReusePort(fd)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}, nil
+}
+
+// Closes a failed listener and binds a new one in its place.
+func rebind(l *net.TCPListener) (*net.TCPListener, error) {
+	addr := l.Addr().String()
+	l.Close()
+	nl, err := listenConfig.Listen(context.Background(), PROTO, addr)
+	if err != nil {
+		return nil, err
+	}
+	return nl.(*net.TCPListener), nil
+}
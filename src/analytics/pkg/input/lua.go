@@ -0,0 +1,256 @@
+// Operator supplied Lua processing.  LUA_SCRIPT names a script defining a
+// global function process(event) which gets each event as a table and
+// returns:
+//
+//   nil                 to drop the event
+//   event               to forward it, changed or not
+//   event, "output"     to forward it to another output
+//
+// An event the script returns unchanged is forwarded exactly as received.
+// Each call is allowed LUA_TIMEOUT.  A script error or timeout is counted
+// and the event forwarded unchanged.  The bridge won't start with a script
+// which fails to run or doesn't define process.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	LUA_TIMEOUT = "5ms"
+)
+
+type luaStage struct {
+	proto   *lua.FunctionProto
+	timeout time.Duration
+
+	// Lua states aren't safe for concurrent use, so keep a pool of them.
+	states chan *lua.LState
+
+	errors   *prometheus.CounterVec
+	duration prometheus.Summary
+}
+
+func newLuaStage() (stage, error) {
+	path := utils.Getenv("LUA_SCRIPT", "")
+	if path == "" {
+		return nil, nil
+	}
+
+	timeout, err := time.ParseDuration(utils.Getenv("LUA_TIMEOUT", LUA_TIMEOUT))
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(utils.Getenv("LUA_STATES",
+		strconv.Itoa(runtime.GOMAXPROCS(0))))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunk, err := parse.Parse(f, path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &luaStage{
+		proto:   proto,
+		timeout: timeout,
+		states:  make(chan *lua.LState, n),
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "lua_errors",
+				Help: "Lua script failures",
+			},
+			[]string{"reason"},
+		),
+		duration: prometheus.NewSummary(prometheus.SummaryOpts{
+			Name: "lua_duration",
+			Help: "Time spent in the Lua script per event",
+		}),
+	}
+	for i := 0; i < n; i++ {
+		L, err := l.newState()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		l.states <- L
+	}
+	mustRegister(l.errors)
+	mustRegister(l.duration)
+	utils.Log("INFO: Loaded Lua script: %s", path)
+	return l, nil
+}
+
+func (l *luaStage) newState() (*lua.LState, error) {
+	L := lua.NewState()
+	L.Push(L.NewFunctionFromProto(l.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	if L.GetGlobal("process").Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("no process function defined")
+	}
+	return L, nil
+}
+
+func (l *luaStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+
+	L := <-l.states
+	start := time.Now()
+	arg := toLua(L, fields)
+
+	// The event as the script sees it, before the script can change it.
+	before, _ := fromLua(arg).(map[string]interface{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	L.SetContext(ctx)
+	err = L.CallByParam(lua.P{
+		Fn:      L.GetGlobal("process"),
+		NRet:    2,
+		Protect: true,
+	}, arg)
+	L.RemoveContext()
+	timedOut := ctx.Err() != nil
+	cancel()
+	l.duration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		reason := "error"
+		if timedOut {
+			reason = "timeout"
+		}
+		utils.Log("WARN: Lua %s: %s", reason, err.Error())
+		l.errors.With(prometheus.Labels{"reason": reason}).Inc()
+
+		// An interrupted state may be left inconsistent, start afresh.
+		L.Close()
+		if L, err = l.newState(); err != nil {
+			utils.Log("ERROR: Unable to restart Lua: %s", err.Error())
+			L = lua.NewState()
+		}
+		l.states <- L
+		return true
+	}
+
+	result, output := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	l.states <- L
+
+	tbl, ok := result.(*lua.LTable)
+	if !ok {
+		e.output = ""
+		return false
+	}
+	if after, ok := fromLua(tbl).(map[string]interface{}); ok &&
+		!reflect.DeepEqual(before, after) {
+		e.fields = mergeLua(fields, before, after)
+		e.modified()
+	}
+	if name, ok := output.(lua.LString); ok && name != "" {
+		e.output = string(name)
+	}
+	return true
+}
+
+// Applies what a script changed to an event.  Going through Lua loses
+// detail: numbers become floats, nulls vanish and empty arrays become
+// objects.  So only the fields which differ from before, the event as the
+// script was given it, are taken from after, the rest are kept as decoded.
+func mergeLua(fields, before, after map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for k, v := range fields {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		if inBefore == inAfter && reflect.DeepEqual(b, a) {
+			merged[k] = v
+		}
+	}
+	for k, a := range after {
+		if _, ok := merged[k]; !ok {
+			merged[k] = a
+		}
+	}
+	return merged
+}
+
+// Converts decoded JSON to a Lua value.
+func toLua(L *lua.LState, val interface{}) lua.LValue {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		tbl := L.NewTable()
+		for k, elt := range v {
+			tbl.RawSetString(k, toLua(L, elt))
+		}
+		return tbl
+	case []interface{}:
+		tbl := L.NewTable()
+		for _, elt := range v {
+			tbl.Append(toLua(L, elt))
+		}
+		return tbl
+	case string:
+		return lua.LString(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return lua.LNumber(f)
+	case float64:
+		return lua.LNumber(v)
+	case bool:
+		return lua.LBool(v)
+	}
+	return lua.LNil
+}
+
+// Converts a Lua value back to JSON.  Tables with keys 1..n become arrays.
+func fromLua(val lua.LValue) interface{} {
+	switch v := val.(type) {
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 {
+			arr := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				arr = append(arr, fromLua(v.RawGetInt(i)))
+			}
+			return arr
+		}
+		obj := map[string]interface{}{}
+		v.ForEach(func(k, elt lua.LValue) {
+			obj[k.String()] = fromLua(elt)
+		})
+		return obj
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LBool:
+		return bool(v)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package input
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Fields which don't survive a trip through Lua.
+const luaEvent = `{"id":"a","count":12345678901234567890,"ratio":1.50,` +
+	`"missing":null,"list":[],"nested":{"n":7}}` + "\n"
+
+func newTestLuaStage(t *testing.T, script string) *luaStage {
+	dir, err := ioutil.TempDir("", "lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "script.lua")
+	if err := ioutil.WriteFile(path, []byte(script), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LUA_SCRIPT", path)
+	os.Setenv("LUA_STATES", "1")
+	defer os.Unsetenv("LUA_SCRIPT")
+	defer os.Unsetenv("LUA_STATES")
+
+	st, err := newLuaStage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.(*luaStage)
+}
+
+func TestLuaUnchangedEvent(t *testing.T) {
+	l := newTestLuaStage(t, `function process(event) return event end`)
+	e := &event{data: []byte(luaEvent)}
+	if !l.process(e) {
+		t.Fatal("event dropped")
+	}
+	if got := string(e.bytes()); got != luaEvent {
+		t.Errorf("got %s, want %s", got, luaEvent)
+	}
+}
+
+func TestLuaChangedEvent(t *testing.T) {
+	l := newTestLuaStage(t, `function process(event)
+	event.action = "seen"
+	event.id = nil
+	return event
+end`)
+	e := &event{data: []byte(luaEvent)}
+	if !l.process(e) {
+		t.Fatal("event dropped")
+	}
+	got := string(e.bytes())
+	for _, want := range []string{`"action":"seen"`, `"count":12345678901234567890`,
+		`"ratio":1.50`, `"missing":null`, `"list":[]`, `"nested":{"n":7}`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s missing from %s", want, got)
+		}
+	}
+	if strings.Contains(got, `"id"`) {
+		t.Errorf("id not removed: %s", got)
+	}
+}
@@ -0,0 +1,87 @@
+// Handling of lines which aren't JSON objects.  MALFORMED_EVENTS chooses what
+// happens to them: "forward" passes them on untouched, as the bridge always
+// has, "drop" discards them and "quarantine" sends them to the reject output.
+// Either way they're counted, by the action taken.  In strict mode they're
+// dropped unless told otherwise.
+//
+// Forwarded lines skip the stages which work on an event's fields, but not
+// the gatekeepers, HMAC and schema checks, which reject them as they would
+// any event failing the check.
+
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type malformedStage struct {
+	action    string
+	malformed prometheus.Counter
+}
+
+func newMalformedStage() (stage, error) {
+	action := utils.Getenv("MALFORMED_EVENTS", "")
+	if action == "" && strictMode() {
+		action = "drop"
+	}
+	switch action {
+	case "":
+		return nil, nil
+	case "forward", "drop", "quarantine":
+	default:
+		return nil, fmt.Errorf("MALFORMED_EVENTS: unknown action %q", action)
+	}
+
+	counter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "malformed_events",
+			Help: "Events which aren't valid JSON objects, by the action taken",
+		},
+		[]string{"action"},
+	)
+	mustRegister(counter)
+
+	return &malformedStage{
+		action:    action,
+		malformed: counter.With(prometheus.Labels{"action": action}),
+	}, nil
+}
+
+// Reports whether a line holds a JSON object.
+func wellFormed(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '{' && json.Valid(data)
+}
+
+func (m *malformedStage) process(e *event) bool {
+	if wellFormed(e.data) {
+		return true
+	}
+	m.malformed.Inc()
+	switch m.action {
+	case "drop":
+		e.output = ""
+		e.problem = "invalid JSON"
+		return false
+	case "quarantine":
+		return reject(e, "invalid JSON")
+	}
+
+	// Only the gatekeepers have anything to do with it.
+	e.malformed = true
+	return true
+}
+
+// Implemented by stages which check events are fit to forward, and so must
+// see malformed ones too.
+type gatekeeper interface {
+	checksMalformed()
+}
+
+func (h *hmacStage) checksMalformed()   {}
+func (v *schemaStage) checksMalformed() {}
@@ -0,0 +1,495 @@
+// NetFlow v9 and IPFIX collector, for pipelines with "source": "netflow",
+// so the routers and switches near the probes needn't export to a collector
+// of their own.  The pipeline's port is a UDP port taking both versions, and
+// each flow record becomes an event:
+//
+//   {"id": "...", "action": "netflow", "source": "netflow",
+//    "device": "10.0.0.254", "time": "2024-01-02T03:04:05.000Z",
+//    "src": ["ipv4:10.0.0.1", "tcp:51234"],
+//    "dest": ["ipv4:192.0.2.1", "tcp:443"],
+//    "netflow": {"version": 10, "bytes": 5120, "packets": 12,
+//                "protocol": 6, "tcp_flags": 27, "start": "...", ...}}
+//
+// the device being the exporter and the time when the flow ended.  Templates
+// are learned per exporter and observation domain, and records arriving
+// before their template are dropped and counted.  Options templates, and
+// their records, are ignored.  At most NETFLOW_MAX_TEMPLATES templates and
+// NETFLOW_MAX_EXPORTERS exporters are remembered, templates beyond that
+// being ignored, so a flood of spoofed exporters can't exhaust memory.
+//
+// The socket is bound with SO_REUSEPORT with REUSE_PORT=true, which
+// upgrades need for the new process to bind it before the old one lets go.
+
+package input
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	NETFLOW_MAX_TEMPLATES = "10000"
+	NETFLOW_MAX_EXPORTERS = "1000"
+)
+
+var (
+	netflowPackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "netflow_packets",
+			Help: "NetFlow and IPFIX packets received, by version",
+		},
+		[]string{"version"},
+	)
+	netflowRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "netflow_records",
+			Help: "Flow records received, by what became of them",
+		},
+		[]string{"result"},
+	)
+	netflowErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "netflow_packet_errors",
+		Help: "NetFlow and IPFIX packets which couldn't be read",
+	})
+)
+
+// How a field's value is given.
+const (
+	flowNumber = iota
+	flowAddress
+)
+
+// The fields read from flow records, by information element.  NetFlow v9
+// and IPFIX number those they share alike.
+var flowFields = map[uint16]struct {
+	name string
+	kind int
+}{
+	1:   {"bytes", flowNumber},
+	2:   {"packets", flowNumber},
+	4:   {"protocol", flowNumber},
+	5:   {"tos", flowNumber},
+	6:   {"tcp_flags", flowNumber},
+	7:   {"src_port", flowNumber},
+	8:   {"src_ip", flowAddress},
+	10:  {"input_if", flowNumber},
+	11:  {"dest_port", flowNumber},
+	12:  {"dest_ip", flowAddress},
+	14:  {"output_if", flowNumber},
+	15:  {"next_hop", flowAddress},
+	16:  {"src_as", flowNumber},
+	17:  {"dest_as", flowNumber},
+	21:  {"last_switched", flowNumber},
+	22:  {"first_switched", flowNumber},
+	23:  {"out_bytes", flowNumber},
+	24:  {"out_packets", flowNumber},
+	27:  {"src_ip", flowAddress},
+	28:  {"dest_ip", flowAddress},
+	58:  {"vlan", flowNumber},
+	61:  {"direction", flowNumber},
+	62:  {"next_hop", flowAddress},
+	150: {"start_seconds", flowNumber},
+	151: {"end_seconds", flowNumber},
+	152: {"start_ms", flowNumber},
+	153: {"end_ms", flowNumber},
+}
+
+type flowTemplateKey struct {
+	exporter string
+	domain   uint32
+	id       uint16
+}
+
+type flowTemplateField struct {
+	id     uint16
+	length uint16
+
+	// Enterprise specific elements are skipped.
+	enterprise bool
+}
+
+// Length IPFIX gives variable length fields in templates.
+const flowVariableLength = 65535
+
+// State of a source, only touched by its reading goroutine.
+type netflowCollector struct {
+	templates    map[flowTemplateKey][]flowTemplateField
+	maxTemplates int
+	maxExporters int
+
+	// One client per exporter, for the stages keeping state per client.
+	clients map[string]*client
+}
+
+var errFlowTruncated = errors.New("truncated")
+
+// Binds a UDP socket for a NetFlow source.
+func listenUDP(addr string) (*net.UDPConn, error) {
+	var lc net.ListenConfig
+	if utils.Getenv("REUSE_PORT", "") == "true" {
+		var err error
+		lc.Control, err = reusePort("REUSE_PORT")
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// Collects flows for a pipeline in the background.
+func (s *Service) startNetFlowSource(conn *net.UDPConn, p *pipeline) {
+	mustRegister(netflowPackets, netflowRecords, netflowErrors)
+	s.waitGroup.Add(1)
+	go func() {
+		defer s.waitGroup.Done()
+		s.collectFlows(conn, p)
+	}()
+}
+
+// Reads flow packets until stopped or handed over.  Records arriving while
+// draining or on standby are dropped, exporters not waiting for an answer.
+func (s *Service) collectFlows(conn *net.UDPConn, p *pipeline) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.handedOff:
+		case <-ctx.Done():
+		}
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	c := &netflowCollector{
+		templates: map[flowTemplateKey][]flowTemplateField{},
+		clients:   map[string]*client{},
+	}
+	var err error
+	c.maxTemplates, err = strconv.Atoi(utils.Getenv("NETFLOW_MAX_TEMPLATES", NETFLOW_MAX_TEMPLATES))
+	if err != nil || c.maxTemplates < 1 {
+		utils.Log("ERROR: NETFLOW_MAX_TEMPLATES: must be a positive number")
+		return
+	}
+	c.maxExporters, err = strconv.Atoi(utils.Getenv("NETFLOW_MAX_EXPORTERS", NETFLOW_MAX_EXPORTERS))
+	if err != nil || c.maxExporters < 1 {
+		utils.Log("ERROR: NETFLOW_MAX_EXPORTERS: must be a positive number")
+		return
+	}
+	forwarded := netflowRecords.With(prometheus.Labels{"result": "forwarded"})
+	refused := netflowRecords.With(prometheus.Labels{"result": "refused"})
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+				utils.Log("INFO: Stopping NetFlow source %s", p.Name)
+			} else {
+				utils.Log("ERROR: NetFlow source %s failed: %s", p.Name, err.Error())
+			}
+			return
+		}
+		received := time.Now()
+		records, err := c.packet(addr.IP.String(), buf[:n])
+		if err != nil {
+			netflowErrors.Inc()
+			continue
+		}
+		if !s.accepting() {
+			refused.Add(float64(len(records)))
+			continue
+		}
+		cl := c.client(addr)
+		for _, rec := range records {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				continue
+			}
+			e := &event{
+				data:     append(data, '\n'),
+				output:   p.Outputs[0],
+				remote:   addr,
+				client:   cl,
+				pipeline: p,
+				received: received,
+			}
+			s.process(e)
+			s.send(e)
+		}
+		forwarded.Add(float64(len(records)))
+	}
+}
+
+func (c *netflowCollector) client(addr *net.UDPAddr) *client {
+	exporter := addr.IP.String()
+	cl, ok := c.clients[exporter]
+	if !ok {
+		if len(c.clients) >= c.maxExporters {
+			// Start afresh rather than grow without limit; the
+			// state forgotten is only per-client stage state.
+			c.clients = map[string]*client{}
+		}
+		cl = &client{
+			id:     nextConnection(),
+			remote: addr,
+			state:  map[stage]interface{}{},
+		}
+		c.clients[exporter] = cl
+	}
+	return cl
+}
+
+// Reads a packet, learning its templates and returning the events of its
+// flow records.
+func (c *netflowCollector) packet(exporter string, b []byte) ([]map[string]interface{}, error) {
+	if len(b) < 4 {
+		return nil, errFlowTruncated
+	}
+	version := binary.BigEndian.Uint16(b)
+
+	// Exported and uptime place NetFlow v9's times, which are given in
+	// milliseconds of the exporter's uptime.
+	var exported time.Time
+	var uptime, domain uint32
+	var templateSet, optionsSet uint16
+	var sets []byte
+	switch version {
+	case 9:
+		if len(b) < 20 {
+			return nil, errFlowTruncated
+		}
+		uptime = binary.BigEndian.Uint32(b[4:])
+		exported = time.Unix(int64(binary.BigEndian.Uint32(b[8:])), 0)
+		domain = binary.BigEndian.Uint32(b[16:])
+		templateSet, optionsSet = 0, 1
+		sets = b[20:]
+	case 10:
+		if len(b) < 16 {
+			return nil, errFlowTruncated
+		}
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		if length < 16 || length > len(b) {
+			return nil, errFlowTruncated
+		}
+		b = b[:length]
+		exported = time.Unix(int64(binary.BigEndian.Uint32(b[4:])), 0)
+		domain = binary.BigEndian.Uint32(b[12:])
+		templateSet, optionsSet = 2, 3
+		sets = b[16:]
+	default:
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	netflowPackets.With(prometheus.Labels{"version": fmt.Sprint(version)}).Inc()
+
+	var events []map[string]interface{}
+	for len(sets) >= 4 {
+		id := binary.BigEndian.Uint16(sets)
+		length := int(binary.BigEndian.Uint16(sets[2:]))
+		if length < 4 || length > len(sets) {
+			return nil, errFlowTruncated
+		}
+		body := sets[4:length]
+		sets = sets[length:]
+
+		switch {
+		case id == templateSet:
+			if err := c.learn(exporter, domain, version, body); err != nil {
+				return nil, err
+			}
+		case id == optionsSet, id < 256:
+		default:
+			fields, ok := c.templates[flowTemplateKey{exporter, domain, id}]
+			if !ok {
+				netflowRecords.With(prometheus.Labels{"result": "no_template"}).Inc()
+				continue
+			}
+			// Anything too short for another record is padding.
+			for len(body) > 0 {
+				rec := map[string]interface{}{}
+				n, ok := readFlowRecord(fields, body, rec)
+				if !ok || n == 0 {
+					break
+				}
+				body = body[n:]
+				events = append(events, flowEvent(version, exporter, exported, uptime, rec))
+			}
+		}
+	}
+	return events, nil
+}
+
+// Learns the templates in a template set.
+func (c *netflowCollector) learn(exporter string, domain uint32, version uint16, body []byte) error {
+	for len(body) >= 4 {
+		id := binary.BigEndian.Uint16(body)
+		count := int(binary.BigEndian.Uint16(body[2:]))
+		body = body[4:]
+		if id < 256 {
+			// Padding.
+			return nil
+		}
+		key := flowTemplateKey{exporter, domain, id}
+		if count == 0 {
+			// IPFIX withdraws a template by sending it empty.
+			delete(c.templates, key)
+			continue
+		}
+		fields := make([]flowTemplateField, 0, count)
+		for i := 0; i < count; i++ {
+			if len(body) < 4 {
+				return errFlowTruncated
+			}
+			f := flowTemplateField{
+				id:     binary.BigEndian.Uint16(body),
+				length: binary.BigEndian.Uint16(body[2:]),
+			}
+			body = body[4:]
+			if version == 10 && f.id&0x8000 != 0 {
+				if len(body) < 4 {
+					return errFlowTruncated
+				}
+				f.id &^= 0x8000
+				f.enterprise = true
+				body = body[4:]
+			}
+			fields = append(fields, f)
+		}
+		if _, known := c.templates[key]; !known && len(c.templates) >= c.maxTemplates {
+			netflowRecords.With(prometheus.Labels{"result": "template_overflow"}).Inc()
+			continue
+		}
+		c.templates[key] = fields
+	}
+	return nil
+}
+
+// Reads a record's fields into rec, returning its length, or false if
+// there isn't a whole record.
+func readFlowRecord(fields []flowTemplateField, b []byte, rec map[string]interface{}) (int, bool) {
+	off := 0
+	for _, f := range fields {
+		length := int(f.length)
+		if f.length == flowVariableLength {
+			if off >= len(b) {
+				return 0, false
+			}
+			length = int(b[off])
+			off++
+			if length == 255 {
+				if off+2 > len(b) {
+					return 0, false
+				}
+				length = int(binary.BigEndian.Uint16(b[off:]))
+				off += 2
+			}
+		}
+		if off+length > len(b) {
+			return 0, false
+		}
+		v := b[off : off+length]
+		off += length
+
+		known, ok := flowFields[f.id]
+		if f.enterprise || !ok {
+			continue
+		}
+		switch known.kind {
+		case flowAddress:
+			if length == net.IPv4len || length == net.IPv6len {
+				rec[known.name] = net.IP(append([]byte(nil), v...)).String()
+			}
+		case flowNumber:
+			if length <= 8 {
+				var n uint64
+				for _, x := range v {
+					n = n<<8 | uint64(x)
+				}
+				rec[known.name] = n
+			}
+		}
+	}
+	// A template of nothing would never end.
+	return off, off > 0
+}
+
+// Returns the event of a flow record.
+func flowEvent(version uint16, exporter string, exported time.Time, uptime uint32,
+	rec map[string]interface{}) map[string]interface{} {
+
+	take := func(name string) (uint64, bool) {
+		v, ok := rec[name].(uint64)
+		delete(rec, name)
+		return v, ok
+	}
+	// Times relative to the exporter's uptime, in NetFlow v9.
+	sinceBoot := func(ms uint64) time.Time {
+		return exported.Add(-time.Duration(uptime-uint32(ms)) * time.Millisecond)
+	}
+
+	var start, end time.Time
+	if v, ok := take("first_switched"); ok && version == 9 {
+		start = sinceBoot(v)
+	}
+	if v, ok := take("last_switched"); ok && version == 9 {
+		end = sinceBoot(v)
+	}
+	if v, ok := take("start_seconds"); ok {
+		start = time.Unix(int64(v), 0)
+	}
+	if v, ok := take("end_seconds"); ok {
+		end = time.Unix(int64(v), 0)
+	}
+	if v, ok := take("start_ms"); ok {
+		start = time.Unix(0, int64(v)*int64(time.Millisecond))
+	}
+	if v, ok := take("end_ms"); ok {
+		end = time.Unix(0, int64(v)*int64(time.Millisecond))
+	}
+	if !start.IsZero() {
+		rec["start"] = start.UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+	if end.IsZero() {
+		end = exported
+	}
+	rec["end"] = end.UTC().Format("2006-01-02T15:04:05.000Z")
+	rec["version"] = version
+
+	ev := map[string]interface{}{
+		"id":     randomEventID(),
+		"action": "netflow",
+		"source": "netflow",
+		"device": exporter,
+		"time":   rec["end"],
+	}
+	proto := ""
+	switch rec["protocol"] {
+	case uint64(6):
+		proto = "tcp"
+	case uint64(17):
+		proto = "udp"
+	}
+	srcPort, _ := take("src_port")
+	destPort, _ := take("dest_port")
+	if src := addressList(rec["src_ip"], float64(srcPort), proto); src != nil {
+		ev["src"] = src
+		delete(rec, "src_ip")
+	}
+	if dest := addressList(rec["dest_ip"], float64(destPort), proto); dest != nil {
+		ev["dest"] = dest
+		delete(rec, "dest_ip")
+	}
+	ev["netflow"] = rec
+	return ev
+}
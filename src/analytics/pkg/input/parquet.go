@@ -0,0 +1,365 @@
+// Parquet output, writing events to columnar files for an analytics lake to
+// query directly.  PARQUET_OUTPUT names the output, whose events are written
+// under PARQUET_DIR rather than published, partitioned by event time and
+// device as
+//
+//   dt=2006-01-02/hour=15/device=<device>/<instance>-<n>.parquet
+//
+// The fields every event has are columns of their own, src and dest lists,
+// and the rest of the event is kept as JSON in the detail column.
+//
+// Each partition's file is finished once it's been open PARQUET_ROLL_INTERVAL
+// or has PARQUET_MAX_EVENTS events, and when the bridge stops.  Until then
+// it's named .tmp.  At most PARQUET_MAX_OPEN files are open at once, the one
+// written least recently being finished to make room, and events timestamped
+// more than PARQUET_TIME_WINDOW from when they were read are partitioned by
+// the time read, so probes can't open files without limit.  With PARQUET_UPLOAD_URL set, finished files are PUT
+// under that URL, such as https://storage.googleapis.com/<bucket>/events,
+// with the bearer token in PARQUET_UPLOAD_TOKEN_FILE if set, and removed
+// once uploaded.  Files which fail to upload are tried again at the next
+// roll.
+
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	PARQUET_ROLL_INTERVAL = "5m"
+	PARQUET_MAX_EVENTS    = "1000000"
+	PARQUET_MAX_OPEN      = "64"
+	PARQUET_TIME_WINDOW   = "24h"
+)
+
+const parquetSchema = `{
+  "Tag": "name=event, repetitiontype=REQUIRED",
+  "Fields": [
+    {"Tag": "name=id, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=action, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=device, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=network, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=origin, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=time, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=url, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"},
+    {"Tag": "name=src, type=LIST, repetitiontype=OPTIONAL", "Fields": [
+      {"Tag": "name=element, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED"}
+    ]},
+    {"Tag": "name=dest, type=LIST, repetitiontype=OPTIONAL", "Fields": [
+      {"Tag": "name=element, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED"}
+    ]},
+    {"Tag": "name=risk, type=DOUBLE, repetitiontype=OPTIONAL"},
+    {"Tag": "name=detail, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"}
+  ]
+}`
+
+type parquetFile struct {
+	path   string
+	file   source.ParquetFile
+	writer *writer.JSONWriter
+	count  int
+	opened time.Time
+
+	// When last written, for finishing the least recently used.
+	written time.Time
+}
+
+type parquetSink struct {
+	name      string
+	dir       string
+	roll      time.Duration
+	maxEvents int
+	maxOpen   int
+	window    time.Duration
+	upload    string
+	tokenFile string
+	client    *http.Client
+
+	mutex sync.Mutex
+	files map[string]*parquetFile
+	seq   uint64
+
+	done     chan bool
+	finished *prometheus.CounterVec
+}
+
+// Returns the Parquet output, nil if PARQUET_OUTPUT isn't set.
+func newParquetSink() (*parquetSink, error) {
+	name := utils.Getenv("PARQUET_OUTPUT", "")
+	if name == "" {
+		return nil, nil
+	}
+	dir := utils.Getenv("PARQUET_DIR", "")
+	if dir == "" {
+		return nil, fmt.Errorf("PARQUET_DIR: must be set with PARQUET_OUTPUT")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("PARQUET_DIR: %s", err.Error())
+	}
+	roll, err := time.ParseDuration(utils.Getenv("PARQUET_ROLL_INTERVAL",
+		PARQUET_ROLL_INTERVAL))
+	if err != nil {
+		return nil, fmt.Errorf("PARQUET_ROLL_INTERVAL: %s", err.Error())
+	}
+	maxEvents, err := strconv.Atoi(utils.Getenv("PARQUET_MAX_EVENTS", PARQUET_MAX_EVENTS))
+	if err != nil || maxEvents < 1 {
+		return nil, fmt.Errorf("PARQUET_MAX_EVENTS: must be a positive number")
+	}
+	maxOpen, err := strconv.Atoi(utils.Getenv("PARQUET_MAX_OPEN", PARQUET_MAX_OPEN))
+	if err != nil || maxOpen < 1 {
+		return nil, fmt.Errorf("PARQUET_MAX_OPEN: must be a positive number")
+	}
+	window, err := time.ParseDuration(utils.Getenv("PARQUET_TIME_WINDOW", PARQUET_TIME_WINDOW))
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("PARQUET_TIME_WINDOW: must be a positive duration")
+	}
+
+	p := &parquetSink{
+		name:      name,
+		dir:       dir,
+		roll:      roll,
+		maxEvents: maxEvents,
+		maxOpen:   maxOpen,
+		window:    window,
+		upload:    strings.TrimRight(utils.Getenv("PARQUET_UPLOAD_URL", ""), "/"),
+		tokenFile: utils.Getenv("PARQUET_UPLOAD_TOKEN_FILE", ""),
+		client:    &http.Client{Timeout: 5 * time.Minute},
+		files:     map[string]*parquetFile{},
+		done:      make(chan bool),
+		finished: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "parquet_files",
+				Help: "Parquet files finished, and uploaded",
+			},
+			[]string{"state"},
+		),
+	}
+	mustRegister(p.finished)
+	utils.Log("INFO: Output %s written as Parquet to %s", name, dir)
+	go p.run()
+	return p, nil
+}
+
+// Writes an event to its partition's file.
+func (p *parquetSink) add(msg []byte, received time.Time) error {
+	env, err := splitEnvelope(msg)
+	if err != nil {
+		return err
+	}
+	t, err := parseEventTime(env.strings["time"])
+	if err != nil || t.Sub(received) > p.window || received.Sub(t) > p.window {
+		t = received
+	}
+	device := env.strings["device"]
+	if device == "" {
+		device = "unknown"
+	}
+	t = t.UTC()
+	partition := fmt.Sprintf("dt=%s/hour=%s/device=%s",
+		t.Format("2006-01-02"), t.Format("15"), url.PathEscape(device))
+
+	row := map[string]interface{}{}
+	for name, s := range env.strings {
+		row[name] = s
+	}
+	if env.src != nil {
+		row["src"] = env.src
+	}
+	if env.dest != nil {
+		row["dest"] = env.dest
+	}
+	if env.risk != 0 {
+		row["risk"] = env.risk
+	}
+	if env.detail != nil {
+		row["detail"] = string(env.detail)
+	}
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f, ok := p.files[partition]
+	if !ok {
+		if len(p.files) >= p.maxOpen {
+			p.finishLeastRecent()
+		}
+		f, err = p.open(partition)
+		if err != nil {
+			return err
+		}
+		p.files[partition] = f
+	}
+	if err := f.writer.Write(string(data)); err != nil {
+		return err
+	}
+	f.count++
+	f.written = time.Now()
+	if f.count >= p.maxEvents {
+		delete(p.files, partition)
+		return p.finish(f)
+	}
+	return nil
+}
+
+func (p *parquetSink) open(partition string) (*parquetFile, error) {
+	dir := filepath.Join(p.dir, filepath.FromSlash(partition))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%d.parquet", instanceID, atomic.AddUint64(&p.seq, 1))
+	path := filepath.Join(dir, name)
+	file, err := local.NewLocalFileWriter(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	w, err := writer.NewJSONWriter(parquetSchema, file, 4)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetFile{path: path, file: file, writer: w, opened: time.Now()}, nil
+}
+
+// Finishes the file written least recently.  Called with the mutex held.
+func (p *parquetSink) finishLeastRecent() {
+	var oldest string
+	for partition, f := range p.files {
+		if oldest == "" || f.written.Before(p.files[oldest].written) {
+			oldest = partition
+		}
+	}
+	if f, ok := p.files[oldest]; ok {
+		delete(p.files, oldest)
+		p.finish(f)
+	}
+}
+
+// Completes a file and gives it its final name.
+func (p *parquetSink) finish(f *parquetFile) error {
+	err := f.writer.WriteStop()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		utils.Log("ERROR: Unable to write %s: %s", f.path, err.Error())
+		return err
+	}
+	p.finished.With(prometheus.Labels{"state": "written"}).Inc()
+	return os.Rename(f.path+".tmp", f.path)
+}
+
+// Finishes files as they're due and uploads them, until closed.
+func (p *parquetSink) run() {
+	ticker := time.NewTicker(p.roll / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.mutex.Lock()
+		for partition, f := range p.files {
+			if time.Since(f.opened) >= p.roll {
+				delete(p.files, partition)
+				p.finish(f)
+			}
+		}
+		p.mutex.Unlock()
+		p.uploadFinished()
+	}
+}
+
+// Uploads every finished file, removing those uploaded.
+func (p *parquetSink) uploadFinished() {
+	if p.upload == "" {
+		return
+	}
+	filepath.Walk(p.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".parquet") {
+			return nil
+		}
+		rel, err := filepath.Rel(p.dir, path)
+		if err != nil {
+			return nil
+		}
+		if err := p.put(path, filepath.ToSlash(rel)); err != nil {
+			utils.Log("WARN: Unable to upload %s: %s", rel, err.Error())
+			return nil
+		}
+		p.finished.With(prometheus.Labels{"state": "uploaded"}).Inc()
+		os.Remove(path)
+		return nil
+	})
+}
+
+func (p *parquetSink) put(path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", p.upload+"/"+name, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/vnd.apache.parquet")
+	if p.tokenFile != "" {
+		token, err := ioutil.ReadFile(p.tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("upload answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Finishes and uploads every file.
+func (p *parquetSink) close() {
+	if p == nil {
+		return
+	}
+	close(p.done)
+	p.mutex.Lock()
+	for partition, f := range p.files {
+		delete(p.files, partition)
+		p.finish(f)
+	}
+	p.mutex.Unlock()
+	p.uploadFinished()
+}
@@ -0,0 +1,111 @@
+// Limits on the packet payloads some events carry, base64 encoded, so a
+// burst of bulky streams doesn't fill the output queues.  PAYLOAD_MODE is
+// one of
+//
+//   cap    payloads are cut to PAYLOAD_MAX_SIZE bytes, decoded
+//   strip  payloads are removed
+//   hash   payloads are replaced by the SHA-256 digest of their bytes, as
+//          <field>_sha256
+//
+// and the payload's decoded length is kept as <field>_length in each case.
+// PAYLOAD_FIELDS lists the dotted paths of the payloads, by default those
+// of cybermon's events and the etsi source's packets.
+
+package input
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	PAYLOAD_FIELDS = "payload,unrecognised_stream.payload," +
+		"unrecognised_datagram.payload,icmp.payload,http_request.body," +
+		"http_response.body,smtp_data.data"
+	PAYLOAD_MAX_SIZE = "1024"
+)
+
+type payloadStage struct {
+	mode    string
+	maxSize int
+	fields  [][]string
+	removed prometheus.Counter
+}
+
+func newPayloadStage() (stage, error) {
+	mode := utils.Getenv("PAYLOAD_MODE", "")
+	switch mode {
+	case "":
+		return nil, nil
+	case "cap", "strip", "hash":
+	default:
+		return nil, fmt.Errorf("PAYLOAD_MODE: expected cap, strip or hash, got %q", mode)
+	}
+	maxSize, err := strconv.Atoi(utils.Getenv("PAYLOAD_MAX_SIZE", PAYLOAD_MAX_SIZE))
+	if err != nil || maxSize < 0 {
+		return nil, fmt.Errorf("PAYLOAD_MAX_SIZE: must be a number of bytes")
+	}
+	p := &payloadStage{
+		mode:    mode,
+		maxSize: maxSize,
+		fields:  fieldPaths(utils.Getenv("PAYLOAD_FIELDS", PAYLOAD_FIELDS)),
+		removed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "payload_bytes_removed",
+			Help: "Bytes of encoded payloads cut, stripped or hashed",
+		}),
+	}
+	mustRegister(p.removed)
+	utils.Log("INFO: Payloads handled with mode %s", mode)
+	return p, nil
+}
+
+func (p *payloadStage) process(e *event) bool {
+	// An event smaller than the cap can't have a payload over it, and
+	// needn't be decoded to find out.
+	if p.mode == "cap" && !e.dirty && len(e.data) <= p.maxSize {
+		return true
+	}
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	for _, path := range p.fields {
+		walkPath(fields, path, func(parent map[string]interface{}, key string) {
+			encoded, ok := parent[key].(string)
+			if !ok {
+				return
+			}
+			data, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				// Not base64 after all, taken as it is.
+				data = []byte(encoded)
+			}
+			switch p.mode {
+			case "cap":
+				if len(data) <= p.maxSize {
+					return
+				}
+				capped := base64.StdEncoding.EncodeToString(data[:p.maxSize])
+				p.removed.Add(float64(len(encoded) - len(capped)))
+				parent[key] = capped
+			case "strip":
+				p.removed.Add(float64(len(encoded)))
+				delete(parent, key)
+			case "hash":
+				sum := sha256.Sum256(data)
+				p.removed.Add(float64(len(encoded)))
+				delete(parent, key)
+				parent[key+"_sha256"] = hex.EncodeToString(sum[:])
+			}
+			parent[key+"_length"] = len(data)
+			e.modified()
+		})
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+// The most recent events, for confirming what's arriving without access to
+// the store.  With PEEK_SIZE set, that many of the latest events forwarded
+// are kept, as processed and so redacted as configured, and GET /admin/peek
+// returns them oldest first, one per line.  ?n= returns only the latest n.
+
+package input
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type peekBuffer struct {
+	mutex  sync.Mutex
+	events [][]byte
+	next   int
+	full   bool
+}
+
+// Returns the buffer, nil unless PEEK_SIZE is set.
+func newPeekBuffer() (*peekBuffer, error) {
+	n, err := strconv.Atoi(utils.Getenv("PEEK_SIZE", "0"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("PEEK_SIZE: must be a number")
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return &peekBuffer{events: make([][]byte, n)}, nil
+}
+
+// Keeps a copy of an event, in place of the oldest.
+func (p *peekBuffer) add(data []byte) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.events[p.next] = append(p.events[p.next][:0], data...)
+	p.next++
+	if p.next == len(p.events) {
+		p.next, p.full = 0, true
+	}
+}
+
+// Returns copies of up to n of the latest events, oldest first.
+func (p *peekBuffer) latest(n int) [][]byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	count := p.next
+	if p.full {
+		count = len(p.events)
+	}
+	if n > count {
+		n = count
+	}
+	out := make([][]byte, 0, n)
+	for i := n; i > 0; i-- {
+		j := (p.next - i + len(p.events)) % len(p.events)
+		out = append(out, append([]byte(nil), p.events[j]...))
+	}
+	return out
+}
+
+func (s *Service) peekHandler(w http.ResponseWriter, r *http.Request) {
+	if s.peek == nil {
+		http.Error(w, "PEEK_SIZE not set", http.StatusNotFound)
+		return
+	}
+	n := len(s.peek.events)
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "n: must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	s.audit.record("peek", r.RemoteAddr, "")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	for _, data := range s.peek.latest(n) {
+		w.Write(data)
+	}
+}
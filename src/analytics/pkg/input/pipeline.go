@@ -0,0 +1,319 @@
+// Processing applied to events between the socket and the outputs.
+//
+// The flow is described as pipelines, each a source, the stages it applies
+// and its outputs.  PIPELINES_FILE lists them as a JSON array of:
+//
+//   {"name": "probes", "source": "tcp", "port": 48879,
+//    "stages": ["redact"], "outputs": ["kafka"], "queue_size": 10000}
+//
+// The source is "tcp", for probe connections, "http", for events POSTed
+// as in httpsource.go, "netflow", for flows exported as in netflow.go, or
+// "etsi", for cyberprobe's ETSI LI delivery as in etsi.go.
+// Stages are named as in stageConstructors and must be configured in the
+// environment as usual; each pipeline applies those it lists, in its order.
+// Events go to every output listed, unless a stage routes them elsewhere or
+// a tenant has its own.  Without PIPELINES_FILE there's the one pipeline,
+// from TCP_PORT through every configured stage to "output".
+//
+// A pipeline's "format" names what its source receives, if that isn't
+// cybermon's events: "eve" for Suricata's EVE JSON or "zeek" for Zeek's JSON
+// logs.  Records are converted as in formatConstructors before the
+// pipeline's stages.
+//
+// Pipelines run side by side, each with its own listeners, send queues and
+// metrics, so collectors for several destinations can share a process.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// A stage is one step applied to each event.  Stages are shared by all
+// connections so must be safe for concurrent use.  Returning false ends
+// processing of the event, which is then sent to e.output as it stands, or
+// discarded if that is empty.
+type stage interface {
+	process(e *event) bool
+}
+
+// Sends a message to a named output.
+type sendFunc func(output string, msg []byte)
+
+// Stages which generate messages of their own, rather than only passing on
+// events, implement this to be given the means to send them once the
+// service is running.  They stop when ctx is done, sending what they hold,
+// and call wg.Done once they've finished sending.
+type generator interface {
+	start(ctx context.Context, wg *sync.WaitGroup, send sendFunc)
+}
+
+// Constructors for the optional stages, by the names pipelines use, in the
+// default processing order.  Each returns nil if the stage isn't configured.
+var stageConstructors = []struct {
+	name string
+	new  func() (stage, error)
+}{
+	{"malformed", newMalformedStage},
+	{"hmac", newHMACStage},
+	{"schema", newSchemaStage},
+	{"sequence", newSequenceStage},
+	{"clock", newClockStage},
+	{"aggregate", newAggregateStage},
+	{"flow", newFlowStage},
+
+	// Filtering and routing
+	{"actions", newActionStage},
+	{"stale", newStaleStage},
+	{"dedup", newDedupStage},
+	{"cel", newCELStage},
+	{"sample", newSampleStage},
+
+	// Enrichment
+	{"geoip", newGeoIPStage},
+	{"asn", newASNStage},
+	{"rdns", newRDNSStage},
+	{"useragent", newUserAgentStage},
+	{"fingerprint", newFingerprintStage},
+	{"dnscorrelate", newDNSCorrelateStage},
+	{"url", newURLStage},
+	{"stamp", newStampStage},
+	{"ioc", newIOCStage},
+
+	// Detection, over the enriched event
+	{"sigma", newSigmaStage},
+
+	// Scripting
+	{"lua", newLuaStage},
+	{"plugins", newPluginStage},
+
+	// Data minimisation, last so enrichment still sees the real values
+	// and redaction applies to what it added.
+	{"payload", newPayloadStage},
+	{"pseudonymize", newPseudonymizeStage},
+	{"redact", newRedactStage},
+}
+
+// Converters of the formats pipelines may receive, by name, into cybermon's
+// events.
+var formatConstructors = map[string]func() (stage, error){
+	"eve":  newEVEFormat,
+	"zeek": newZeekFormat,
+}
+
+var pipelineSources = map[string]bool{
+	"tcp":     true,
+	"http":    true,
+	"netflow": true,
+	"etsi":    true,
+}
+
+type pipeline struct {
+	Name    string   `json:"name"`
+	Source  string   `json:"source"`
+	Port    int      `json:"port"`
+	Stages  []string `json:"stages"`
+	Outputs []string `json:"outputs"`
+
+	// Format of the events received, empty for cybermon's.
+	Format string `json:"format"`
+
+	// Size of the pipeline's send queues, 0 for SEND_QUEUE_SIZE.
+	QueueSize int `json:"queue_size"`
+
+	stages []stage
+	events prometheus.Counter
+
+	// Output receiving events rejected as invalid.  If empty they're
+	// dropped.
+	rejectOutput string
+}
+
+var pipelineEvents = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pipeline_events",
+		Help: "Events received by each pipeline",
+	},
+	[]string{"pipeline"},
+)
+
+// Ends processing of an invalid event, routing it to its pipeline's reject
+// output.
+func reject(e *event, problem string) bool {
+	e.output = ""
+	if e.pipeline != nil {
+		e.output = e.pipeline.rejectOutput
+	}
+	e.problem = problem
+	return false
+}
+
+// Builds the configured stages, and the pipelines using them.
+func newPipelines() ([]stage, []*pipeline, error) {
+	var stages []stage
+	named := map[string]stage{}
+	for _, c := range stageConstructors {
+		st, err := c.new()
+		if err != nil {
+			return nil, nil, err
+		}
+		if st != nil {
+			stages = append(stages, st)
+			named[c.name] = st
+		}
+	}
+	utils.Log("INFO: %d processing stages configured", len(stages))
+	mustRegister(pipelineEvents)
+	rejectOutput := utils.Getenv("REJECT_OUTPUT", "")
+
+	path := utils.Getenv("PIPELINES_FILE", "")
+	if path == "" {
+		// Defaults to listen on 127.0.0.1:48879.  That's my favorite port
+		// number because in hex 48879 is 0xBEEF.
+		port, err := strconv.Atoi(utils.Getenv("TCP_PORT", PORT))
+		if err != nil {
+			return nil, nil, fmt.Errorf("TCP_PORT: must be a number")
+		}
+		return stages, []*pipeline{{
+			Name:    "default",
+			Source:  "tcp",
+			Port:    port,
+			Outputs: []string{"output"},
+			stages:  stages,
+			events:  pipelineEvents.With(prometheus.Labels{"pipeline": "default"}),
+
+			rejectOutput: rejectOutput,
+		}}, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pipelines []*pipeline
+	if err := json.Unmarshal(data, &pipelines); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if len(pipelines) == 0 {
+		return nil, nil, fmt.Errorf("%s: no pipelines", path)
+	}
+	names := map[string]bool{}
+	for _, p := range pipelines {
+		switch {
+		case p.Name == "":
+			return nil, nil, fmt.Errorf("%s: pipeline without a name", path)
+		case !pipelineSources[p.Source]:
+			return nil, nil, fmt.Errorf("%s: %s: unknown source %q", path, p.Name, p.Source)
+		case p.Port <= 0:
+			return nil, nil, fmt.Errorf("%s: %s: no port", path, p.Name)
+		case len(p.Outputs) == 0:
+			return nil, nil, fmt.Errorf("%s: %s: no outputs", path, p.Name)
+		case names[p.Name]:
+			return nil, nil, fmt.Errorf("%s: %s: more than one pipeline of that name",
+				path, p.Name)
+		}
+		names[p.Name] = true
+		if p.Format != "" && p.Format != "cybermon" {
+			constructor, ok := formatConstructors[p.Format]
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: %s: unknown format %q", path, p.Name, p.Format)
+			}
+			convert, err := constructor()
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %s: %s", path, p.Name, err.Error())
+			}
+			p.stages = append(p.stages, convert)
+		}
+		p.events = pipelineEvents.With(prometheus.Labels{"pipeline": p.Name})
+		p.rejectOutput = rejectOutput
+		for _, name := range p.Stages {
+			st, ok := named[name]
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: %s: stage %s isn't configured",
+					path, p.Name, name)
+			}
+			p.stages = append(p.stages, st)
+		}
+		utils.Log("INFO: Pipeline %s: %s :%d, %d stages, to %v", p.Name, p.Source,
+			p.Port, len(p.stages), p.Outputs)
+	}
+	return stages, pipelines, nil
+}
+
+// Starts the stages which generate messages.
+func (s *Service) startGenerators() {
+	// Queued like any event, so they're encoded for their output.
+	send := func(output string, msg []byte) {
+		s.sender.enqueue(&event{
+			data:     msg,
+			output:   output,
+			received: time.Now(),
+		})
+	}
+	for _, st := range s.stages {
+		if g, ok := st.(generator); ok {
+			s.waitGroup.Add(1)
+			g.start(s.ctx, s.waitGroup, send)
+		}
+	}
+}
+
+// Run an event through its pipeline's stages, the first pipeline's if it
+// didn't come from a source.
+func (s *Service) process(e *event) {
+	start := time.Now()
+	if e.pipeline == nil {
+		e.pipeline = s.pipelines[0]
+	}
+	e.pipeline.events.Inc()
+	for _, st := range e.pipeline.stages {
+		if _, ok := st.(gatekeeper); e.malformed && !ok {
+			continue
+		}
+		if !st.process(e) {
+			break
+		}
+	}
+
+	// Encode here rather than in a sender, so the work is spread over the
+	// connections and the event isn't changed once queued.
+	e.bytes()
+	s.sender.observe("process", time.Since(start))
+}
+
+// Queue a processed event for sending, or discard it if it's been dropped.
+// The event mustn't be touched afterwards, its buffer may have been reused.
+func (s *Service) send(e *event) {
+	if e.output == "" {
+		e.release()
+		return
+	}
+	if p := e.pipeline; p != nil && e.output == p.Outputs[0] {
+		for _, output := range p.Outputs[1:] {
+			s.sender.enqueue(&event{
+				data:      append([]byte(nil), e.data...),
+				output:    output,
+				remote:    e.remote,
+				client:    e.client,
+				pipeline:  e.pipeline,
+				received:  e.received,
+				malformed: e.malformed,
+			})
+		}
+	}
+	if s.tail.active() {
+		s.tail.publish(e.data)
+	}
+	s.peek.add(e.data)
+	s.top.add(e.data)
+	s.sender.enqueue(e)
+}
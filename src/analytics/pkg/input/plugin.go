@@ -0,0 +1,256 @@
+// External plugins, for processing and outputs which don't belong in this
+// repository.  A plugin is a program run by the bridge which reads events,
+// one JSON object per line, on its stdin and answers each with one line on
+// its stdout.  Any language will do.
+//
+// PLUGIN_STAGES lists processing plugins, run in order after the Lua script,
+// as name=command pairs separated by ';', for example
+//
+//   PLUGIN_STAGES="tagger=/opt/plugins/tagger --db /data/tags"
+//
+// Each answers with the event to forward, changed or not, or an empty line
+// to drop it.
+//
+// PLUGIN_OUTPUTS lists outputs delivered by a plugin rather than the queue
+// worker, in the same form, the name being that of the output.  Each
+// answers "ok" once the event is delivered, or else a line describing the
+// failure.
+//
+// PLUGIN_INSTANCES copies of each plugin are run, each started when first
+// needed and handling one event at a time, so one slow event holds up only
+// its own copy.  An event waiting for a free copy, or whose copy doesn't
+// answer, for PLUGIN_TIMEOUT is given up on and forwarded unchanged, or for
+// an output counted as failed; a copy which fails or doesn't answer is
+// killed and started again for its next event.
+
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	PLUGIN_TIMEOUT   = "1s"
+	PLUGIN_INSTANCES = "4"
+)
+
+type pluginProcess struct {
+	name    string
+	args    []string
+	timeout time.Duration
+	errors  prometheus.Counter
+
+	// Copies not handling an event.
+	idle chan *pluginInstance
+}
+
+// One running copy of a plugin, nil cmd until started.
+type pluginInstance struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+var pluginErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "plugin_errors",
+		Help: "Plugin failures and timeouts",
+	},
+	[]string{"plugin"},
+)
+
+// Parses a list of name=command plugins from an environment variable.
+func newPlugins(env string) ([]*pluginProcess, error) {
+	v := utils.Getenv(env, "")
+	if v == "" {
+		return nil, nil
+	}
+	timeout, err := time.ParseDuration(utils.Getenv("PLUGIN_TIMEOUT", PLUGIN_TIMEOUT))
+	if err != nil {
+		return nil, fmt.Errorf("PLUGIN_TIMEOUT: %s", err.Error())
+	}
+	instances, err := strconv.Atoi(utils.Getenv("PLUGIN_INSTANCES", PLUGIN_INSTANCES))
+	if err != nil || instances < 1 {
+		return nil, fmt.Errorf("PLUGIN_INSTANCES: must be a positive number")
+	}
+	mustRegister(pluginErrors)
+
+	var plugins []*pluginProcess
+	for _, spec := range strings.Split(v, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		i := strings.Index(spec, "=")
+		var args []string
+		if i > 0 {
+			args = strings.Fields(spec[i+1:])
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s: expected name=command, got %q", env, spec)
+		}
+		name := strings.TrimSpace(spec[:i])
+		p := &pluginProcess{
+			name:    name,
+			args:    args,
+			timeout: timeout,
+			errors:  pluginErrors.With(prometheus.Labels{"plugin": name}),
+			idle:    make(chan *pluginInstance, instances),
+		}
+		for n := 0; n < instances; n++ {
+			p.idle <- &pluginInstance{}
+		}
+		plugins = append(plugins, p)
+		utils.Log("INFO: Plugin %s: %s, %d instances", name, strings.Join(args, " "),
+			instances)
+	}
+	return plugins, nil
+}
+
+func (pi *pluginInstance) start(args []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pi.cmd, pi.stdin, pi.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+func (pi *pluginInstance) kill() {
+	if pi.cmd == nil {
+		return
+	}
+	pi.stdin.Close()
+	pi.cmd.Process.Kill()
+	go pi.cmd.Wait()
+	pi.cmd = nil
+}
+
+// Passes an event to a free copy of the plugin, returning its answer.  Gives
+// up after the plugin's timeout, counting the wait for a copy, or sooner if
+// ctx is done.
+func (p *pluginProcess) call(ctx context.Context, msg []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var pi *pluginInstance
+	select {
+	case pi = <-p.idle:
+	case <-ctx.Done():
+		p.errors.Inc()
+		return nil, fmt.Errorf("none free: %s", ctx.Err().Error())
+	}
+	defer func() { p.idle <- pi }()
+
+	if pi.cmd == nil {
+		if err := pi.start(p.args); err != nil {
+			p.errors.Inc()
+			return nil, err
+		}
+	}
+	if !bytes.HasSuffix(msg, []byte("\n")) {
+		msg = append(msg[:len(msg):len(msg)], '\n')
+	}
+
+	type answer struct {
+		line []byte
+		err  error
+	}
+	ch := make(chan answer, 1)
+	stdin, stdout := pi.stdin, pi.stdout
+	go func() {
+		if _, err := stdin.Write(msg); err != nil {
+			ch <- answer{nil, err}
+			return
+		}
+		line, err := stdout.ReadBytes('\n')
+		ch <- answer{line, err}
+	}()
+
+	var a answer
+	select {
+	case a = <-ch:
+	case <-ctx.Done():
+		a.err = fmt.Errorf("no answer: %s", ctx.Err().Error())
+	}
+	if a.err != nil {
+		utils.Log("WARN: Plugin %s failed: %s", p.name, a.err.Error())
+		p.errors.Inc()
+		pi.kill()
+		return nil, a.err
+	}
+	return a.line, nil
+}
+
+// Delivers an event through an output plugin.
+func (p *pluginProcess) send(ctx context.Context, msg []byte) error {
+	line, err := p.call(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if answer := strings.TrimSpace(string(line)); answer != "ok" {
+		return errors.New(answer)
+	}
+	return nil
+}
+
+type pluginStage struct {
+	plugins []*pluginProcess
+}
+
+func newPluginStage() (stage, error) {
+	plugins, err := newPlugins("PLUGIN_STAGES")
+	if err != nil || plugins == nil {
+		return nil, err
+	}
+	return &pluginStage{plugins: plugins}, nil
+}
+
+func (ps *pluginStage) process(e *event) bool {
+	for _, p := range ps.plugins {
+		line, err := p.call(context.Background(), e.bytes())
+		if err != nil {
+			continue
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			e.output = ""
+			return false
+		}
+		e.replace(line)
+	}
+	return true
+}
+
+// Returns the output plugins by output name.
+func newPluginOutputs() (map[string]*pluginProcess, error) {
+	plugins, err := newPlugins("PLUGIN_OUTPUTS")
+	if err != nil {
+		return nil, err
+	}
+	outputs := map[string]*pluginProcess{}
+	for _, p := range plugins {
+		outputs[p.name] = p
+	}
+	return outputs, nil
+}
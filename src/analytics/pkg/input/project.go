@@ -0,0 +1,134 @@
+// Field projection, for outputs which only need part of each event.
+// OUTPUT_FIELDS lists the fields kept for such outputs as output=fields
+// pairs separated by ';', the fields being dotted paths separated by ',',
+// for example
+//
+//   OUTPUT_FIELDS="realtime=id,action,device,time,src,dest,http_request.method"
+//
+// keeps the bulky bodies and headers out of the real-time queue, while other
+// outputs such as an archive still get the whole event.  A path reaching
+// into an array keeps that field of each element.  Projection comes before
+// any encoding, and the bytes it saves are counted.
+
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// The fields kept, by name, with those kept of each.  A nil projection
+// keeps the whole field.
+type projection map[string]projection
+
+var projectedBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "projected_bytes_removed",
+		Help: "Bytes of events left out of outputs by field projection",
+	},
+	[]string{"output"},
+)
+
+// Returns the projection of each output listed in OUTPUT_FIELDS.
+func newProjections() (map[string]projection, error) {
+	v := utils.Getenv("OUTPUT_FIELDS", "")
+	if v == "" {
+		return nil, nil
+	}
+	mustRegister(projectedBytes)
+	mustRegister(encodeErrors)
+
+	projections := map[string]projection{}
+	for _, spec := range strings.Split(v, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		i := strings.Index(spec, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("OUTPUT_FIELDS: expected output=fields, got %q", spec)
+		}
+		output := strings.TrimSpace(spec[:i])
+		p := projection{}
+		for _, path := range fieldPaths(spec[i+1:]) {
+			p.add(path)
+		}
+		if len(p) == 0 {
+			return nil, fmt.Errorf("OUTPUT_FIELDS: no fields for %s", output)
+		}
+		projections[output] = p
+		utils.Log("INFO: Output %s limited to fields %s", output, spec[i+1:])
+	}
+	return projections, nil
+}
+
+func (p projection) add(path []string) {
+	sub, seen := p[path[0]]
+	if len(path) == 1 {
+		// The whole field, whatever else was asked for.
+		p[path[0]] = nil
+		return
+	}
+	if seen && sub == nil {
+		return
+	}
+	if sub == nil {
+		sub = projection{}
+		p[path[0]] = sub
+	}
+	sub.add(path[1:])
+}
+
+// Returns the part of a node the projection keeps.
+func (p projection) apply(node interface{}) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, sub := range p {
+			v, ok := n[k]
+			if !ok {
+				continue
+			}
+			if sub == nil {
+				out[k] = v
+			} else {
+				out[k] = sub.apply(v)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(n))
+		for i, v := range n {
+			out[i] = p.apply(v)
+		}
+		return out
+	}
+	return node
+}
+
+// Returns the event with only the output's fields.
+func (s *sender) project(output string, msg []byte) ([]byte, error) {
+	p, ok := s.projections[output]
+	if !ok {
+		return msg, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(p.apply(fields))
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, '\n')
+	if removed := len(msg) - len(data); removed > 0 {
+		projectedBytes.With(prometheus.Labels{"output": output}).Add(float64(removed))
+	}
+	return data, nil
+}
@@ -0,0 +1,138 @@
+// Protobuf output encoding, smaller and cheaper to parse than JSON.  Events
+// are encoded as the Event message in proto/event.proto: the fields every
+// cyberprobe event has are typed, and the rest of the event is kept as JSON
+// in detail, so nothing is lost.  The wire format is simple enough to write
+// directly; the field numbers are generated from the schema, in
+// event_fields.go, so the two can't drift apart.
+
+package input
+
+//go:generate go run ../../internal/protofields -message Event -prefix protobufEvent -package input -o event_fields.go ../../proto/event.proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// An event split into the common fields, typed, and the rest as JSON.
+type eventEnvelope struct {
+	strings   map[string]string
+	src, dest []string
+	risk      float64
+
+	// The rest of the event as a JSON object, nil if there's nothing else.
+	detail []byte
+}
+
+// Splits an event into its envelope.  Fields of unexpected types are left
+// in detail.
+func splitEnvelope(msg []byte) (*eventEnvelope, error) {
+	// Numbers are kept as they are for detail.
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	env := &eventEnvelope{strings: map[string]string{}}
+	for _, f := range protobufEventStrings {
+		if s, ok := fields[f.name].(string); ok {
+			env.strings[f.name] = s
+			delete(fields, f.name)
+		}
+	}
+	addresses := func(name string) []string {
+		list, ok := fields[name].([]interface{})
+		if !ok {
+			return nil
+		}
+		addrs := make([]string, 0, len(list))
+		for _, v := range list {
+			s, ok := v.(string)
+			if !ok {
+				return nil
+			}
+			addrs = append(addrs, s)
+		}
+		delete(fields, name)
+		return addrs
+	}
+	env.src = addresses("src")
+	env.dest = addresses("dest")
+	if n, ok := fields["risk"].(json.Number); ok {
+		if risk, err := n.Float64(); err == nil {
+			env.risk = risk
+			delete(fields, "risk")
+		}
+	}
+
+	if len(fields) > 0 {
+		detail, err := json.Marshal(fields)
+		if err != nil {
+			return nil, fmt.Errorf("detail: %s", err.Error())
+		}
+		env.detail = detail
+	}
+	return env, nil
+}
+
+const (
+	protobufVarint  = 0
+	protobufFixed64 = 1
+	protobufBytes   = 2
+)
+
+type protobufEncoder struct{}
+
+func newProtobufEncoder() (encoder, error) {
+	return protobufEncoder{}, nil
+}
+
+func appendProtobufVarint(buf []byte, n uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], n)]...)
+}
+
+func appendProtobufTag(buf []byte, number, wireType uint64) []byte {
+	return appendProtobufVarint(buf, number<<3|wireType)
+}
+
+func appendProtobufBytes(buf []byte, number uint64, b []byte) []byte {
+	buf = appendProtobufTag(buf, number, protobufBytes)
+	buf = appendProtobufVarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func (protobufEncoder) encode(msg []byte) ([]byte, error) {
+	env, err := splitEnvelope(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	for _, f := range protobufEventStrings {
+		if s := env.strings[f.name]; s != "" {
+			buf = appendProtobufBytes(buf, f.number, []byte(s))
+		}
+	}
+	for _, addr := range env.src {
+		buf = appendProtobufBytes(buf, protobufEventSrc, []byte(addr))
+	}
+	for _, addr := range env.dest {
+		buf = appendProtobufBytes(buf, protobufEventDest, []byte(addr))
+	}
+	if env.risk != 0 {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(env.risk))
+		buf = appendProtobufTag(buf, protobufEventRisk, protobufFixed64)
+		buf = append(buf, b[:]...)
+	}
+	if env.detail != nil {
+		buf = appendProtobufBytes(buf, protobufEventDetail, env.detail)
+	}
+	return buf, nil
+}
@@ -0,0 +1,129 @@
+// Pseudonymisation of IP addresses, so analysts don't see raw subscriber
+// addresses but the same address always maps to the same pseudonym.  The
+// addresses at PSEUDONYMIZE_FIELDS are rewritten using the secret
+// PSEUDONYMIZE_KEY, in one of two PSEUDONYMIZE_MODEs:
+//
+//   prefix  prefix-preserving: addresses sharing an n bit prefix map to
+//           pseudonyms sharing an n bit prefix, so subnets stay visible
+//   hash    a keyed hash of the whole address
+//
+// Both keep the address family.
+
+package input
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	PSEUDONYMIZE_FIELDS = "src,dest"
+	PSEUDONYMIZE_MODE   = "prefix"
+
+	// Bound on the number of cached pseudonyms.
+	pseudonymCacheSize = 100000
+)
+
+type pseudonymizeStage struct {
+	key    []byte
+	fields [][]string
+	prefix bool
+
+	mutex sync.Mutex
+	cache map[string]net.IP
+}
+
+func newPseudonymizeStage() (stage, error) {
+	key := utils.Getenv("PSEUDONYMIZE_KEY", "")
+	if key == "" {
+		return nil, nil
+	}
+	p := &pseudonymizeStage{
+		key:    []byte(key),
+		fields: fieldPaths(utils.Getenv("PSEUDONYMIZE_FIELDS", PSEUDONYMIZE_FIELDS)),
+		cache:  map[string]net.IP{},
+	}
+	switch mode := utils.Getenv("PSEUDONYMIZE_MODE", PSEUDONYMIZE_MODE); mode {
+	case "prefix":
+		p.prefix = true
+	case "hash":
+	default:
+		return nil, fmt.Errorf("PSEUDONYMIZE_MODE: unknown mode %q", mode)
+	}
+	return p, nil
+}
+
+func (p *pseudonymizeStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	for _, path := range p.fields {
+		walkPath(fields, path, func(parent map[string]interface{}, key string) {
+			parent[key] = mapAddresses(parent[key], p.pseudonym)
+			e.modified()
+		})
+	}
+	return true
+}
+
+func (p *pseudonymizeStage) pseudonym(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	p.mutex.Lock()
+	cached, ok := p.cache[string(ip)]
+	p.mutex.Unlock()
+	if ok {
+		return cached
+	}
+
+	var out net.IP
+	if p.prefix {
+		out = p.prefixPreserving(ip)
+	} else {
+		mac := hmac.New(sha256.New, p.key)
+		mac.Write(ip)
+		out = net.IP(mac.Sum(nil)[:len(ip)])
+	}
+
+	p.mutex.Lock()
+	if len(p.cache) >= pseudonymCacheSize {
+		p.cache = map[string]net.IP{}
+	}
+	p.cache[string(ip)] = out
+	p.mutex.Unlock()
+	return out
+}
+
+// Each output bit is the input bit flipped by a keyed function of the bits
+// before it, in the manner of Crypto-PAn.
+func (p *pseudonymizeStage) prefixPreserving(ip net.IP) net.IP {
+	out := make(net.IP, len(ip))
+	prefix := make([]byte, len(ip)+1)
+	for i := 0; i < len(ip)*8; i++ {
+		byteIdx, bit := i/8, byte(0x80)>>uint(i%8)
+
+		// The prefix is the first i bits of the input, plus its length
+		// so that different lengths never collide.
+		prefix[len(ip)] = byte(i)
+		mac := hmac.New(sha256.New, p.key)
+		mac.Write(prefix)
+		flip := mac.Sum(nil)[0]&1 == 1
+
+		in := ip[byteIdx]&bit != 0
+		if in != flip {
+			out[byteIdx] |= bit
+		}
+		if in {
+			prefix[byteIdx] |= bit
+		}
+	}
+	return out
+}
@@ -0,0 +1,363 @@
+// Delivery to the outputs.  The bridge publishes through a Publisher, given
+// to NewService, so embedders can supply their own and tests a fake.  The
+// analytics-common queue worker is the usual one.
+//
+// Normally the bridge won't start unless the worker can reach its queues.
+// With LAZY_OUTPUTS=true it starts regardless, trying again every
+// OUTPUT_RETRY_INTERVAL in the background.  Connections are accepted
+// meanwhile, their events waiting in the send queues, which hold them
+// until the outputs are attached or SEND_TIMEOUT is up, and reads are held
+// up once the queues fill.  Every publish waits at most SEND_TIMEOUT for the
+// outputs, failing if they haven't been attached, and publishes still
+// waiting at shutdown fail at once.  The bridge isn't ready until the
+// outputs are attached.
+//
+// The worker stays connected to the broker addresses it resolved at the
+// start, so after OUTPUT_RECONNECT_FAILURES publishes in a row fail it's
+// replaced by a new one, resolving and connecting afresh, and with
+// OUTPUT_RECONNECT_INTERVAL set it's replaced that often regardless, for a
+// broker which moves without the old address failing.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+)
+
+const (
+	OUTPUT_RETRY_INTERVAL     = "5s"
+	OUTPUT_RECONNECT_FAILURES = "5"
+	OUTPUT_RECONNECT_INTERVAL = "0"
+)
+
+// Publisher delivers messages to named outputs.  Send must be safe for
+// concurrent use, and mustn't keep msg after returning.  A Publisher whose
+// outputs carry message keys may also implement SendKeyed, as in sender.go.
+type Publisher interface {
+	Send(output string, msg []uint8) error
+}
+
+// Makes a Publisher of the queue worker, for outputs given as on the
+// command line, such as "output:/queue/input".
+func NewWorkerPublisher(outputs []string) (Publisher, error) {
+	maxFailures, err := strconv.Atoi(utils.Getenv("OUTPUT_RECONNECT_FAILURES",
+		OUTPUT_RECONNECT_FAILURES))
+	if err != nil || maxFailures < 1 {
+		return nil, fmt.Errorf("OUTPUT_RECONNECT_FAILURES: must be a positive number")
+	}
+	interval, err := time.ParseDuration(utils.Getenv("OUTPUT_RECONNECT_INTERVAL",
+		OUTPUT_RECONNECT_INTERVAL))
+	if err != nil || interval < 0 {
+		return nil, fmt.Errorf("OUTPUT_RECONNECT_INTERVAL: must be a duration")
+	}
+	w, err := newWorker(outputs)
+	if err != nil {
+		return nil, err
+	}
+	r := &reconnectingPublisher{
+		outputs:     outputs,
+		maxFailures: maxFailures,
+		interval:    interval,
+		p:           w,
+		connected:   time.Now(),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "output_reconnects",
+			Help: "Queue worker connections replaced",
+		}),
+	}
+	mustRegister(r.reconnects)
+	return r, nil
+}
+
+// Connects a queue worker to outputs.  A variable so tests can stand in a
+// fake.
+var newWorker = func(outputs []string) (Publisher, error) {
+	var w worker.Worker
+	err := w.Initialise(outputs)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// The queue worker, replaced by a new one when publishes keep failing or
+// it's been connected for the interval.
+type reconnectingPublisher struct {
+	outputs     []string
+	maxFailures int
+	interval    time.Duration
+
+	mutex        sync.Mutex
+	p            Publisher
+	failures     int
+	connected    time.Time
+	reconnecting bool
+
+	reconnects prometheus.Counter
+}
+
+func (r *reconnectingPublisher) Send(output string, msg []uint8) error {
+	return r.publish(func(p Publisher) error {
+		return p.Send(output, msg)
+	})
+}
+
+func (r *reconnectingPublisher) SendKeyed(output, key string, msg []uint8) error {
+	return r.publish(func(p Publisher) error {
+		if kp, ok := p.(keyedPublisher); ok {
+			return kp.SendKeyed(output, key, msg)
+		}
+		return p.Send(output, msg)
+	})
+}
+
+func (r *reconnectingPublisher) SendWithHeaders(output, key string, headers map[string]string, msg []uint8) error {
+	return r.publish(func(p Publisher) error {
+		if hp, ok := p.(headerPublisher); ok {
+			return hp.SendWithHeaders(output, key, headers, msg)
+		}
+		if kp, ok := p.(keyedPublisher); ok && key != "" {
+			return kp.SendKeyed(output, key, msg)
+		}
+		return p.Send(output, msg)
+	})
+}
+
+func (r *reconnectingPublisher) SendContext(ctx context.Context, output string, msg []uint8) error {
+	return r.publish(func(p Publisher) error {
+		if cp, ok := p.(contextPublisher); ok {
+			return cp.SendContext(ctx, output, msg)
+		}
+		return p.Send(output, msg)
+	})
+}
+
+// Publishes through the current worker with send, counting failures and
+// reconnecting when due.
+func (r *reconnectingPublisher) publish(send func(p Publisher) error) error {
+	r.mutex.Lock()
+	p := r.p
+	r.mutex.Unlock()
+
+	err := send(p)
+
+	r.mutex.Lock()
+	if err == nil {
+		r.failures = 0
+	} else {
+		r.failures++
+	}
+	due := r.failures >= r.maxFailures ||
+		(r.interval > 0 && time.Since(r.connected) >= r.interval)
+	if !due || r.reconnecting {
+		r.mutex.Unlock()
+		return err
+	}
+	r.reconnecting = true
+	r.mutex.Unlock()
+
+	// Publishes carry on through the old worker meanwhile.
+	go r.reconnect()
+	return err
+}
+
+func (r *reconnectingPublisher) reconnect() {
+	w, err := newWorker(r.outputs)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reconnecting = false
+	r.failures = 0
+	r.connected = time.Now()
+	if err != nil {
+		utils.Log("WARN: Unable to reconnect outputs: %s", err.Error())
+		return
+	}
+	if c, ok := r.p.(io.Closer); ok {
+		c.Close()
+	}
+	r.p = w
+	r.reconnects.Inc()
+	utils.Log("INFO: Outputs reconnected")
+}
+
+// Implemented by Publishers which attach to their outputs in the
+// background.
+type lazyOutputs interface {
+	// Reports whether the outputs have been attached.
+	attached() bool
+
+	// Gives up waiting for them, failing publishes still waiting.
+	abandon()
+}
+
+var errOutputsAbandoned = errors.New("outputs never attached")
+
+// Makes a Publisher of the queue worker which connects in the background,
+// retrying every interval until it can.  Publishes wait until it has, for
+// at most timeout unless that's 0.
+func NewLazyWorkerPublisher(outputs []string, interval, timeout time.Duration) Publisher {
+	l := &lazyPublisher{
+		ready:     make(chan struct{}),
+		abandoned: make(chan struct{}),
+		timeout:   timeout,
+		connected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "outputs_connected",
+			Help: "Whether the outputs have been attached",
+		}),
+	}
+	mustRegister(l.connected)
+	go l.connect(outputs, interval)
+	return l
+}
+
+type lazyPublisher struct {
+	// Closed once p is set.
+	ready chan struct{}
+	p     Publisher
+
+	// Closed when the bridge stops.
+	abandoned   chan struct{}
+	abandonOnce sync.Once
+
+	timeout time.Duration
+
+	connected prometheus.Gauge
+}
+
+func (l *lazyPublisher) connect(outputs []string, interval time.Duration) {
+	for {
+		p, err := NewWorkerPublisher(outputs)
+		if err == nil {
+			l.p = p
+			close(l.ready)
+			l.connected.Set(1)
+			utils.Log("INFO: Outputs attached")
+			return
+		}
+		utils.Log("WARN: Outputs unavailable, retrying in %s: %s",
+			interval, err.Error())
+		select {
+		case <-l.abandoned:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (l *lazyPublisher) attached() bool {
+	select {
+	case <-l.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *lazyPublisher) abandon() {
+	l.abandonOnce.Do(func() {
+		close(l.abandoned)
+	})
+}
+
+// Waits for the outputs to be attached, for at most the timeout.
+func (l *lazyPublisher) wait(ctx context.Context) error {
+	if l.attached() {
+		return nil
+	}
+	var timeout <-chan time.Time
+	if l.timeout > 0 {
+		t := time.NewTimer(l.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-l.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.abandoned:
+		return errOutputsAbandoned
+	case <-timeout:
+		return fmt.Errorf("outputs not attached within %s", l.timeout)
+	}
+}
+
+func (l *lazyPublisher) Send(output string, msg []uint8) error {
+	if err := l.wait(context.Background()); err != nil {
+		return err
+	}
+	return l.p.Send(output, msg)
+}
+
+func (l *lazyPublisher) SendKeyed(output, key string, msg []uint8) error {
+	if err := l.wait(context.Background()); err != nil {
+		return err
+	}
+	if kp, ok := l.p.(keyedPublisher); ok {
+		return kp.SendKeyed(output, key, msg)
+	}
+	return l.p.Send(output, msg)
+}
+
+func (l *lazyPublisher) SendWithHeaders(output, key string, headers map[string]string, msg []uint8) error {
+	if err := l.wait(context.Background()); err != nil {
+		return err
+	}
+	if hp, ok := l.p.(headerPublisher); ok {
+		return hp.SendWithHeaders(output, key, headers, msg)
+	}
+	if kp, ok := l.p.(keyedPublisher); ok && key != "" {
+		return kp.SendKeyed(output, key, msg)
+	}
+	return l.p.Send(output, msg)
+}
+
+func (l *lazyPublisher) SendContext(ctx context.Context, output string, msg []uint8) error {
+	if err := l.wait(ctx); err != nil {
+		return err
+	}
+	if cp, ok := l.p.(contextPublisher); ok {
+		return cp.SendContext(ctx, output, msg)
+	}
+	return l.p.Send(output, msg)
+}
+
+// Makes the worker Publisher for Main, lazily if LAZY_OUTPUTS is set.
+func newPublisher(outputs []string) (Publisher, error) {
+	if utils.Getenv("LAZY_OUTPUTS", "") != "true" {
+		return NewWorkerPublisher(outputs)
+	}
+	interval, err := time.ParseDuration(utils.Getenv("OUTPUT_RETRY_INTERVAL",
+		OUTPUT_RETRY_INTERVAL))
+	if err != nil {
+		return nil, fmt.Errorf("OUTPUT_RETRY_INTERVAL: %s", err.Error())
+	}
+	var timeout time.Duration
+	if v := utils.Getenv("SEND_TIMEOUT", ""); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("SEND_TIMEOUT: %s", err.Error())
+		}
+	}
+	return NewLazyWorkerPublisher(outputs, interval, timeout), nil
+}
+
+// Makes a Service publishing through the queue worker.
+func newWorkerService(outputs []string) (*Service, error) {
+	p, err := NewWorkerPublisher(outputs)
+	if err != nil {
+		return nil, err
+	}
+	return NewService(p, outputs)
+}
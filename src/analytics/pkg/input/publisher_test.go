@@ -0,0 +1,118 @@
+package input
+
+import (
+	"context"
+	"testing"
+)
+
+type fakeSend struct {
+	method, output, key string
+	headers             map[string]string
+	ctx                 context.Context
+}
+
+// A worker taking keys, headers and contexts, recording how it was called.
+type fakeWorker struct {
+	sent []fakeSend
+}
+
+func (f *fakeWorker) Send(output string, msg []uint8) error {
+	f.sent = append(f.sent, fakeSend{method: "Send", output: output})
+	return nil
+}
+
+func (f *fakeWorker) SendKeyed(output, key string, msg []uint8) error {
+	f.sent = append(f.sent, fakeSend{method: "SendKeyed", output: output, key: key})
+	return nil
+}
+
+func (f *fakeWorker) SendWithHeaders(output, key string, headers map[string]string, msg []uint8) error {
+	f.sent = append(f.sent, fakeSend{method: "SendWithHeaders", output: output,
+		key: key, headers: headers})
+	return nil
+}
+
+func (f *fakeWorker) SendContext(ctx context.Context, output string, msg []uint8) error {
+	f.sent = append(f.sent, fakeSend{method: "SendContext", output: output, ctx: ctx})
+	return nil
+}
+
+// A worker only able to Send.
+type plainWorker struct {
+	sent int
+}
+
+func (p *plainWorker) Send(output string, msg []uint8) error {
+	p.sent++
+	return nil
+}
+
+func withWorker(t *testing.T, w Publisher) Publisher {
+	saved := newWorker
+	newWorker = func(outputs []string) (Publisher, error) { return w, nil }
+	defer func() { newWorker = saved }()
+	p, err := NewWorkerPublisher([]string{"output:/queue/input"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestWorkerPublisherPassesThrough(t *testing.T) {
+	w := &fakeWorker{}
+	p := withWorker(t, w)
+
+	kp, ok := p.(keyedPublisher)
+	if !ok {
+		t.Fatal("not a keyedPublisher")
+	}
+	hp, ok := p.(headerPublisher)
+	if !ok {
+		t.Fatal("not a headerPublisher")
+	}
+	cp, ok := p.(contextPublisher)
+	if !ok {
+		t.Fatal("not a contextPublisher")
+	}
+
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, 1)
+	headers := map[string]string{"h": "v"}
+	p.Send("a", nil)
+	kp.SendKeyed("b", "k1", nil)
+	hp.SendWithHeaders("c", "k2", headers, nil)
+	cp.SendContext(ctx, "d", nil)
+
+	if len(w.sent) != 4 {
+		t.Fatalf("got %d sends, want 4", len(w.sent))
+	}
+	want := []fakeSend{
+		{method: "Send", output: "a"},
+		{method: "SendKeyed", output: "b", key: "k1"},
+		{method: "SendWithHeaders", output: "c", key: "k2"},
+		{method: "SendContext", output: "d"},
+	}
+	for i, s := range w.sent {
+		if s.method != want[i].method || s.output != want[i].output || s.key != want[i].key {
+			t.Errorf("send %d: got %+v, want %+v", i, s, want[i])
+		}
+	}
+	if w.sent[2].headers["h"] != "v" {
+		t.Errorf("headers not passed: %v", w.sent[2].headers)
+	}
+	if w.sent[3].ctx != ctx {
+		t.Errorf("context not passed")
+	}
+}
+
+func TestWorkerPublisherFallsBack(t *testing.T) {
+	w := &plainWorker{}
+	p := withWorker(t, w)
+
+	p.(keyedPublisher).SendKeyed("a", "k", nil)
+	p.(headerPublisher).SendWithHeaders("a", "k", map[string]string{"h": "v"}, nil)
+	p.(contextPublisher).SendContext(context.Background(), "a", nil)
+	if w.sent != 3 {
+		t.Errorf("got %d sends, want 3", w.sent)
+	}
+}
@@ -0,0 +1,229 @@
+// Pushing metrics, for collectors which can't be scraped: short-lived ones,
+// or those behind NAT at the edge.  With METRICS_PUSH_URL set, every metric
+// is pushed there every METRICS_PUSH_INTERVAL, and once more at shutdown.
+// METRICS_PUSH_MODE is "pushgateway", the default, for a Prometheus
+// Pushgateway at that base URL, the metrics replacing the group
+//
+//   /metrics/job/<METRICS_PUSH_JOB>/instance/<instance>
+//
+// or "remote_write" for a Prometheus remote write endpoint, such as
+// Prometheus's own, Cortex or Thanos receive, the series carrying job and
+// instance labels.  METRICS_PUSH_TOKEN is sent as a bearer token if given.
+
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	METRICS_PUSH_MODE     = "pushgateway"
+	METRICS_PUSH_INTERVAL = "15s"
+	METRICS_PUSH_JOB      = "analytics-input"
+	METRICS_PUSH_TIMEOUT  = 10 * time.Second
+)
+
+type metricsPusher struct {
+	url    string
+	mode   string
+	job    string
+	token  string
+	client *http.Client
+
+	failures prometheus.Counter
+}
+
+// Starts pushing metrics, if there's somewhere to push them.
+func (s *Service) startMetricsPush() error {
+	u := utils.Getenv("METRICS_PUSH_URL", "")
+	if u == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(utils.Getenv("METRICS_PUSH_INTERVAL", METRICS_PUSH_INTERVAL))
+	if err != nil || interval <= 0 {
+		return fmt.Errorf("METRICS_PUSH_INTERVAL: must be a positive duration")
+	}
+	p := &metricsPusher{
+		url:    u,
+		mode:   utils.Getenv("METRICS_PUSH_MODE", METRICS_PUSH_MODE),
+		job:    utils.Getenv("METRICS_PUSH_JOB", METRICS_PUSH_JOB),
+		token:  utils.Getenv("METRICS_PUSH_TOKEN", ""),
+		client: &http.Client{Timeout: METRICS_PUSH_TIMEOUT},
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "metrics_push_failures",
+			Help: "Pushes of metrics which failed",
+		}),
+	}
+	switch p.mode {
+	case "pushgateway":
+		p.url = fmt.Sprintf("%s/metrics/job/%s/instance/%s",
+			u, url.PathEscape(p.job), url.PathEscape(instanceID))
+	case "remote_write":
+	default:
+		return fmt.Errorf("METRICS_PUSH_MODE: expected pushgateway or remote_write, got %q", p.mode)
+	}
+	mustRegister(p.failures)
+
+	utils.Log("INFO: Pushing metrics to %s every %s", u, interval)
+	s.waitGroup.Add(1)
+	go func() {
+		defer s.waitGroup.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				// The last word, for collectors which are going away.
+				p.push()
+				return
+			case <-ticker.C:
+				p.push()
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *metricsPusher) push() {
+	families, err := gatherer.Gather()
+	if err != nil {
+		utils.Log("WARN: Unable to gather metrics to push: %s", err.Error())
+		return
+	}
+	var req *http.Request
+	if p.mode == "remote_write" {
+		body := snappy.Encode(nil, p.writeRequest(families, time.Now()))
+		req, err = http.NewRequest("POST", p.url, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-protobuf")
+			req.Header.Set("Content-Encoding", "snappy")
+			req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		}
+	} else {
+		var buf bytes.Buffer
+		enc := expfmt.NewEncoder(&buf, expfmt.FmtText)
+		for _, f := range families {
+			if err := enc.Encode(f); err != nil {
+				utils.Log("WARN: Unable to encode metrics to push: %s", err.Error())
+				return
+			}
+		}
+		req, err = http.NewRequest("PUT", p.url, &buf)
+		if err == nil {
+			req.Header.Set("Content-Type", string(expfmt.FmtText))
+		}
+	}
+	if err == nil {
+		if p.token != "" {
+			req.Header.Set("Authorization", "Bearer "+p.token)
+		}
+		var resp *http.Response
+		resp, err = p.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("answered %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		p.failures.Inc()
+		utils.Log("WARN: Unable to push metrics: %s", err.Error())
+	}
+}
+
+// Returns the metrics as a remote write WriteRequest message.  Histograms
+// and summaries become their _bucket or quantile, _sum and _count series,
+// as a scrape would.
+func (p *metricsPusher) writeRequest(families []*dto.MetricFamily, now time.Time) []byte {
+	ms := now.UnixNano() / int64(time.Millisecond)
+	var buf []byte
+	add := func(name string, labels []*dto.LabelPair, extra []string, value float64) {
+		pairs := map[string]string{
+			"__name__": name,
+			"job":      p.job,
+			"instance": instanceID,
+		}
+		for _, l := range labels {
+			pairs[l.GetName()] = l.GetValue()
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			pairs[extra[i]] = extra[i+1]
+		}
+		// Labels have to be sorted by name.
+		names := make([]string, 0, len(pairs))
+		for n := range pairs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		var series []byte
+		for _, n := range names {
+			var label []byte
+			label = appendProtobufBytes(label, 1, []byte(n))
+			label = appendProtobufBytes(label, 2, []byte(pairs[n]))
+			series = appendProtobufBytes(series, 1, label)
+		}
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(value))
+		sample := appendProtobufTag(nil, 1, protobufFixed64)
+		sample = append(sample, b[:]...)
+		sample = appendProtobufTag(sample, 2, protobufVarint)
+		sample = appendProtobufVarint(sample, uint64(ms))
+		series = appendProtobufBytes(series, 2, sample)
+		buf = appendProtobufBytes(buf, 1, series)
+	}
+
+	for _, f := range families {
+		name := f.GetName()
+		for _, m := range f.GetMetric() {
+			labels := m.GetLabel()
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, labels, nil, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, labels, nil, m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", labels,
+						[]string{"le", metricFloat(b.GetUpperBound())},
+						float64(b.GetCumulativeCount()))
+				}
+				add(name+"_bucket", labels, []string{"le", "+Inf"}, float64(h.GetSampleCount()))
+				add(name+"_sum", labels, nil, h.GetSampleSum())
+				add(name+"_count", labels, nil, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				sm := m.GetSummary()
+				for _, q := range sm.GetQuantile() {
+					add(name, labels,
+						[]string{"quantile", metricFloat(q.GetQuantile())},
+						q.GetValue())
+				}
+				add(name+"_sum", labels, nil, sm.GetSampleSum())
+				add(name+"_count", labels, nil, float64(sm.GetSampleCount()))
+			default:
+				add(name, labels, nil, m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return buf
+}
+
+func metricFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,169 @@
+// Reverse DNS enrichment.  Addresses at RDNS_FIELDS are resolved to names
+// added under "rdns", keyed by field.  Lookups are cached, failures
+// included, for RDNS_CACHE_TTL, and an event waits at most RDNS_BUDGET for an
+// uncached answer; a slow lookup carries on in the background and serves
+// later events from the cache, so the ingest path never stalls on DNS.
+// Once RDNS_CACHE_SIZE addresses are cached the least recently used is
+// forgotten to make room.
+
+package input
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	RDNS_BUDGET         = "20ms"
+	RDNS_LOOKUP_TIMEOUT = "2s"
+	RDNS_CACHE_TTL      = "10m"
+	RDNS_CACHE_SIZE     = "100000"
+	RDNS_CONCURRENCY    = "32"
+)
+
+type rdnsEntry struct {
+	addr    string
+	name    string
+	expires time.Time
+	done    chan struct{}
+}
+
+type rdnsStage struct {
+	fields   [][]string
+	budget   time.Duration
+	timeout  time.Duration
+	ttl      time.Duration
+	size     int
+	lookups  chan struct{}
+	resolver *net.Resolver
+
+	// Cached entries, with a list from least to most recently used.
+	mutex sync.Mutex
+	cache map[string]*list.Element
+	order *list.List
+}
+
+func newRDNSStage() (stage, error) {
+	fields := fieldPaths(utils.Getenv("RDNS_FIELDS", ""))
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	r := &rdnsStage{
+		fields:   fields,
+		resolver: &net.Resolver{},
+		cache:    map[string]*list.Element{},
+		order:    list.New(),
+	}
+	var err error
+	if r.budget, err = time.ParseDuration(utils.Getenv("RDNS_BUDGET", RDNS_BUDGET)); err != nil {
+		return nil, err
+	}
+	if r.timeout, err = time.ParseDuration(utils.Getenv("RDNS_LOOKUP_TIMEOUT", RDNS_LOOKUP_TIMEOUT)); err != nil {
+		return nil, err
+	}
+	if r.ttl, err = time.ParseDuration(utils.Getenv("RDNS_CACHE_TTL", RDNS_CACHE_TTL)); err != nil {
+		return nil, err
+	}
+	if r.size, err = strconv.Atoi(utils.Getenv("RDNS_CACHE_SIZE", RDNS_CACHE_SIZE)); err != nil {
+		return nil, err
+	}
+	concurrency, err := strconv.Atoi(utils.Getenv("RDNS_CONCURRENCY", RDNS_CONCURRENCY))
+	if err != nil {
+		return nil, err
+	}
+	r.lookups = make(chan struct{}, concurrency)
+	return r, nil
+}
+
+func (r *rdnsStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	eachAddress(fields, r.fields, func(path string, ip net.IP) {
+		if name := r.lookup(ip.String()); name != "" {
+			annotate(fields, "rdns", path, name)
+			e.modified()
+		}
+	})
+	return true
+}
+
+// Returns the name for an address, or "" if there isn't one or it couldn't
+// be found within the budget.
+func (r *rdnsStage) lookup(addr string) string {
+	now := time.Now()
+
+	r.mutex.Lock()
+	var ent *rdnsEntry
+	if elt, ok := r.cache[addr]; ok {
+		ent = elt.Value.(*rdnsEntry)
+		r.order.MoveToBack(elt)
+	}
+	if ent == nil || now.After(ent.expires) {
+		ent = r.start(addr, now)
+		if ent == nil {
+			r.mutex.Unlock()
+			return ""
+		}
+	}
+	r.mutex.Unlock()
+
+	timer := time.NewTimer(r.budget)
+	defer timer.Stop()
+	select {
+	case <-ent.done:
+		return ent.name
+	case <-timer.C:
+		return ""
+	}
+}
+
+// Starts a background lookup, called with the mutex held.  Returns nil if
+// too many lookups are already in flight.
+func (r *rdnsStage) start(addr string, now time.Time) *rdnsEntry {
+	select {
+	case r.lookups <- struct{}{}:
+	default:
+		return nil
+	}
+
+	if elt, ok := r.cache[addr]; ok {
+		r.order.Remove(elt)
+		delete(r.cache, addr)
+	}
+	for len(r.cache) >= r.size && r.order.Len() > 0 {
+		front := r.order.Front()
+		delete(r.cache, front.Value.(*rdnsEntry).addr)
+		r.order.Remove(front)
+	}
+
+	// Expiry covers the lookup too, so a pending entry is waited on rather
+	// than restarted.
+	ent := &rdnsEntry{
+		addr:    addr,
+		expires: now.Add(r.timeout + r.ttl),
+		done:    make(chan struct{}),
+	}
+	r.cache[addr] = r.order.PushBack(ent)
+
+	go func() {
+		defer func() { <-r.lookups }()
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		names, err := r.resolver.LookupAddr(ctx, addr)
+		cancel()
+		if err == nil && len(names) > 0 {
+			ent.name = strings.TrimSuffix(names[0], ".")
+		}
+		close(ent.done)
+	}()
+	return ent
+}
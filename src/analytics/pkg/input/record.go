@@ -0,0 +1,267 @@
+// Recording what probes send, for offline analysis.  With RECORD_DIR set,
+// every byte read from a connection, after TLS, is also written to a file
+// there while being forwarded as usual.  RECORD_FROM limits recording to a
+// comma separated list of probe addresses.
+//
+// Files are named <probe>-<connection>-<opened>.<part>.raw, the part going
+// up each time RECORD_MAX_SIZE bytes have been written, if set.  With
+// RECORD_COMPRESS=true they're gzipped, and named .raw.gz.  A failure to
+// record is logged and recording of the connection stops; reading carries
+// on regardless.
+//
+// Recordings older than RECORD_RETENTION, if set, are removed.  With
+// RECORD_MAX_BYTES set, recording stops once the recordings in RECORD_DIR
+// come to that many bytes, and starts again once retention, or an
+// operator, has made room.  The directory is checked
+// every RECORD_SWEEP_INTERVAL.
+
+package input
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	RECORD_SWEEP_INTERVAL = time.Minute
+)
+
+type recorder struct {
+	// Bytes in the directory when last swept, and written since.  First
+	// for alignment, as it's used atomically.
+	used int64
+
+	// Set while over maxBytes.
+	full int32
+
+	dir       string
+	maxSize   int64
+	compress  bool
+	maxBytes  int64
+	retention time.Duration
+
+	// Probes recorded, all of them if empty.
+	from map[string]bool
+
+	recorded prometheus.Counter
+}
+
+func newRecorder() (*recorder, error) {
+	dir := utils.Getenv("RECORD_DIR", "")
+	if dir == "" {
+		return nil, nil
+	}
+	var maxSize int64
+	if v := utils.Getenv("RECORD_MAX_SIZE", ""); v != "" {
+		var err error
+		maxSize, err = parseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("RECORD_MAX_SIZE: %s", err.Error())
+		}
+	}
+	var maxBytes int64
+	if v := utils.Getenv("RECORD_MAX_BYTES", ""); v != "" {
+		var err error
+		maxBytes, err = parseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("RECORD_MAX_BYTES: %s", err.Error())
+		}
+	}
+	var retention time.Duration
+	if v := utils.Getenv("RECORD_RETENTION", ""); v != "" {
+		var err error
+		retention, err = time.ParseDuration(v)
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("RECORD_RETENTION: must be a positive duration")
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	r := &recorder{
+		dir:       dir,
+		maxSize:   maxSize,
+		compress:  utils.Getenv("RECORD_COMPRESS", "") == "true",
+		maxBytes:  maxBytes,
+		retention: retention,
+		from:      map[string]bool{},
+		recorded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "recorded_bytes",
+			Help: "Bytes read from probes and written to recordings",
+		}),
+	}
+	for _, p := range splitList(utils.Getenv("RECORD_FROM", "")) {
+		r.from[p] = true
+	}
+	mustRegister(r.recorded)
+	r.sweep()
+	utils.Log("INFO: Recording probe streams in %s", dir)
+	return r, nil
+}
+
+// Starts sweeping the recordings, if recording.
+func (s *Service) startRecordSweep() {
+	if s.recorder == nil {
+		return
+	}
+	s.waitGroup.Add(1)
+	go func() {
+		defer s.waitGroup.Done()
+		ticker := time.NewTicker(RECORD_SWEEP_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.recorder.sweep()
+			}
+		}
+	}()
+}
+
+// Removes recordings past retention, and totals the rest.
+func (r *recorder) sweep() {
+	files, err := filepath.Glob(filepath.Join(r.dir, "*.raw*"))
+	if err != nil {
+		return
+	}
+	var used int64
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if r.retention > 0 && time.Since(info.ModTime()) > r.retention {
+			if err := os.Remove(name); err != nil {
+				utils.Log("WARN: Unable to remove old recording: %s", err.Error())
+			} else {
+				continue
+			}
+		}
+		used += info.Size()
+	}
+	atomic.StoreInt64(&r.used, used)
+	r.roomFor()
+}
+
+// Reports whether there's room for more recording, logging when that
+// changes.
+func (r *recorder) roomFor() bool {
+	if r.maxBytes == 0 {
+		return true
+	}
+	full := atomic.LoadInt64(&r.used) >= r.maxBytes
+	switch {
+	case full && atomic.CompareAndSwapInt32(&r.full, 0, 1):
+		utils.Log("WARN: Recordings reached RECORD_MAX_BYTES, recording stopped")
+	case !full && atomic.CompareAndSwapInt32(&r.full, 1, 0):
+		utils.Log("INFO: Recording again")
+	}
+	return !full
+}
+
+// Returns a reader passing on what's read from conn, recording it if the
+// connection is to be recorded, and a function to call when it's closed.
+func (r *recorder) wrap(conn io.Reader, id uint32, remote net.Addr) (io.Reader, func()) {
+	if r == nil {
+		return conn, func() {}
+	}
+	host := probeHost(remote)
+	if len(r.from) > 0 && !r.from[host] {
+		return conn, func() {}
+	}
+	rec := &recording{
+		r: r,
+		base: fmt.Sprintf("%s-%d-%s", strings.Replace(host, ":", "_", -1), id,
+			time.Now().UTC().Format("20060102T150405")),
+	}
+	utils.Log("INFO: Recording connection from: %s", remote)
+	return io.TeeReader(conn, rec), rec.close
+}
+
+// One connection's recording.
+type recording struct {
+	r    *recorder
+	base string
+	part int
+
+	file    *os.File
+	gz      *gzip.Writer
+	w       io.Writer
+	written int64
+	failed  bool
+}
+
+// Records p.  Never fails, so reading isn't interrupted.
+func (c *recording) Write(p []byte) (int, error) {
+	if c.failed || !c.r.roomFor() {
+		return len(p), nil
+	}
+	if c.file != nil && c.r.maxSize > 0 && c.written >= c.r.maxSize {
+		c.close()
+	}
+	if c.file == nil {
+		if err := c.open(); err != nil {
+			c.fail(err)
+			return len(p), nil
+		}
+	}
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+	atomic.AddInt64(&c.r.used, int64(n))
+	c.r.recorded.Add(float64(n))
+	if err != nil {
+		c.fail(err)
+	}
+	return len(p), nil
+}
+
+func (c *recording) open() error {
+	c.part++
+	name := fmt.Sprintf("%s.%d.raw", c.base, c.part)
+	if c.r.compress {
+		name += ".gz"
+	}
+	file, err := os.OpenFile(filepath.Join(c.r.dir, name),
+		os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	c.file, c.w, c.written = file, file, 0
+	if c.r.compress {
+		c.gz = gzip.NewWriter(file)
+		c.w = c.gz
+	}
+	return nil
+}
+
+func (c *recording) fail(err error) {
+	utils.Log("WARN: Recording %s stopped: %s", c.base, err.Error())
+	c.close()
+	c.failed = true
+}
+
+// Completes the current file.
+func (c *recording) close() {
+	if c.file == nil {
+		return
+	}
+	if c.gz != nil {
+		c.gz.Close()
+		c.gz = nil
+	}
+	c.file.Close()
+	c.file = nil
+}
@@ -0,0 +1,75 @@
+// Data minimisation.  Fields listed in REDACT_FIELDS are removed from
+// events, and those in HASH_FIELDS replaced by a SHA-256 digest, keyed with
+// REDACT_HASH_KEY if set, so they can still be correlated without being
+// disclosed.  Fields are dotted paths, e.g. "http_request.body".
+
+package input
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type redactStage struct {
+	remove [][]string
+	hash   [][]string
+	key    []byte
+}
+
+func newRedactStage() (stage, error) {
+	r := &redactStage{
+		remove: fieldPaths(utils.Getenv("REDACT_FIELDS", "")),
+		hash:   fieldPaths(utils.Getenv("HASH_FIELDS", "")),
+		key:    []byte(utils.Getenv("REDACT_HASH_KEY", "")),
+	}
+	if len(r.remove) == 0 && len(r.hash) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+func (r *redactStage) process(e *event) bool {
+
+	fields, err := e.decode()
+	if err != nil {
+		// Nothing we can safely forward.
+		utils.Log("WARN: Dropping undecodable event from: %s, %s", e.remote, err.Error())
+		e.output = ""
+		return false
+	}
+
+	for _, path := range r.remove {
+		walkPath(fields, path, func(parent map[string]interface{}, key string) {
+			delete(parent, key)
+			e.modified()
+		})
+	}
+	for _, path := range r.hash {
+		walkPath(fields, path, func(parent map[string]interface{}, key string) {
+			parent[key] = r.digest(parent[key])
+			e.modified()
+		})
+	}
+	return true
+}
+
+func (r *redactStage) digest(val interface{}) string {
+	var h hash.Hash
+	if len(r.key) > 0 {
+		h = hmac.New(sha256.New, r.key)
+	} else {
+		h = sha256.New()
+	}
+	if s, ok := val.(string); ok {
+		h.Write([]byte(s))
+	} else {
+		b, _ := json.Marshal(val)
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
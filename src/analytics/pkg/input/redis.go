@@ -0,0 +1,124 @@
+// Dedup shared by several bridges behind a load balancer, selected by
+// DEDUP_MODE=redis.  Each id is claimed with SET NX and a TTL of the dedup
+// window on the Redis server at REDIS_ADDR, so whichever instance sees an
+// event first forwards it.  If Redis can't be reached events are passed
+// rather than lost, and after REDIS_BREAKER_FAILURES failures in a row it
+// isn't asked again for REDIS_BREAKER_COOLDOWN, so a slow Redis costs each
+// read at most REDIS_TIMEOUT while it's being found out, not every event.
+
+package input
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	REDIS_ADDR       = "redis:6379"
+	REDIS_KEY_PREFIX = "analytics-input:dedup:"
+	REDIS_TIMEOUT    = 100 * time.Millisecond
+
+	REDIS_BREAKER_FAILURES = "5"
+	REDIS_BREAKER_COOLDOWN = "10s"
+)
+
+type redisDedup struct {
+	pool   *redis.Pool
+	prefix string
+	ttl    int64
+	errors prometheus.Counter
+
+	// Circuit breaker: after maxFailures failures in a row, Redis isn't
+	// asked until openUntil.
+	maxFailures int
+	cooldown    time.Duration
+	mutex       sync.Mutex
+	failures    int
+	openUntil   time.Time
+}
+
+func newRedisDedup(window time.Duration) (*redisDedup, error) {
+	addr := utils.Getenv("REDIS_ADDR", REDIS_ADDR)
+	password := utils.Getenv("REDIS_PASSWORD", "")
+	maxFailures, err := strconv.Atoi(utils.Getenv("REDIS_BREAKER_FAILURES", REDIS_BREAKER_FAILURES))
+	if err != nil || maxFailures < 1 {
+		return nil, fmt.Errorf("REDIS_BREAKER_FAILURES: must be a positive number")
+	}
+	cooldown, err := time.ParseDuration(utils.Getenv("REDIS_BREAKER_COOLDOWN", REDIS_BREAKER_COOLDOWN))
+	if err != nil || cooldown <= 0 {
+		return nil, fmt.Errorf("REDIS_BREAKER_COOLDOWN: must be a positive duration")
+	}
+
+	// PX takes whole milliseconds, and refuses 0.
+	ttl := int64(window / time.Millisecond)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	d := &redisDedup{
+		pool: &redis.Pool{
+			MaxIdle:     16,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr,
+					redis.DialPassword(password),
+					redis.DialConnectTimeout(REDIS_TIMEOUT),
+					redis.DialReadTimeout(REDIS_TIMEOUT),
+					redis.DialWriteTimeout(REDIS_TIMEOUT))
+			},
+		},
+		prefix: utils.Getenv("REDIS_KEY_PREFIX", REDIS_KEY_PREFIX),
+		ttl:    ttl,
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dedup_store_errors",
+			Help: "Failed or skipped dedup store lookups, the events were passed",
+		}),
+		maxFailures: maxFailures,
+		cooldown:    cooldown,
+	}
+	mustRegister(d.errors)
+	utils.Log("INFO: Dedup shared through Redis at %s", addr)
+	return d, nil
+}
+
+func (d *redisDedup) seen(id string) bool {
+	d.mutex.Lock()
+	open := time.Now().Before(d.openUntil)
+	d.mutex.Unlock()
+	if open {
+		d.errors.Inc()
+		return false
+	}
+
+	conn := d.pool.Get()
+	defer conn.Close()
+	reply, err := conn.Do("SET", d.prefix+id, 1, "NX", "PX", d.ttl)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err != nil {
+		d.errors.Inc()
+		d.failures++
+		if d.failures >= d.maxFailures {
+			utils.Log("WARN: Dedup store failing, not asked for %s: %s",
+				d.cooldown, err.Error())
+			d.openUntil = time.Now().Add(d.cooldown)
+			d.failures = 0
+		}
+		return false
+	}
+	if !d.openUntil.IsZero() {
+		utils.Log("INFO: Dedup store answering again")
+		d.openUntil = time.Time{}
+	}
+	d.failures = 0
+
+	// A nil reply means the key already existed.
+	return reply == nil
+}
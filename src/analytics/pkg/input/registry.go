@@ -0,0 +1,41 @@
+// Where the bridge's metrics are registered.  By default that's
+// Prometheus' default registry, served on /metrics by Main.  A program
+// embedding the bridge can give it a registry of its own with UseRegistry
+// before calling NewService.
+//
+// Each Service registers every metric it uses, shared ones included, so a
+// registry given before a second Service is created gets them all.
+// Creating a second Service replaces the metrics the first registered,
+// rather than panicking, so the registry reports the latest Service.
+
+package input
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	registerer prometheus.Registerer = prometheus.DefaultRegisterer
+	gatherer   prometheus.Gatherer   = prometheus.DefaultGatherer
+)
+
+// UseRegistry registers the metrics of Services created from now on with
+// r rather than the default registry.
+func UseRegistry(r *prometheus.Registry) {
+	registerer, gatherer = r, r
+}
+
+// Registers collectors, replacing any registered already as the same
+// metrics.  Panics if they clash with others, as prometheus.MustRegister.
+func mustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		err := registerer.Register(c)
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			registerer.Unregister(are.ExistingCollector)
+			err = registerer.Register(c)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Replaying archived events, for reproducing incidents against a staging
+// stack.  "input replay" reads NDJSON captures, gzipped if they end in .gz,
+// and runs them through the processing stages to the outputs:
+//
+//   input replay -speed 10 capture.json.gz output:/queue/input
+//
+// With -speed 0, the default, events are sent as fast as the outputs take
+// them.  Otherwise the gaps between event times are kept, divided by the
+// speed, so 1 reproduces the original timing and 10 plays it ten times as
+// fast.  Events without a readable time are sent straight away.
+
+package input
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Runs the replay subcommand.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := fs.Float64("speed", 0, "timing scale, 1 for the original timing, 0 for no delay")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *speed < 0 {
+		return fmt.Errorf("speed must not be negative")
+	}
+	if fs.NArg() < 2 {
+		return fmt.Errorf("usage: replay [-speed n] capture outputs...")
+	}
+
+	s, err := newWorkerService(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	err = replay(s, fs.Arg(0), *speed)
+	s.Stop()
+	return err
+}
+
+// Stands in for the probe's address on replayed events, giving the device.
+type replayAddr string
+
+func (a replayAddr) Network() string { return "replay" }
+func (a replayAddr) String() string  { return string(a) }
+
+func replay(s *Service, name string, speed float64) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// A client per device keeps each device's events in order.
+	clients := map[string]*client{}
+
+	var first, start time.Time
+	n := 0
+	br := bufio.NewReaderSize(r, 1<<20)
+	for {
+		data, err := br.ReadBytes('\n')
+		if len(data) > 0 {
+			e := &event{data: data, output: "output"}
+			if speed > 0 {
+				if t, err := e.time(); err == nil {
+					if first.IsZero() {
+						first, start = t, time.Now()
+					}
+					due := start.Add(time.Duration(float64(t.Sub(first)) / speed))
+					time.Sleep(time.Until(due))
+				}
+			}
+
+			device := topLevelFields(data, "device")["device"]
+			cl, ok := clients[device]
+			if !ok {
+				cl = &client{
+					id:     nextConnection(),
+					remote: replayAddr(device),
+					state:  map[stage]interface{}{},
+				}
+				clients[device] = cl
+			}
+			e.client = cl
+			e.remote = cl.remote
+			e.received = time.Now()
+			s.process(e)
+			s.send(e)
+			n++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	utils.Log("INFO: Replayed %d events from %s", n, name)
+	return nil
+}
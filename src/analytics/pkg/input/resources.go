@@ -0,0 +1,122 @@
+// Resource usage of the bridge itself, since collector hosts are small and
+// running out of file descriptors loses events quietly.  Goroutines, heap,
+// GC pauses and open files are already exported by the standard go_* and
+// process_* metrics; on top of those, every RESOURCE_CHECK_INTERVAL
+//
+//   resource_usage_ratio{resource="fds|memory|goroutines"}
+//
+// gives how close each is to its limit: the open files limit, MEMORY_LIMIT
+// and RESOURCE_MAX_GOROUTINES.  A warning is logged when one passes
+// RESOURCE_WARN_RATIO, and a note when it drops back.  Memory is only
+// checked with MEMORY_LIMIT set, and open files only on Linux.
+// RESOURCE_CHECK_INTERVAL=0 turns the checks off.
+
+package input
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	RESOURCE_CHECK_INTERVAL = "15s"
+	RESOURCE_WARN_RATIO     = "0.8"
+	RESOURCE_MAX_GOROUTINES = "100000"
+)
+
+type resourceWatch struct {
+	warnRatio     float64
+	maxGoroutines int
+
+	usage *prometheus.GaugeVec
+
+	// Resources over the warning ratio when last checked.
+	warned map[string]bool
+}
+
+// Starts checking the bridge's resource usage, unless turned off.
+func (s *Service) startResourceWatch() error {
+	interval, err := time.ParseDuration(utils.Getenv("RESOURCE_CHECK_INTERVAL", RESOURCE_CHECK_INTERVAL))
+	if err != nil || interval < 0 {
+		return fmt.Errorf("RESOURCE_CHECK_INTERVAL: must be a duration")
+	}
+	if interval == 0 {
+		return nil
+	}
+	warnRatio, err := strconv.ParseFloat(utils.Getenv("RESOURCE_WARN_RATIO", RESOURCE_WARN_RATIO), 64)
+	if err != nil || warnRatio <= 0 {
+		return fmt.Errorf("RESOURCE_WARN_RATIO: must be a positive number")
+	}
+	maxGoroutines, err := strconv.Atoi(utils.Getenv("RESOURCE_MAX_GOROUTINES", RESOURCE_MAX_GOROUTINES))
+	if err != nil || maxGoroutines < 1 {
+		return fmt.Errorf("RESOURCE_MAX_GOROUTINES: must be a positive number")
+	}
+	r := &resourceWatch{
+		warnRatio:     warnRatio,
+		maxGoroutines: maxGoroutines,
+		usage: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "resource_usage_ratio",
+				Help: "Usage of each resource as a fraction of its limit",
+			},
+			[]string{"resource"},
+		),
+		warned: map[string]bool{},
+	}
+	mustRegister(r.usage)
+	if _, _, err := openFiles(); err != nil {
+		utils.Log("WARN: Not checking open files: %s", err.Error())
+	}
+
+	r.check()
+	s.waitGroup.Add(1)
+	go func() {
+		defer s.waitGroup.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				r.check()
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *resourceWatch) check() {
+	if n, limit, err := openFiles(); err == nil && limit > 0 {
+		r.report("fds", float64(n), float64(limit))
+	}
+
+	// A negative limit leaves it as it is, returning it.
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		r.report("memory", float64(m.Sys-m.HeapReleased), float64(limit))
+	}
+
+	r.report("goroutines", float64(runtime.NumGoroutine()), float64(r.maxGoroutines))
+}
+
+func (r *resourceWatch) report(resource string, used, limit float64) {
+	ratio := used / limit
+	r.usage.With(prometheus.Labels{"resource": resource}).Set(ratio)
+	over := ratio >= r.warnRatio
+	switch {
+	case over && !r.warned[resource]:
+		utils.Log("WARN: Nearing the %s limit: %.0f of %.0f in use", resource, used, limit)
+	case !over && r.warned[resource]:
+		utils.Log("INFO: Back under the %s limit: %.0f of %.0f in use", resource, used, limit)
+	}
+	r.warned[resource] = over
+}
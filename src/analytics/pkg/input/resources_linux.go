@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package input
+
+import (
+	"io/ioutil"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns the number of open files and the soft limit on them.
+func openFiles() (int, uint64, error) {
+	var rl unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, 0, err
+	}
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(fds), rl.Cur, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package input
+
+import (
+	"fmt"
+)
+
+func openFiles() (int, uint64, error) {
+	return 0, 0, fmt.Errorf("counting open files is only supported on Linux")
+}
@@ -0,0 +1,124 @@
+// Runtime tuning, since the bridge shares hosts with capture processes and
+// needs a bounded footprint:
+//
+//   MAX_PROCS       GOMAXPROCS override, or "auto" to follow the container's
+//                   CPU quota
+//   GC_PERCENT      garbage collection target, as GOGC
+//   MEMORY_LIMIT    soft memory limit, e.g. "48M", the collector working
+//                   harder as it's approached
+//   MEMORY_BALLAST  heap allocated up front, e.g. "16M", so collection isn't
+//                   triggered constantly while the live heap is small
+
+package input
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Kept reachable so the ballast stays allocated.  Never touched, so it
+// costs address space rather than resident memory.
+var ballast []byte
+
+func tuneRuntime() error {
+
+	switch procs := utils.Getenv("MAX_PROCS", ""); procs {
+	case "":
+	case "auto":
+		if n := cpuQuota(); n > 0 {
+			runtime.GOMAXPROCS(n)
+		}
+	default:
+		n, err := strconv.Atoi(procs)
+		if err != nil || n < 1 {
+			return fmt.Errorf("MAX_PROCS: must be a positive number or auto")
+		}
+		runtime.GOMAXPROCS(n)
+	}
+
+	if v := utils.Getenv("GC_PERCENT", ""); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("GC_PERCENT: %s", err.Error())
+		}
+		debug.SetGCPercent(n)
+	}
+
+	if v := utils.Getenv("MEMORY_LIMIT", ""); v != "" {
+		n, err := parseSize(v)
+		if err != nil {
+			return fmt.Errorf("MEMORY_LIMIT: %s", err.Error())
+		}
+		debug.SetMemoryLimit(n)
+	}
+
+	if v := utils.Getenv("MEMORY_BALLAST", ""); v != "" {
+		n, err := parseSize(v)
+		if err != nil {
+			return fmt.Errorf("MEMORY_BALLAST: %s", err.Error())
+		}
+		ballast = make([]byte, n)
+	}
+
+	utils.Log("INFO: Running with GOMAXPROCS %d", runtime.GOMAXPROCS(0))
+	return nil
+}
+
+// Returns the CPUs allowed by the cgroup quota, rounded up, or 0 if there's
+// no quota.
+func cpuQuota() int {
+	var quota, period float64
+
+	// cgroup v2, then v1.
+	if b, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		f := strings.Fields(string(b))
+		if len(f) != 2 || f[0] == "max" {
+			return 0
+		}
+		quota, _ = strconv.ParseFloat(f[0], 64)
+		period, _ = strconv.ParseFloat(f[1], 64)
+	} else {
+		q, err1 := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+		p, err2 := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+		if err1 != nil || err2 != nil {
+			return 0
+		}
+		quota, _ = strconv.ParseFloat(strings.TrimSpace(string(q)), 64)
+		period, _ = strconv.ParseFloat(strings.TrimSpace(string(p)), 64)
+	}
+	if quota <= 0 || period <= 0 {
+		return 0
+	}
+	return int(math.Ceil(quota / period))
+}
+
+// Parses a size in bytes with an optional K, M or G suffix, decimal, or
+// Ki, Mi or Gi, binary, as in Kubernetes resource specs.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9},
+	}
+	scale := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, scale = strings.TrimSuffix(s, u.suffix), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * scale, nil
+}
@@ -0,0 +1,90 @@
+// Sampling by event action.  SAMPLE_RATES gives the fraction of each action
+// to forward, e.g. "flow=0.1,connection_up=0.5", and SAMPLE_DEFAULT that of
+// actions not listed.  The count sampled out is exported per action so
+// downstream rates can be scaled back up.
+
+package input
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	SAMPLE_DEFAULT = "1"
+)
+
+type sampleStage struct {
+	rates    map[string]float64
+	fallback float64
+	dropped  *prometheus.CounterVec
+}
+
+func newSampleStage() (stage, error) {
+	rates := utils.Getenv("SAMPLE_RATES", "")
+	fallback := utils.Getenv("SAMPLE_DEFAULT", SAMPLE_DEFAULT)
+	if rates == "" && fallback == SAMPLE_DEFAULT {
+		return nil, nil
+	}
+
+	s := &sampleStage{
+		rates: map[string]float64{},
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sampled_out_events",
+				Help: "Events not forwarded due to sampling",
+			},
+			[]string{"action"},
+		),
+	}
+	var err error
+	if s.fallback, err = sampleRate(fallback); err != nil {
+		return nil, fmt.Errorf("SAMPLE_DEFAULT: %s", err.Error())
+	}
+	for _, rule := range splitList(rates) {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("SAMPLE_RATES: expected action=rate, got %q", rule)
+		}
+		if s.rates[parts[0]], err = sampleRate(parts[1]); err != nil {
+			return nil, fmt.Errorf("SAMPLE_RATES: %s", err.Error())
+		}
+	}
+	mustRegister(s.dropped)
+	return s, nil
+}
+
+func sampleRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("rate %s not between 0 and 1", s)
+	}
+	return rate, nil
+}
+
+func (s *sampleStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	action, _ := fields["action"].(string)
+	rate, ok := s.rates[action]
+	if !ok {
+		rate = s.fallback
+		action = "other"
+	}
+	if rate < 1 && rand.Float64() >= rate {
+		s.dropped.With(prometheus.Labels{"action": action}).Inc()
+		e.output = ""
+		return false
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+// Validation of events against a JSON schema, typically the cybermon event
+// schema, given by SCHEMA_FILE.  Invalid events are counted, logged with the
+// reason and sent to the reject output instead of the normal one.
+
+package input
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+type schemaStage struct {
+	schema  *gojsonschema.Schema
+	invalid prometheus.Counter
+}
+
+func newSchemaStage() (stage, error) {
+	path := utils.Getenv("SCHEMA_FILE", "")
+	if path == "" {
+		return nil, nil
+	}
+
+	schema, err := gojsonschema.NewSchema(
+		gojsonschema.NewReferenceLoader("file://" + path))
+	if err != nil {
+		return nil, err
+	}
+
+	v := &schemaStage{
+		schema: schema,
+		invalid: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "schema_invalid_events",
+			Help: "Events failing schema validation",
+		}),
+	}
+	mustRegister(v.invalid)
+	return v, nil
+}
+
+func (v *schemaStage) process(e *event) bool {
+
+	result, err := v.schema.Validate(gojsonschema.NewBytesLoader(e.data))
+	if err != nil {
+		return v.reject(e, err.Error())
+	}
+	if result.Valid() {
+		return true
+	}
+
+	var reasons []string
+	for _, re := range result.Errors() {
+		reasons = append(reasons, re.String())
+	}
+	return v.reject(e, strings.Join(reasons, "; "))
+}
+
+func (v *schemaStage) reject(e *event, reason string) bool {
+	utils.Log("WARN: Invalid event from: %s, %s", e.remote, reason)
+	v.invalid.Inc()
+	return reject(e, "schema: "+reason)
+}
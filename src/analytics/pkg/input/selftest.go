@@ -0,0 +1,77 @@
+// Self-test at startup.  With SELF_TEST=true an event
+//
+//   {"action": "self_test", "self_test": true, "time": "..",
+//    "device": "analytics-input", "instance": ".."}
+//
+// is published to each output before connections are accepted, and the bridge
+// exits if any isn't accepted within SELF_TEST_TIMEOUT.  A mistyped queue
+// name then fails the deploy rather than traffic going nowhere, and the pod
+// is never ready while it's wrong.
+
+package input
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	SELF_TEST_TIMEOUT = "30s"
+)
+
+// Returns the names of the outputs in the output specifications the bridge
+// was started with.
+func outputNames(outputs []string) []string {
+	var names []string
+	for _, o := range outputs {
+		names = append(names, strings.SplitN(o, ":", 2)[0])
+	}
+	return names
+}
+
+// Runs the self-test, if enabled.
+func (s *Service) selfTest(outputs []string) error {
+	if utils.Getenv("SELF_TEST", "") != "true" {
+		return nil
+	}
+	timeout, err := time.ParseDuration(utils.Getenv("SELF_TEST_TIMEOUT", SELF_TEST_TIMEOUT))
+	if err != nil {
+		return fmt.Errorf("SELF_TEST_TIMEOUT: %s", err.Error())
+	}
+
+	msg, err := json.Marshal(map[string]interface{}{
+		"action":    "self_test",
+		"self_test": true,
+		"time":      time.Now().UTC().Format(time.RFC3339Nano),
+		"device":    "analytics-input",
+		"instance":  instanceID,
+	})
+	if err != nil {
+		return err
+	}
+	msg = append(msg, '\n')
+
+	for _, output := range outputNames(outputs) {
+		result := make(chan error, 1)
+		go func(output string) {
+			result <- s.worker.Send(output, msg)
+		}(output)
+		ctx, cancel := context.WithTimeout(s.ctx, timeout)
+		select {
+		case err = <-result:
+		case <-ctx.Done():
+			err = fmt.Errorf("no response in %s", timeout)
+		}
+		cancel()
+		if err != nil {
+			return fmt.Errorf("output %s failed self-test: %s", output, err.Error())
+		}
+		utils.Log("INFO: Output %s passed self-test", output)
+	}
+	return nil
+}
@@ -0,0 +1,608 @@
+// Sending is decoupled from reading.  Connections process each event and
+// queue it for its output, which has up to SENDERS publishes in flight, so a
+// slow output only holds up reads once its SEND_QUEUE_SIZE queue has filled.
+//
+// Events from one connection are published to each output in the order they
+// arrived, which session reconstruction downstream relies on.  An output's
+// events are split over SENDERS queues with one publisher each, and all of a
+// connection's events go through the same queue.  A failed publish is
+// retried by the worker before the next event on the queue is sent.
+//
+// With ORDERING_KEY naming a field such as "device", events are split by
+// key instead, so events sharing a key are published in arrival
+// order, whichever connection they came on.  UNORDERED_SEND=true gives up
+// ordering altogether, all the publishers sharing one queue, which evens out
+// the load when a few connections carry most of the events.
+//
+// With MESSAGE_KEY naming a field, normally "id", each event is published
+// with that field as its message key, for outputs such as Kafka and Pub/Sub
+// where brokers and consumers can deduplicate or partition on it.  Workers
+// implementing SendKeyed or SendWithHeaders are given the key, and HTTP
+// outputs send it as an X-Message-Key header; plugin, Parquet and TAXII
+// outputs, and batches, have nowhere to put it.  Either key may list fields
+// to fall back on, see keys.go.
+//
+// With SEND_TTL set, an event which has waited longer than that to be sent
+// is dropped and counted rather than delivered too late to be of use.
+// SEND_TIMEOUT limits each publish, for outputs which can be cancelled: those
+// delivered by plugins, HTTP and TAXII outputs, and workers implementing
+// SendContext.
+//
+// Each pipeline has queues and publishers of its own, even to an output it
+// shares with another, so a backlog in one pipeline doesn't hold up the
+// rest.  A pipeline's "queue_size" overrides SEND_QUEUE_SIZE for its queues.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	SENDERS         = "4"
+	SEND_QUEUE_SIZE = "10000"
+)
+
+// The queues and publishers for one pipeline's output.  Unordered, all the
+// publishers share one queue; ordered, each has its own.
+type outputQueue struct {
+	pipeline string
+	lanes    []chan *event
+}
+
+type queueKey struct {
+	pipeline string
+	output   string
+}
+
+// Implemented by workers whose outputs carry message keys.  Workers without
+// it publish the body alone.
+type keyedPublisher interface {
+	SendKeyed(output, key string, msg []uint8) error
+}
+
+// Implemented by workers which can give up on a publish when its context is
+// done.
+type contextPublisher interface {
+	SendContext(ctx context.Context, output string, msg []uint8) error
+}
+
+// Connections are numbered to spread them over the queues.
+var connections uint32
+
+func nextConnection() uint32 {
+	return atomic.AddUint32(&connections, 1)
+}
+
+type sender struct {
+	worker      Publisher
+	concurrency int
+	queueSize   int
+	orderingKey *eventKey
+	unordered   bool
+	ttl         time.Duration
+	timeout     time.Duration
+	waitGroup   sync.WaitGroup
+
+	// Field giving each event's message key, and the means to send it.
+	messageKey *eventKey
+	keyed      keyedPublisher
+
+	// Metadata sent with each event, and the means to send it.
+	headers  []messageHeader
+	headered headerPublisher
+
+	mutex   sync.RWMutex
+	outputs map[queueKey]*outputQueue
+
+	// Pipelines whose queue depth is exported.
+	pipelineDepths map[string]bool
+
+	// Outputs taking batches of events.
+	batchers map[string]*batcher
+
+	// Outputs delivered by plugins rather than the worker.
+	plugins map[string]*pluginProcess
+
+	// Outputs POSTed to over HTTP.
+	httpOutputs map[string]*httpOutput
+
+	// Fields kept for outputs taking part of each event.
+	projections map[string]projection
+
+	// Encoders of outputs not taking JSON.
+	encoders map[string]*outputEncoder
+
+	// Compressors of outputs taking compressed messages.
+	compressors map[string]*outputCompressor
+
+	// The output written as Parquet files, if any.
+	parquet *parquetSink
+
+	// The output added to a TAXII collection, if any.
+	taxii *taxiiOutput
+
+	// Time spent by events in each part of the bridge.
+	duration *prometheus.HistogramVec
+
+	// Events dropped for waiting longer than the TTL.
+	expired *prometheus.CounterVec
+
+	// Time from reading events to their output accepting them.
+	publishLatency *prometheus.HistogramVec
+
+	health *outputHealth
+
+	// Ingest SLIs, nil unless tracked.
+	slo *sloTracker
+
+	// Faults to inject, nil unless testing.
+	chaos *chaosConfig
+
+	// Called with the latency of each delivered event, if set.
+	onDelivered func(output string, latency time.Duration)
+
+	// Where unsent events go at shutdown, if anywhere, and whether
+	// shutdown has begun.
+	spool    *spool
+	handover int32
+}
+
+func newSender(w Publisher, chaos *chaosConfig) (*sender, error) {
+	n, err := strconv.Atoi(utils.Getenv("SENDERS", SENDERS))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("SENDERS: must be a positive number")
+	}
+	size, err := strconv.Atoi(utils.Getenv("SEND_QUEUE_SIZE", SEND_QUEUE_SIZE))
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("SEND_QUEUE_SIZE: must be a number")
+	}
+	var ttl time.Duration
+	if v := utils.Getenv("SEND_TTL", ""); v != "" {
+		ttl, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("SEND_TTL: %s", err.Error())
+		}
+	}
+
+	var timeout time.Duration
+	if v := utils.Getenv("SEND_TIMEOUT", ""); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("SEND_TIMEOUT: %s", err.Error())
+		}
+	}
+
+	s := &sender{
+		worker:      w,
+		concurrency: n,
+		queueSize:   size,
+		orderingKey: newEventKey(utils.Getenv("ORDERING_KEY", "")),
+		unordered:   utils.Getenv("UNORDERED_SEND", "") == "true",
+		ttl:         ttl,
+		timeout:     timeout,
+		messageKey:  newEventKey(utils.Getenv("MESSAGE_KEY", "")),
+		chaos:       chaos,
+		outputs:     map[queueKey]*outputQueue{},
+
+		pipelineDepths: map[string]bool{},
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "event_stage_duration",
+				Help:    "Time spent by events in each stage of the bridge",
+				Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+			},
+			[]string{"stage"},
+		),
+		expired: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "expired_events",
+				Help: "Events dropped for waiting longer than the send TTL",
+			},
+			[]string{"pipeline", "output"},
+		),
+		publishLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "publish_latency",
+				Help:    "Time from reading events to their output accepting them",
+				Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+			},
+			[]string{"output"},
+		),
+	}
+	mustRegister(s.duration)
+	mustRegister(s.expired)
+	mustRegister(s.publishLatency)
+
+	s.headers, err = newMessageHeaders()
+	if err != nil {
+		return nil, err
+	}
+	if h, ok := w.(headerPublisher); ok {
+		s.headered = h
+	} else if len(s.headers) > 0 {
+		utils.Log("WARN: MESSAGE_HEADERS: only HTTP outputs will have headers")
+	}
+
+	if s.messageKey != nil {
+		s.keyed, _ = w.(keyedPublisher)
+	}
+
+	s.plugins, err = newPluginOutputs()
+	if err != nil {
+		return nil, err
+	}
+
+	s.httpOutputs, err = newHTTPOutputs()
+	if err != nil {
+		return nil, err
+	}
+	if s.messageKey != nil && s.keyed == nil && s.headered == nil && len(s.httpOutputs) == 0 {
+		utils.Log("WARN: MESSAGE_KEY: outputs don't support message keys")
+	}
+
+	s.projections, err = newProjections()
+	if err != nil {
+		return nil, err
+	}
+
+	s.encoders, err = newEncoders()
+	if err != nil {
+		return nil, err
+	}
+
+	s.compressors, err = newCompressors()
+	if err != nil {
+		return nil, err
+	}
+
+	s.parquet, err = newParquetSink()
+	if err != nil {
+		return nil, err
+	}
+
+	s.taxii, err = newTAXIIOutput()
+	if err != nil {
+		return nil, err
+	}
+
+	s.health, err = newOutputHealth()
+	if err != nil {
+		return nil, err
+	}
+
+	s.slo, err = newSLOTracker()
+	if err != nil {
+		return nil, err
+	}
+
+	s.spool, err = newSpool()
+	if err != nil {
+		return nil, err
+	}
+	if s.spool != nil {
+		s.spool.start(s.enqueue)
+	}
+
+	s.batchers, err = newBatchers(func(output string, msg []byte, received []time.Time) {
+		msg, err := s.compress(output, msg)
+		if err == nil {
+			err = s.dispatch(output, "", nil, msg, received[0])
+		}
+		s.health.result(output, err)
+		if err == nil {
+			s.delivered(output, received...)
+		} else {
+			s.slo.failed(len(received))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	// These take one event at a time.
+	if s.parquet != nil && s.batchers[s.parquet.name] != nil {
+		return nil, fmt.Errorf("BATCH_OUTPUTS: the Parquet output %s can't be batched", s.parquet.name)
+	}
+	if s.taxii != nil && s.batchers[s.taxii.name] != nil {
+		return nil, fmt.Errorf("BATCH_OUTPUTS: the TAXII output %s can't be batched", s.taxii.name)
+	}
+	// The TAXII server takes STIX bundles and nothing else.
+	if s.taxii != nil {
+		if enc := s.encoders[s.taxii.name]; enc == nil || enc.encoding != "stix" {
+			return nil, fmt.Errorf("OUTPUT_ENCODINGS: the TAXII output %s must be encoded as stix",
+				s.taxii.name)
+		}
+		if s.compressors[s.taxii.name] != nil {
+			return nil, fmt.Errorf("OUTPUT_COMPRESSION: the TAXII output %s can't be compressed",
+				s.taxii.name)
+		}
+	}
+	mustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "send_queue_depth",
+			Help: "Events waiting to be sent",
+		},
+		s.depth,
+	))
+	return s, nil
+}
+
+// Returns the queue for a pipeline's output, starting its publishers on
+// first use.  Events from no pipeline, such as canaries, have their own.
+func (s *sender) output(p *pipeline, name string) *outputQueue {
+	key := queueKey{output: name}
+	size := s.queueSize
+	if p != nil {
+		key.pipeline = p.Name
+		if p.QueueSize > 0 {
+			size = p.QueueSize
+		}
+	}
+	s.mutex.RLock()
+	q, ok := s.outputs[key]
+	s.mutex.RUnlock()
+	if ok {
+		return q
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if q, ok := s.outputs[key]; ok {
+		return q
+	}
+
+	q = &outputQueue{
+		pipeline: key.pipeline,
+		lanes:    make([]chan *event, s.concurrency),
+	}
+	if s.shared() {
+		shared := make(chan *event, size)
+		for i := range q.lanes {
+			q.lanes[i] = shared
+		}
+	} else {
+		for i := range q.lanes {
+			q.lanes[i] = make(chan *event, size/s.concurrency)
+		}
+	}
+	s.waitGroup.Add(s.concurrency)
+	for _, lane := range q.lanes {
+		go s.run(lane)
+	}
+	s.outputs[key] = q
+
+	if !s.pipelineDepths[key.pipeline] {
+		s.pipelineDepths[key.pipeline] = true
+		pipeline := key.pipeline
+		mustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "pipeline_queue_depth",
+				Help:        "Events waiting to be sent for each pipeline",
+				ConstLabels: prometheus.Labels{"pipeline": pipeline},
+			},
+			func() float64 { return s.pipelineDepth(pipeline) },
+		))
+	}
+	return q
+}
+
+// Queues an event for sending, blocking while the queue is full.
+func (s *sender) enqueue(e *event) {
+	q := s.output(e.pipeline, e.output)
+	lane := q.lanes[0]
+	switch {
+	case s.orderingKey != nil:
+		key := s.orderingKey.of(e)
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		lane = q.lanes[h.Sum32()%uint32(len(q.lanes))]
+	case !s.unordered && e.client != nil:
+		lane = q.lanes[e.client.id%uint32(len(q.lanes))]
+	}
+	e.queued = time.Now()
+	lane <- e
+}
+
+func (s *sender) run(lane chan *event) {
+	defer s.waitGroup.Done()
+	for e := range lane {
+		start := time.Now()
+		s.observe("queue", start.Sub(e.queued))
+		if s.ttl > 0 && start.Sub(e.queued) > s.ttl {
+			s.expired.With(prometheus.Labels{
+				"pipeline": e.pipelineName(),
+				"output":   e.output,
+			}).Inc()
+			s.slo.failed(1)
+			e.release()
+			continue
+		}
+		if atomic.LoadInt32(&s.handover) != 0 {
+			s.spool.write(e.output, e.bytes())
+			e.release()
+			continue
+		}
+		msg, ok := s.encode(e)
+		if !ok {
+			e.release()
+			continue
+		}
+		if b, ok := s.batchers[e.output]; ok {
+			b.add(msg, e.received)
+		} else {
+			s.publish(e, msg)
+		}
+		s.observe("send", time.Since(start))
+		e.release()
+	}
+}
+
+// Publishes an event on its own, as encoded for its output, keyed and with
+// headers if possible.
+func (s *sender) publish(e *event, msg []byte) {
+	key := ""
+	if s.messageKey != nil {
+		key = s.messageKey.of(e)
+	}
+	err := s.dispatch(e.output, key, s.messageHeaders(e), msg, e.received)
+	s.health.result(e.output, err)
+	if err == nil {
+		s.delivered(e.output, e.received)
+	} else {
+		s.slo.failed(1)
+	}
+}
+
+// Hands a message, one event or a batch, to whatever delivers its output.
+// received is when its first event was read.
+func (s *sender) dispatch(output, key string, headers map[string]string, msg []byte, received time.Time) error {
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	cw, cancellable := s.worker.(contextPublisher)
+	err := s.chaos.send()
+	switch {
+	case err != nil:
+	case s.plugins[output] != nil:
+		err = s.plugins[output].send(ctx, msg)
+	case s.httpOutputs[output] != nil:
+		err = s.httpOutputs[output].send(ctx, key, msg, headers)
+	case s.parquet != nil && output == s.parquet.name:
+		err = s.parquet.add(msg, received)
+	case s.taxii != nil && output == s.taxii.name:
+		err = s.taxii.send(ctx, msg)
+	case s.headered != nil && (len(headers) > 0 || key != ""):
+		err = s.headered.SendWithHeaders(output, key, headers, msg)
+	case key != "" && s.keyed != nil:
+		err = s.keyed.SendKeyed(output, key, msg)
+	case cancellable:
+		err = cw.SendContext(ctx, output, msg)
+	default:
+		err = s.worker.Send(output, msg)
+	}
+	return err
+}
+
+// Records events read at the given times having been accepted by an output.
+func (s *sender) delivered(output string, received ...time.Time) {
+	o := s.publishLatency.With(prometheus.Labels{"output": output})
+	now := time.Now()
+	for _, r := range received {
+		o.Observe(now.Sub(r).Seconds())
+		s.slo.delivered(now.Sub(r))
+		if s.onDelivered != nil {
+			s.onDelivered(output, now.Sub(r))
+		}
+	}
+}
+
+// Returns the names of the outputs events can go to: those given on the
+// command line, for the worker, and those delivered some other way.
+func (s *sender) knownOutputs(outputs []string) map[string]bool {
+	known := map[string]bool{}
+	for _, name := range outputNames(outputs) {
+		known[name] = true
+	}
+	for name := range s.plugins {
+		known[name] = true
+	}
+	for name := range s.httpOutputs {
+		known[name] = true
+	}
+	if s.parquet != nil {
+		known[s.parquet.name] = true
+	}
+	if s.taxii != nil {
+		known[s.taxii.name] = true
+	}
+	return known
+}
+
+// Reports whether an output's publishers share one queue.
+func (s *sender) shared() bool {
+	return s.unordered && s.orderingKey == nil
+}
+
+func (s *sender) observe(stage string, d time.Duration) {
+	s.duration.With(prometheus.Labels{"stage": stage}).Observe(d.Seconds())
+}
+
+// Returns the number of events waiting across all outputs.
+func (s *sender) depth() float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n := 0
+	for _, q := range s.outputs {
+		n += s.queued(q)
+	}
+	return float64(n)
+}
+
+// Returns the number of events waiting in a pipeline's queues.
+func (s *sender) pipelineDepth(pipeline string) float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	n := 0
+	for _, q := range s.outputs {
+		if q.pipeline == pipeline {
+			n += s.queued(q)
+		}
+	}
+	return float64(n)
+}
+
+// Returns the number of events in a queue.
+func (s *sender) queued(q *outputQueue) int {
+	if s.shared() {
+		return len(q.lanes[0])
+	}
+	n := 0
+	for _, lane := range q.lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+// Sends what's queued, or spools it if there's a spool, and stops the
+// senders.  Nothing may be queued after this is called.
+func (s *sender) stop() {
+	if s.spool != nil {
+		s.spool.stop()
+		atomic.StoreInt32(&s.handover, 1)
+	}
+	// Events can't wait any longer for outputs which never came.
+	if l, ok := s.worker.(lazyOutputs); ok && !l.attached() {
+		l.abandon()
+	}
+	s.mutex.Lock()
+	for _, q := range s.outputs {
+		closed := map[chan *event]bool{}
+		for _, lane := range q.lanes {
+			if !closed[lane] {
+				close(lane)
+				closed[lane] = true
+			}
+		}
+	}
+	s.mutex.Unlock()
+	s.waitGroup.Wait()
+	for _, b := range s.batchers {
+		b.flush()
+	}
+	s.parquet.close()
+	if s.spool != nil {
+		s.spool.close()
+	}
+}
@@ -0,0 +1,93 @@
+// Loss detection on the probe to bridge hop.  Probes which number their
+// events in the field named by SEQUENCE_FIELD get each connection's numbers
+// checked for gaps, which are logged and counted per probe address, as
+// far as labelguard.go allows.  A number going backwards is taken as the
+// probe restarting its count.
+
+package input
+
+import (
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type sequenceStage struct {
+	field   string
+	gaps    *prometheus.CounterVec
+	missing *prometheus.CounterVec
+	probes  *labelGuard
+}
+
+func newSequenceStage() (stage, error) {
+	field := utils.Getenv("SEQUENCE_FIELD", "")
+	if field == "" {
+		return nil, nil
+	}
+	probes, err := newLabelGuard("sequence_gaps")
+	if err != nil {
+		return nil, err
+	}
+	s := &sequenceStage{
+		field: field,
+		gaps: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sequence_gaps",
+				Help: "Gaps in event sequence numbers",
+			},
+			[]string{"probe"},
+		),
+		missing: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sequence_missing_events",
+				Help: "Events missing from sequence gaps",
+			},
+			[]string{"probe"},
+		),
+		probes: probes,
+	}
+	mustRegister(s.gaps)
+	mustRegister(s.missing)
+	return s, nil
+}
+
+func (s *sequenceStage) process(e *event) bool {
+	if e.client == nil {
+		return true
+	}
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	seq, ok := jsonFloat(fields[s.field])
+	if !ok {
+		return true
+	}
+
+	last, ok := e.client.state[s].(float64)
+	e.client.state[s] = seq
+	if !ok {
+		return true
+	}
+
+	switch {
+	case seq > last+1:
+		utils.Log("WARN: Sequence gap from %s: %d events missing after %d",
+			e.remote, int64(seq-last-1), int64(last))
+		labels := prometheus.Labels{"probe": s.probes.value(probeHost(e.remote))}
+		s.gaps.With(labels).Inc()
+		s.missing.With(labels).Add(seq - last - 1)
+	case seq <= last:
+		utils.Log("INFO: Sequence restarted from %s at %d", e.remote, int64(seq))
+	}
+	return true
+}
+
+// The probe's address without the port, which changes on every reconnect.
+func probeHost(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return addr.String()
+}
@@ -0,0 +1,163 @@
+// CEF and LEEF output encodings, so ArcSight and QRadar can take events
+// straight from the bridge.  Each event becomes one syslog message, headed
+// as RFC 3164 unless SIEM_SYSLOG_HEADER=false.  The action is the event
+// class, the addresses and ports come from src and dest, and the severity is
+// the event's risk scaled to 0-10.  The rest of the event isn't carried.
+//
+// Values are escaped as each format requires: in headers pipes and
+// backslashes are escaped and line breaks, which headers can't carry,
+// become spaces; in CEF extensions line breaks are escaped, and in LEEF
+// attributes, which can't escape the tab between them, tabs become spaces.
+// Nothing from the event can start a message of its own.
+
+package input
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	SIEM_VENDOR  = "Trust Networks"
+	SIEM_PRODUCT = "cybermon"
+	SIEM_VERSION = "1.0"
+)
+
+type siemEncoder struct {
+	// "cef" or "leef".
+	format string
+
+	// Hostname for the syslog header, empty if there's no header.
+	host string
+}
+
+func newCEFEncoder() (encoder, error) {
+	return newSIEMEncoder("cef")
+}
+
+func newLEEFEncoder() (encoder, error) {
+	return newSIEMEncoder("leef")
+}
+
+func newSIEMEncoder(format string) (encoder, error) {
+	e := &siemEncoder{format: format}
+	if utils.Getenv("SIEM_SYSLOG_HEADER", "true") != "false" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		e.host = host
+	}
+	return e, nil
+}
+
+// The first address and port of a cyberprobe address list, such as
+// ["ipv4:10.0.0.1", "tcp:443"].
+func siemAddress(addrs []string) (ip, port, proto string) {
+	for _, a := range addrs {
+		i := strings.Index(a, ":")
+		if i < 0 {
+			continue
+		}
+		switch kind, v := a[:i], a[i+1:]; kind {
+		case "ipv4", "ipv6":
+			if ip == "" {
+				ip = v
+			}
+		case "tcp", "udp":
+			if port == "" {
+				port, proto = v, strings.ToUpper(kind)
+			}
+		}
+	}
+	return
+}
+
+// Header fields are escaped alike in CEF and LEEF.
+var siemHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+var cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+var leefValueEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+func (s *siemEncoder) encode(msg []byte) ([]byte, error) {
+	env, err := splitEnvelope(msg)
+	if err != nil {
+		return nil, err
+	}
+	action := env.strings["action"]
+	if action == "" {
+		return nil, fmt.Errorf("no action")
+	}
+	t, err := parseEventTime(env.strings["time"])
+	if err != nil {
+		t = time.Now()
+	}
+	severity := int(env.risk*10 + 0.5)
+	if severity > 10 {
+		severity = 10
+	}
+	src, srcPort, proto := siemAddress(env.src)
+	dst, dstPort, _ := siemAddress(env.dest)
+
+	// Extension keys in CEF and LEEF, and their values.  CEF has no keys
+	// of its own for some, they go in custom strings labelled with the LEEF
+	// key.
+	fields := []struct{ cef, leef, value string }{
+		{"rt", "devTime", fmt.Sprint(t.UnixNano() / int64(time.Millisecond))},
+		{"externalId", "externalId", env.strings["id"]},
+		{"dvchost", "identHostName", env.strings["device"]},
+		{"src", "src", src},
+		{"spt", "srcPort", srcPort},
+		{"dst", "dst", dst},
+		{"dpt", "dstPort", dstPort},
+		{"proto", "proto", proto},
+		{"request", "url", env.strings["url"]},
+		{"cs1", "network", env.strings["network"]},
+		{"cs2", "origin", env.strings["origin"]},
+	}
+
+	var b strings.Builder
+	if s.host != "" {
+		// user.info
+		fmt.Fprintf(&b, "<14>%s %s ", t.UTC().Format(time.Stamp), s.host)
+	}
+	switch s.format {
+	case "cef":
+		fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+			siemHeaderEscaper.Replace(SIEM_VENDOR),
+			siemHeaderEscaper.Replace(SIEM_PRODUCT),
+			siemHeaderEscaper.Replace(SIEM_VERSION),
+			siemHeaderEscaper.Replace(action),
+			siemHeaderEscaper.Replace(action),
+			severity)
+		sep := ""
+		for _, f := range fields {
+			if f.value == "" {
+				continue
+			}
+			fmt.Fprintf(&b, "%s%s=%s", sep, f.cef, cefValueEscaper.Replace(f.value))
+			if strings.HasPrefix(f.cef, "cs") {
+				fmt.Fprintf(&b, " %sLabel=%s", f.cef, f.leef)
+			}
+			sep = " "
+		}
+	case "leef":
+		fmt.Fprintf(&b, "LEEF:2.0|%s|%s|%s|%s|x09|",
+			siemHeaderEscaper.Replace(SIEM_VENDOR),
+			siemHeaderEscaper.Replace(SIEM_PRODUCT),
+			siemHeaderEscaper.Replace(SIEM_VERSION),
+			siemHeaderEscaper.Replace(action))
+		fmt.Fprintf(&b, "cat=%s\tsev=%d", leefValueEscaper.Replace(action), severity)
+		for _, f := range fields {
+			if f.value == "" {
+				continue
+			}
+			fmt.Fprintf(&b, "\t%s=%s", f.leef, leefValueEscaper.Replace(f.value))
+		}
+	}
+	b.WriteString("\n")
+	return []byte(b.String()), nil
+}
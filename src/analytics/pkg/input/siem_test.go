@@ -0,0 +1,100 @@
+package input
+
+import (
+	"strings"
+	"testing"
+)
+
+// An event whose strings try to end header fields and messages early.
+const hostileEvent = `{"action": "evil|act\\\\\r\nCEF:0|forged|x|1|a|a|10|", ` +
+	`"id": "1|2\n3", "device": "host\r\nLEEF:2.0|forged", ` +
+	`"url": "http://x/?a=b|c\td\\", "network": "net=\r\nwork", ` +
+	`"time": "2018-01-01T00:00:00.000Z", "risk": 1.0, ` +
+	`"src": ["ipv4:10.0.0.1", "tcp:1234"], "dest": ["ipv4:10.0.0.2", "tcp:80"]}`
+
+// Splits off the first n fields ending in an unescaped c, returning them
+// and the rest.
+func splitHeader(s string, c byte, n int) ([]string, string) {
+	var fields []string
+	start := 0
+	for i := 0; i < len(s) && len(fields) < n; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case c:
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	return fields, s[start:]
+}
+
+// Counts the occurrences of c not escaped by a backslash.
+func countUnescaped(s string, c byte) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case c:
+			n++
+		}
+	}
+	return n
+}
+
+func encodeSIEM(t *testing.T, format string) string {
+	s := &siemEncoder{format: format}
+	out, err := s.encode([]byte(hostileEvent))
+	if err != nil {
+		t.Fatalf("%s: %s", format, err.Error())
+	}
+	msg := string(out)
+	if strings.Count(msg, "\n") != 1 || !strings.HasSuffix(msg, "\n") {
+		t.Errorf("%s: line breaks in message: %q", format, msg)
+	}
+	if strings.Contains(msg, "\r") {
+		t.Errorf("%s: carriage return in message: %q", format, msg)
+	}
+	return strings.TrimSuffix(msg, "\n")
+}
+
+func TestCEFHostileEvent(t *testing.T) {
+	msg := encodeSIEM(t, "cef")
+	header, ext := splitHeader(msg, '|', 7)
+	if len(header) != 7 || header[0] != "CEF:0" || header[6] != "10" {
+		t.Fatalf("header fields %q", header)
+	}
+	if !strings.HasPrefix(header[4], "evil\\|act") {
+		t.Errorf("action %q", header[4])
+	}
+
+	// Values have their = escaped, so there's one unescaped per key: the
+	// nine set and the label of cs1.
+	if n := countUnescaped(ext, '='); n != 11 {
+		t.Errorf("%d keys in extension, want 11: %q", n, ext)
+	}
+}
+
+func TestLEEFHostileEvent(t *testing.T) {
+	msg := encodeSIEM(t, "leef")
+	header, attrs := splitHeader(msg, '|', 6)
+	if len(header) != 6 || header[0] != "LEEF:2.0" || header[5] != "x09" {
+		t.Fatalf("header fields %q", header)
+	}
+	if !strings.HasPrefix(header[4], "evil\\|act") {
+		t.Errorf("action %q", header[4])
+	}
+
+	want := []string{"cat", "sev", "devTime", "externalId", "identHostName",
+		"src", "srcPort", "dst", "dstPort", "proto", "url", "network"}
+	fields := strings.Split(attrs, "\t")
+	if len(fields) != len(want) {
+		t.Fatalf("got attributes %q, want keys %q", fields, want)
+	}
+	for i, f := range fields {
+		if !strings.HasPrefix(f, want[i]+"=") {
+			t.Errorf("attribute %d: got %q, want key %s", i, f, want[i])
+		}
+	}
+}
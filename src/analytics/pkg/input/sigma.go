@@ -0,0 +1,585 @@
+// Sigma rule matching.  SIGMA_RULES names a rule file, or a directory of
+// .yml and .yaml files, and events matching a rule are tagged with it:
+//
+//   "sigma": [{"id": "...", "title": "Suspicious user agent", "level": "high"}]
+//
+// With SIGMA_OUTPUT set, events matching a rule of SIGMA_ROUTE_LEVEL or
+// above, "high" unless set, are sent there rather than to the pipeline's
+// outputs, so detections reach analysts without waiting behind the bulk.
+//
+// Rules' fields are dotted paths into the event, as elsewhere, and the
+// logsource is ignored.  Detections may use the contains, startswith,
+// endswith, re, cidr and all modifiers, keyword lists, and conditions of
+// and, or, not, parentheses and "1 of" or "all of" a selection pattern or
+// them.  Aggregations and timeframes aren't supported, and a rule using
+// them fails to load.
+
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	SIGMA_ROUTE_LEVEL = "high"
+)
+
+var sigmaLevels = map[string]int{
+	"informational": 0,
+	"low":           1,
+	"medium":        2,
+	"high":          3,
+	"critical":      4,
+}
+
+type sigmaStage struct {
+	rules      []*sigmaRule
+	output     string
+	routeLevel int
+	matches    *prometheus.CounterVec
+}
+
+type sigmaRule struct {
+	id, title, level string
+	rank             int
+	selections       map[string]sigmaSelection
+	condition        sigmaCondition
+}
+
+// A selection matches if any of its groups does, a group if all its fields
+// do.
+type sigmaSelection struct {
+	groups   [][]sigmaField
+	keywords []func(string) bool
+}
+
+type sigmaField struct {
+	path []string
+
+	// Values matching, any of them or, with the all modifier, all.
+	values []func(string) bool
+	all    bool
+
+	// The field must be absent, for a null value.
+	absent bool
+}
+
+// A condition, given a way to evaluate the rule's selections by name.
+type sigmaCondition func(selected func(name string) bool) bool
+
+func newSigmaStage() (stage, error) {
+	path := utils.Getenv("SIGMA_RULES", "")
+	if path == "" {
+		return nil, nil
+	}
+	level := utils.Getenv("SIGMA_ROUTE_LEVEL", SIGMA_ROUTE_LEVEL)
+	routeLevel, ok := sigmaLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("SIGMA_ROUTE_LEVEL: unknown level %q", level)
+	}
+	rules, err := loadSigmaRules(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &sigmaStage{
+		rules:      rules,
+		output:     utils.Getenv("SIGMA_OUTPUT", ""),
+		routeLevel: routeLevel,
+		matches: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sigma_matches",
+				Help: "Events matching Sigma rules, by rule level",
+			},
+			[]string{"level"},
+		),
+	}
+	mustRegister(s.matches)
+	utils.Log("INFO: %d Sigma rules loaded from %s", len(rules), path)
+	return s, nil
+}
+
+func (s *sigmaStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	var tags []interface{}
+	route := false
+	for _, r := range s.rules {
+		if !r.match(fields) {
+			continue
+		}
+		s.matches.With(prometheus.Labels{"level": r.level}).Inc()
+		tags = append(tags, map[string]interface{}{
+			"id":    r.id,
+			"title": r.title,
+			"level": r.level,
+		})
+		if r.rank >= s.routeLevel {
+			route = true
+		}
+	}
+	if tags == nil {
+		return true
+	}
+	fields["sigma"] = tags
+	e.modified()
+	if route && s.output != "" {
+		e.output = s.output
+	}
+	return true
+}
+
+func (r *sigmaRule) match(fields map[string]interface{}) bool {
+	results := map[string]bool{}
+	return r.condition(func(name string) bool {
+		v, ok := results[name]
+		if !ok {
+			v = r.selections[name].match(fields)
+			results[name] = v
+		}
+		return v
+	})
+}
+
+func (sel sigmaSelection) match(fields map[string]interface{}) bool {
+	if sel.keywords != nil {
+		for _, s := range eventStrings(fields) {
+			for _, kw := range sel.keywords {
+				if kw(s) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, group := range sel.groups {
+		matched := true
+		for _, f := range group {
+			if !f.match(fields) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (f sigmaField) match(fields map[string]interface{}) bool {
+	var values []string
+	found := false
+	walkPath(fields, f.path, func(parent map[string]interface{}, key string) {
+		if parent[key] != nil {
+			found = true
+		}
+		values = append(values, eventStrings(parent[key])...)
+	})
+	if f.absent {
+		return !found
+	}
+	matchesAny := func(fn func(string) bool) bool {
+		for _, v := range values {
+			if fn(v) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, fn := range f.values {
+		m := matchesAny(fn)
+		if f.all && !m {
+			return false
+		}
+		if !f.all && m {
+			return true
+		}
+	}
+	return f.all
+}
+
+// Returns the strings and numbers in a node, as strings.
+func eventStrings(node interface{}) []string {
+	switch n := node.(type) {
+	case string:
+		return []string{n}
+	case json.Number:
+		return []string{string(n)}
+	case float64:
+		return []string{strconv.FormatFloat(n, 'f', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(n)}
+	case []interface{}:
+		var out []string
+		for _, v := range n {
+			out = append(out, eventStrings(v)...)
+		}
+		return out
+	case map[string]interface{}:
+		var out []string
+		for _, v := range n {
+			out = append(out, eventStrings(v)...)
+		}
+		return out
+	}
+	return nil
+}
+
+// Loads the rules in a file or directory.
+func loadSigmaRules(path string) ([]*sigmaRule, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("SIGMA_RULES: %s", err.Error())
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		for _, pattern := range []string{"*.yml", "*.yaml"} {
+			matches, _ := filepath.Glob(filepath.Join(path, pattern))
+			files = append(files, matches...)
+		}
+	}
+
+	var rules []*sigmaRule
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		for {
+			var doc map[string]interface{}
+			err := dec.Decode(&doc)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err.Error())
+			}
+			if doc == nil {
+				continue
+			}
+			r, err := parseSigmaRule(doc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err.Error())
+			}
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+func parseSigmaRule(doc map[string]interface{}) (*sigmaRule, error) {
+	r := &sigmaRule{
+		id:         fmt.Sprint(doc["id"]),
+		title:      fmt.Sprint(doc["title"]),
+		level:      "medium",
+		selections: map[string]sigmaSelection{},
+	}
+	if level, ok := doc["level"].(string); ok {
+		r.level = level
+	}
+	rank, ok := sigmaLevels[r.level]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown level %q", r.title, r.level)
+	}
+	r.rank = rank
+
+	detection, ok := doc["detection"].(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: no detection", r.title)
+	}
+	var conditions []string
+	for k, v := range detection {
+		name := fmt.Sprint(k)
+		switch name {
+		case "condition":
+			switch c := v.(type) {
+			case string:
+				conditions = []string{c}
+			case []interface{}:
+				for _, c := range c {
+					conditions = append(conditions, fmt.Sprint(c))
+				}
+			}
+		case "timeframe":
+			return nil, fmt.Errorf("%s: timeframes aren't supported", r.title)
+		default:
+			sel, err := parseSigmaSelection(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", r.title, name, err.Error())
+			}
+			r.selections[name] = sel
+		}
+	}
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("%s: no condition", r.title)
+	}
+
+	// A list of conditions matches if any does.
+	var parsed []sigmaCondition
+	for _, c := range conditions {
+		cond, err := parseSigmaCondition(c, r.selections)
+		if err != nil {
+			return nil, fmt.Errorf("%s: condition %q: %s", r.title, c, err.Error())
+		}
+		parsed = append(parsed, cond)
+	}
+	r.condition = func(selected func(string) bool) bool {
+		for _, c := range parsed {
+			if c(selected) {
+				return true
+			}
+		}
+		return false
+	}
+	return r, nil
+}
+
+func parseSigmaSelection(v interface{}) (sigmaSelection, error) {
+	var sel sigmaSelection
+	switch s := v.(type) {
+	case map[interface{}]interface{}:
+		group, err := parseSigmaGroup(s)
+		if err != nil {
+			return sel, err
+		}
+		sel.groups = append(sel.groups, group)
+	case []interface{}:
+		for _, item := range s {
+			if m, ok := item.(map[interface{}]interface{}); ok {
+				group, err := parseSigmaGroup(m)
+				if err != nil {
+					return sel, err
+				}
+				sel.groups = append(sel.groups, group)
+				continue
+			}
+			// Keywords, searched for anywhere in the event.
+			fn, err := sigmaValue(fmt.Sprint(item), "contains")
+			if err != nil {
+				return sel, err
+			}
+			sel.keywords = append(sel.keywords, fn)
+		}
+	default:
+		return sel, fmt.Errorf("expected a map or list")
+	}
+	return sel, nil
+}
+
+func parseSigmaGroup(m map[interface{}]interface{}) ([]sigmaField, error) {
+	var group []sigmaField
+	for k, v := range m {
+		parts := strings.Split(fmt.Sprint(k), "|")
+		f := sigmaField{path: strings.Split(parts[0], ".")}
+		modifier := ""
+		for _, mod := range parts[1:] {
+			switch mod {
+			case "all":
+				f.all = true
+			case "contains", "startswith", "endswith", "re", "cidr":
+				modifier = mod
+			default:
+				return nil, fmt.Errorf("%s: unsupported modifier %q", parts[0], mod)
+			}
+		}
+		values, ok := v.([]interface{})
+		if !ok {
+			values = []interface{}{v}
+		}
+		for _, value := range values {
+			if value == nil {
+				f.absent = true
+				continue
+			}
+			fn, err := sigmaValue(fmt.Sprint(value), modifier)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", parts[0], err.Error())
+			}
+			f.values = append(f.values, fn)
+		}
+		group = append(group, f)
+	}
+	return group, nil
+}
+
+// Returns a matcher for a value with a modifier.  Values are matched
+// case-insensitively, with * and ? as wildcards, except as regular
+// expressions and CIDR blocks.
+func sigmaValue(value, modifier string) (func(string) bool, error) {
+	switch modifier {
+	case "re":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	case "cidr":
+		_, block, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) bool {
+			// Addresses in src and dest are prefixed with their kind.
+			if strings.HasPrefix(s, "ipv4:") || strings.HasPrefix(s, "ipv6:") {
+				s = s[5:]
+			}
+			ip := net.ParseIP(s)
+			return ip != nil && block.Contains(ip)
+		}, nil
+	case "contains":
+		value = "*" + value + "*"
+	case "startswith":
+		value = value + "*"
+	case "endswith":
+		value = "*" + value
+	}
+	pattern := regexp.QuoteMeta(value)
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+	re, err := regexp.Compile("(?is)^" + pattern + "$")
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+// Parses a condition, over the named selections.
+func parseSigmaCondition(s string, selections map[string]sigmaSelection) (sigmaCondition, error) {
+	s = strings.Replace(s, "(", " ( ", -1)
+	s = strings.Replace(s, ")", " ) ", -1)
+	p := &sigmaParser{tokens: strings.Fields(s), selections: selections}
+	cond, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return cond, nil
+}
+
+type sigmaParser struct {
+	tokens     []string
+	pos        int
+	selections map[string]sigmaSelection
+}
+
+func (p *sigmaParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *sigmaParser) or() (sigmaCondition, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(sel func(string) bool) bool { return l(sel) || right(sel) }
+	}
+	return left, nil
+}
+
+func (p *sigmaParser) and() (sigmaCondition, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(sel func(string) bool) bool { return l(sel) && right(sel) }
+	}
+	return left, nil
+}
+
+func (p *sigmaParser) not() (sigmaCondition, error) {
+	if p.peek() == "not" {
+		p.pos++
+		c, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(sel func(string) bool) bool { return !c(sel) }, nil
+	}
+	return p.term()
+}
+
+func (p *sigmaParser) term() (sigmaCondition, error) {
+	tok := p.peek()
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end")
+	case tok == "(":
+		p.pos++
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return c, nil
+	case tok == "|":
+		return nil, fmt.Errorf("aggregations aren't supported")
+	case (tok == "1" || tok == "any" || tok == "all") &&
+		p.pos+2 < len(p.tokens) && strings.ToLower(p.tokens[p.pos+1]) == "of":
+		all := tok == "all"
+		pattern := p.tokens[p.pos+2]
+		p.pos += 3
+		var names []string
+		for name := range p.selections {
+			if ok, _ := filepath.Match(pattern, name); ok || pattern == "them" {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no selections match %q", pattern)
+		}
+		return func(sel func(string) bool) bool {
+			for _, name := range names {
+				if sel(name) != all {
+					return !all
+				}
+			}
+			return all
+		}, nil
+	}
+	name := p.tokens[p.pos]
+	if _, ok := p.selections[name]; !ok {
+		return nil, fmt.Errorf("unknown selection %q", name)
+	}
+	p.pos++
+	return func(sel func(string) bool) bool { return sel(name) }, nil
+}
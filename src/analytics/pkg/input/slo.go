@@ -0,0 +1,186 @@
+// Ingest SLIs.  With SLO_LATENCY set, each event an output accepts, fails
+// to accept or drops for its TTL is counted, and for each of the rolling
+// windows in SLO_WINDOWS the bridge exports
+//
+//   slo_latency_ratio{window}     fraction delivered within SLO_LATENCY
+//   slo_delivery_ratio{window}    fraction accepted by the first publish
+//   slo_error_budget_remaining{sli, window}
+//
+// the last being the part of the budget SLO_TARGET allows which is left,
+// negative once it's spent, so an ingest SLO can be tracked per collector
+// without histogram arithmetic.  A window with no events reports 1.  The
+// windows are counted in slots of a tenth of the shortest.
+
+package input
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	SLO_WINDOWS = "5m,1h,24h"
+	SLO_TARGET  = "0.999"
+)
+
+type sloSlot struct {
+	events, fast, firstTry int64
+}
+
+type sloTracker struct {
+	latency time.Duration
+	target  float64
+	windows []time.Duration
+
+	mutex   sync.Mutex
+	slot    time.Duration
+	slots   []sloSlot
+	current int
+	ends    time.Time
+}
+
+// Returns the tracker, nil unless SLO_LATENCY is set.
+func newSLOTracker() (*sloTracker, error) {
+	v := utils.Getenv("SLO_LATENCY", "")
+	if v == "" {
+		return nil, nil
+	}
+	latency, err := time.ParseDuration(v)
+	if err != nil || latency <= 0 {
+		return nil, fmt.Errorf("SLO_LATENCY: must be a positive duration")
+	}
+	target, err := strconv.ParseFloat(utils.Getenv("SLO_TARGET", SLO_TARGET), 64)
+	if err != nil || target <= 0 || target >= 1 {
+		return nil, fmt.Errorf("SLO_TARGET: must be between 0 and 1")
+	}
+	t := &sloTracker{latency: latency, target: target}
+	var shortest, longest time.Duration
+	for _, w := range splitList(utils.Getenv("SLO_WINDOWS", SLO_WINDOWS)) {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("SLO_WINDOWS: %q is not a duration", w)
+		}
+		if shortest == 0 || d < shortest {
+			shortest = d
+		}
+		if d > longest {
+			longest = d
+		}
+		t.windows = append(t.windows, d)
+	}
+	if len(t.windows) == 0 {
+		return nil, fmt.Errorf("SLO_WINDOWS: no windows given")
+	}
+	t.slot = shortest / 10
+	if t.slot < time.Second {
+		t.slot = time.Second
+	}
+	t.slots = make([]sloSlot, int(longest/t.slot)+1)
+	t.ends = time.Now().Add(t.slot)
+
+	for _, w := range t.windows {
+		w := w
+		labels := prometheus.Labels{"window": w.String()}
+		mustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "slo_latency_ratio",
+				Help:        "Fraction of events delivered within SLO_LATENCY",
+				ConstLabels: labels,
+			}, func() float64 {
+				fast, _ := t.ratios(w)
+				return fast
+			}),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "slo_delivery_ratio",
+				Help:        "Fraction of events accepted by their first publish",
+				ConstLabels: labels,
+			}, func() float64 {
+				_, firstTry := t.ratios(w)
+				return firstTry
+			}),
+		)
+		for _, sli := range []string{"latency", "delivery"} {
+			sli := sli
+			mustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "slo_error_budget_remaining",
+				Help:        "Fraction of the error budget left",
+				ConstLabels: prometheus.Labels{"sli": sli, "window": w.String()},
+			}, func() float64 {
+				fast, firstTry := t.ratios(w)
+				good := fast
+				if sli == "delivery" {
+					good = firstTry
+				}
+				return 1 - (1-good)/(1-t.target)
+			}))
+		}
+	}
+	utils.Log("INFO: Tracking ingest SLIs over %s, within %s", utils.Getenv("SLO_WINDOWS", SLO_WINDOWS), latency)
+	return t, nil
+}
+
+// Moves on to the slot covering now.  Called with the mutex held.
+func (t *sloTracker) advance(now time.Time) {
+	for i := 0; now.After(t.ends) && i < len(t.slots); i++ {
+		t.current = (t.current + 1) % len(t.slots)
+		t.slots[t.current] = sloSlot{}
+		t.ends = t.ends.Add(t.slot)
+	}
+	if now.After(t.ends) {
+		// Idle for longer than every window.
+		t.ends = now.Add(t.slot)
+	}
+}
+
+// Records an event accepted by its output, latency after being read.
+func (t *sloTracker) delivered(latency time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.advance(time.Now())
+	s := &t.slots[t.current]
+	s.events++
+	s.firstTry++
+	if latency <= t.latency {
+		s.fast++
+	}
+}
+
+// Records n events not delivered, through a failed publish or expiry.
+func (t *sloTracker) failed(n int) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.advance(time.Now())
+	t.slots[t.current].events += int64(n)
+}
+
+// Returns the fractions of events in the window delivered in time and
+// delivered first time.
+func (t *sloTracker) ratios(window time.Duration) (float64, float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.advance(time.Now())
+	var sum sloSlot
+	n := int(window / t.slot)
+	for i := 0; i < n && i < len(t.slots); i++ {
+		s := t.slots[(t.current-i+len(t.slots))%len(t.slots)]
+		sum.events += s.events
+		sum.fast += s.fast
+		sum.firstTry += s.firstTry
+	}
+	if sum.events == 0 {
+		return 1, 1
+	}
+	return float64(sum.fast) / float64(sum.events),
+		float64(sum.firstTry) / float64(sum.events)
+}
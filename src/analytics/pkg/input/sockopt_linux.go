@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package input
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+func setKeepAliveCount(fd uintptr, n int) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, n)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package input
+
+import (
+	"fmt"
+)
+
+const reusePortSupported = false
+
+func setReusePort(fd uintptr) error {
+	return fmt.Errorf("SO_REUSEPORT is only supported on Linux")
+}
+
+func setKeepAliveCount(fd uintptr, n int) error {
+	return fmt.Errorf("TCP_KEEPALIVE_COUNT is only supported on Linux")
+}
@@ -0,0 +1,241 @@
+// Handoff of unsent events between instances.  With SPOOL_DIR pointing at a
+// directory shared by the instances, a volume such as NFS, an instance
+// shutting down writes whatever is still queued there instead of waiting
+// for its outputs to take it, which they may not under backlog.  Every
+// instance scans the directory each SPOOL_SCAN_INTERVAL, claims any spool
+// files left by others and sends their events, so a rolling deploy doesn't
+// lose a backlog.
+//
+// Files are named <instance>.<output>.spool, the names path escaped with
+// their dots too, written as .tmp and renamed once complete.  A claim renames the file to .<claimer>.claimed, which only
+// one instance can do, and the file is removed once its events are queued.
+// An instance restarting with the same name picks its own claims up again.
+
+package input
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	SPOOL_SCAN_INTERVAL = "10s"
+)
+
+type spoolFile struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+type spool struct {
+	dir      string
+	interval time.Duration
+
+	mutex sync.Mutex
+	files map[string]*spoolFile
+
+	done     chan bool
+	draining sync.WaitGroup
+
+	spooled   prometheus.Counter
+	recovered prometheus.Counter
+}
+
+func newSpool() (*spool, error) {
+	dir := utils.Getenv("SPOOL_DIR", "")
+	if dir == "" || toolMode {
+		return nil, nil
+	}
+	interval, err := time.ParseDuration(utils.Getenv("SPOOL_SCAN_INTERVAL",
+		SPOOL_SCAN_INTERVAL))
+	if err != nil {
+		return nil, fmt.Errorf("SPOOL_SCAN_INTERVAL: %s", err.Error())
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	sp := &spool{
+		dir:      dir,
+		interval: interval,
+		files:    map[string]*spoolFile{},
+		done:     make(chan bool),
+		spooled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "spooled_events",
+			Help: "Unsent events handed off at shutdown",
+		}),
+		recovered: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "spool_recovered_events",
+			Help: "Events taken over from spool files",
+		}),
+	}
+	mustRegister(sp.spooled)
+	mustRegister(sp.recovered)
+	return sp, nil
+}
+
+// Writes an unsent event to the spool.
+func (sp *spool) write(output string, data []byte) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	f, ok := sp.files[output]
+	if !ok {
+		name := filepath.Join(sp.dir,
+			spoolEscape(instanceID)+"."+spoolEscape(output)+".spool.tmp")
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			utils.Log("ERROR: Unable to spool events: %s", err.Error())
+			sp.files[output] = nil
+			return
+		}
+		f = &spoolFile{file: file, writer: bufio.NewWriter(file)}
+		sp.files[output] = f
+	}
+	if f == nil {
+		return
+	}
+	f.writer.Write(data)
+	sp.spooled.Inc()
+}
+
+// Completes the spool files, making them available to other instances.
+func (sp *spool) close() {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	for output, f := range sp.files {
+		if f == nil {
+			continue
+		}
+		err := f.writer.Flush()
+		if err == nil {
+			err = f.file.Close()
+		}
+		if err != nil {
+			utils.Log("ERROR: Unable to spool events for %s: %s", output, err.Error())
+			continue
+		}
+		tmp := f.file.Name()
+		if err := os.Rename(tmp, strings.TrimSuffix(tmp, ".tmp")); err != nil {
+			utils.Log("ERROR: Unable to complete spool file: %s", err.Error())
+		}
+	}
+	sp.files = map[string]*spoolFile{}
+}
+
+// Starts taking over spool files, passing their events to enqueue.
+func (sp *spool) start(enqueue func(e *event)) {
+	sp.draining.Add(1)
+	go func() {
+		defer sp.draining.Done()
+		ticker := time.NewTicker(sp.interval)
+		defer ticker.Stop()
+		for {
+			sp.scan(enqueue)
+			select {
+			case <-sp.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stops taking over spool files.  A file part way through is finished.
+func (sp *spool) stop() {
+	close(sp.done)
+	sp.draining.Wait()
+}
+
+func (sp *spool) scan(enqueue func(e *event)) {
+	// Our own claims first, left by a run which didn't finish them.
+	claims, _ := filepath.Glob(filepath.Join(sp.dir, "*."+spoolEscape(instanceID)+".claimed"))
+	for _, claim := range claims {
+		sp.drain(claim, enqueue)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(sp.dir, "*.spool"))
+	for _, name := range files {
+		select {
+		case <-sp.done:
+			return
+		default:
+		}
+		claim := name + "." + spoolEscape(instanceID) + ".claimed"
+		if os.Rename(name, claim) != nil {
+			// Another instance got it first.
+			continue
+		}
+		sp.drain(claim, enqueue)
+	}
+}
+
+// Queues the events in a claimed file, then removes it.
+func (sp *spool) drain(name string, enqueue func(e *event)) {
+	base := filepath.Base(name)
+	j := strings.LastIndex(base, ".spool.")
+	if j < 0 {
+		return
+	}
+	i := strings.LastIndex(base[:j], ".")
+	if i < 0 {
+		return
+	}
+	from, err := url.PathUnescape(base[:i])
+	if err != nil {
+		utils.Log("WARN: Ignoring spool file %s: %s", base, err.Error())
+		return
+	}
+	output, err := url.PathUnescape(base[i+1 : j])
+	if err != nil {
+		utils.Log("WARN: Ignoring spool file %s: %s", base, err.Error())
+		return
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		utils.Log("WARN: Unable to read spool file %s: %s", base, err.Error())
+		return
+	}
+	defer file.Close()
+
+	n := 0
+	r := bufio.NewReader(file)
+	for {
+		data, err := r.ReadBytes('\n')
+		if len(data) > 0 {
+			enqueue(&event{
+				data:     data,
+				output:   output,
+				received: time.Now(),
+			})
+			n++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			utils.Log("WARN: Unable to read spool file %s: %s", base, err.Error())
+			return
+		}
+	}
+	sp.recovered.Add(float64(n))
+	utils.Log("INFO: Took over %d events for %s from %s", n, output, from)
+	os.Remove(name)
+}
+
+// Escapes a name for a spool file name, where dots separate the parts and
+// the names are globbed.
+func spoolEscape(name string) string {
+	return strings.Replace(url.PathEscape(name), ".", "%2E", -1)
+}
@@ -0,0 +1,53 @@
+// Stale event filtering.  Events older than MAX_EVENT_AGE, by their own
+// timestamp, are sent to STALE_OUTPUT, or dropped if that isn't set, so a
+// probe flushing an old backlog doesn't skew real-time detection.
+
+package input
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type staleStage struct {
+	maxAge time.Duration
+	output string
+	stale  prometheus.Counter
+}
+
+func newStaleStage() (stage, error) {
+	age := utils.Getenv("MAX_EVENT_AGE", "")
+	if age == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(age)
+	if err != nil {
+		return nil, fmt.Errorf("MAX_EVENT_AGE: %s", err.Error())
+	}
+	s := &staleStage{
+		maxAge: d,
+		output: utils.Getenv("STALE_OUTPUT", ""),
+		stale: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "stale_events",
+			Help: "Events older than the maximum age",
+		}),
+	}
+	mustRegister(s.stale)
+	return s, nil
+}
+
+func (s *staleStage) process(e *event) bool {
+	t, err := e.time()
+	if err != nil {
+		return true
+	}
+	if e.received.Sub(t) <= s.maxAge {
+		return true
+	}
+	s.stale.Inc()
+	e.output = s.output
+	return false
+}
@@ -0,0 +1,43 @@
+// Provenance stamping.  With STAMP_EVENTS set, each event is annotated with
+// when and where the bridge received it:
+//
+//   "bridge": {"received": "2018-..Z", "instance": "input-1", "remote": "10.1.2.3:5678"}
+
+package input
+
+import (
+	"os"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Identifies this bridge instance in stamped events and elsewhere.  Defaults
+// to the hostname, which is the pod name under Kubernetes.
+var instanceID = func() string {
+	host, _ := os.Hostname()
+	return utils.Getenv("INSTANCE_ID", host)
+}()
+
+type stampStage struct{}
+
+func newStampStage() (stage, error) {
+	if utils.Getenv("STAMP_EVENTS", "") == "" {
+		return nil, nil
+	}
+	return stampStage{}, nil
+}
+
+func (stampStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	annotate(fields, "bridge", "received", e.received.UTC().Format(time.RFC3339Nano))
+	annotate(fields, "bridge", "instance", instanceID)
+	if e.remote != nil {
+		annotate(fields, "bridge", "remote", e.remote.String())
+	}
+	e.modified()
+	return true
+}
@@ -0,0 +1,34 @@
+// Notice of changes to the state connections are served under, leadership
+// and draining, so serve loops blocked reading can look again at once
+// rather than polling.
+
+package input
+
+import (
+	"sync"
+)
+
+type stateSignal struct {
+	mutex sync.Mutex
+	ch    chan struct{}
+}
+
+func newStateSignal() *stateSignal {
+	return &stateSignal{ch: make(chan struct{})}
+}
+
+// Returns a channel closed at the next change.  Take it before looking at
+// the state, so a change in between isn't missed.
+func (s *stateSignal) next() <-chan struct{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ch
+}
+
+// Wakes everyone waiting for a change.
+func (s *stateSignal) changed() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	close(s.ch)
+	s.ch = make(chan struct{})
+}
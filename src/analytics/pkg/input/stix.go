@@ -0,0 +1,293 @@
+// STIX 2.1 output encoding, for threat intelligence sharing.  Connection,
+// DNS and HTTP events become a bundle holding an observed-data object and
+// the observables it refers to: the addresses and traffic between them,
+// the domain names asked about and answered, and the URL requested.  Other
+// events aren't sent to the output.  Observables have the deterministic IDs
+// STIX defines, so the same address or domain is the same object whichever
+// event it came from.
+//
+// Bundles can go to a queue like any other encoding, or to a TAXII 2.1
+// collection: TAXII_OUTPUT names an output whose events are added to the
+// collection whose objects endpoint is TAXII_URL, such as
+// https://taxii.example.com/api/collections/<id>/objects/, authenticating
+// with TAXII_USER and TAXII_PASSWORD if set.  The bridge won't start unless
+// OUTPUT_ENCODINGS encodes that output as stix, and it's neither compressed
+// nor batched.
+
+package input
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Events with observables worth sharing.
+var stixActions = map[string]bool{
+	"connection_up": true,
+	"dns_message":   true,
+	"http_request":  true,
+	"http_response": true,
+}
+
+// The namespace of STIX observable IDs.
+var stixNamespace = [16]byte{
+	0x00, 0xab, 0xed, 0xb4, 0xaa, 0x42, 0x46, 0x6c,
+	0x9c, 0x01, 0xfe, 0xd2, 0x33, 0x15, 0xa9, 0xb7,
+}
+
+type stixEncoder struct{}
+
+func newSTIXEncoder() (encoder, error) {
+	return stixEncoder{}, nil
+}
+
+func formatUUID(u []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// Returns a random ID, for the objects which aren't observables.
+func stixRandomID(kind string) string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return kind + "--" + formatUUID(u[:])
+}
+
+// Collects the objects of a bundle, each observable once.
+type stixObjects struct {
+	objects []map[string]interface{}
+	ids     map[string]bool
+}
+
+// Adds an observable with the properties which identify it, returning its
+// ID.
+func (o *stixObjects) observable(kind string, props map[string]interface{}) string {
+	// The ID is a UUIDv5 of the properties, as canonical JSON.
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonical bytes.Buffer
+	canonical.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			canonical.WriteString(",")
+		}
+		kj, _ := json.Marshal(k)
+		vj, _ := json.Marshal(props[k])
+		canonical.Write(kj)
+		canonical.WriteString(":")
+		canonical.Write(vj)
+	}
+	canonical.WriteString("}")
+	h := sha1.New()
+	h.Write(stixNamespace[:])
+	h.Write(canonical.Bytes())
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	id := kind + "--" + formatUUID(u)
+
+	if !o.ids[id] {
+		obj := map[string]interface{}{
+			"type":         kind,
+			"spec_version": "2.1",
+			"id":           id,
+		}
+		for k, v := range props {
+			obj[k] = v
+		}
+		o.objects = append(o.objects, obj)
+		o.ids[id] = true
+	}
+	return id
+}
+
+// Adds the address of a cyberprobe address list, returning its ID, and the
+// transport protocol and port.
+func (o *stixObjects) address(addrs []string) (id, proto string, port int) {
+	for _, a := range addrs {
+		i := strings.Index(a, ":")
+		if i < 0 {
+			continue
+		}
+		switch kind, v := a[:i], a[i+1:]; kind {
+		case "ipv4", "ipv6":
+			if id == "" {
+				id = o.observable(kind+"-addr", map[string]interface{}{"value": v})
+			}
+		case "tcp", "udp":
+			if proto == "" {
+				proto = kind
+				fmt.Sscan(v, &port)
+			}
+		}
+	}
+	return
+}
+
+func (stixEncoder) encode(msg []byte) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return nil, err
+	}
+	action, _ := fields["action"].(string)
+	if !stixActions[action] {
+		return nil, errNotEncoded
+	}
+	env, err := splitEnvelope(msg)
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseEventTime(env.strings["time"])
+	if err != nil {
+		t = time.Now()
+	}
+
+	o := &stixObjects{ids: map[string]bool{}}
+	src, proto, srcPort := o.address(env.src)
+	dst, _, dstPort := o.address(env.dest)
+	if src != "" && dst != "" {
+		traffic := map[string]interface{}{
+			"src_ref": src,
+			"dst_ref": dst,
+		}
+		if proto != "" {
+			network := strings.SplitN(src, "-", 2)[0]
+			traffic["protocols"] = []string{network, proto}
+			traffic["src_port"] = srcPort
+			traffic["dst_port"] = dstPort
+		}
+		o.observable("network-traffic", traffic)
+	}
+
+	if dns, ok := fields["dns_message"].(map[string]interface{}); ok {
+		for _, section := range []string{"query", "answer"} {
+			records, _ := dns[section].([]interface{})
+			for _, r := range records {
+				r, _ := r.(map[string]interface{})
+				name, _ := r["name"].(string)
+				if name == "" {
+					continue
+				}
+				props := map[string]interface{}{"value": strings.TrimSuffix(name, ".")}
+				if addr, ok := r["address"].(string); ok && addr != "" {
+					kind := "ipv4-addr"
+					if strings.Contains(addr, ":") {
+						kind = "ipv6-addr"
+					}
+					props["resolves_to_refs"] = []string{
+						o.observable(kind, map[string]interface{}{"value": addr}),
+					}
+				}
+				o.observable("domain-name", props)
+			}
+		}
+	}
+	if u := env.strings["url"]; u != "" {
+		o.observable("url", map[string]interface{}{"value": u})
+	}
+	if len(o.objects) == 0 {
+		return nil, errNotEncoded
+	}
+
+	refs := make([]string, len(o.objects))
+	for i, obj := range o.objects {
+		refs[i] = obj["id"].(string)
+	}
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	observed := t.UTC().Format("2006-01-02T15:04:05.000Z")
+	objects := append([]map[string]interface{}{{
+		"type":            "observed-data",
+		"spec_version":    "2.1",
+		"id":              stixRandomID("observed-data"),
+		"created":         now,
+		"modified":        now,
+		"first_observed":  observed,
+		"last_observed":   observed,
+		"number_observed": 1,
+		"object_refs":     refs,
+	}}, o.objects...)
+	bundle, err := json.Marshal(map[string]interface{}{
+		"type":    "bundle",
+		"id":      stixRandomID("bundle"),
+		"objects": objects,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(bundle, '\n'), nil
+}
+
+// A TAXII 2.1 collection, taking bundles encoded as above.
+type taxiiOutput struct {
+	name     string
+	url      string
+	user     string
+	password string
+	client   *http.Client
+}
+
+// Returns the TAXII output, nil if TAXII_OUTPUT isn't set.
+func newTAXIIOutput() (*taxiiOutput, error) {
+	name := utils.Getenv("TAXII_OUTPUT", "")
+	if name == "" {
+		return nil, nil
+	}
+	url := utils.Getenv("TAXII_URL", "")
+	if url == "" {
+		return nil, fmt.Errorf("TAXII_URL: must be set with TAXII_OUTPUT")
+	}
+	utils.Log("INFO: Output %s added to TAXII collection %s", name, url)
+	return &taxiiOutput{
+		name:     name,
+		url:      url,
+		user:     utils.Getenv("TAXII_USER", ""),
+		password: utils.Getenv("TAXII_PASSWORD", ""),
+		client:   &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// Adds a bundle's objects to the collection.
+func (t *taxiiOutput) send(ctx context.Context, msg []byte) error {
+	var bundle struct {
+		Objects []json.RawMessage `json:"objects"`
+	}
+	if err := json.Unmarshal(msg, &bundle); err != nil {
+		return fmt.Errorf("not a STIX bundle: %s", err.Error())
+	}
+	envelope, err := json.Marshal(map[string]interface{}{"objects": bundle.Objects})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(envelope))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/taxii+json;version=2.1")
+	req.Header.Set("Accept", "application/taxii+json;version=2.1")
+	if t.user != "" {
+		req.SetBasicAuth(t.user, t.password)
+	}
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("TAXII server answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Strict protocol mode.  With STRICT_MODE set the bridge answers each event
+// it rejects, because it was larger than MAX_EVENT_SIZE, wasn't JSON or
+// failed validation, with an error line on the same connection:
+//
+//   {"error":"schema: ...","id":"<event id>"}
+//
+// so a misconfigured probe finds out from its own logs.  Probes which never
+// read from the socket are unaffected, the replies are written with a short
+// deadline and given up on if the probe isn't reading.
+
+package input
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	// Time allowed to write an error reply.
+	REPLY_TIMEOUT = 100 * time.Millisecond
+)
+
+// Reports whether STRICT_MODE is set.
+func strictMode() bool {
+	return utils.Getenv("STRICT_MODE", "") == "true"
+}
+
+var oversizedEvents = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "oversized_events",
+	Help: "Events dropped for exceeding the maximum event size",
+})
+
+type errorReply struct {
+	Error string `json:"error"`
+	ID    string `json:"id,omitempty"`
+}
+
+// Tells the probe an event was rejected.  id may be empty if the event was
+// unreadable.
+func (s *Service) replyError(conn net.Conn, problem, id string) {
+	if !s.strict {
+		return
+	}
+	line, err := json.Marshal(errorReply{Error: problem, ID: id})
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(REPLY_TIMEOUT))
+	_, err = conn.Write(append(line, '\n'))
+	if err != nil {
+		utils.Log("WARN: Unable to send error reply to: %s, %s",
+			conn.RemoteAddr(), err.Error())
+	}
+}
@@ -0,0 +1,248 @@
+// Suricata EVE JSON, for pipelines with "format": "eve", so IDS alerts take
+// the same pipeline as cybermon's events.  EVE_MODE decides what's done with
+// each record:
+//
+//   map    rewritten as a cybermon event, the default
+//   tag    passed on as it is, with "source": "suricata" added
+//
+// Mapped records take the cybermon fields:
+//
+//   timestamp                        time
+//   host                             device, else the sensor's address
+//   src_ip, src_port, proto          src, as ["ipv4:10.0.0.1", "tcp:1234"]
+//   dest_ip, dest_port               dest
+//   event_type                       action, suricata_alert, suricata_flow...
+//   alert.severity                   risk, 1.0 for severity 1 down to 0.2
+//   dns, http                        dns_message, http_request and url, with
+//                                    the dns_message and http_request actions
+//
+// and the rest of the record, including the alert and the dns or http
+// object as Suricata gave it, is kept under "suricata".
+
+package input
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	EVE_MODE = "map"
+
+	// EVE's timestamp layout, which RFC 3339 parsing doesn't take.
+	eveTimeLayout = "2006-01-02T15:04:05.999999-0700"
+)
+
+type eveFormat struct {
+	mapped bool
+}
+
+func newEVEFormat() (stage, error) {
+	switch mode := utils.Getenv("EVE_MODE", EVE_MODE); mode {
+	case "map":
+		return &eveFormat{mapped: true}, nil
+	case "tag":
+		return &eveFormat{}, nil
+	default:
+		return nil, fmt.Errorf("EVE_MODE: expected map or tag, got %q", mode)
+	}
+}
+
+func (f *eveFormat) process(e *event) bool {
+	rec, err := e.decode()
+	if err != nil {
+		return reject(e, "invalid EVE record: "+err.Error())
+	}
+	if !f.mapped {
+		rec["source"] = "suricata"
+		e.modified()
+		return true
+	}
+	e.fields = mapEVE(rec, e.remote)
+	e.modified()
+	return true
+}
+
+// Returns the cybermon event for an EVE record, taking the fields it maps
+// out of the record.
+func mapEVE(rec map[string]interface{}, remote net.Addr) map[string]interface{} {
+	take := func(name string) interface{} {
+		v := rec[name]
+		delete(rec, name)
+		return v
+	}
+	takeString := func(name string) string {
+		s, _ := take(name).(string)
+		return s
+	}
+
+	ev := map[string]interface{}{
+		"id":     randomEventID(),
+		"source": "suricata",
+	}
+
+	ts := takeString("timestamp")
+	if t, err := time.Parse(eveTimeLayout, ts); err == nil {
+		ev["time"] = t.UTC().Format("2006-01-02T15:04:05.000Z")
+	} else if ts != "" {
+		ev["time"] = ts
+	}
+
+	if host := takeString("host"); host != "" {
+		ev["device"] = host
+	} else if tcp, ok := remote.(*net.TCPAddr); ok {
+		ev["device"] = tcp.IP.String()
+	}
+
+	proto := strings.ToLower(takeString("proto"))
+	if src := addressList(take("src_ip"), take("src_port"), proto); src != nil {
+		ev["src"] = src
+	}
+	if dest := addressList(take("dest_ip"), take("dest_port"), proto); dest != nil {
+		ev["dest"] = dest
+	}
+
+	kind := takeString("event_type")
+	ev["action"] = "suricata_" + kind
+	switch kind {
+	case "alert":
+		if alert, ok := rec["alert"].(map[string]interface{}); ok {
+			if sev, ok := jsonFloat(alert["severity"]); ok && sev >= 1 {
+				ev["risk"] = eveRisk(sev)
+			}
+		}
+	case "dns":
+		if dns, ok := rec["dns"].(map[string]interface{}); ok {
+			ev["action"] = "dns_message"
+			ev["dns_message"] = eveDNS(dns)
+		}
+	case "http":
+		if http, ok := rec["http"].(map[string]interface{}); ok {
+			ev["action"] = "http_request"
+			ev["http_request"] = eveHTTP(http)
+			host, _ := http["hostname"].(string)
+			path, _ := http["url"].(string)
+			if host != "" {
+				ev["url"] = "http://" + host + path
+			}
+		}
+	}
+
+	if len(rec) > 0 {
+		ev["suricata"] = rec
+	}
+	return ev
+}
+
+// Returns a random event ID, for records without one of their own.
+func randomEventID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u[:])
+}
+
+// Returns a cyberprobe address list, nil if there's no address.
+func addressList(ip, port interface{}, proto string) []string {
+	addr, _ := ip.(string)
+	parsed := net.ParseIP(addr)
+	if parsed == nil {
+		return nil
+	}
+	list := []string{"ipv6:" + addr}
+	if parsed.To4() != nil {
+		list[0] = "ipv4:" + addr
+	}
+	if p, ok := jsonFloat(port); ok && (proto == "tcp" || proto == "udp") {
+		list = append(list, fmt.Sprintf("%s:%d", proto, int(p)))
+	}
+	return list
+}
+
+// Maps Suricata's severity, 1 the most severe, to a risk between 0 and 1.
+func eveRisk(severity float64) float64 {
+	risk := 1.2 - 0.2*severity
+	if risk < 0.2 {
+		risk = 0.2
+	}
+	return risk
+}
+
+// Maps an EVE dns object, in either the version 1 or 2 layout.
+func eveDNS(dns map[string]interface{}) map[string]interface{} {
+	msg := map[string]interface{}{}
+	switch t, _ := dns["type"].(string); t {
+	case "query":
+		msg["type"] = "query"
+	case "answer":
+		msg["type"] = "response"
+	}
+	if name, ok := dns["rrname"].(string); ok && msg["type"] == "query" {
+		msg["query"] = []interface{}{map[string]interface{}{
+			"name": name,
+			"type": dns["rrtype"],
+		}}
+	}
+
+	var answers []interface{}
+	add := func(a map[string]interface{}) {
+		answer := map[string]interface{}{
+			"name": a["rrname"],
+			"type": a["rrtype"],
+		}
+		if data, ok := a["rdata"].(string); ok && net.ParseIP(data) != nil {
+			answer["address"] = data
+		}
+		answers = append(answers, answer)
+	}
+	if list, ok := dns["answers"].([]interface{}); ok {
+		for _, a := range list {
+			if a, ok := a.(map[string]interface{}); ok {
+				add(a)
+			}
+		}
+	} else if msg["type"] == "response" {
+		// Version 1 logs an answer a record.
+		if _, ok := dns["rdata"]; ok {
+			add(dns)
+		}
+	}
+	if name, ok := dns["rrname"].(string); ok && msg["type"] == "response" {
+		msg["query"] = []interface{}{map[string]interface{}{"name": name}}
+	}
+	if answers != nil {
+		msg["answer"] = answers
+	}
+	if rcode, ok := dns["rcode"].(string); ok {
+		msg["rcode"] = rcode
+	}
+	return msg
+}
+
+// Maps an EVE http object.
+func eveHTTP(http map[string]interface{}) map[string]interface{} {
+	header := map[string]interface{}{}
+	if host, ok := http["hostname"].(string); ok {
+		header["Host"] = host
+	}
+	if ua, ok := http["http_user_agent"].(string); ok {
+		header["User-Agent"] = ua
+	}
+	if ref, ok := http["http_refer"].(string); ok {
+		header["Referer"] = ref
+	}
+	if ct, ok := http["http_content_type"].(string); ok {
+		header["Content-Type"] = ct
+	}
+	req := map[string]interface{}{"header": header}
+	if method, ok := http["http_method"].(string); ok {
+		req["method"] = method
+	}
+	return req
+}
@@ -0,0 +1,156 @@
+// Live tail of the events being forwarded, for checking data is flowing
+// without consuming from the queues.  GET /admin/tail streams events as
+// server-sent events, once processed and so redacted as configured.  Query
+// parameters other than "sample" are top level field values an event must
+// have, and sample=N passes one matching event in N:
+//
+//   curl -N -H "Authorization: Bearer $ADMIN_TOKEN" \
+//       'http://bridge:8080/admin/tail?action=dns_message&sample=100'
+//
+// A client which can't keep up misses events rather than holding up the
+// bridge.
+
+package input
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	// Events buffered for each tail client.
+	tailBufferSize = 256
+
+	// Interval between comments keeping idle streams open through proxies.
+	tailKeepalive = 15 * time.Second
+)
+
+type tailClient struct {
+	ch      chan []byte
+	filters map[string]string
+	keys    []string
+	every   int
+	n       int
+}
+
+type tailHub struct {
+	mutex   sync.Mutex
+	clients map[*tailClient]bool
+
+	// Number of clients, checked without the lock on every event.
+	count int32
+}
+
+func newTailHub() *tailHub {
+	return &tailHub{clients: map[*tailClient]bool{}}
+}
+
+func (h *tailHub) active() bool {
+	return atomic.LoadInt32(&h.count) != 0
+}
+
+// Passes a copy of an event to each client wanting it.
+func (h *tailHub) publish(data []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var msg []byte
+	for c := range h.clients {
+		if len(c.keys) > 0 {
+			fields := topLevelFields(data, c.keys...)
+			match := true
+			for k, v := range c.filters {
+				if fields[k] != v {
+					match = false
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+		}
+		if c.n++; c.n < c.every {
+			continue
+		}
+		c.n = 0
+		if msg == nil {
+			msg = append([]byte(nil), bytes.TrimRight(data, "\r\n")...)
+		}
+		select {
+		case c.ch <- msg:
+		default:
+		}
+	}
+}
+
+func (h *tailHub) subscribe(c *tailClient) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.clients[c] = true
+	atomic.AddInt32(&h.count, 1)
+}
+
+func (h *tailHub) unsubscribe(c *tailClient) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.clients, c)
+	atomic.AddInt32(&h.count, -1)
+}
+
+func (s *Service) tailHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c := &tailClient{
+		ch:      make(chan []byte, tailBufferSize),
+		filters: map[string]string{},
+		every:   1,
+	}
+	for k, v := range r.URL.Query() {
+		if k == "sample" {
+			n, err := strconv.Atoi(v[0])
+			if err != nil || n < 1 {
+				http.Error(w, "sample: must be a positive number", http.StatusBadRequest)
+				return
+			}
+			c.every = n
+			continue
+		}
+		c.filters[k] = v[0]
+		c.keys = append(c.keys, k)
+	}
+
+	s.tail.subscribe(c)
+	defer s.tail.unsubscribe(c)
+	utils.Log("INFO: Tail started by: %s", r.RemoteAddr)
+	s.audit.record("tail", r.RemoteAddr, r.URL.RawQuery)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(tailKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			w.Write([]byte(":\n\n"))
+		case msg := <-c.ch:
+			w.Write([]byte("data: "))
+			w.Write(msg)
+			w.Write([]byte("\n\n"))
+		}
+		flusher.Flush()
+	}
+}
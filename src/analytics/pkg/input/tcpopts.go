@@ -0,0 +1,80 @@
+// Options for accepted connections:
+//
+//   TCP_KEEPALIVE_INTERVAL  enables keepalives, probing this often once the
+//                           connection is idle
+//   TCP_KEEPALIVE_COUNT     unanswered probes before the connection is
+//                           dropped (Linux only)
+//   TCP_NODELAY             "false" turns Nagle's algorithm back on, trading
+//                           latency for fewer packets
+//
+// Together these have half-dead probe connections noticed promptly.
+
+package input
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	TCP_NODELAY = "true"
+)
+
+type tcpOptions struct {
+	keepAlive      time.Duration
+	keepAliveCount int
+	noDelay        bool
+}
+
+func newTCPOptions() (*tcpOptions, error) {
+	o := &tcpOptions{}
+	var err error
+	if v := utils.Getenv("TCP_KEEPALIVE_INTERVAL", ""); v != "" {
+		if o.keepAlive, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("TCP_KEEPALIVE_INTERVAL: %s", err.Error())
+		}
+	}
+	if v := utils.Getenv("TCP_KEEPALIVE_COUNT", ""); v != "" {
+		if o.keepAliveCount, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("TCP_KEEPALIVE_COUNT: %s", err.Error())
+		}
+	}
+	if o.noDelay, err = strconv.ParseBool(utils.Getenv("TCP_NODELAY", TCP_NODELAY)); err != nil {
+		return nil, fmt.Errorf("TCP_NODELAY: %s", err.Error())
+	}
+	return o, nil
+}
+
+func (o *tcpOptions) apply(conn *net.TCPConn) error {
+	if err := conn.SetNoDelay(o.noDelay); err != nil {
+		return err
+	}
+	if o.keepAlive == 0 {
+		return nil
+	}
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if err := conn.SetKeepAlivePeriod(o.keepAlive); err != nil {
+		return err
+	}
+	if o.keepAliveCount == 0 {
+		return nil
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = setKeepAliveCount(fd, o.keepAliveCount)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,207 @@
+// Multi-tenant operation.  TENANTS_FILE lists the customer estates a bridge
+// serves, as a JSON array of:
+//
+//   {"name": "acme", "certificate": "probe.acme.example", "port": 48880,
+//    "token": "...", "output": "acme", "rate": 5000, "burst": 10000}
+//
+// A connection belongs to the tenant whose certificate common name its
+// client certificate has, failing that the one whose port it arrived on,
+// failing that the one whose token it sends as an "AUTH <token>" first
+// line.  Connections matching no tenant are refused.  A tenant's events go
+// to its output in place of the default one, and beyond rate events a
+// second, with bursts of up to burst, they're dropped.  Everything is
+// counted per tenant.  A tenant's output must be one the bridge has.
+
+package input
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/trustnetworks/analytics-common/utils"
+
+	"analytics/internal/frames"
+)
+
+type tenant struct {
+	Name        string  `json:"name"`
+	Certificate string  `json:"certificate"`
+	Port        int     `json:"port"`
+	Token       string  `json:"token"`
+	Output      string  `json:"output"`
+	Rate        float64 `json:"rate"`
+	Burst       float64 `json:"burst"`
+
+	mutex  sync.Mutex
+	tokens float64
+	filled time.Time
+
+	events    prometheus.Counter
+	overQuota prometheus.Counter
+}
+
+type tenantTable struct {
+	tenants     []*tenant
+	connections *prometheus.GaugeVec
+}
+
+// Loads the tenants, whose outputs must be among those known.
+func newTenantTable(known map[string]bool) (*tenantTable, error) {
+	path := utils.Getenv("TENANTS_FILE", "")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &tenantTable{}
+	if err := json.Unmarshal(data, &t.tenants); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	events := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tenant_events",
+			Help: "Events received from each tenant",
+		},
+		[]string{"tenant"},
+	)
+	overQuota := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tenant_quota_exceeded_events",
+			Help: "Events dropped for exceeding the tenant's rate",
+		},
+		[]string{"tenant"},
+	)
+	t.connections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tenant_connections",
+			Help: "Open connections from each tenant",
+		},
+		[]string{"tenant"},
+	)
+	mustRegister(events, overQuota, t.connections)
+
+	for _, tn := range t.tenants {
+		if tn.Name == "" {
+			return nil, fmt.Errorf("%s: tenant without a name", path)
+		}
+		if tn.Output != "" && !known[tn.Output] {
+			return nil, fmt.Errorf("%s: %s: unknown output %q", path, tn.Name, tn.Output)
+		}
+		if tn.Burst < tn.Rate {
+			tn.Burst = tn.Rate
+		}
+		tn.tokens = tn.Burst
+		tn.filled = time.Now()
+		labels := prometheus.Labels{"tenant": tn.Name}
+		tn.events = events.With(labels)
+		tn.overQuota = overQuota.With(labels)
+	}
+	utils.Log("INFO: Serving %d tenants", len(t.tenants))
+	return t, nil
+}
+
+// Returns the tenant a connection belongs to by its certificate or port,
+// nil if neither identifies one.
+func (t *tenantTable) identify(conn net.Conn) *tenant {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) > 0 {
+			for _, tn := range t.tenants {
+				if tn.Certificate != "" &&
+					tn.Certificate == certs[0].Subject.CommonName {
+					return tn
+				}
+			}
+		}
+	}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		for _, tn := range t.tenants {
+			if tn.Port != 0 && tn.Port == addr.Port {
+				return tn
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the tenant whose token an "AUTH <token>" line gives, or nil.
+func (t *tenantTable) authenticate(line []byte) *tenant {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("AUTH ")) {
+		return nil
+	}
+	token := bytes.TrimSpace(line[len("AUTH "):])
+	for _, tn := range t.tenants {
+		if tn.Token != "" &&
+			subtle.ConstantTimeCompare([]byte(tn.Token), token) == 1 {
+			return tn
+		}
+	}
+	return nil
+}
+
+// Reports whether any tenant authenticates by token.
+func (t *tenantTable) tokens() bool {
+	for _, tn := range t.tenants {
+		if tn.Token != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts an event against the tenant's quota, reporting whether it's
+// within it.
+func (tn *tenant) admit(now time.Time) bool {
+	tn.events.Inc()
+	if tn.Rate <= 0 {
+		return true
+	}
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	if now.After(tn.filled) {
+		tn.tokens += now.Sub(tn.filled).Seconds() * tn.Rate
+		if tn.tokens > tn.Burst {
+			tn.tokens = tn.Burst
+		}
+		tn.filled = now
+	}
+	if tn.tokens < 1 {
+		tn.overQuota.Inc()
+		return false
+	}
+	tn.tokens--
+	return true
+}
+
+// Works out which tenant a new connection belongs to, reading its token
+// line if it has to.
+func (t *tenantTable) connect(conn net.Conn, f *frames.Framer) (*tenant, error) {
+	if tn := t.identify(conn); tn != nil {
+		return tn, nil
+	}
+	if !t.tokens() {
+		return nil, fmt.Errorf("no tenant for connection")
+	}
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	line, ck, err := f.Next()
+	if err != nil {
+		return nil, err
+	}
+	ck.Release()
+	if tn := t.authenticate(line); tn != nil {
+		return tn, nil
+	}
+	return nil, fmt.Errorf("no tenant for token")
+}
@@ -0,0 +1,74 @@
+// Event timestamps.  Probes don't agree on a format, so TIME_FORMATS lists
+// those to try, separated by ';', in order.  Each is a Go time layout or one
+// of:
+//
+//   rfc3339   RFC 3339, with or without fractional seconds
+//   epoch     a number of seconds, milliseconds, microseconds or
+//             nanoseconds since 1970, the unit judged by magnitude
+//
+// Numbers may be given as JSON numbers or strings.
+
+package input
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	TIME_FORMATS = "rfc3339;epoch"
+)
+
+var timeFormats = func() []string {
+	var formats []string
+	for _, f := range strings.Split(utils.Getenv("TIME_FORMATS", TIME_FORMATS), ";") {
+		if f = strings.TrimSpace(f); f != "" {
+			formats = append(formats, f)
+		}
+	}
+	return formats
+}()
+
+// Parses an event timestamp in any of the configured formats.
+func parseEventTime(s string) (time.Time, error) {
+	for _, f := range timeFormats {
+		switch f {
+		case "rfc3339":
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return t, nil
+			}
+		case "epoch":
+			if t, ok := parseEpoch(s); ok {
+				return t, nil
+			}
+		default:
+			if t, err := time.Parse(f, s); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", s)
+}
+
+func parseEpoch(s string) (time.Time, bool) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v <= 0 {
+		return time.Time{}, false
+	}
+	// 1e11 seconds is in the year 5138, so anything bigger is in a finer
+	// unit.
+	scale := 1e9
+	for _, limit := range []float64{1e11, 1e14, 1e17} {
+		if v < limit {
+			break
+		}
+		scale /= 1000
+	}
+	sec, frac := math.Modf(v * scale / 1e9)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
@@ -0,0 +1,179 @@
+// TLS support for the probe facing listener.  Certificates are either
+// obtained and renewed automatically from an ACME CA, a public one such as
+// Let's Encrypt or an internal CA exposing an ACME directory, or supplied as
+// PEM through the environment (typically from Vault) or files.  Probes'
+// client certificates are verified against the bundle in TLS_CLIENT_CA or
+// TLS_CLIENT_CA_FILE, if given, see certexpiry.go.
+
+package input
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/trustnetworks/analytics-common/utils"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	ACME_CACHE_DIR = "/var/cache/analytics-input/acme"
+)
+
+// TLSConfig returns the TLS configuration for the listener, or nil if TLS is
+// not configured.  ACME is enabled by setting ACME_DOMAINS to a comma
+// separated list of the names probes use to reach the bridge, otherwise a
+// key pair from TLS_CERT/TLS_KEY or TLS_CERT_FILE/TLS_KEY_FILE is used.
+func TLSConfig() (*tls.Config, error) {
+
+	domains := splitList(utils.Getenv("ACME_DOMAINS", ""))
+	if len(domains) == 0 {
+		cfg, err := keyPairConfig()
+		if err != nil || cfg == nil {
+			return cfg, err
+		}
+		return cfg, useClientCAs(cfg)
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(utils.Getenv("ACME_CACHE_DIR", ACME_CACHE_DIR)),
+		Email:      utils.Getenv("ACME_EMAIL", ""),
+	}
+	if url := utils.Getenv("ACME_DIRECTORY_URL", ""); url != "" {
+		m.Client = &acme.Client{DirectoryURL: url}
+	}
+
+	// The HTTP-01 challenge has to be answered on port 80 of the names
+	// above, which is only possible if something routes it to us.
+	// Otherwise the TLS-ALPN-01 challenge is answered on the listener.
+	if port := utils.Getenv("ACME_HTTP_PORT", ""); port != "" {
+		utils.Log("INFO: Answering ACME challenges on :%s", port)
+		go func() {
+			err := http.ListenAndServe(fmt.Sprintf(":%s", port),
+				m.HTTPHandler(nil))
+			utils.Log("ERROR: ACME challenge listener failed: %s", err.Error())
+		}()
+	}
+
+	cfg := m.TLSConfig()
+
+	// Probes often connect by address and don't send SNI, in which case
+	// present the certificate for the first configured name.
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			hello.ServerName = domains[0]
+		}
+		cert, err := m.GetCertificate(hello)
+		if err == nil {
+			certExpiries.recordPair("server", cert)
+		}
+		return cert, err
+	}
+
+	utils.Log("INFO: TLS enabled, ACME certificates for: %s",
+		strings.Join(domains, ", "))
+	return cfg, useClientCAs(cfg)
+}
+
+// Key pair read from the environment or files.  The source is checked on
+// every handshake so renewed certificates are picked up without a restart.
+type keyPair struct {
+	mutex   sync.Mutex
+	certPEM []byte
+	keyPEM  []byte
+	cert    *tls.Certificate
+}
+
+func keyPairConfig() (*tls.Config, error) {
+	k := &keyPair{}
+	certPEM, _, err := k.source()
+	if err != nil {
+		return nil, err
+	}
+	if certPEM == nil {
+		return nil, nil
+	}
+	if _, err := k.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	utils.Log("INFO: TLS enabled with the configured key pair")
+	return &tls.Config{GetCertificate: k.getCertificate}, nil
+}
+
+// Returns the current PEM blocks, nil if no key pair is configured.
+func (k *keyPair) source() ([]byte, []byte, error) {
+	if cert := os.Getenv("TLS_CERT"); cert != "" {
+		return []byte(cert), []byte(os.Getenv("TLS_KEY")), nil
+	}
+	certFile := utils.Getenv("TLS_CERT_FILE", "")
+	if certFile == "" {
+		return nil, nil, nil
+	}
+	cert, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ioutil.ReadFile(utils.Getenv("TLS_KEY_FILE", ""))
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func (k *keyPair) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	certPEM, keyPEM, err := k.source()
+	if err != nil || certPEM == nil {
+		// Keep serving what we have if the source went away.
+		if k.cert != nil {
+			return k.cert, nil
+		}
+		return nil, fmt.Errorf("no TLS key pair available: %v", err)
+	}
+	if k.cert != nil && bytes.Equal(certPEM, k.certPEM) &&
+		bytes.Equal(keyPEM, k.keyPEM) {
+		return k.cert, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if k.cert != nil {
+		utils.Log("INFO: Loaded renewed TLS certificate")
+	}
+	k.cert, k.certPEM, k.keyPEM = &cert, certPEM, keyPEM
+	certExpiries.recordPair("server", k.cert)
+	return k.cert, nil
+}
+
+// Returns the subject of the client's certificate, if it presented one.
+func peerName(conn *tls.Conn) string {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.String()
+}
+
+// Splits a comma separated configuration value, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,208 @@
+// Top talkers, for spotting a runaway probe or a scanning host at the
+// collector.  With TOP_WINDOW set, events and bytes forwarded are counted by
+// device and by destination address over that rolling window, and GET
+// /admin/top returns the heaviest of each:
+//
+//   {"window": 300, "devices": [{"name": "dmz-1", "events": 91234,
+//    "bytes": 81203344}, ..], "destinations": [..]}
+//
+// ?n= sets how many of each, 10 unless given, and ?by=bytes orders by bytes
+// rather than events.  Each tenth of the window counts at most TOP_MAX_KEYS
+// devices and destinations, others being counted as "other".
+
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	TOP_MAX_KEYS = "10000"
+
+	// The window is counted in this many parts, the oldest dropped as
+	// each new one starts.
+	topBuckets = 10
+)
+
+type topCount struct {
+	Name   string `json:"name"`
+	Events int64  `json:"events"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type topBucket struct {
+	devices, dests map[string]*topCount
+}
+
+type topTalkers struct {
+	window  time.Duration
+	maxKeys int
+
+	mutex   sync.Mutex
+	buckets [topBuckets]topBucket
+	current int
+	ends    time.Time
+}
+
+// Returns the counters, nil unless TOP_WINDOW is set.
+func newTopTalkers() (*topTalkers, error) {
+	v := utils.Getenv("TOP_WINDOW", "")
+	if v == "" {
+		return nil, nil
+	}
+	window, err := time.ParseDuration(v)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("TOP_WINDOW: must be a duration")
+	}
+	maxKeys, err := strconv.Atoi(utils.Getenv("TOP_MAX_KEYS", TOP_MAX_KEYS))
+	if err != nil || maxKeys < 1 {
+		return nil, fmt.Errorf("TOP_MAX_KEYS: must be a positive number")
+	}
+	t := &topTalkers{window: window, maxKeys: maxKeys}
+	for i := range t.buckets {
+		t.buckets[i] = topBucket{map[string]*topCount{}, map[string]*topCount{}}
+	}
+	t.ends = time.Now().Add(t.window / topBuckets)
+	return t, nil
+}
+
+var destPrefix = []byte(`"dest":[`)
+
+// Returns the address in an event's dest, if it's found without decoding
+// the event.
+func eventDest(data []byte) string {
+	i := bytes.Index(data, destPrefix)
+	if i < 0 {
+		return ""
+	}
+	i = skipSpace(data, i+len(destPrefix))
+	end := skipString(data, i)
+	if end < 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(data[i:end], &s) != nil {
+		return ""
+	}
+	if len(s) > 5 && (s[:5] == "ipv4:" || s[:5] == "ipv6:") {
+		return s[5:]
+	}
+	return s
+}
+
+// Counts an event forwarded.
+func (t *topTalkers) add(data []byte) {
+	if t == nil {
+		return
+	}
+	device := topLevelFields(data, "device")["device"]
+	dest := eventDest(data)
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i := 0; now.After(t.ends) && i < topBuckets; i++ {
+		t.current = (t.current + 1) % topBuckets
+		t.buckets[t.current] = topBucket{map[string]*topCount{}, map[string]*topCount{}}
+		t.ends = t.ends.Add(t.window / topBuckets)
+	}
+	if now.After(t.ends) {
+		// Idle for longer than the window.
+		t.ends = now.Add(t.window / topBuckets)
+	}
+	b := &t.buckets[t.current]
+	t.count(b.devices, device, len(data))
+	if dest != "" {
+		t.count(b.dests, dest, len(data))
+	}
+}
+
+func (t *topTalkers) count(counts map[string]*topCount, name string, size int) {
+	c, ok := counts[name]
+	if !ok {
+		if len(counts) >= t.maxKeys {
+			name = "other"
+			c = counts[name]
+		}
+		if c == nil {
+			c = &topCount{Name: name}
+			counts[name] = c
+		}
+	}
+	c.Events++
+	c.Bytes += int64(size)
+}
+
+// Returns the n heaviest of each over the window.
+func (t *topTalkers) top(n int, byBytes bool) ([]topCount, []topCount) {
+	devices := map[string]*topCount{}
+	dests := map[string]*topCount{}
+	t.mutex.Lock()
+	for _, b := range t.buckets {
+		mergeTopCounts(devices, b.devices)
+		mergeTopCounts(dests, b.dests)
+	}
+	t.mutex.Unlock()
+	return heaviestTalkers(devices, n, byBytes), heaviestTalkers(dests, n, byBytes)
+}
+
+func mergeTopCounts(into, from map[string]*topCount) {
+	for name, c := range from {
+		sum, ok := into[name]
+		if !ok {
+			sum = &topCount{Name: name}
+			into[name] = sum
+		}
+		sum.Events += c.Events
+		sum.Bytes += c.Bytes
+	}
+}
+
+func heaviestTalkers(counts map[string]*topCount, n int, byBytes bool) []topCount {
+	list := make([]topCount, 0, len(counts))
+	for _, c := range counts {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if byBytes {
+			return list[i].Bytes > list[j].Bytes
+		}
+		return list[i].Events > list[j].Events
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+func (s *Service) topHandler(w http.ResponseWriter, r *http.Request) {
+	if s.top == nil {
+		http.Error(w, "TOP_WINDOW not set", http.StatusNotFound)
+		return
+	}
+	n := 10
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "n: must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	devices, dests := s.top.top(n, r.URL.Query().Get("by") == "bytes")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Window       float64    `json:"window"`
+		Devices      []topCount `json:"devices"`
+		Destinations []topCount `json:"destinations"`
+	}{s.top.window.Seconds(), devices, dests})
+}
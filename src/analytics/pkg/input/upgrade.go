@@ -0,0 +1,158 @@
+// Upgrading the bridge in place.  On SIGUSR2 the binary is started again
+// from its path, which may since have been replaced, and handed the probe
+// and metrics listening sockets as inherited descriptors.  The new process
+// accepts on them as soon as it's running, connections arriving in the
+// meantime waiting in the kernel's backlog, so none are refused.
+//
+// The old process stops accepting and drains its connections as for POST
+// /admin/drain, so probes reconnect to the new one, then sends everything
+// it has read and exits.  If the new process can't be started the old one
+// carries on as before.
+//
+// This is for hosts running the bridge directly.  Run as a container's
+// init process the container would end with the old process.
+
+package input
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Number of probe listeners handed over, set in the new process's
+// environment.  The metrics listener follows them.
+const UPGRADE_LISTENERS = "UPGRADE_LISTENERS"
+
+// First inherited descriptor, after stdin, stdout and stderr.
+const inheritedFD = 3
+
+// Listeners taken over from the process being upgraded.
+type handover struct {
+	listeners []*net.TCPListener
+	metrics   net.Listener
+}
+
+// Set if this process was started by an upgrade.
+var handedOver *handover
+
+// Takes over the listeners passed by the process being upgraded, if any.
+func takeOver() error {
+	v := os.Getenv(UPGRADE_LISTENERS)
+	if v == "" {
+		return nil
+	}
+	os.Unsetenv(UPGRADE_LISTENERS)
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return fmt.Errorf("%s: must be a positive number", UPGRADE_LISTENERS)
+	}
+
+	h := &handover{}
+	for i := 0; i <= n; i++ {
+		f := os.NewFile(uintptr(inheritedFD+i), "listener")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited listener %d: %s", i, err.Error())
+		}
+		if i == n {
+			h.metrics = l
+			break
+		}
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("inherited listener %d: not TCP", i)
+		}
+		h.listeners = append(h.listeners, tl)
+	}
+	handedOver = h
+	utils.Log("INFO: Took over %d listeners from the previous process", n)
+	return nil
+}
+
+// Returns the listeners handed over bound to addr's port.
+func (h *handover) take(addr string) ([]*net.TCPListener, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var listeners []*net.TCPListener
+	for _, l := range h.listeners {
+		if strconv.Itoa(l.Addr().(*net.TCPAddr).Port) == port {
+			listeners = append(listeners, l)
+		}
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listener on %s handed over", addr)
+	}
+	return listeners, nil
+}
+
+// Returns the listener for the metrics and admin endpoints.
+func metricsListener(addr string) (net.Listener, error) {
+	if handedOver != nil {
+		return handedOver.metrics, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Starts the new binary with the listeners, as bound now.  Once it's
+// running this process stops accepting and begins draining.
+func (s *Service) upgrade(metrics net.Listener) error {
+	listeners := s.currentListeners()
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	f, err := metrics.(*net.TCPListener).File()
+	if err != nil {
+		return err
+	}
+	files = append(files, f)
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", UPGRADE_LISTENERS, len(listeners)))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	utils.Log("INFO: Started process %d to take over", cmd.Process.Pid)
+	go cmd.Wait()
+
+	// The new process has its own copies, closing ours leaves it to
+	// accept alone.
+	close(s.handedOff)
+	s.stopHTTPSources()
+	metrics.Close()
+	if s.setDraining(true) {
+		utils.Log("INFO: Draining connections")
+		s.audit.record("drain", "", "upgrade")
+	}
+
+	// Allow for the grace, and for the last reads to be sent on.
+	time.Sleep(s.drain.grace + 2*time.Second)
+	return nil
+}
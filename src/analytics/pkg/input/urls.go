@@ -0,0 +1,106 @@
+// URL normalisation.  With NORMALIZE_URLS set, URLs at URL_FIELDS are
+// parsed into their parts under "url_parts", keyed by field:
+//
+//   "url_parts": {"url": {"normalized": "http://www.example.co.uk/a?b=1&c=2",
+//                         "scheme": "http", "host": "www.example.co.uk",
+//                         "domain": "example.co.uk", "path": "/a",
+//                         "query": "b=1&c=2"}}
+//
+// Normalisation lower-cases the scheme and host, drops default ports,
+// cleans the path and sorts the query parameters.
+
+package input
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/trustnetworks/analytics-common/utils"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	URL_FIELDS = "url"
+)
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+type urlStage struct {
+	fields [][]string
+}
+
+func newURLStage() (stage, error) {
+	if utils.Getenv("NORMALIZE_URLS", "") == "" {
+		return nil, nil
+	}
+	return &urlStage{
+		fields: fieldPaths(utils.Getenv("URL_FIELDS", URL_FIELDS)),
+	}, nil
+}
+
+func (u *urlStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	for _, p := range u.fields {
+		name := strings.Join(p, ".")
+		walkPath(fields, p, func(parent map[string]interface{}, key string) {
+			raw, ok := parent[key].(string)
+			if !ok {
+				return
+			}
+			if parts := urlParts(raw); parts != nil {
+				annotate(fields, "url_parts", name, parts)
+				e.modified()
+			}
+		})
+	}
+	return true
+}
+
+func urlParts(raw string) map[string]interface{} {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	u.Host = host
+	if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	if u.Path != "" {
+		cleaned := path.Clean(u.Path)
+		if strings.HasSuffix(u.Path, "/") && cleaned != "/" {
+			cleaned += "/"
+		}
+		u.Path = cleaned
+	}
+	u.RawQuery = u.Query().Encode()
+	u.Fragment = ""
+
+	parts := map[string]interface{}{
+		"normalized": u.String(),
+		"scheme":     u.Scheme,
+		"host":       host,
+		"path":       u.Path,
+		"query":      u.RawQuery,
+	}
+	if port != "" {
+		parts["port"] = port
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		parts["domain"] = domain
+	}
+	return parts
+}
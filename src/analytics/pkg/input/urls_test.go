@@ -0,0 +1,34 @@
+package input
+
+import (
+	"testing"
+)
+
+func TestURLParts(t *testing.T) {
+	tests := []struct {
+		raw, normalized, host, port string
+	}{
+		{"HTTP://WWW.Example.co.uk:80/a/../b?c=2&b=1#x",
+			"http://www.example.co.uk/b?b=1&c=2", "www.example.co.uk", ""},
+		{"https://example.com:8443/", "https://example.com:8443/", "example.com", "8443"},
+		{"http://[::1]/", "http://[::1]/", "::1", ""},
+		{"http://[::1]:80/a", "http://[::1]/a", "::1", ""},
+		{"https://[2001:DB8::1]:8443/a/", "https://[2001:db8::1]:8443/a/", "2001:db8::1", "8443"},
+	}
+	for _, tt := range tests {
+		parts := urlParts(tt.raw)
+		if parts == nil {
+			t.Errorf("%s: not parsed", tt.raw)
+			continue
+		}
+		if parts["normalized"] != tt.normalized {
+			t.Errorf("%s: normalized to %v, want %s", tt.raw, parts["normalized"], tt.normalized)
+		}
+		if parts["host"] != tt.host {
+			t.Errorf("%s: host %v, want %s", tt.raw, parts["host"], tt.host)
+		}
+		if port, _ := parts["port"].(string); port != tt.port {
+			t.Errorf("%s: port %q, want %q", tt.raw, port, tt.port)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// User-Agent parsing.  With PARSE_USER_AGENT set, the header found at
+// USER_AGENT_FIELD is broken down under "user_agent":
+//
+//   "user_agent": {"browser": "Firefox", "version": "60.0", "os": "Windows 10",
+//                  "platform": "Windows", "mobile": false, "bot": false}
+
+package input
+
+import (
+	"github.com/mssola/useragent"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	USER_AGENT_FIELD = "http_request.header.User-Agent"
+)
+
+type userAgentStage struct {
+	fields [][]string
+}
+
+func newUserAgentStage() (stage, error) {
+	if utils.Getenv("PARSE_USER_AGENT", "") == "" {
+		return nil, nil
+	}
+	return &userAgentStage{
+		fields: fieldPaths(utils.Getenv("USER_AGENT_FIELD", USER_AGENT_FIELD)),
+	}, nil
+}
+
+func (u *userAgentStage) process(e *event) bool {
+	fields, err := e.decode()
+	if err != nil {
+		return true
+	}
+	for _, path := range u.fields {
+		walkPath(fields, path, func(parent map[string]interface{}, key string) {
+			header, ok := parent[key].(string)
+			if !ok || header == "" {
+				return
+			}
+			ua := useragent.New(header)
+			browser, version := ua.Browser()
+			fields["user_agent"] = map[string]interface{}{
+				"browser":  browser,
+				"version":  version,
+				"os":       ua.OS(),
+				"platform": ua.Platform(),
+				"mobile":   ua.Mobile(),
+				"bot":      ua.Bot(),
+			}
+			e.modified()
+		})
+	}
+	return true
+}
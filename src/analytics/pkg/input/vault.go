@@ -0,0 +1,222 @@
+// Secrets held in HashiCorp Vault.  The key/value pairs of each configured
+// secret are exported into the environment before anything reads its
+// configuration, so output credentials, tokens and TLS keys can be kept out
+// of the deployment manifests.  Secrets are re-read periodically, and the
+// Vault token renewed, for as long as the bridge runs.
+//
+// Most settings are only read at startup, so a secret rotated in Vault
+// reaches them on the next restart, and a warning is logged naming it.
+// Those watched with watchSecret, HMAC_KEY for one, take the new value at
+// once.
+
+package input
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+const (
+	VAULT_REFRESH_INTERVAL = "5m"
+	VAULT_AUTH_PATH        = "kubernetes"
+	SA_TOKEN_FILE          = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+type vaultClient struct {
+	addr    string
+	token   string
+	role    string
+	auth    string
+	secrets []string
+	client  *http.Client
+
+	// Values loaded, to tell when one changes.
+	values map[string]string
+}
+
+// Functions taking new values of settings from Vault, by name.
+var secretWatches = struct {
+	mutex sync.Mutex
+	fns   map[string]func(string)
+}{fns: map[string]func(string){}}
+
+// Calls fn with the setting's new value whenever it changes in Vault.
+func watchSecret(name string, fn func(string)) {
+	secretWatches.mutex.Lock()
+	defer secretWatches.mutex.Unlock()
+	secretWatches.fns[name] = fn
+}
+
+// Response envelope shared by the Vault API calls used here.
+type vaultResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+	Auth   *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+// Loads secrets from Vault if VAULT_ADDR is set, and starts refreshing them
+// in the background.  Authenticates with VAULT_TOKEN or, failing that, with
+// the pod's service account against the Kubernetes auth method for
+// VAULT_ROLE.
+func startVault() error {
+
+	addr := utils.Getenv("VAULT_ADDR", "")
+	if addr == "" {
+		return nil
+	}
+
+	interval, err := time.ParseDuration(utils.Getenv("VAULT_REFRESH_INTERVAL",
+		VAULT_REFRESH_INTERVAL))
+	if err != nil {
+		return fmt.Errorf("VAULT_REFRESH_INTERVAL: %s", err.Error())
+	}
+
+	v := &vaultClient{
+		addr:    strings.TrimRight(addr, "/"),
+		token:   utils.Getenv("VAULT_TOKEN", ""),
+		role:    utils.Getenv("VAULT_ROLE", ""),
+		auth:    utils.Getenv("VAULT_AUTH_PATH", VAULT_AUTH_PATH),
+		secrets: splitList(utils.Getenv("VAULT_SECRETS", "")),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		values:  map[string]string{},
+	}
+
+	if v.token == "" {
+		if err := v.login(); err != nil {
+			return err
+		}
+	}
+	if err := v.load(); err != nil {
+		return err
+	}
+	utils.Log("INFO: Loaded %d secrets from Vault at %s", len(v.secrets), v.addr)
+
+	go func() {
+		for range time.Tick(interval) {
+			v.refresh()
+		}
+	}()
+	return nil
+}
+
+// Renew or re-acquire the token, then re-read the secrets.  Failures are
+// logged and the previously loaded values stay in place.
+func (v *vaultClient) refresh() {
+	_, err := v.call("POST", "/v1/auth/token/renew-self", nil)
+	if err != nil && v.role != "" {
+		err = v.login()
+	}
+	if err != nil {
+		utils.Log("WARN: Unable to renew Vault token: %s", err.Error())
+	}
+	if err := v.load(); err != nil {
+		utils.Log("WARN: Unable to refresh Vault secrets: %s", err.Error())
+	}
+}
+
+// Log in with the service account token using the Kubernetes auth method.
+func (v *vaultClient) login() error {
+	if v.role == "" {
+		return fmt.Errorf("Vault needs VAULT_TOKEN or VAULT_ROLE")
+	}
+	jwt, err := ioutil.ReadFile(utils.Getenv("SA_TOKEN_FILE", SA_TOKEN_FILE))
+	if err != nil {
+		return err
+	}
+	resp, err := v.call("POST", "/v1/auth/"+v.auth+"/login",
+		map[string]string{"role": v.role, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return err
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return fmt.Errorf("Vault login returned no token")
+	}
+	v.token = resp.Auth.ClientToken
+	return nil
+}
+
+// Read each secret and export its values into the environment.
+func (v *vaultClient) load() error {
+	for _, path := range v.secrets {
+		resp, err := v.call("GET", "/v1/"+strings.TrimLeft(path, "/"), nil)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+
+		// KV version 2 nests the values one level deeper.
+		data := resp.Data
+		if inner, ok := data["data"].(map[string]interface{}); ok {
+			if _, ok := data["metadata"]; ok {
+				data = inner
+			}
+		}
+
+		for key, val := range data {
+			sval, ok := val.(string)
+			if !ok {
+				continue
+			}
+			os.Setenv(key, sval)
+			old, loaded := v.values[key]
+			v.values[key] = sval
+			if !loaded || old == sval {
+				continue
+			}
+			secretWatches.mutex.Lock()
+			fn := secretWatches.fns[key]
+			secretWatches.mutex.Unlock()
+			if fn != nil {
+				fn(sval)
+				utils.Log("INFO: %s updated from Vault", key)
+			} else {
+				utils.Log("WARN: %s changed in Vault, restart to use it", key)
+			}
+		}
+	}
+	return nil
+}
+
+func (v *vaultClient) call(method, path string, body interface{}) (*vaultResponse, error) {
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, v.addr+path, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var vr vaultResponse
+	err = json.NewDecoder(resp.Body).Decode(&vr)
+	if err != nil && resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("%s: %s", resp.Status, err.Error())
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.Join(vr.Errors, ", "))
+	}
+	return &vr, nil
+}
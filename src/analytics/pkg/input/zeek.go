@@ -0,0 +1,197 @@
+// Zeek's JSON logs, for pipelines with "format": "zeek", so sensors running
+// Zeek rather than cyberprobe feed the same pipeline.  Records are expected
+// one per line as the json-streaming-logs package writes them, the log named
+// by "_path"; without it the log is judged by the fields present.  conn, dns
+// and http records become cybermon's events:
+//
+//   conn    connection_down, the record being written as it closes
+//   dns     dns_message, with the query, answers and rcode
+//   http    http_request, with the method, headers and url
+//
+// and other logs zeek_<log>.  ts becomes time, id.orig_h and id.orig_p src,
+// id.resp_h and id.resp_p dest, and _system_name, if present, the device,
+// else the sensor's address.  The rest of the record, including uid, is kept
+// under "zeek".
+
+package input
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type zeekFormat struct{}
+
+func newZeekFormat() (stage, error) {
+	return zeekFormat{}, nil
+}
+
+func (zeekFormat) process(e *event) bool {
+	rec, err := e.decode()
+	if err != nil {
+		return reject(e, "invalid Zeek record: "+err.Error())
+	}
+	e.fields = mapZeek(rec, e.remote)
+	e.modified()
+	return true
+}
+
+// Returns the log a record is from.
+func zeekLog(rec map[string]interface{}) string {
+	if path, ok := rec["_path"].(string); ok {
+		return path
+	}
+	switch {
+	case rec["query"] != nil || rec["qtype_name"] != nil:
+		return "dns"
+	case rec["method"] != nil || rec["uri"] != nil:
+		return "http"
+	case rec["conn_state"] != nil:
+		return "conn"
+	}
+	return ""
+}
+
+// Returns the time of a record, given as seconds since 1970 or, with
+// LogAscii::json_timestamps set, ISO 8601.
+func zeekTime(ts interface{}) (time.Time, bool) {
+	switch v := ts.(type) {
+	case json.Number:
+		return parseEpoch(string(v))
+	case float64:
+		return parseEpoch(strconv.FormatFloat(v, 'f', -1, 64))
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// Returns the cybermon event for a Zeek record, taking the fields it maps
+// out of the record.
+func mapZeek(rec map[string]interface{}, remote net.Addr) map[string]interface{} {
+	take := func(name string) interface{} {
+		v := rec[name]
+		delete(rec, name)
+		return v
+	}
+	takeString := func(name string) string {
+		s, _ := take(name).(string)
+		return s
+	}
+
+	log := zeekLog(rec)
+	delete(rec, "_path")
+	delete(rec, "_write_ts")
+
+	ev := map[string]interface{}{
+		"id":     randomEventID(),
+		"source": "zeek",
+		"action": "zeek_" + log,
+	}
+
+	if t, ok := zeekTime(take("ts")); ok {
+		ev["time"] = t.UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+	if system := takeString("_system_name"); system != "" {
+		ev["device"] = system
+	} else if tcp, ok := remote.(*net.TCPAddr); ok {
+		ev["device"] = tcp.IP.String()
+	}
+
+	// The transport isn't in the http log, only ever being TCP.
+	proto, _ := rec["proto"].(string)
+	if log == "http" {
+		proto = "tcp"
+	}
+	proto = strings.ToLower(proto)
+	if src := addressList(take("id.orig_h"), take("id.orig_p"), proto); src != nil {
+		ev["src"] = src
+	}
+	if dest := addressList(take("id.resp_h"), take("id.resp_p"), proto); dest != nil {
+		ev["dest"] = dest
+	}
+
+	switch log {
+	case "conn":
+		ev["action"] = "connection_down"
+	case "dns":
+		ev["action"] = "dns_message"
+		ev["dns_message"] = zeekDNS(rec)
+	case "http":
+		ev["action"] = "http_request"
+		ev["http_request"] = zeekHTTP(rec)
+		host, _ := rec["host"].(string)
+		uri, _ := rec["uri"].(string)
+		if host != "" {
+			ev["url"] = "http://" + host + uri
+		}
+	}
+
+	if len(rec) > 0 {
+		ev["zeek"] = rec
+	}
+	return ev
+}
+
+// Maps a dns log record.  Zeek logs a query and its response as one record,
+// so it's a response if it has an answer or rcode.
+func zeekDNS(rec map[string]interface{}) map[string]interface{} {
+	msg := map[string]interface{}{"type": "query"}
+	query := map[string]interface{}{}
+	if name, ok := rec["query"].(string); ok {
+		query["name"] = name
+	}
+	if t, ok := rec["qtype_name"].(string); ok {
+		query["type"] = t
+	}
+	if c, ok := rec["qclass_name"].(string); ok {
+		query["class"] = c
+	}
+	if len(query) > 0 {
+		msg["query"] = []interface{}{query}
+	}
+
+	if rcode, ok := rec["rcode_name"].(string); ok {
+		msg["type"] = "response"
+		msg["rcode"] = rcode
+	}
+	if list, ok := rec["answers"].([]interface{}); ok && len(list) > 0 {
+		msg["type"] = "response"
+		var answers []interface{}
+		for _, a := range list {
+			a, _ := a.(string)
+			answer := map[string]interface{}{"name": query["name"]}
+			if net.ParseIP(a) != nil {
+				answer["address"] = a
+			} else {
+				answer["data"] = a
+			}
+			answers = append(answers, answer)
+		}
+		msg["answer"] = answers
+	}
+	return msg
+}
+
+// Maps an http log record.
+func zeekHTTP(rec map[string]interface{}) map[string]interface{} {
+	header := map[string]interface{}{}
+	if host, ok := rec["host"].(string); ok {
+		header["Host"] = host
+	}
+	if ua, ok := rec["user_agent"].(string); ok {
+		header["User-Agent"] = ua
+	}
+	if ref, ok := rec["referrer"].(string); ok {
+		header["Referer"] = ref
+	}
+	req := map[string]interface{}{"header": header}
+	if method, ok := rec["method"].(string); ok {
+		req["method"] = method
+	}
+	return req
+}